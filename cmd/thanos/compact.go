@@ -18,6 +18,7 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/oklog/run"
+	"github.com/oklog/ulid"
 	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
@@ -260,6 +261,15 @@ func runCompact(
 		sy  *compact.Syncer
 	)
 	{
+		denylist := make([]ulid.ULID, 0, len(conf.denylistedBlocks))
+		for _, b := range conf.denylistedBlocks {
+			id, err := ulid.Parse(b)
+			if err != nil {
+				return errors.Wrapf(err, "parse denylisted block ID %q", b)
+			}
+			denylist = append(denylist, id)
+		}
+
 		// Make sure all compactor meta syncs are done through Syncer.SyncMeta for readability.
 		cf := baseMetaFetcher.NewMetaFetcher(
 			extprom.WrapRegistererWithPrefix("thanos_", reg), []block.MetadataFilter{
@@ -283,7 +293,11 @@ func runCompact(
 			ignoreDeletionMarkFilter,
 			compactMetrics.blocksMarked.WithLabelValues(metadata.DeletionMarkFilename),
 			compactMetrics.garbageCollectedBlocks,
-			conf.blockSyncConcurrency)
+			conf.blockSyncConcurrency,
+			compact.WithDenylist(denylist...),
+			compact.WithGarbageCollectionConcurrency(conf.garbageCollectionConcurrency),
+			compact.WithSyncerDeleteTimeout(time.Duration(conf.deleteTimeout)),
+		)
 		if err != nil {
 			return errors.Wrap(err, "create syncer")
 		}
@@ -341,6 +355,33 @@ func runCompact(
 		return errors.Wrap(err, "create working downsample directory")
 	}
 
+	groupOpts := []compact.GroupOption{
+		compact.WithDownloadStallTimeout(time.Duration(conf.downloadStallTimeout)),
+		compact.WithGroupDeleteTimeout(time.Duration(conf.deleteTimeout)),
+		compact.WithDownloadConcurrency(conf.blockDownloadConcurrency),
+	}
+	if conf.gatherLabelCardinality {
+		groupOpts = append(groupOpts, compact.WithLabelCardinality())
+	}
+	var uploadOpts []block.UploadOption
+	if conf.compressMeta {
+		groupOpts = append(groupOpts, compact.WithCompressedMeta())
+		uploadOpts = append(uploadOpts, block.WithCompressedMeta())
+	}
+	var notifier compact.Notifier
+	if conf.webhookURL != "" {
+		notifier = compact.NewHTTPNotifier(conf.webhookURL, time.Duration(conf.webhookTimeout))
+		groupOpts = append(groupOpts, compact.WithEventCallback(compact.NewNotifierEventCallback(logger, notifier)))
+	}
+
+	downsampleOpts := downsampleOptions{
+		significantDigits:  conf.downsampleSignificantDigits,
+		seriesConcurrency:  conf.downsampleSeriesConcurrency,
+		streamingThreshold: conf.downsampleStreamingThreshold,
+		notifier:           notifier,
+		uploadOpts:         uploadOpts,
+	}
+
 	grouper := compact.NewDefaultGrouper(
 		logger,
 		bkt,
@@ -350,13 +391,31 @@ func runCompact(
 		compactMetrics.blocksMarked.WithLabelValues(metadata.DeletionMarkFilename),
 		compactMetrics.garbageCollectedBlocks,
 		metadata.HashFunc(conf.hashFunc),
+		groupOpts...,
 	)
-	planner := compact.WithLargeTotalIndexSizeFilter(
-		compact.NewPlanner(logger, levels, noCompactMarkerFilter),
+	tsdbPlanner := compact.WithMaxCompactionLevel(compact.NewPlanner(logger, levels, noCompactMarkerFilter), conf.maxBlockCompactionLevel)
+	var indexSizePlanner compact.Planner = compact.WithLargeTotalIndexSizeFilter(
+		tsdbPlanner,
 		bkt,
 		int64(conf.maxBlockIndexSize),
 		compactMetrics.blocksMarked.WithLabelValues(metadata.DeletionMarkFilename),
 	)
+	if conf.dryRun {
+		// Dry runs must not place no-compact marks.
+		indexSizePlanner = compact.WithLargeTotalIndexSizeDryRunFilter(
+			tsdbPlanner,
+			bkt,
+			int64(conf.maxBlockIndexSize),
+		)
+	}
+	planner := compact.WithMinGroupSizeFilter(
+		compact.WithMaxBlockDurationFilter(
+			indexSizePlanner,
+			time.Duration(conf.maxBlockDuration).Milliseconds(),
+		),
+		conf.minGroupBlocks,
+		int64(conf.minGroupSize),
+	)
 	blocksCleaner := compact.NewBlocksCleaner(logger, bkt, ignoreDeletionMarkFilter, deleteDelay, compactMetrics.blocksCleaned, compactMetrics.blockCleanupFailures)
 	compactor, err := compact.NewBucketCompactor(
 		logger,
@@ -367,6 +426,19 @@ func runCompact(
 		compactDir,
 		bkt,
 		conf.compactionConcurrency,
+		compact.WithCompactorRegisterer(reg),
+		compact.WithMaxCompactDirBytes(int64(conf.maxCompactDirSize)),
+		compact.WithGroupOrder(compact.GroupOrder(conf.groupOrder)),
+		compact.WithCompactorDeleteTimeout(time.Duration(conf.deleteTimeout)),
+		compact.WithRetryBackoff(compact.RetryBackoffConfig{
+			MaxRetries: conf.retryMaxAttempts,
+			Min:        time.Duration(conf.retryBackoffMin),
+			Max:        time.Duration(conf.retryBackoffMax),
+			Factor:     2,
+			Jitter:     true,
+		}),
+		compact.WithGarbageCollection(!conf.disableGarbageCollection),
+		compact.WithMaxGroupsPerRun(conf.maxGroupsPerRun),
 	)
 	if err != nil {
 		return errors.Wrap(err, "create bucket compactor")
@@ -427,7 +499,7 @@ func runCompact(
 				downsampleMetrics.downsamples.WithLabelValues(groupKey)
 				downsampleMetrics.downsampleFailures.WithLabelValues(groupKey)
 			}
-			if err := downsampleBucket(ctx, logger, downsampleMetrics, bkt, sy.Metas(), downsamplingDir, conf.downsampleConcurrency, metadata.HashFunc(conf.hashFunc)); err != nil {
+			if err := downsampleBucket(ctx, logger, downsampleMetrics, bkt, sy.Metas(), downsamplingDir, conf.downsampleConcurrency, metadata.HashFunc(conf.hashFunc), downsampleOpts); err != nil {
 				return errors.Wrap(err, "first pass of downsampling failed")
 			}
 
@@ -435,7 +507,7 @@ func runCompact(
 			if err := sy.SyncMetas(ctx); err != nil {
 				return errors.Wrap(err, "sync before second pass of downsampling")
 			}
-			if err := downsampleBucket(ctx, logger, downsampleMetrics, bkt, sy.Metas(), downsamplingDir, conf.downsampleConcurrency, metadata.HashFunc(conf.hashFunc)); err != nil {
+			if err := downsampleBucket(ctx, logger, downsampleMetrics, bkt, sy.Metas(), downsamplingDir, conf.downsampleConcurrency, metadata.HashFunc(conf.hashFunc), downsampleOpts); err != nil {
 				return errors.Wrap(err, "second pass of downsampling failed")
 			}
 			level.Info(logger).Log("msg", "downsampling iterations done")
@@ -458,6 +530,19 @@ func runCompact(
 	g.Add(func() error {
 		defer runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
 
+		if conf.dryRun {
+			plans, err := compactor.Plan(ctx)
+			if err != nil {
+				return errors.Wrap(err, "dry run planning")
+			}
+			for _, p := range plans {
+				level.Info(logger).Log("msg", "dry run: planned compaction", "group", p.Group, "resolution", p.Resolution,
+					"labels", p.Labels.String(), "blocks", fmt.Sprintf("%v", p.Blocks), "mint", p.MinTime, "maxt", p.MaxTime)
+			}
+			level.Info(logger).Log("msg", "dry run finished", "planned_compactions", len(plans))
+			return nil
+		}
+
 		if !conf.wait {
 			return compactMainFn()
 		}
@@ -525,7 +610,7 @@ func runCompact(
 
 		// Periodically remove partial blocks and blocks marked for deletion
 		// since one iteration potentially could take a long time.
-		if conf.cleanupBlocksInterval > 0 {
+		if conf.cleanupBlocksInterval > 0 && !conf.dryRun {
 			g.Add(func() error {
 				return runutil.Repeat(conf.cleanupBlocksInterval, ctx.Done(), cleanPartialMarked)
 			}, func(error) {
@@ -576,15 +661,39 @@ type compactConfig struct {
 	cleanupBlocksInterval                          time.Duration
 	compactionConcurrency                          int
 	downsampleConcurrency                          int
+	downsampleSignificantDigits                    int
+	downsampleSeriesConcurrency                    int
+	downsampleStreamingThreshold                   int
+	garbageCollectionConcurrency                   int
+	disableGarbageCollection                       bool
 	deleteDelay                                    model.Duration
 	dedupReplicaLabels                             []string
 	selectorRelabelConf                            extflag.PathOrContent
 	webConf                                        webConfig
 	label                                          string
 	maxBlockIndexSize                              units.Base2Bytes
+	maxCompactDirSize                              units.Base2Bytes
+	maxGroupsPerRun                                int
+	groupOrder                                     string
+	downloadStallTimeout                           model.Duration
+	blockDownloadConcurrency                       int
+	deleteTimeout                                  model.Duration
+	retryMaxAttempts                               int
+	retryBackoffMin                                model.Duration
+	retryBackoffMax                                model.Duration
 	hashFunc                                       string
 	enableVerticalCompaction                       bool
 	dedupFunc                                      string
+	gatherLabelCardinality                         bool
+	compressMeta                                   bool
+	dryRun                                         bool
+	maxBlockDuration                               model.Duration
+	minGroupBlocks                                 int
+	maxBlockCompactionLevel                        int
+	minGroupSize                                   units.Base2Bytes
+	denylistedBlocks                               []string
+	webhookURL                                     string
+	webhookTimeout                                 model.Duration
 }
 
 func (cc *compactConfig) registerFlag(cmd extkingpin.FlagClause) {
@@ -637,6 +746,47 @@ func (cc *compactConfig) registerFlag(cmd extkingpin.FlagClause) {
 		Default("1").IntVar(&cc.compactionConcurrency)
 	cmd.Flag("downsample.concurrency", "Number of goroutines to use when downsampling blocks.").
 		Default("1").IntVar(&cc.downsampleConcurrency)
+	cmd.Flag("downsample.significant-digits", "Lossy. If above 0, sum, min and max aggregates of downsampled blocks are rounded to this number of significant digits "+
+		"to make them compress better. Count and counter aggregates are never rounded.").
+		Default("0").IntVar(&cc.downsampleSignificantDigits)
+	cmd.Flag("downsample.streaming-threshold", "Number of samples above which raw series are downsampled in parts of about this many samples, instead of being loaded into memory at once. "+
+		"This bounds memory usage for huge series, but the last window of each part ends with its last sample. 0 disables it.").
+		Default("0").IntVar(&cc.downsampleStreamingThreshold)
+	cmd.Flag("downsample.series-concurrency", "Number of goroutines to use when downsampling series of a single block.").
+		Default("1").IntVar(&cc.downsampleSeriesConcurrency)
+	cmd.Flag("compact.max-work-dir-size", "Maximum disk space used by downloaded and compacted blocks in the compaction work directory. "+
+		"While it is exceeded, no new compaction group is started until running ones finish. 0 disables the limit.").
+		Default("0").BytesVar(&cc.maxCompactDirSize)
+	cmd.Flag("compact.max-groups-per-run", "Maximum number of groups compacted in a single compaction run. Remaining groups are compacted in the next run, "+
+		"which makes each run shorter and easier to interrupt. 0 disables the limit.").
+		Default("0").IntVar(&cc.maxGroupsPerRun)
+	cmd.Flag("compact.group-order", "Order in which compaction groups are started. 'key' starts them in group key order, 'oldest-first' starts groups with the oldest data first "+
+		"to finalize history quickly, 'largest-first' starts groups with the most blocks first to reduce the block count fastest.").
+		Default(string(compact.GroupOrderKey)).EnumVar(&cc.groupOrder, string(compact.GroupOrderKey), string(compact.GroupOrderOldestFirst), string(compact.GroupOrderLargestFirst))
+	cmd.Flag("compact.download-stall-timeout", "Abort the download of a block for compaction if no data was received for this long. The compaction is retried on the next iteration. Setting it to 0s disables the check.").
+		Default("0s").SetValue(&cc.downloadStallTimeout)
+	cmd.Flag("compact.block-download-concurrency", "Number of source blocks of a compaction group which are downloaded and verified concurrently.").
+		Default("1").IntVar(&cc.blockDownloadConcurrency)
+	cmd.Flag("compact.delete-timeout", "Maximum time allowed for marking a single block for deletion, after garbage collection, compaction or repair. "+
+		"Raise it for large buckets in object storages with high latency.").
+		Default("5m").SetValue(&cc.deleteTimeout)
+	cmd.Flag("compact.retry-max-attempts", "Number of consecutive compaction iterations failing with retriable errors (e.g. transient object storage errors) that are retried "+
+		"with exponential backoff, before the error is reported. 0 disables retrying, so the compaction is retried on the next run.").
+		Default("0").IntVar(&cc.retryMaxAttempts)
+	cmd.Flag("compact.retry-backoff-min", "Backoff before the first retry of a compaction iteration failing with retriable errors.").
+		Default("1s").SetValue(&cc.retryBackoffMin)
+	cmd.Flag("compact.retry-backoff-max", "Maximum backoff between retries of compaction iterations failing with retriable errors.").
+		Default("1m").SetValue(&cc.retryBackoffMax)
+	cmd.Flag("compact.garbage-collection-concurrency", "Number of goroutines to use when marking blocks for deletion during garbage collection.").
+		Default("1").IntVar(&cc.garbageCollectionConcurrency)
+	cmd.Flag("compact.disable-garbage-collection", "Do not mark blocks fully covered by other blocks for deletion before each compaction iteration. "+
+		"Such duplicates are still excluded from compaction. Useful when another process is responsible for cleaning up the bucket.").
+		Default("false").BoolVar(&cc.disableGarbageCollection)
+	cmd.Flag("compact.webhook-url", "URL to which a JSON event is POSTed after each compaction and downsample operation, describing its type, group, source blocks, "+
+		"duration and whether it succeeded. Failed notifications are only logged. Empty disables notifications.").
+		Default("").StringVar(&cc.webhookURL)
+	cmd.Flag("compact.webhook-timeout", "Timeout of a single request to --compact.webhook-url.").
+		Default("10s").SetValue(&cc.webhookTimeout)
 
 	cmd.Flag("delete-delay", "Time before a block marked for deletion is deleted from bucket. "+
 		"If delete-delay is non zero, blocks will be marked for deletion and compactor component will delete blocks marked for deletion from the bucket. "+
@@ -671,6 +821,31 @@ func (cc *compactConfig) registerFlag(cmd extkingpin.FlagClause) {
 	cmd.Flag("hash-func", "Specify which hash function to use when calculating the hashes of produced files. If no function has been specified, it does not happen. This permits avoiding downloading some files twice albeit at some performance cost. Possible values are: \"\", \"SHA256\".").
 		Default("").EnumVar(&cc.hashFunc, "SHA256", "")
 
+	cmd.Flag("compact.max-block-duration", "Maximum time range a block produced by compaction may span. Planned compactions are trimmed to blocks fitting into this window. Setting it to 0d disables the limit.").
+		Default("0d").SetValue(&cc.maxBlockDuration)
+
+	cmd.Flag("compact.max-block-compaction-level", "Blocks whose TSDB compaction level (as in their meta.json) reached this value are not compacted any further, which keeps block sizes bounded. "+
+		"No compaction spans them, and they are still checked for overlaps, garbage collected, downsampled and subject to retention. 0 means no limit.").
+		Default("0").IntVar(&cc.maxBlockCompactionLevel)
+
+	cmd.Flag("compact.min-group-blocks", "Minimum number of blocks a planned compaction must include before it is performed. Smaller compactions are deferred until more blocks arrive, unless they satisfy --compact.min-group-size. Already compacted blocks of the group do not count. 0 disables the threshold.").
+		Default("0").IntVar(&cc.minGroupBlocks)
+
+	cmd.Flag("compact.min-group-size", "Minimum total size of the blocks a planned compaction must include before it is performed. Smaller compactions are deferred until more data arrives, unless they satisfy --compact.min-group-blocks. Already compacted blocks of the group do not count. 0 disables the threshold.").
+		Default("0").BytesVar(&cc.minGroupSize)
+
+	cmd.Flag("compact.denylisted-block", "ULID of a block compactor must never touch: it is excluded from compaction, downsampling, retention, garbage collection, partial upload cleanup and repair (repeated flag). A block already marked for deletion is still deleted, remove its deletion-mark.json to keep it.").
+		PlaceHolder("<ULID>").StringsVar(&cc.denylistedBlocks)
+
+	cmd.Flag("compact.gather-label-cardinality", "When set, compactor computes the number of distinct values for each label name of the compacted block and stores it in the Thanos section of its meta.json.").
+		Default("false").BoolVar(&cc.gatherLabelCardinality)
+
+	cmd.Flag("compact.compress-meta", "When set, the meta.json of compacted and downsampled blocks is uploaded gzip-compressed to reduce storage and transfer for large metas. Only enable it once all components reading the bucket support compressed metas.").
+		Default("false").BoolVar(&cc.compressMeta)
+
+	cmd.Flag("compact.dry-run", "Only log the compactions the next iteration would perform and exit. No block is downloaded, compacted, downsampled, marked or deleted.").
+		Default("false").BoolVar(&cc.dryRun)
+
 	cc.selectorRelabelConf = *extkingpin.RegisterSelectorRelabelFlags(cmd)
 
 	cc.webConf.registerFlag(cmd)
@@ -181,6 +181,9 @@ type queryConfig struct {
 	dnsSDInterval time.Duration
 	httpMethod    string
 	dnsSDResolver string
+	dnsSDCacheTTL time.Duration
+
+	failAbsentOnPartialResponse bool
 }
 
 func (qc *queryConfig) registerFlag(cmd extkingpin.FlagClause) *queryConfig {
@@ -195,8 +198,12 @@ func (qc *queryConfig) registerFlag(cmd extkingpin.FlagClause) *queryConfig {
 		Default("30s").DurationVar(&qc.dnsSDInterval)
 	cmd.Flag("query.http-method", "HTTP method to use when sending queries. Possible options: [GET, POST]").
 		Default("POST").EnumVar(&qc.httpMethod, "GET", "POST")
+	cmd.Flag("query.fail-absent-on-partial-response", "Fail the evaluation of rules using absent() or absent_over_time() when their query returned a partial response, instead of possibly firing because the series are on a failed store.").
+		Default("false").BoolVar(&qc.failAbsentOnPartialResponse)
 	cmd.Flag("query.sd-dns-resolver", "Resolver to use. Possible options: [golang, miekgdns]").
 		Default("golang").Hidden().StringVar(&qc.dnsSDResolver)
+	cmd.Flag("query.sd-dns-cache-ttl", "Duration for which successful DNS resolutions of query API servers and Alertmanager hosts are reused instead of looking them up again. 0 disables caching.").
+		Default("0s").DurationVar(&qc.dnsSDCacheTTL)
 	return qc
 }
 
@@ -205,6 +212,7 @@ type alertMgrConfig struct {
 	alertmgrURLs           []string
 	alertmgrsTimeout       time.Duration
 	alertmgrsDNSSDInterval time.Duration
+	alertmgrsMaxBatchSize  int
 	alertExcludeLabels     []string
 	alertQueryURL          *string
 	alertRelabelConfigPath *extflag.PathOrContent
@@ -218,6 +226,8 @@ func (ac *alertMgrConfig) registerFlag(cmd extflag.FlagClause) *alertMgrConfig {
 		DurationVar(&ac.alertmgrsTimeout)
 	cmd.Flag("alertmanagers.sd-dns-interval", "Interval between DNS resolutions of Alertmanager hosts.").
 		Default("30s").DurationVar(&ac.alertmgrsDNSSDInterval)
+	cmd.Flag("alertmanagers.max-batch-size", "Maximum number of alerts sent to Alertmanager in a single request. Larger batches are split into consecutive requests. 0 means no limit.").
+		Default("0").IntVar(&ac.alertmgrsMaxBatchSize)
 	ac.alertQueryURL = cmd.Flag("alert.query-url", "The external Thanos Query URL that would be set in all alerts 'Source' field").String()
 	cmd.Flag("alert.label-drop", "Labels by name to drop before sending to alertmanager. This allows alert to be deduplicated on replica label (repeated). Similar Prometheus alert relabelling").
 		StringsVar(&ac.alertExcludeLabels)
@@ -38,6 +38,7 @@ import (
 type DownsampleMetrics struct {
 	downsamples        *prometheus.CounterVec
 	downsampleFailures *prometheus.CounterVec
+	droppedSeries      prometheus.Counter
 }
 
 func newDownsampleMetrics(reg *prometheus.Registry) *DownsampleMetrics {
@@ -51,6 +52,10 @@ func newDownsampleMetrics(reg *prometheus.Registry) *DownsampleMetrics {
 		Name: "thanos_compact_downsample_failures_total",
 		Help: "Total number of failed downsampling attempts.",
 	}, []string{"group"})
+	m.droppedSeries = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_downsample_dropped_series_total",
+		Help: "Total number of series dropped while downsampling because no samples were left after removing stale markers.",
+	})
 
 	return m
 }
@@ -67,6 +72,7 @@ func RunDownsample(
 	objStoreConfig *extflag.PathOrContent,
 	comp component.Component,
 	hashFunc metadata.HashFunc,
+	opts downsampleOptions,
 ) error {
 	confContentYaml, err := objStoreConfig.Content()
 	if err != nil {
@@ -118,7 +124,7 @@ func RunDownsample(
 				metrics.downsamples.WithLabelValues(groupKey)
 				metrics.downsampleFailures.WithLabelValues(groupKey)
 			}
-			if err := downsampleBucket(ctx, logger, metrics, bkt, metas, dataDir, downsampleConcurrency, hashFunc); err != nil {
+			if err := downsampleBucket(ctx, logger, metrics, bkt, metas, dataDir, downsampleConcurrency, hashFunc, opts); err != nil {
 				return errors.Wrap(err, "downsampling failed")
 			}
 
@@ -127,7 +133,7 @@ func RunDownsample(
 			if err != nil {
 				return errors.Wrap(err, "sync before second pass of downsampling")
 			}
-			if err := downsampleBucket(ctx, logger, metrics, bkt, metas, dataDir, downsampleConcurrency, hashFunc); err != nil {
+			if err := downsampleBucket(ctx, logger, metrics, bkt, metas, dataDir, downsampleConcurrency, hashFunc, opts); err != nil {
 				return errors.Wrap(err, "downsampling failed")
 			}
 
@@ -158,6 +164,16 @@ func RunDownsample(
 	return nil
 }
 
+// downsampleOptions are the optional knobs of downsampleBucket. The zero value downsamples with the defaults of
+// downsample.Downsample and notifies nobody.
+type downsampleOptions struct {
+	significantDigits  int
+	seriesConcurrency  int
+	streamingThreshold int
+	notifier           compact.Notifier
+	uploadOpts         []block.UploadOption
+}
+
 func downsampleBucket(
 	ctx context.Context,
 	logger log.Logger,
@@ -167,6 +183,7 @@ func downsampleBucket(
 	dir string,
 	downsampleConcurrency int,
 	hashFunc metadata.HashFunc,
+	opts downsampleOptions,
 ) (rerr error) {
 	if err := os.MkdirAll(dir, 0750); err != nil {
 		return errors.Wrap(err, "create dir")
@@ -237,7 +254,15 @@ func downsampleBucket(
 					resolution = downsample.ResLevel2
 					errMsg = "downsampling to 60 min"
 				}
-				if err := processDownsampling(ctx, logger, bkt, m, dir, resolution, hashFunc); err != nil {
+				begin := time.Now()
+				err := processDownsampling(ctx, logger, bkt, m, dir, resolution, hashFunc, metrics, opts)
+				if opts.notifier != nil {
+					e := compact.NewEvent(compact.EventDownsample, compact.DefaultGroupKey(m.Thanos), []ulid.ULID{m.ULID}, ulid.ULID{}, time.Since(begin), err)
+					if nerr := opts.notifier.Notify(ctx, e); nerr != nil {
+						level.Warn(logger).Log("msg", "failed to notify about downsampling", "block", m.ULID, "err", nerr)
+					}
+				}
+				if err != nil {
 					metrics.downsampleFailures.WithLabelValues(compact.DefaultGroupKey(m.Thanos)).Inc()
 					return errors.Wrap(err, errMsg)
 				}
@@ -309,7 +334,7 @@ func downsampleBucket(
 	return nil
 }
 
-func processDownsampling(ctx context.Context, logger log.Logger, bkt objstore.Bucket, m *metadata.Meta, dir string, resolution int64, hashFunc metadata.HashFunc) error {
+func processDownsampling(ctx context.Context, logger log.Logger, bkt objstore.Bucket, m *metadata.Meta, dir string, resolution int64, hashFunc metadata.HashFunc, metrics *DownsampleMetrics, opts downsampleOptions) error {
 	begin := time.Now()
 	bdir := filepath.Join(dir, m.ULID.String())
 
@@ -338,14 +363,21 @@ func processDownsampling(ctx context.Context, logger log.Logger, bkt objstore.Bu
 	}
 	defer runutil.CloseWithLogOnErr(log.With(logger, "outcome", "potential left mmap file handlers left"), b, "tsdb reader")
 
-	id, err := downsample.Downsample(logger, m, b, dir, resolution)
+	id, stats, err := downsample.Downsample(logger, m, b, dir, resolution,
+		downsample.WithSignificantDigits(opts.significantDigits),
+		downsample.WithConcurrency(opts.seriesConcurrency),
+		downsample.WithStreamingThreshold(opts.streamingThreshold),
+	)
 	if err != nil {
 		return errors.Wrapf(err, "downsample block %s to window %d", m.ULID, resolution)
 	}
+	metrics.droppedSeries.Add(float64(stats.DroppedSeries))
 	resdir := filepath.Join(dir, id.String())
 
 	level.Info(logger).Log("msg", "downsampled block",
-		"from", m.ULID, "to", id, "duration", time.Since(begin))
+		"from", m.ULID, "to", id, "duration", time.Since(begin),
+		"series", stats.Series, "dropped_series", stats.DroppedSeries,
+		"input_samples", stats.InputSamples, "output_samples", stats.OutputSamples, "counter_resets", stats.CounterResets)
 
 	if err := block.VerifyIndex(logger, filepath.Join(resdir, block.IndexFilename), m.MinTime, m.MaxTime); err != nil {
 		return errors.Wrap(err, "output block index not valid")
@@ -353,7 +385,7 @@ func processDownsampling(ctx context.Context, logger log.Logger, bkt objstore.Bu
 
 	begin = time.Now()
 
-	err = block.Upload(ctx, logger, bkt, resdir, hashFunc)
+	err = block.Upload(ctx, logger, bkt, resdir, hashFunc, opts.uploadOpts...)
 	if err != nil {
 		return errors.Wrapf(err, "upload downsampled block %s", id)
 	}
@@ -86,6 +86,11 @@ func registerQuery(app *extkingpin.App) {
 	maxConcurrentSelects := cmd.Flag("query.max-concurrent-select", "Maximum number of select requests made concurrently per a query.").
 		Default("4").Int()
 
+	maxQueryRetries := cmd.Flag("query.max-retries", "Maximum number of times a query is retried when it failed because stores were unavailable, e.g. while they restart. Only queries with partial response disabled are retried: with partial response enabled, unavailable stores are reported as warnings instead. 0 disables retries.").
+		Default("0").Int()
+	queryRetryBackoff := extkingpin.ModelDuration(cmd.Flag("query.retry-backoff", "Backoff before the first retry of a query failed because stores were unavailable. It doubles with every retry.").
+		Default("1s"))
+
 	queryReplicaLabels := cmd.Flag("query.replica-label", "Labels to treat as a replica indicator along which data is deduplicated. Still you will be able to query without deduplication using 'dedup=false' parameter. Data includes time series, recording rules, and alerting rules.").
 		Strings()
 
@@ -129,11 +134,17 @@ func registerQuery(app *extkingpin.App) {
 	dnsSDResolver := cmd.Flag("store.sd-dns-resolver", fmt.Sprintf("Resolver to use. Possible options: [%s, %s]", dns.GolangResolverType, dns.MiekgdnsResolverType)).
 		Default(string(dns.GolangResolverType)).Hidden().String()
 
+	dnsSDCacheTTL := extkingpin.ModelDuration(cmd.Flag("store.sd-dns-cache-ttl", "Duration for which successful DNS resolutions of an address are reused instead of looking it up again. Reduces the number of DNS queries for large lists of addresses. 0 disables caching.").
+		Default("0s"))
+
 	unhealthyStoreTimeout := extkingpin.ModelDuration(cmd.Flag("store.unhealthy-timeout", "Timeout before an unhealthy store is cleaned from the store UI page.").Default("5m"))
 
 	enableAutodownsampling := cmd.Flag("query.auto-downsampling", "Enable automatic adjustment (step / 5) to what source of data should be used in store gateways if no max_source_resolution param is specified.").
 		Default("false").Bool()
 
+	enableResolutionDowngradeWarning := cmd.Flag("query.resolution-downgrade-warning", "Return a warning for range queries whose max_source_resolution allows downsampled data coarser than the query step.").
+		Default("false").Bool()
+
 	enableQueryPartialResponse := cmd.Flag("query.partial-response", "Enable partial response for queries if no partial_response param is specified. --no-query.partial-response for disabling.").
 		Default("true").Bool()
 
@@ -253,9 +264,13 @@ func registerQuery(app *extkingpin.App) {
 			*enableRulePartialResponse,
 			*enableTargetPartialResponse,
 			*enableMetricMetadataPartialResponse,
+			*enableResolutionDowngradeWarning,
+			*maxQueryRetries,
+			time.Duration(*queryRetryBackoff),
 			fileSD,
 			time.Duration(*dnsSDInterval),
 			*dnsSDResolver,
+			time.Duration(*dnsSDCacheTTL),
 			time.Duration(*unhealthyStoreTimeout),
 			time.Duration(*instantDefaultMaxSourceResolution),
 			*defaultMetadataTimeRange,
@@ -314,9 +329,13 @@ func runQuery(
 	enableRulePartialResponse bool,
 	enableTargetPartialResponse bool,
 	enableMetricMetadataPartialResponse bool,
+	enableResolutionDowngradeWarning bool,
+	maxQueryRetries int,
+	queryRetryBackoff time.Duration,
 	fileSD *file.Discovery,
 	dnsSDInterval time.Duration,
 	dnsSDResolver string,
+	dnsSDCacheTTL time.Duration,
 	unhealthyStoreTimeout time.Duration,
 	instantDefaultMaxSourceResolution time.Duration,
 	defaultMetadataTimeRange time.Duration,
@@ -336,10 +355,11 @@ func runQuery(
 	}
 
 	fileSDCache := cache.New()
-	dnsStoreProvider := dns.NewProvider(
+	dnsStoreProvider := dns.NewCachingProvider(
 		logger,
 		extprom.WrapRegistererWithPrefix("thanos_query_store_apis_", reg),
 		dns.ResolverType(dnsSDResolver),
+		dnsSDCacheTTL,
 	)
 
 	for _, store := range strictStores {
@@ -348,28 +368,32 @@ func runQuery(
 		}
 	}
 
-	dnsRuleProvider := dns.NewProvider(
+	dnsRuleProvider := dns.NewCachingProvider(
 		logger,
 		extprom.WrapRegistererWithPrefix("thanos_query_rule_apis_", reg),
 		dns.ResolverType(dnsSDResolver),
+		dnsSDCacheTTL,
 	)
 
-	dnsTargetProvider := dns.NewProvider(
+	dnsTargetProvider := dns.NewCachingProvider(
 		logger,
 		extprom.WrapRegistererWithPrefix("thanos_query_target_apis_", reg),
 		dns.ResolverType(dnsSDResolver),
+		dnsSDCacheTTL,
 	)
 
-	dnsMetadataProvider := dns.NewProvider(
+	dnsMetadataProvider := dns.NewCachingProvider(
 		logger,
 		extprom.WrapRegistererWithPrefix("thanos_query_metadata_apis_", reg),
 		dns.ResolverType(dnsSDResolver),
+		dnsSDCacheTTL,
 	)
 
-	dnsExemplarProvider := dns.NewProvider(
+	dnsExemplarProvider := dns.NewCachingProvider(
 		logger,
 		extprom.WrapRegistererWithPrefix("thanos_query_exemplar_apis_", reg),
 		dns.ResolverType(dnsSDResolver),
+		dnsSDCacheTTL,
 	)
 
 	var (
@@ -577,6 +601,9 @@ func runQuery(
 			enableRulePartialResponse,
 			enableTargetPartialResponse,
 			enableMetricMetadataPartialResponse,
+			enableResolutionDowngradeWarning,
+			maxQueryRetries,
+			queryRetryBackoff,
 			queryReplicaLabels,
 			flagsMap,
 			defaultRangeQueryStep,
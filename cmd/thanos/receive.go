@@ -8,8 +8,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"sync"
 	"time"
 
+	"github.com/alecthomas/units"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	grpc_logging "github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/logging"
@@ -58,6 +60,9 @@ func registerReceive(app *extkingpin.App) {
 		if !model.LabelName.IsValid(model.LabelName(conf.tenantLabelName)) {
 			return errors.Errorf("unsupported format for tenant label name, got %s", conf.tenantLabelName)
 		}
+		if conf.tenantSeriesLabel != "" && !model.LabelName.IsValid(model.LabelName(conf.tenantSeriesLabel)) {
+			return errors.Errorf("unsupported format for tenant series label, got %s", conf.tenantSeriesLabel)
+		}
 		if len(lset) == 0 {
 			return errors.New("no external labels configured for receive, uniquely identifying external labels must be configured (ideally with `receive_` prefix); see https://thanos.io/tip/thanos/storage.md#external-labels for details.")
 		}
@@ -96,6 +101,9 @@ func registerReceive(app *extkingpin.App) {
 	})
 }
 
+// walFlushCheckInterval is how often the WAL is checked against the configured flush thresholds.
+const walFlushCheckInterval = 30 * time.Second
+
 func runReceive(
 	g *run.Group,
 	logger log.Logger,
@@ -189,6 +197,7 @@ func runReceive(
 		Endpoint:          conf.endpoint,
 		TenantHeader:      conf.tenantHeader,
 		DefaultTenantID:   conf.defaultTenantID,
+		TenantSeriesLabel: conf.tenantSeriesLabel,
 		ReplicaHeader:     conf.replicaHeader,
 		ReplicationFactor: conf.replicationFactor,
 		ReceiverMode:      receiveMode,
@@ -196,6 +205,11 @@ func runReceive(
 		TLSConfig:         rwTLSConfig,
 		DialOpts:          dialOpts,
 		ForwardTimeout:    time.Duration(*conf.forwardTimeout),
+
+		MaxFutureTolerance:  time.Duration(*conf.maxFutureTolerance),
+		MaxLabelsPerSeries:  conf.maxLabelsPerSeries,
+		MaxLabelNameLength:  conf.maxLabelNameLength,
+		MaxLabelValueLength: conf.maxLabelValueLength,
 	})
 
 	grpcProbe := prober.NewGRPC()
@@ -214,6 +228,8 @@ func runReceive(
 	reloadGRPCServer := make(chan struct{}, 1)
 	// hashringChangedChan signals when TSDB needs to be flushed and updated due to hashring config change.
 	hashringChangedChan := make(chan struct{}, 1)
+	// walFlushes signals when TSDB needs to be flushed because the WAL exceeds the configured size or age.
+	walFlushes := newFlushRequests()
 	// uploadC signals when new blocks should be uploaded.
 	uploadC := make(chan struct{}, 1)
 	// uploadDone signals when uploading has finished.
@@ -222,12 +238,16 @@ func runReceive(
 	if enableIngestion {
 		level.Debug(logger).Log("msg", "setting up tsdb")
 		{
-			if err := startTSDBAndUpload(g, logger, reg, dbs, reloadGRPCServer, uploadC, hashringChangedChan, upload, uploadDone, statusProber, bkt); err != nil {
+			if err := startTSDBAndUpload(g, logger, reg, dbs, reloadGRPCServer, uploadC, hashringChangedChan, upload, uploadDone, statusProber, bkt, walFlushes); err != nil {
 				return err
 			}
 		}
 	}
 
+	if enableIngestion && (conf.walFlushSize > 0 || *conf.walFlushAge > 0) {
+		setupWALFlushTrigger(g, logger, dbs.WALStats, int64(conf.walFlushSize), time.Duration(*conf.walFlushAge), walFlushCheckInterval, walFlushes)
+	}
+
 	level.Debug(logger).Log("msg", "setting up hashring")
 	{
 		if err := setupHashring(g, logger, reg, conf, hashringChangedChan, webHandler, statusProber, reloadGRPCServer, enableIngestion); err != nil {
@@ -472,7 +492,7 @@ func startTSDBAndUpload(g *run.Group,
 	uploadDone chan struct{},
 	statusProber prober.Probe,
 	bkt objstore.Bucket,
-
+	walFlushes *flushRequests,
 ) error {
 
 	log.With(logger, "component", "storage")
@@ -495,6 +515,7 @@ func startTSDBAndUpload(g *run.Group,
 	g.Add(func() error {
 		defer close(reloadGRPCServer)
 		defer close(uploadC)
+		defer walFlushes.close()
 
 		// Before quitting, ensure the WAL is flushed and the DBs are closed.
 		defer func() {
@@ -536,6 +557,17 @@ func startTSDBAndUpload(g *run.Group,
 				level.Info(logger).Log("msg", "storage started, and server is ready to receive web requests")
 				dbUpdatesCompleted.Inc()
 				reloadGRPCServer <- struct{}{}
+			case <-walFlushes.c:
+				// Only the part of the heads that no longer accepts appends is flushed, so ingestion continues and
+				// the storage stays open, without reloading the gRPC server.
+				level.Info(logger).Log("msg", "flushing storage as the WAL exceeds the configured threshold")
+				if err := dbs.FlushClosed(); err != nil {
+					return errors.Wrap(err, "flushing storage")
+				}
+				if upload {
+					uploadC <- struct{}{}
+					<-uploadDone
+				}
 			}
 		}
 	}, func(err error) {
@@ -617,6 +649,70 @@ func startTSDBAndUpload(g *run.Group,
 	return nil
 }
 
+// flushRequests carries requests to flush the storage to the storage actor, which owns it and closes it on shutdown.
+// Requests made after closing are dropped, so requesters never race with the shutdown.
+type flushRequests struct {
+	mtx    sync.Mutex
+	c      chan struct{}
+	closed bool
+}
+
+func newFlushRequests() *flushRequests {
+	return &flushRequests{c: make(chan struct{}, 1)}
+}
+
+// request asks for a flush. It returns false if the storage actor is shut down, it never blocks.
+func (f *flushRequests) request() bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.closed {
+		return false
+	}
+	select {
+	case f.c <- struct{}{}:
+	default:
+		// A flush is already pending.
+	}
+	return true
+}
+
+func (f *flushRequests) close() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if !f.closed {
+		f.closed = true
+		close(f.c)
+	}
+}
+
+// setupWALFlushTrigger checks the WAL stats every interval and requests a storage flush, and upload if enabled,
+// once they exceed the given size or age.
+func setupWALFlushTrigger(g *run.Group, logger log.Logger, walStats func() (receive.WALStats, error), maxSizeBytes int64, maxAge, interval time.Duration, flushes *flushRequests) {
+	logger = log.With(logger, "component", "wal-flush-trigger")
+	ctx, cancel := context.WithCancel(context.Background())
+	g.Add(func() error {
+		return runutil.Repeat(interval, ctx.Done(), func() error {
+			stats, err := walStats()
+			if err != nil {
+				level.Warn(logger).Log("msg", "failed to get WAL stats", "err", err)
+				return nil
+			}
+			if !stats.Exceeds(maxSizeBytes, maxAge, time.Now()) {
+				return nil
+			}
+			level.Info(logger).Log("msg", "WAL exceeds threshold; requesting storage flush", "size", stats.SizeBytes, "oldestSample", stats.OldestSampleTime)
+			if !flushes.request() {
+				level.Debug(logger).Log("msg", "storage is shut down; dropping flush request")
+			}
+			return nil
+		})
+	}, func(error) {
+		cancel()
+	})
+}
+
 func migrateLegacyStorage(logger log.Logger, dataDir, defaultTenantID string) error {
 	defaultTenantDataDir := path.Join(dataDir, defaultTenantID)
 
@@ -686,16 +782,24 @@ type receiveConfig struct {
 	tenantHeader      string
 	tenantLabelName   string
 	defaultTenantID   string
+	tenantSeriesLabel string
 	replicaHeader     string
 	replicationFactor uint64
 	forwardTimeout    *model.Duration
 
+	maxFutureTolerance  *model.Duration
+	maxLabelsPerSeries  int
+	maxLabelNameLength  int
+	maxLabelValueLength int
+
 	tsdbMinBlockDuration       *model.Duration
 	tsdbMaxBlockDuration       *model.Duration
 	tsdbAllowOverlappingBlocks bool
 	tsdbMaxExemplars           int
 
 	walCompression bool
+	walFlushSize   units.Base2Bytes
+	walFlushAge    *model.Duration
 	noLockFile     bool
 
 	hashFunc string
@@ -751,12 +855,22 @@ func (rc *receiveConfig) registerFlag(cmd extkingpin.FlagClause) {
 
 	cmd.Flag("receive.tenant-label-name", "Label name through which the tenant will be announced.").Default(receive.DefaultTenantLabel).StringVar(&rc.tenantLabelName)
 
+	cmd.Flag("receive.tenant-series-label", "Label of incoming series to determine the tenant from when the tenant header is absent. The label is then removed from the series and series without it are written to the default tenant. Requests with the tenant header are written as is, keeping the label. Empty disables this.").Default("").StringVar(&rc.tenantSeriesLabel)
+
 	cmd.Flag("receive.replica-header", "HTTP header specifying the replica number of a write request.").Default(receive.DefaultReplicaHeader).StringVar(&rc.replicaHeader)
 
 	cmd.Flag("receive.replication-factor", "How many times to replicate incoming write requests.").Default("1").Uint64Var(&rc.replicationFactor)
 
 	rc.forwardTimeout = extkingpin.ModelDuration(cmd.Flag("receive-forward-timeout", "Timeout for each forward request.").Default("5s").Hidden())
 
+	rc.maxFutureTolerance = extkingpin.ModelDuration(cmd.Flag("receive.max-future-tolerance", "Maximum time sample timestamps can be ahead of the current time. Samples further in the future are rejected. 0s disables the check.").Default("0s"))
+
+	cmd.Flag("receive.max-labels-per-series", "Maximum number of labels per series. Series with more labels are rejected. 0 disables the limit.").Default("0").IntVar(&rc.maxLabelsPerSeries)
+
+	cmd.Flag("receive.max-label-name-length", "Maximum length of label names. Series with longer label names are rejected. 0 disables the limit.").Default("0").IntVar(&rc.maxLabelNameLength)
+
+	cmd.Flag("receive.max-label-value-length", "Maximum length of label values. Series with longer label values are rejected. 0 disables the limit.").Default("0").IntVar(&rc.maxLabelValueLength)
+
 	rc.tsdbMinBlockDuration = extkingpin.ModelDuration(cmd.Flag("tsdb.min-block-duration", "Min duration for local TSDB blocks").Default("2h").Hidden())
 
 	rc.tsdbMaxBlockDuration = extkingpin.ModelDuration(cmd.Flag("tsdb.max-block-duration", "Max duration for local TSDB blocks").Default("2h").Hidden())
@@ -765,6 +879,12 @@ func (rc *receiveConfig) registerFlag(cmd extkingpin.FlagClause) {
 
 	cmd.Flag("tsdb.wal-compression", "Compress the tsdb WAL.").Default("true").BoolVar(&rc.walCompression)
 
+	cmd.Flag("tsdb.wal-flush-size", "Flush the storage, and upload the resulting blocks if enabled, once the total size of the tenants' WAL exceeds this size. Only samples older than half of the minimum block duration before the newest sample are flushed, so ingestion continues meanwhile. 0 disables the size trigger.").
+		Default("0B").BytesVar(&rc.walFlushSize)
+
+	rc.walFlushAge = extkingpin.ModelDuration(cmd.Flag("tsdb.wal-flush-age", "Flush the storage, and upload the resulting blocks if enabled, once the WAL holds samples older than this. Only samples older than half of the minimum block duration before the newest sample are flushed, so ingestion continues meanwhile. 0s disables the age trigger.").
+		Default("0s"))
+
 	cmd.Flag("tsdb.no-lockfile", "Do not create lockfile in TSDB data directory. In any case, the lockfiles will be deleted on next startup.").Default("false").BoolVar(&rc.noLockFile)
 
 	cmd.Flag("tsdb.max-exemplars",
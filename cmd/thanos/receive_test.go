@@ -0,0 +1,70 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/run"
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
+
+	"github.com/thanos-io/thanos/pkg/receive"
+	"github.com/thanos-io/thanos/pkg/runutil"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestWALFlushTrigger(t *testing.T) {
+	var (
+		checks  atomic.Int64
+		size    atomic.Int64
+		flushes = newFlushRequests()
+		g       run.Group
+	)
+	setupWALFlushTrigger(&g, log.NewNopLogger(), func() (receive.WALStats, error) {
+		checks.Inc()
+		return receive.WALStats{SizeBytes: size.Load(), OldestSampleTime: math.MaxInt64}, nil
+	}, 10, 0, time.Millisecond, flushes)
+
+	waitForChecks := func(n int64) error {
+		target := checks.Load() + n
+		return runutil.Retry(time.Millisecond, make(chan struct{}), func() error {
+			if checks.Load() < target {
+				return errors.New("not enough checks yet")
+			}
+			return nil
+		})
+	}
+
+	// Storage actor.
+	g.Add(func() error {
+		// Below the threshold, no flush is requested.
+		if err := waitForChecks(3); err != nil {
+			return err
+		}
+		select {
+		case <-flushes.c:
+			return errors.New("unexpected flush request below the threshold")
+		default:
+		}
+
+		size.Store(11)
+		<-flushes.c
+
+		// Shutting down the storage while the trigger keeps requesting flushes must not panic.
+		flushes.close()
+		if err := waitForChecks(3); err != nil {
+			return err
+		}
+		if flushes.request() {
+			return errors.New("expected flush request to be dropped after shutdown")
+		}
+		return nil
+	}, func(error) {})
+
+	testutil.Ok(t, g.Run())
+}
@@ -297,10 +297,11 @@ func runRule(
 		}
 	}
 
-	queryProvider := dns.NewProvider(
+	queryProvider := dns.NewCachingProvider(
 		logger,
 		extprom.WrapRegistererWithPrefix("thanos_rule_query_apis_", reg),
 		dns.ResolverType(conf.query.dnsSDResolver),
+		conf.query.dnsSDCacheTTL,
 	)
 	var queryClients []*http_util.Client
 	for _, cfg := range queryCfg {
@@ -368,14 +369,15 @@ func runRule(
 		}
 	}
 
-	amProvider := dns.NewProvider(
+	amProvider := dns.NewCachingProvider(
 		logger,
 		extprom.WrapRegistererWithPrefix("thanos_rule_alertmanagers_", reg),
 		dns.ResolverType(conf.query.dnsSDResolver),
+		conf.query.dnsSDCacheTTL,
 	)
 	var alertmgrs []*alert.Alertmanager
 	for _, cfg := range alertingCfg.Alertmanagers {
-		c, err := http_util.NewHTTPClient(cfg.HTTPClientConfig, "alertmanager")
+		c, err := http_util.NewHTTPClient(cfg.HTTPClientConfig, "alertmanager", cfg.ClientOptions()...)
 		if err != nil {
 			return err
 		}
@@ -434,7 +436,7 @@ func runRule(
 				Queryable:   db,
 				ResendDelay: conf.resendDelay,
 			},
-			queryFuncCreator(logger, queryClients, metrics.duplicatedQuery, metrics.ruleEvalWarnings, conf.query.httpMethod),
+			queryFuncCreator(logger, queryClients, metrics.duplicatedQuery, metrics.ruleEvalWarnings, conf.query.httpMethod, conf.query.failAbsentOnPartialResponse),
 			conf.lset,
 		)
 
@@ -451,7 +453,7 @@ func runRule(
 	}
 	// Run the alert sender.
 	{
-		sdr := alert.NewSender(logger, reg, alertmgrs)
+		sdr := alert.NewSender(logger, reg, alertmgrs, conf.alertmgr.alertmgrsMaxBatchSize)
 		ctx, cancel := context.WithCancel(context.Background())
 		ctx = tracing.ContextWithTracer(ctx, tracer)
 
@@ -700,6 +702,7 @@ func queryFuncCreator(
 	duplicatedQuery prometheus.Counter,
 	ruleEvalWarnings *prometheus.CounterVec,
 	httpMethod string,
+	failAbsentOnPartialResponse bool,
 ) func(partialResponseStrategy storepb.PartialResponseStrategy) rules.QueryFunc {
 
 	// queryFunc returns query function that hits the HTTP query API of query peers in randomized order until we get a result
@@ -743,6 +746,12 @@ func queryFuncCreator(
 						ruleEvalWarnings.WithLabelValues(strings.ToLower(partialResponseStrategy.String())).Inc()
 						// TODO(bwplotka): Propagate those to UI, probably requires changing rule manager code ):
 						level.Warn(logger).Log("warnings", strings.Join(warns, ", "), "query", q)
+						if failAbsentOnPartialResponse {
+							// Fail the evaluation rather than risk firing on series hidden by a failed store.
+							if err := query.CheckAbsentOnPartialResponse(q, warns); err != nil {
+								return nil, err
+							}
+						}
 					}
 					return v, nil
 				}
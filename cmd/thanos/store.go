@@ -6,6 +6,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/alecthomas/units"
@@ -13,6 +14,7 @@ import (
 	"github.com/go-kit/kit/log/level"
 	grpclogging "github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/logging"
 	"github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/tags"
+	"github.com/jpillora/backoff"
 	"github.com/oklog/run"
 	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
@@ -22,6 +24,7 @@ import (
 	commonmodel "github.com/prometheus/common/model"
 
 	extflag "github.com/efficientgo/tools/extkingpin"
+	baseAPI "github.com/thanos-io/thanos/pkg/api"
 	blocksAPI "github.com/thanos-io/thanos/pkg/api/blocks"
 	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
@@ -51,19 +54,24 @@ type storeConfig struct {
 	grpcConfig                  grpcConfig
 	httpConfig                  httpConfig
 	indexCacheSizeBytes         units.Base2Bytes
+	indexCacheMaxItemSizeBytes  units.Base2Bytes
 	chunkPoolSize               units.Base2Bytes
 	maxSampleCount              uint64
 	maxTouchedSeriesCount       uint64
+	maxSeriesChunksCount        uint64
 	maxConcurrency              int
 	component                   component.StoreAPI
 	debugLogging                bool
 	syncInterval                time.Duration
+	syncRetryBackoffMin         time.Duration
+	syncRetryBackoffMax         time.Duration
 	blockSyncConcurrency        int
 	blockMetaFetchConcurrency   int
 	filterConf                  *store.FilterConfig
 	selectorRelabelConf         extflag.PathOrContent
 	advertiseCompatibilityLabel bool
 	consistencyDelay            commonmodel.Duration
+	newBlockGracePeriod         commonmodel.Duration
 	ignoreDeletionMarksDelay    commonmodel.Duration
 	webConfig                   webConfig
 	postingOffsetsInMemSampling int
@@ -83,6 +91,9 @@ func (sc *storeConfig) registerFlag(cmd extkingpin.FlagClause) {
 	cmd.Flag("index-cache-size", "Maximum size of items held in the in-memory index cache. Ignored if --index-cache.config or --index-cache.config-file option is specified.").
 		Default("250MB").BytesVar(&sc.indexCacheSizeBytes)
 
+	cmd.Flag("index-cache-max-item-size", "Maximum size of a single item held in the in-memory index cache. Larger items, e.g. huge postings lists, are not cached so they do not evict everything else. Must not exceed --index-cache-size. Ignored if --index-cache.config or --index-cache.config-file option is specified.").
+		Default("125MB").BytesVar(&sc.indexCacheMaxItemSizeBytes)
+
 	sc.indexCacheConfigs = *extflag.RegisterPathOrContent(cmd, "index-cache.config",
 		"YAML file that contains index cache configuration. See format details: https://thanos.io/tip/components/store.md/#index-cache",
 		extflag.WithEnvSubstitution(),
@@ -104,6 +115,10 @@ func (sc *storeConfig) registerFlag(cmd extkingpin.FlagClause) {
 		"Maximum amount of touched series returned via a single Series call. The Series call fails if this limit is exceeded. 0 means no limit.").
 		Default("0").Uint64Var(&sc.maxTouchedSeriesCount)
 
+	cmd.Flag("store.grpc.chunks-per-series-limit",
+		"Maximum amount of chunks of any single series fetched from a block via a single Series call. The Series call fails if this limit is exceeded. 0 means no limit.").
+		Default("0").Uint64Var(&sc.maxSeriesChunksCount)
+
 	cmd.Flag("store.grpc.series-max-concurrency", "Maximum number of concurrent Series calls.").Default("20").IntVar(&sc.maxConcurrency)
 
 	sc.component = component.Store
@@ -113,6 +128,13 @@ func (sc *storeConfig) registerFlag(cmd extkingpin.FlagClause) {
 	cmd.Flag("sync-block-duration", "Repeat interval for syncing the blocks between local and remote view.").
 		Default("3m").DurationVar(&sc.syncInterval)
 
+	cmd.Flag("sync-block-retry-backoff-min", "Backoff before retrying a failed sync of blocks, instead of waiting for the next sync interval. "+
+		"It doubles with each consecutive failure, up to sync-block-retry-backoff-max, and is reset once a sync succeeds. 0 disables the backoff, so failed syncs are retried on the next interval.").
+		Default("5s").DurationVar(&sc.syncRetryBackoffMin)
+
+	cmd.Flag("sync-block-retry-backoff-max", "Maximum backoff between retries of consecutive failed syncs of blocks. The backoff never exceeds sync-block-duration.").
+		Default("1m").DurationVar(&sc.syncRetryBackoffMax)
+
 	cmd.Flag("block-sync-concurrency", "Number of goroutines to use when constructing index-cache.json blocks from object storage.").
 		Default("20").IntVar(&sc.blockSyncConcurrency)
 
@@ -140,6 +162,10 @@ func (sc *storeConfig) registerFlag(cmd extkingpin.FlagClause) {
 	cmd.Flag("consistency-delay", "Minimum age of all blocks before they are being read. Set it to safe value (e.g 30m) if your object storage is eventually consistent. GCS and S3 are (roughly) strongly consistent.").
 		Default("0s").SetValue(&sc.consistencyDelay)
 
+	cmd.Flag("store.new-block-grace-period", "Minimum age of a block, based on its ULID, before it is served. Unlike --consistency-delay it also applies to blocks produced by compaction, "+
+		"which reduces the chance of serving overlapping data while a compaction replaces its source blocks. 0s disables it.").
+		Default("0s").SetValue(&sc.newBlockGracePeriod)
+
 	cmd.Flag("ignore-deletion-marks-delay", "Duration after which the blocks marked for deletion will be filtered out while fetching blocks. "+
 		"The idea of ignore-deletion-marks-delay is to ignore blocks that are marked for deletion with some delay. This ensures store can still serve blocks that are meant to be deleted but do not have a replacement yet. "+
 		"If delete-delay duration is provided to compactor or bucket verify component, it will upload deletion-mark.json file to mark after what duration the block should be deleted rather than deleting the block straight away. "+
@@ -289,7 +315,7 @@ func runStore(
 	} else {
 		indexCache, err = storecache.NewInMemoryIndexCacheWithConfig(logger, reg, storecache.InMemoryIndexCacheConfig{
 			MaxSize:     model.Bytes(conf.indexCacheSizeBytes),
-			MaxItemSize: storecache.DefaultInMemoryIndexCacheConfig.MaxItemSize,
+			MaxItemSize: model.Bytes(conf.indexCacheMaxItemSizeBytes),
 		})
 	}
 	if err != nil {
@@ -302,6 +328,7 @@ func runStore(
 			block.NewTimePartitionMetaFilter(conf.filterConf.MinTime, conf.filterConf.MaxTime),
 			block.NewLabelShardedMetaFilter(relabelConfig),
 			block.NewConsistencyDelayMetaFilter(logger, time.Duration(conf.consistencyDelay), extprom.WrapRegistererWithPrefix("thanos_", reg)),
+			block.NewBlockGracePeriodMetaFilter(logger, time.Duration(conf.newBlockGracePeriod)),
 			ignoreDeletionMarkFilter,
 			block.NewDeduplicateFilter(),
 		}, nil)
@@ -328,6 +355,7 @@ func runStore(
 		store.WithQueryGate(queriesGate),
 		store.WithChunkPool(chunkPool),
 		store.WithFilterConfig(conf.filterConf),
+		store.WithSeriesChunksLimit(conf.maxSeriesChunksCount),
 	}
 
 	if conf.debugLogging {
@@ -369,15 +397,24 @@ func runStore(
 			level.Info(logger).Log("msg", "bucket store ready", "init_duration", time.Since(begin).String())
 			close(bucketStoreReady)
 
-			err := runutil.Repeat(conf.syncInterval, ctx.Done(), func() error {
+			var syncBackoff *backoff.Backoff
+			if conf.syncRetryBackoffMin > 0 {
+				syncBackoff = &backoff.Backoff{
+					Min:    conf.syncRetryBackoffMin,
+					Max:    conf.syncRetryBackoffMax,
+					Factor: 2,
+				}
+			}
+			runutil.RepeatWithBackoff(conf.syncInterval, syncBackoff, ctx.Done(), func() error {
 				if err := bs.SyncBlocks(ctx); err != nil {
 					level.Warn(logger).Log("msg", "syncing blocks failed", "err", err)
+					return err
 				}
 				return nil
 			})
 
 			runutil.CloseWithLogOnErr(logger, bs, "bucket store")
-			return err
+			return nil
 		}, func(error) {
 			cancel()
 		})
@@ -418,6 +455,12 @@ func runStore(
 		api := blocksAPI.NewBlocksAPI(logger, conf.webConfig.disableCORS, "", flagsMap)
 		api.Register(r.WithPrefix("/api/v1"), tracer, logger, ins, logMiddleware)
 
+		// Expose blocks actually loaded by the bucket store, useful for debugging gaps in query results.
+		instr := baseAPI.GetInstr(tracer, logger, ins, logMiddleware, conf.webConfig.disableCORS)
+		r.Get("/api/v1/loaded-blocks", instr("loaded-blocks", func(*http.Request) (interface{}, []error, *baseAPI.ApiError) {
+			return bs.LoadedBlocks(), nil, nil
+		}))
+
 		metaFetcher.UpdateOnChange(func(blocks []metadata.Meta, err error) {
 			compactorView.Set(blocks, err)
 			api.SetLoaded(blocks, err)
@@ -528,9 +528,21 @@ func registerBucketDownsample(app extkingpin.AppClause, objStoreConfig *extflag.
 		Default("./data").String()
 	hashFunc := cmd.Flag("hash-func", "Specify which hash function to use when calculating the hashes of produced files. If no function has been specified, it does not happen. This permits avoiding downloading some files twice albeit at some performance cost. Possible values are: \"\", \"SHA256\".").
 		Default("").Enum("SHA256", "")
+	significantDigits := cmd.Flag("downsample.significant-digits", "Lossy. If above 0, sum, min and max aggregates of downsampled blocks are rounded to this number of significant digits "+
+		"to make them compress better. Count and counter aggregates are never rounded.").
+		Default("0").Int()
+	seriesConcurrency := cmd.Flag("downsample.series-concurrency", "Number of goroutines to use when downsampling series of a single block.").
+		Default("1").Int()
+	streamingThreshold := cmd.Flag("downsample.streaming-threshold", "Number of samples above which raw series are downsampled in parts of about this many samples, instead of being loaded into memory at once. "+
+		"This bounds memory usage for huge series, but the last window of each part ends with its last sample. 0 disables it.").
+		Default("0").Int()
 
 	cmd.Setup(func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, _ <-chan struct{}, _ bool) error {
-		return RunDownsample(g, logger, reg, *httpAddr, *httpTLSConfig, time.Duration(*httpGracePeriod), *dataDir, *downsampleConcurrency, objStoreConfig, component.Downsample, metadata.HashFunc(*hashFunc))
+		return RunDownsample(g, logger, reg, *httpAddr, *httpTLSConfig, time.Duration(*httpGracePeriod), *dataDir, *downsampleConcurrency, objStoreConfig, component.Downsample, metadata.HashFunc(*hashFunc), downsampleOptions{
+			significantDigits:  *significantDigits,
+			seriesConcurrency:  *seriesConcurrency,
+			streamingThreshold: *streamingThreshold,
+		})
 	})
 }
 
@@ -600,7 +612,8 @@ func registerBucketCleanup(app extkingpin.AppClause, objStoreConfig *extflag.Pat
 				ignoreDeletionMarkFilter,
 				stubCounter,
 				stubCounter,
-				*blockSyncConcurrency)
+				*blockSyncConcurrency,
+			)
 			if err != nil {
 				return errors.Wrap(err, "create syncer")
 			}
@@ -1084,7 +1097,8 @@ func registerBucketRetention(app extkingpin.AppClause, objStoreConfig *extflag.P
 				ignoreDeletionMarkFilter,
 				stubCounter,
 				stubCounter,
-				*blockSyncConcurrency)
+				*blockSyncConcurrency,
+			)
 			if err != nil {
 				return errors.Wrap(err, "create syncer")
 			}
@@ -23,6 +23,7 @@ import (
 	"github.com/prometheus/alertmanager/api/v2/models"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/pkg/relabel"
 	"go.uber.org/atomic"
@@ -266,19 +267,23 @@ type Sender struct {
 	logger        log.Logger
 	alertmanagers []*Alertmanager
 	versions      []APIVersion
+	maxBatchSize  int
 
 	sent    *prometheus.CounterVec
 	errs    *prometheus.CounterVec
 	dropped prometheus.Counter
+	invalid prometheus.Counter
 	latency *prometheus.HistogramVec
 }
 
 // NewSender returns a new sender. On each call to Send the entire alert batch is sent
-// to each Alertmanager returned by the getter function.
+// to each Alertmanager returned by the getter function. If maxBatchSize is positive, alerts
+// are sent in consecutive requests of at most maxBatchSize alerts each.
 func NewSender(
 	logger log.Logger,
 	reg prometheus.Registerer,
 	alertmanagers []*Alertmanager,
+	maxBatchSize int,
 ) *Sender {
 	if logger == nil {
 		logger = log.NewNopLogger()
@@ -297,6 +302,7 @@ func NewSender(
 		logger:        logger,
 		alertmanagers: alertmanagers,
 		versions:      versions,
+		maxBatchSize:  maxBatchSize,
 
 		sent: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
 			Name: "thanos_alert_sender_alerts_sent_total",
@@ -313,6 +319,11 @@ func NewSender(
 			Help: "Total number of alerts dropped in case of all sends to alertmanagers failed.",
 		}),
 
+		invalid: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "thanos_alert_sender_alerts_invalid_total",
+			Help: "Total number of alerts rejected before sending because they were invalid.",
+		}),
+
 		latency: promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
 			Name: "thanos_alert_sender_latency_seconds",
 			Help: "Latency for sending alert notifications (not including dropped notifications).",
@@ -330,9 +341,50 @@ func toAPILabels(labels labels.Labels) models.LabelSet {
 	return apiLabels
 }
 
-// Send an alert batch to all given Alertmanager clients.
+// validateAlert returns an error if the alert misses fields required by Alertmanager.
+func validateAlert(a *Alert) error {
+	if a.Name() == "" {
+		return errors.Errorf("missing %q label", labels.AlertName)
+	}
+	for _, l := range a.Labels {
+		if !model.LabelName(l.Name).IsValid() {
+			return errors.Errorf("invalid label name %q", l.Name)
+		}
+	}
+	if !a.StartsAt.IsZero() && !a.EndsAt.IsZero() && a.EndsAt.Before(a.StartsAt) {
+		return errors.Errorf("end time %v before start time %v", a.EndsAt, a.StartsAt)
+	}
+	return nil
+}
+
+// Send an alert batch to all given Alertmanager clients, split into requests of at most
+// the configured max batch size. Invalid alerts are not sent, but counted and logged.
 // TODO(bwplotka): https://github.com/thanos-io/thanos/issues/660.
 func (s *Sender) Send(ctx context.Context, alerts []*Alert) {
+	valid := make([]*Alert, 0, len(alerts))
+	for _, a := range alerts {
+		if err := validateAlert(a); err != nil {
+			level.Warn(s.logger).Log("msg", "rejecting invalid alert", "alert", a.Labels.String(), "err", err)
+			s.invalid.Inc()
+			continue
+		}
+		valid = append(valid, a)
+	}
+	alerts = valid
+
+	if s.maxBatchSize <= 0 {
+		s.sendBatch(ctx, alerts)
+		return
+	}
+	for len(alerts) > s.maxBatchSize {
+		s.sendBatch(ctx, alerts[:s.maxBatchSize])
+		alerts = alerts[s.maxBatchSize:]
+	}
+	s.sendBatch(ctx, alerts)
+}
+
+// sendBatch sends the alerts to all Alertmanager clients in a single request per endpoint.
+func (s *Sender) sendBatch(ctx context.Context, alerts []*Alert) {
 	if len(alerts) == 0 {
 		return
 	}
@@ -5,9 +5,11 @@ package alert
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -18,6 +20,7 @@ import (
 	"github.com/prometheus/prometheus/pkg/relabel"
 
 	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	http_util "github.com/thanos-io/thanos/pkg/http"
 	"github.com/thanos-io/thanos/pkg/testutil"
 )
 
@@ -132,9 +135,9 @@ func TestSenderSendsOk(t *testing.T) {
 	poster := &fakeClient{
 		urls: []*url.URL{{Host: "am1:9090"}, {Host: "am2:9090"}},
 	}
-	s := NewSender(nil, nil, []*Alertmanager{NewAlertmanager(nil, poster, time.Minute, APIv1)})
+	s := NewSender(nil, nil, []*Alertmanager{NewAlertmanager(nil, poster, time.Minute, APIv1)}, 0)
 
-	s.Send(context.Background(), []*Alert{{}, {}})
+	s.Send(context.Background(), []*Alert{{Labels: labels.FromStrings("alertname", "a")}, {Labels: labels.FromStrings("alertname", "b")}})
 
 	assertSameHosts(t, poster.urls, poster.seen)
 
@@ -146,6 +149,42 @@ func TestSenderSendsOk(t *testing.T) {
 	testutil.Equals(t, 0, int(promtestutil.ToFloat64(s.dropped)))
 }
 
+func TestSenderSendsInBatches(t *testing.T) {
+	var (
+		mtx     sync.Mutex
+		batches [][]string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alerts []*Alert
+		testutil.Ok(t, json.NewDecoder(r.Body).Decode(&alerts))
+
+		var names []string
+		for _, a := range alerts {
+			names = append(names, a.Labels.Get("alertname"))
+		}
+		mtx.Lock()
+		batches = append(batches, names)
+		mtx.Unlock()
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	var alerts []*Alert
+	for i := 0; i < 7; i++ {
+		alerts = append(alerts, &Alert{Labels: labels.FromStrings("alertname", strconv.Itoa(i))})
+	}
+
+	am := NewAlertmanager(nil, clientDispatcher{Client: srv.Client(), urls: []*url.URL{u}}, time.Minute, APIv1)
+	s := NewSender(nil, nil, []*Alertmanager{am}, 3)
+	s.Send(context.Background(), alerts)
+
+	testutil.Equals(t, [][]string{{"0", "1", "2"}, {"3", "4", "5"}, {"6"}}, batches)
+	testutil.Equals(t, 7, int(promtestutil.ToFloat64(s.sent.WithLabelValues(u.Host))))
+	testutil.Equals(t, 0, int(promtestutil.ToFloat64(s.errs.WithLabelValues(u.Host))))
+}
+
 func TestSenderSendsOneFails(t *testing.T) {
 	poster := &fakeClient{
 		urls: []*url.URL{{Host: "am1:9090"}, {Host: "am2:9090"}},
@@ -159,9 +198,9 @@ func TestSenderSendsOneFails(t *testing.T) {
 			return rec.Result(), nil
 		},
 	}
-	s := NewSender(nil, nil, []*Alertmanager{NewAlertmanager(nil, poster, time.Minute, APIv1)})
+	s := NewSender(nil, nil, []*Alertmanager{NewAlertmanager(nil, poster, time.Minute, APIv1)}, 0)
 
-	s.Send(context.Background(), []*Alert{{}, {}})
+	s.Send(context.Background(), []*Alert{{Labels: labels.FromStrings("alertname", "a")}, {Labels: labels.FromStrings("alertname", "b")}})
 
 	assertSameHosts(t, poster.urls, poster.seen)
 
@@ -180,9 +219,9 @@ func TestSenderSendsAllFail(t *testing.T) {
 			return nil, errors.New("no such host")
 		},
 	}
-	s := NewSender(nil, nil, []*Alertmanager{NewAlertmanager(nil, poster, time.Minute, APIv1)})
+	s := NewSender(nil, nil, []*Alertmanager{NewAlertmanager(nil, poster, time.Minute, APIv1)}, 0)
 
-	s.Send(context.Background(), []*Alert{{}, {}})
+	s.Send(context.Background(), []*Alert{{Labels: labels.FromStrings("alertname", "a")}, {Labels: labels.FromStrings("alertname", "b")}})
 
 	assertSameHosts(t, poster.urls, poster.seen)
 
@@ -193,3 +232,93 @@ func TestSenderSendsAllFail(t *testing.T) {
 	testutil.Equals(t, 1, int(promtestutil.ToFloat64(s.errs.WithLabelValues(poster.urls[1].Host))))
 	testutil.Equals(t, 2, int(promtestutil.ToFloat64(s.dropped)))
 }
+
+func TestSenderRejectsInvalidAlerts(t *testing.T) {
+	var (
+		mtx  sync.Mutex
+		sent [][]*Alert
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alerts []*Alert
+		testutil.Ok(t, json.NewDecoder(r.Body).Decode(&alerts))
+		mtx.Lock()
+		sent = append(sent, alerts)
+		mtx.Unlock()
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	am := NewAlertmanager(nil, clientDispatcher{Client: srv.Client(), urls: []*url.URL{u}}, time.Minute, APIv1)
+	s := NewSender(nil, nil, []*Alertmanager{am}, 0)
+
+	s.Send(context.Background(), []*Alert{
+		{Labels: labels.FromStrings("severity", "page")},
+		{Labels: labels.FromStrings("alertname", "valid")},
+		{Labels: labels.FromStrings("alertname", "reversed"), StartsAt: time.Unix(20, 0), EndsAt: time.Unix(10, 0)},
+	})
+
+	testutil.Equals(t, 2, int(promtestutil.ToFloat64(s.invalid)))
+	testutil.Equals(t, 1, int(promtestutil.ToFloat64(s.sent.WithLabelValues(u.Host))))
+	testutil.Equals(t, 1, len(sent))
+	testutil.Equals(t, 1, len(sent[0]))
+	testutil.Equals(t, "valid", sent[0][0].Name())
+
+	// Nothing is sent if all alerts are invalid.
+	s.Send(context.Background(), []*Alert{{}})
+	testutil.Equals(t, 3, int(promtestutil.ToFloat64(s.invalid)))
+	testutil.Equals(t, 1, len(sent))
+	testutil.Equals(t, 0, int(promtestutil.ToFloat64(s.dropped)))
+}
+
+type clientDispatcher struct {
+	*http.Client
+	urls []*url.URL
+}
+
+func (d clientDispatcher) Endpoints() []*url.URL {
+	return d.urls
+}
+
+func TestAlertmanager_HTTP2(t *testing.T) {
+	var (
+		mtx    sync.Mutex
+		protos []int
+	)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		protos = append(protos, r.ProtoMajor)
+		mtx.Unlock()
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	for _, tc := range []struct {
+		config        string
+		expectedProto int
+	}{
+		{config: `{tls_config: {insecure_skip_verify: true}}`, expectedProto: 1},
+		{config: `{tls_config: {insecure_skip_verify: true}}
+  enable_http2: true`, expectedProto: 2},
+	} {
+		cfg, err := LoadAlertingConfig([]byte("alertmanagers:\n- http_config: " + tc.config))
+		testutil.Ok(t, err)
+		amCfg := cfg.Alertmanagers[0]
+
+		c, err := http_util.NewHTTPClient(amCfg.HTTPClientConfig, "alertmanager", amCfg.ClientOptions()...)
+		testutil.Ok(t, err)
+		am := NewAlertmanager(nil, clientDispatcher{Client: c, urls: []*url.URL{u}}, time.Minute, amCfg.APIVersion)
+		s := NewSender(nil, nil, []*Alertmanager{am}, 0)
+		s.Send(context.Background(), []*Alert{{Labels: labels.FromStrings("alertname", "a")}})
+
+		testutil.Equals(t, 0, int(promtestutil.ToFloat64(s.errs.WithLabelValues(u.Host))))
+		mtx.Lock()
+		testutil.Equals(t, tc.expectedProto, protos[len(protos)-1])
+		mtx.Unlock()
+	}
+}
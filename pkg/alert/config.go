@@ -29,6 +29,22 @@ type AlertmanagerConfig struct {
 	EndpointsConfig  http_util.EndpointsConfig `yaml:",inline"`
 	Timeout          model.Duration            `yaml:"timeout"`
 	APIVersion       APIVersion                `yaml:"api_version"`
+	// EnableHTTP2 allows multiplexing requests to Alertmanagers reached over TLS on a single connection.
+	EnableHTTP2 bool `yaml:"enable_http2"`
+	// DisableKeepAlives makes every request to Alertmanagers use a new connection.
+	DisableKeepAlives bool `yaml:"disable_keep_alives"`
+}
+
+// ClientOptions returns the options for the HTTP client used to reach the Alertmanagers.
+func (c AlertmanagerConfig) ClientOptions() []http_util.ClientOption {
+	var opts []http_util.ClientOption
+	if c.EnableHTTP2 {
+		opts = append(opts, http_util.WithHTTP2Enabled())
+	}
+	if c.DisableKeepAlives {
+		opts = append(opts, http_util.WithKeepAlivesDisabled())
+	}
+	return opts
 }
 
 // APIVersion represents the API version of the Alertmanager endpoint.
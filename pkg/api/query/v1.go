@@ -30,6 +30,7 @@ import (
 
 	cortexutil "github.com/cortexproject/cortex/pkg/util"
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
@@ -41,9 +42,12 @@ import (
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/prometheus/prometheus/util/stats"
 	"github.com/thanos-io/thanos/pkg/api"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
 	"github.com/thanos-io/thanos/pkg/exemplars"
 	"github.com/thanos-io/thanos/pkg/exemplars/exemplarspb"
 	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
@@ -65,7 +69,9 @@ const (
 	DedupParam               = "dedup"
 	PartialResponseParam     = "partial_response"
 	MaxSourceResolutionParam = "max_source_resolution"
+	RawParam                 = "raw"
 	ReplicaLabelsParam       = "replicaLabels[]"
+	ReplicaLabelParam        = "replica_label"
 	MatcherParam             = "match[]"
 	StoreMatcherParam        = "storeMatch[]"
 	Step                     = "step"
@@ -91,8 +97,13 @@ type QueryAPI struct {
 	enableTargetPartialResponse         bool
 	enableMetricMetadataPartialResponse bool
 	enableExemplarPartialResponse       bool
+	enableResolutionDowngradeWarning    bool
 	disableCORS                         bool
 
+	// Number of retries of queries failed because stores were unavailable and the backoff before the first one.
+	maxQueryRetries   int
+	queryRetryBackoff time.Duration
+
 	replicaLabels []string
 	storeSet      *query.StoreSet
 
@@ -118,6 +129,9 @@ func NewQueryAPI(
 	enableRulePartialResponse bool,
 	enableTargetPartialResponse bool,
 	enableMetricMetadataPartialResponse bool,
+	enableResolutionDowngradeWarning bool,
+	maxQueryRetries int,
+	queryRetryBackoff time.Duration,
 	replicaLabels []string,
 	flagsMap map[string]string,
 	defaultRangeQueryStep time.Duration,
@@ -143,6 +157,9 @@ func NewQueryAPI(
 		enableRulePartialResponse:              enableRulePartialResponse,
 		enableTargetPartialResponse:            enableTargetPartialResponse,
 		enableMetricMetadataPartialResponse:    enableMetricMetadataPartialResponse,
+		enableResolutionDowngradeWarning:       enableResolutionDowngradeWarning,
+		maxQueryRetries:                        maxQueryRetries,
+		queryRetryBackoff:                      queryRetryBackoff,
 		replicaLabels:                          replicaLabels,
 		storeSet:                               storeSet,
 		defaultRangeQueryStep:                  defaultRangeQueryStep,
@@ -178,8 +195,13 @@ func (qapi *QueryAPI) Register(r *route.Router, tracer opentracing.Tracer, logge
 	r.Get("/labels", instr("label_names", qapi.labelNames))
 	r.Post("/labels", instr("label_names", qapi.labelNames))
 
+	r.Get("/metric_interval", instr("metric_interval", qapi.metricInterval))
+	r.Post("/metric_interval", instr("metric_interval", qapi.metricInterval))
+
 	r.Get("/stores", instr("stores", qapi.stores))
 
+	r.Get("/status/timerange", instr("timerange", NewTimeRangeHandler(qapi.storeSet.GetStoreStatus)))
+
 	r.Get("/rules", instr("rules", NewRulesHandler(qapi.ruleGroups, qapi.enableRulePartialResponse)))
 
 	r.Get("/targets", instr("targets", NewTargetsHandler(qapi.targets, qapi.enableTargetPartialResponse)))
@@ -218,8 +240,12 @@ func (qapi *QueryAPI) parseReplicaLabelsParam(r *http.Request) (replicaLabels []
 
 	replicaLabels = qapi.replicaLabels
 	// Overwrite the cli flag when provided as a query parameter.
-	if len(r.Form[ReplicaLabelsParam]) > 0 {
-		replicaLabels = r.Form[ReplicaLabelsParam]
+	// Copy the form values, appending to them directly could modify the request form.
+	overrides := make([]string, 0, len(r.Form[ReplicaLabelsParam])+len(r.Form[ReplicaLabelParam]))
+	overrides = append(overrides, r.Form[ReplicaLabelsParam]...)
+	overrides = append(overrides, r.Form[ReplicaLabelParam]...)
+	if len(overrides) > 0 {
+		replicaLabels = overrides
 	}
 
 	return replicaLabels, nil
@@ -244,6 +270,17 @@ func (qapi *QueryAPI) parseStoreDebugMatchersParam(r *http.Request) (storeMatche
 func (qapi *QueryAPI) parseDownsamplingParamMillis(r *http.Request, defaultVal time.Duration) (maxResolutionMillis int64, _ *api.ApiError) {
 	maxSourceResolution := 0 * time.Second
 
+	// Raw data is requested explicitly, regardless of autodownsampling and max_source_resolution.
+	if val := r.FormValue(RawParam); val != "" {
+		raw, err := strconv.ParseBool(val)
+		if err != nil {
+			return 0, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrapf(err, "'%s' parameter", RawParam)}
+		}
+		if raw {
+			return 0, nil
+		}
+	}
+
 	val := r.FormValue(MaxSourceResolutionParam)
 	if qapi.enableAutodownsampling || (val == "auto") {
 		maxSourceResolution = defaultVal
@@ -339,20 +376,18 @@ func (qapi *QueryAPI) query(r *http.Request) (interface{}, []error, *api.ApiErro
 	span, ctx := tracing.StartSpan(ctx, "promql_instant_query")
 	defer span.Finish()
 
-	qry, err := qe.NewInstantQuery(qapi.queryableCreate(enableDedup, replicaLabels, storeDebugMatchers, maxSourceResolution, enablePartialResponse, false), r.FormValue("query"), ts)
+	newQuery := func() (promql.Query, error) {
+		return qe.NewInstantQuery(qapi.queryableCreate(enableDedup, replicaLabels, storeDebugMatchers, maxSourceResolution, enablePartialResponse, false), r.FormValue("query"), ts)
+	}
+	qry, err := newQuery()
 	if err != nil {
 		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}
 	}
 
-	tracing.DoInSpan(ctx, "query_gate_ismyturn", func(ctx context.Context) {
-		err = qapi.gate.Start(ctx)
-	})
+	qry, res, err := qapi.execQuery(ctx, qry, newQuery)
 	if err != nil {
 		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: err}
 	}
-	defer qapi.gate.Done()
-
-	res := qry.Exec(ctx)
 	if res.Err != nil {
 		switch res.Err.(type) {
 		case promql.ErrQueryCanceled:
@@ -455,26 +490,24 @@ func (qapi *QueryAPI) queryRange(r *http.Request) (interface{}, []error, *api.Ap
 	span, ctx := tracing.StartSpan(ctx, "promql_range_query")
 	defer span.Finish()
 
-	qry, err := qe.NewRangeQuery(
-		qapi.queryableCreate(enableDedup, replicaLabels, storeDebugMatchers, maxSourceResolution, enablePartialResponse, false),
-		r.FormValue("query"),
-		start,
-		end,
-		step,
-	)
+	newQuery := func() (promql.Query, error) {
+		return qe.NewRangeQuery(
+			qapi.queryableCreate(enableDedup, replicaLabels, storeDebugMatchers, maxSourceResolution, enablePartialResponse, false),
+			r.FormValue("query"),
+			start,
+			end,
+			step,
+		)
+	}
+	qry, err := newQuery()
 	if err != nil {
 		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}
 	}
 
-	tracing.DoInSpan(ctx, "query_gate_ismyturn", func(ctx context.Context) {
-		err = qapi.gate.Start(ctx)
-	})
+	qry, res, err := qapi.execQuery(ctx, qry, newQuery)
 	if err != nil {
 		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: err}
 	}
-	defer qapi.gate.Done()
-
-	res := qry.Exec(ctx)
 	if res.Err != nil {
 		switch res.Err.(type) {
 		case promql.ErrQueryCanceled:
@@ -485,6 +518,13 @@ func (qapi *QueryAPI) queryRange(r *http.Request) (interface{}, []error, *api.Ap
 		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: res.Err}
 	}
 
+	warnings := res.Warnings
+	if qapi.enableResolutionDowngradeWarning {
+		if err := resolutionDowngradeWarning(maxSourceResolution, step); err != nil {
+			warnings = append(warnings, err)
+		}
+	}
+
 	// Optional stats field in response if parameter "stats" is not empty.
 	var qs *stats.QueryStats
 	if r.FormValue(Stats) != "" {
@@ -494,7 +534,91 @@ func (qapi *QueryAPI) queryRange(r *http.Request) (interface{}, []error, *api.Ap
 		ResultType: res.Value.Type(),
 		Result:     res.Value,
 		Stats:      qs,
-	}, res.Warnings, nil
+	}, warnings, nil
+}
+
+// execQuery executes qry. If it fails because stores were unavailable, e.g. while they restart, the query is
+// created again with newQuery and retried up to the configured number of times, doubling the backoff between retries.
+// Only queries with partial response disabled can fail this way: otherwise the proxy turns store failures into
+// warnings and the query is not retried.
+// Each attempt holds the query gate only while executing, so that other queries can run during the backoff.
+// It returns the last executed query and its result, or an error if the gate could not be entered for the first attempt.
+func (qapi *QueryAPI) execQuery(ctx context.Context, qry promql.Query, newQuery func() (promql.Query, error)) (promql.Query, *promql.Result, error) {
+	res, err := qapi.execGated(ctx, qry)
+	if err != nil {
+		return nil, nil, err
+	}
+	backoff := qapi.queryRetryBackoff
+	for retry := 1; retry <= qapi.maxQueryRetries && isUnavailableErr(res.Err); retry++ {
+		level.Debug(qapi.logger).Log("msg", "stores unavailable, retrying query", "retry", retry, "backoff", backoff, "err", res.Err)
+		select {
+		case <-ctx.Done():
+			return qry, res, nil
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+
+		next, err := newQuery()
+		if err != nil {
+			return qry, res, nil
+		}
+		nextRes, err := qapi.execGated(ctx, next)
+		if err != nil {
+			return qry, res, nil
+		}
+		qry, res = next, nextRes
+	}
+	return qry, res, nil
+}
+
+// execGated executes qry once it is its turn at the query gate.
+func (qapi *QueryAPI) execGated(ctx context.Context, qry promql.Query) (*promql.Result, error) {
+	var err error
+	tracing.DoInSpan(ctx, "query_gate_ismyturn", func(ctx context.Context) {
+		err = qapi.gate.Start(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer qapi.gate.Done()
+
+	return qry.Exec(ctx), nil
+}
+
+// isUnavailableErr returns whether err was caused by a store returning the gRPC Unavailable code.
+func isUnavailableErr(err error) bool {
+	for err != nil {
+		if status.Code(err) == codes.Unavailable {
+			return true
+		}
+		switch e := err.(type) {
+		case promql.ErrStorage:
+			err = e.Err
+		case interface{ Cause() error }:
+			err = e.Cause()
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// resolutionDowngradeWarning returns a warning if the given max source resolution allows stores to
+// return downsampled data coarser than the step, in which case the result has less detail than the step implies.
+func resolutionDowngradeWarning(maxSourceResolutionMillis int64, step time.Duration) error {
+	var res int64
+	switch {
+	case maxSourceResolutionMillis >= downsample.ResLevel2:
+		res = downsample.ResLevel2
+	case maxSourceResolutionMillis >= downsample.ResLevel1:
+		res = downsample.ResLevel1
+	default:
+		return nil
+	}
+	if res <= int64(step/time.Millisecond) {
+		return nil
+	}
+	return errors.Errorf("%s %v allows data downsampled to %v resolution, which is coarser than the step %v; results may lack detail", MaxSourceResolutionParam, time.Duration(maxSourceResolutionMillis)*time.Millisecond, time.Duration(res)*time.Millisecond, step)
 }
 
 func (qapi *QueryAPI) labelValues(r *http.Request) (interface{}, []error, *api.ApiError) {
@@ -641,6 +765,143 @@ func (qapi *QueryAPI) series(r *http.Request) (interface{}, []error, *api.ApiErr
 	return metrics, set.Warnings(), nil
 }
 
+// defaultMetricIntervalWindow is the time range before the evaluation time which is sampled to estimate scrape intervals.
+const defaultMetricIntervalWindow = 10 * time.Minute
+
+// MetricInterval is the estimated scrape interval of a single series.
+type MetricInterval struct {
+	Labels labels.Labels `json:"labels"`
+	// Interval is the median distance between consecutive samples, in seconds.
+	Interval float64 `json:"interval"`
+	// Samples is the number of samples the estimate is based on.
+	Samples int `json:"samples"`
+}
+
+// metricInterval estimates the scrape interval of each series matching the given selectors from the raw samples of
+// a short window before the evaluation time. Series with less than two samples in the window are omitted.
+func (qapi *QueryAPI) metricInterval(r *http.Request) (interface{}, []error, *api.ApiError) {
+	if err := r.ParseForm(); err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: errors.Wrap(err, "parse form")}
+	}
+
+	if len(r.Form[MatcherParam]) == 0 {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.New("no match[] parameter provided")}
+	}
+
+	end, err := parseTimeParam(r, "time", qapi.baseAPI.Now())
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}
+	}
+
+	window := defaultMetricIntervalWindow
+	if val := r.FormValue("window"); val != "" {
+		window, err = parseDuration(val)
+		if err != nil {
+			return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrap(err, "invalid window parameter")}
+		}
+		if window <= 0 {
+			return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.New("window must be positive")}
+		}
+	}
+
+	var matcherSets [][]*labels.Matcher
+	for _, s := range r.Form[MatcherParam] {
+		matchers, err := parser.ParseMetricSelector(s)
+		if err != nil {
+			return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+
+	enableDedup, apiErr := qapi.parseEnableDedupParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	replicaLabels, apiErr := qapi.parseReplicaLabelsParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	storeDebugMatchers, apiErr := qapi.parseStoreDebugMatchersParam(r)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	enablePartialResponse, apiErr := qapi.parsePartialResponseParam(r, qapi.enableQueryPartialResponse)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+
+	// Raw samples are selected like for queries, so the request has to wait for its turn like queries do.
+	tracing.DoInSpan(r.Context(), "query_gate_ismyturn", func(ctx context.Context) {
+		err = qapi.gate.Start(ctx)
+	})
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: err}
+	}
+	defer qapi.gate.Done()
+
+	// Downsampled data would report the downsampling resolution instead of the scrape interval, so only raw data is used.
+	q, err := qapi.queryableCreate(enableDedup, replicaLabels, storeDebugMatchers, 0, enablePartialResponse, false).
+		Querier(r.Context(), timestamp.FromTime(end.Add(-window)), timestamp.FromTime(end))
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: err}
+	}
+	defer runutil.CloseWithLogOnErr(qapi.logger, q, "queryable metric interval")
+
+	var sets []storage.SeriesSet
+	for _, mset := range matcherSets {
+		sets = append(sets, q.Select(true, nil, mset...))
+	}
+
+	var (
+		intervals = []MetricInterval{}
+		ts        []int64
+	)
+	set := storage.NewMergeSeriesSet(sets, storage.ChainedSeriesMerge)
+	for set.Next() {
+		series := set.At()
+
+		ts = ts[:0]
+		it := series.Iterator()
+		for it.Next() {
+			t, _ := it.At()
+			ts = append(ts, t)
+		}
+		if it.Err() != nil {
+			return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: it.Err()}
+		}
+		if len(ts) < 2 {
+			continue
+		}
+		intervals = append(intervals, MetricInterval{
+			Labels:   series.Labels(),
+			Interval: medianDelta(ts) / 1000,
+			Samples:  len(ts),
+		})
+	}
+	if set.Err() != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorExec, Err: set.Err()}
+	}
+	return intervals, set.Warnings(), nil
+}
+
+// medianDelta returns the median distance between consecutive timestamps. At least two timestamps are required.
+func medianDelta(ts []int64) float64 {
+	deltas := make([]int64, 0, len(ts)-1)
+	for i := 1; i < len(ts); i++ {
+		deltas = append(deltas, ts[i]-ts[i-1])
+	}
+	sort.Slice(deltas, func(i, j int) bool { return deltas[i] < deltas[j] })
+
+	mid := len(deltas) / 2
+	if len(deltas)%2 == 0 {
+		return float64(deltas[mid-1]+deltas[mid]) / 2
+	}
+	return float64(deltas[mid])
+}
+
 func (qapi *QueryAPI) labelNames(r *http.Request) (interface{}, []error, *api.ApiError) {
 	start, end, err := parseMetadataTimeRange(r, qapi.defaultMetadataTimeRange)
 	if err != nil {
@@ -700,14 +961,58 @@ func (qapi *QueryAPI) labelNames(r *http.Request) (interface{}, []error, *api.Ap
 	return names, warnings, nil
 }
 
-func (qapi *QueryAPI) stores(_ *http.Request) (interface{}, []error, *api.ApiError) {
+// stores returns the statuses of the stores by their type. If start or end are given, only stores whose advertised
+// time range intersects the given one are returned, i.e. the stores a query over that range fans out to.
+func (qapi *QueryAPI) stores(r *http.Request) (interface{}, []error, *api.ApiError) {
+	storeStatuses := qapi.storeSet.GetStoreStatus()
+	if r.FormValue("start") != "" || r.FormValue("end") != "" {
+		start, end, err := parseMetadataTimeRange(r, 0)
+		if err != nil {
+			return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}
+		}
+		storeStatuses = query.StoreStatusesInTimeRange(storeStatuses, timestamp.FromTime(start), timestamp.FromTime(end))
+	}
+
 	statuses := make(map[string][]query.StoreStatus)
-	for _, status := range qapi.storeSet.GetStoreStatus() {
+	for _, status := range storeStatuses {
 		statuses[status.StoreType.String()] = append(statuses[status.StoreType.String()], status)
 	}
 	return statuses, nil, nil
 }
 
+// TimeRange is the range of time covered by the data of the connected stores, in milliseconds.
+type TimeRange struct {
+	MinTime int64 `json:"minTime"`
+	MaxTime int64 `json:"maxTime"`
+}
+
+// NewTimeRangeHandler creates handler returning the union of the time ranges advertised by all healthy stores.
+// It returns no data if no store is healthy.
+func NewTimeRangeHandler(storeStatuses func() []query.StoreStatus) func(*http.Request) (interface{}, []error, *api.ApiError) {
+	return func(_ *http.Request) (interface{}, []error, *api.ApiError) {
+		var tr *TimeRange
+		for _, status := range storeStatuses() {
+			if status.LastError != nil {
+				continue
+			}
+			if tr == nil {
+				tr = &TimeRange{MinTime: status.MinTime, MaxTime: status.MaxTime}
+				continue
+			}
+			if status.MinTime < tr.MinTime {
+				tr.MinTime = status.MinTime
+			}
+			if status.MaxTime > tr.MaxTime {
+				tr.MaxTime = status.MaxTime
+			}
+		}
+		if tr == nil {
+			return nil, nil, nil
+		}
+		return tr, nil, nil
+	}
+}
+
 // NewTargetsHandler created handler compatible with HTTP /api/v1/targets https://prometheus.io/docs/prometheus/latest/querying/api/#targets
 // which uses gRPC Unary Targets API.
 func NewTargetsHandler(client targets.UnaryClient, enablePartialResponse bool) func(*http.Request) (interface{}, []error, *api.ApiError) {
@@ -743,11 +1048,6 @@ func NewTargetsHandler(client targets.UnaryClient, enablePartialResponse bool) f
 // NewRulesHandler created handler compatible with HTTP /api/v1/rules https://prometheus.io/docs/prometheus/latest/querying/api/#rules
 // which uses gRPC Unary Rules API.
 func NewRulesHandler(client rules.UnaryClient, enablePartialResponse bool) func(*http.Request) (interface{}, []error, *api.ApiError) {
-	ps := storepb.PartialResponseStrategy_ABORT
-	if enablePartialResponse {
-		ps = storepb.PartialResponseStrategy_WARN
-	}
-
 	return func(r *http.Request) (interface{}, []error, *api.ApiError) {
 		span, ctx := tracing.StartSpan(r.Context(), "receive_http_request")
 		defer span.Finish()
@@ -767,7 +1067,20 @@ func NewRulesHandler(client rules.UnaryClient, enablePartialResponse bool) func(
 			typ = int32(rulespb.RulesRequest_ALL)
 		}
 
-		// TODO(bwplotka): Allow exactly the same functionality as query API: passing replica, dedup and partial response as HTTP params as well.
+		// Overwrite the cli flag when provided as a query parameter.
+		partialResponse := enablePartialResponse
+		if val := r.FormValue(PartialResponseParam); val != "" {
+			partialResponse, err = strconv.ParseBool(val)
+			if err != nil {
+				return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrapf(err, "'%s' parameter", PartialResponseParam)}
+			}
+		}
+		ps := storepb.PartialResponseStrategy_ABORT
+		if partialResponse {
+			ps = storepb.PartialResponseStrategy_WARN
+		}
+
+		// TODO(bwplotka): Allow exactly the same functionality as query API: passing replica and dedup as HTTP params as well.
 		req := &rulespb.RulesRequest{
 			Type:                    rulespb.RulesRequest_Type(typ),
 			PartialResponseStrategy: ps,
@@ -800,6 +1113,11 @@ func NewExemplarsHandler(client exemplars.UnaryClient, enablePartialResponse boo
 			err      error
 		)
 
+		query := r.FormValue("query")
+		if query == "" {
+			return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.New("query parameter is required")}
+		}
+
 		start, err := cortexutil.ParseTime(r.FormValue("start"))
 		if err != nil {
 			return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}
@@ -812,7 +1130,7 @@ func NewExemplarsHandler(client exemplars.UnaryClient, enablePartialResponse boo
 		req := &exemplarspb.ExemplarsRequest{
 			Start:                   start,
 			End:                     end,
-			Query:                   r.FormValue("query"),
+			Query:                   query,
 			PartialResponseStrategy: ps,
 		}
 
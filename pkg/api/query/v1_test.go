@@ -27,6 +27,7 @@ import (
 	"net/http"
 	"net/url"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -45,11 +46,15 @@ import (
 	"github.com/prometheus/prometheus/tsdb"
 	"github.com/prometheus/prometheus/tsdb/tsdbutil"
 	"github.com/prometheus/prometheus/util/stats"
+	"go.uber.org/atomic"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/thanos-io/thanos/pkg/compact"
 
 	baseAPI "github.com/thanos-io/thanos/pkg/api"
 	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/exemplars/exemplarspb"
 	"github.com/thanos-io/thanos/pkg/gate"
 	"github.com/thanos-io/thanos/pkg/query"
 	"github.com/thanos-io/thanos/pkg/rules/rulespb"
@@ -406,6 +411,96 @@ func TestQueryEndpoints(t *testing.T) {
 				},
 			},
 		},
+		// Query endpoint with deduplication label overridden through replica_label.
+		{
+			endpoint: api.query,
+			query: url.Values{
+				"query":         []string{"test_metric_replica1"},
+				"time":          []string{"1970-01-01T01:02:03+01:00"},
+				"replica_label": []string{"replica1"},
+			},
+			response: &queryData{
+				ResultType: parser.ValueTypeVector,
+				Result: promql.Vector{
+					{
+						Metric: labels.Labels{
+							{
+								Name:  "__name__",
+								Value: "test_metric_replica1",
+							},
+							{
+								Name:  "foo",
+								Value: "bar",
+							},
+							{
+								Name:  "replica",
+								Value: "a",
+							},
+						},
+						Point: promql.Point{
+							T: 123000,
+							V: 2,
+						},
+					},
+					{
+						Metric: labels.Labels{
+							{
+								Name:  "__name__",
+								Value: "test_metric_replica1",
+							},
+							{
+								Name:  "foo",
+								Value: "boo",
+							},
+							{
+								Name:  "replica",
+								Value: "a",
+							},
+						},
+						Point: promql.Point{
+							T: 123000,
+							V: 2,
+						},
+					},
+					{
+						Metric: labels.Labels{
+							{
+								Name:  "__name__",
+								Value: "test_metric_replica1",
+							},
+							{
+								Name:  "foo",
+								Value: "boo",
+							},
+							{
+								Name:  "replica",
+								Value: "b",
+							},
+						},
+						Point: promql.Point{
+							T: 123000,
+							V: 2,
+						},
+					},
+					{
+						Metric: labels.Labels{
+							{
+								Name:  "__name__",
+								Value: "test_metric_replica1",
+							},
+							{
+								Name:  "foo",
+								Value: "boo",
+							},
+						},
+						Point: promql.Point{
+							T: 123000,
+							V: 2,
+						},
+					},
+				},
+			},
+		},
 		// Query endpoint with multiple deduplication label.
 		{
 			endpoint: api.query,
@@ -756,6 +851,10 @@ func TestMetadataEndpoints(t *testing.T) {
 		}),
 	}
 
+	var (
+		recentStart = time.Unix(0, start*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+		recentEnd   = now.UTC().Format(time.RFC3339)
+	)
 	var tests = []endpointTestCase{
 		{
 			endpoint: api.labelValues,
@@ -807,6 +906,47 @@ func TestMetadataEndpoints(t *testing.T) {
 				"test_metric2",
 			},
 		},
+		// Narrowing the window to the recent samples excludes the labels of the old block.
+		{
+			endpoint: api.labelValues,
+			query: url.Values{
+				"start": []string{recentStart},
+				"end":   []string{recentEnd},
+			},
+			params: map[string]string{
+				"name": "__name__",
+			},
+			response: []string{
+				"test_metric_replica1",
+				"test_metric_replica2",
+			},
+		},
+		{
+			endpoint: api.labelValues,
+			query: url.Values{
+				"start": []string{recentStart},
+				"end":   []string{recentEnd},
+			},
+			params: map[string]string{
+				"name": "replica",
+			},
+			response: []string{
+				"a",
+				"b",
+			},
+		},
+		// A window between the old block and the recent samples matches no labels at all.
+		{
+			endpoint: api.labelValues,
+			query: url.Values{
+				"start": []string{"1970-01-02T00:00:00Z"},
+				"end":   []string{"1970-01-03T00:00:00Z"},
+			},
+			params: map[string]string{
+				"name": "__name__",
+			},
+			response: []string{},
+		},
 		{
 			endpoint: api.labelNames,
 			response: []string{
@@ -847,6 +987,27 @@ func TestMetadataEndpoints(t *testing.T) {
 				"foo",
 			},
 		},
+		{
+			endpoint: api.labelNames,
+			query: url.Values{
+				"start": []string{recentStart},
+				"end":   []string{recentEnd},
+			},
+			response: []string{
+				"__name__",
+				"foo",
+				"replica",
+				"replica1",
+			},
+		},
+		{
+			endpoint: api.labelNames,
+			query: url.Values{
+				"start": []string{"1970-01-02T00:00:00Z"},
+				"end":   []string{"1970-01-03T00:00:00Z"},
+			},
+			response: []string{},
+		},
 		// Failed, to parse matchers.
 		{
 			endpoint: api.labelNames,
@@ -1313,6 +1474,7 @@ func TestParseDuration(t *testing.T) {
 func TestParseDownsamplingParamMillis(t *testing.T) {
 	var tests = []struct {
 		maxSourceResolutionParam string
+		rawParam                 string
 		result                   int64
 		step                     time.Duration
 		fail                     bool
@@ -1368,6 +1530,31 @@ func TestParseDownsamplingParamMillis(t *testing.T) {
 			result:                   int64(time.Minute / (1000 * 1000)),
 			fail:                     false,
 		},
+		// raw param forces raw data even with autodownsampling enabled.
+		{
+			maxSourceResolutionParam: "",
+			rawParam:                 "true",
+			enableAutodownsampling:   true,
+			step:                     time.Hour,
+			result:                   int64(compact.ResolutionLevelRaw),
+			fail:                     false,
+		},
+		{
+			maxSourceResolutionParam: "1h",
+			rawParam:                 "true",
+			enableAutodownsampling:   false,
+			step:                     time.Hour,
+			result:                   int64(compact.ResolutionLevelRaw),
+			fail:                     false,
+		},
+		{
+			maxSourceResolutionParam: "",
+			rawParam:                 "false",
+			enableAutodownsampling:   true,
+			step:                     time.Hour,
+			result:                   int64(time.Hour / (5 * 1000 * 1000)),
+			fail:                     false,
+		},
 	}
 
 	for i, test := range tests {
@@ -1380,6 +1567,9 @@ func TestParseDownsamplingParamMillis(t *testing.T) {
 		}
 		v := url.Values{}
 		v.Set(MaxSourceResolutionParam, test.maxSourceResolutionParam)
+		if test.rawParam != "" {
+			v.Set(RawParam, test.rawParam)
+		}
 		r := http.Request{PostForm: v}
 
 		// If no max_source_resolution is specified fit at least 5 samples between steps.
@@ -1444,6 +1634,25 @@ func TestParseStoreDebugMatchersParam(t *testing.T) {
 	}
 }
 
+func TestParseReplicaLabelsParam(t *testing.T) {
+	api := QueryAPI{replicaLabels: []string{"default"}}
+
+	replicaLabels, err := api.parseReplicaLabelsParam(&http.Request{PostForm: url.Values{}})
+	testutil.Equals(t, (*baseAPI.ApiError)(nil), err)
+	testutil.Equals(t, []string{"default"}, replicaLabels)
+
+	// Spare capacity in the form values must not be written to.
+	labelsParam := make([]string, 1, 4)
+	labelsParam[0] = "replica"
+	r := &http.Request{Form: url.Values{ReplicaLabelsParam: labelsParam, ReplicaLabelParam: []string{"replica1"}}, PostForm: url.Values{}}
+
+	replicaLabels, err = api.parseReplicaLabelsParam(r)
+	testutil.Equals(t, (*baseAPI.ApiError)(nil), err)
+	testutil.Equals(t, []string{"replica", "replica1"}, replicaLabels)
+	testutil.Equals(t, []string{"replica"}, r.Form[ReplicaLabelsParam])
+	testutil.Equals(t, "", labelsParam[:2][1])
+}
+
 func TestRulesHandler(t *testing.T) {
 	twoHAgo := time.Now().Add(-2 * time.Hour)
 	all := []*rulespb.Rule{
@@ -1759,6 +1968,57 @@ func (c mockedRulesClient) Rules(_ context.Context, req *rulespb.RulesRequest) (
 	return &rulespb.RuleGroups{Groups: c.g[req.Type]}, c.w, c.err
 }
 
+type mockedExemplarsClient struct {
+	data  []*exemplarspb.ExemplarData
+	calls int
+}
+
+func (c *mockedExemplarsClient) Exemplars(_ context.Context, _ *exemplarspb.ExemplarsRequest) ([]*exemplarspb.ExemplarData, storage.Warnings, error) {
+	c.calls++
+	return c.data, nil, nil
+}
+
+func TestExemplarsHandler(t *testing.T) {
+	data := []*exemplarspb.ExemplarData{{
+		SeriesLabels: labelpb.ZLabelSet{Labels: []labelpb.ZLabel{{Name: "__name__", Value: "test_metric"}}},
+		Exemplars: []*exemplarspb.Exemplar{{
+			Labels: labelpb.ZLabelSet{Labels: []labelpb.ZLabel{{Name: "traceID", Value: "abc"}}},
+			Value:  1,
+			Ts:     1000,
+		}},
+	}}
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		t.Run(method, func(t *testing.T) {
+			t.Run("missing query", func(t *testing.T) {
+				client := &mockedExemplarsClient{data: data}
+				handler := NewExemplarsHandler(client, false)
+
+				req, err := http.NewRequest(method, "http://example.com/api/v1/query_exemplars?start=0&end=10", nil)
+				testutil.Ok(t, err)
+
+				res, _, apiErr := handler(req)
+				testutil.Equals(t, nil, res)
+				testutil.Assert(t, apiErr != nil, "expected an error")
+				testutil.Equals(t, baseAPI.ErrorBadData, apiErr.Typ)
+				testutil.Equals(t, 0, client.calls)
+			})
+			t.Run("query", func(t *testing.T) {
+				client := &mockedExemplarsClient{data: data}
+				handler := NewExemplarsHandler(client, false)
+
+				req, err := http.NewRequest(method, "http://example.com/api/v1/query_exemplars?query=test_metric&start=0&end=10", nil)
+				testutil.Ok(t, err)
+
+				res, _, apiErr := handler(req)
+				testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+				testutil.Equals(t, data, res)
+				testutil.Equals(t, 1, client.calls)
+			})
+		})
+	}
+}
+
 type sample struct {
 	t int64
 	v float64
@@ -1771,3 +2031,339 @@ func (s sample) T() int64 {
 func (s sample) V() float64 {
 	return s.v
 }
+
+func TestTimeRangeHandler(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		statuses []query.StoreStatus
+		expected interface{}
+	}{
+		{
+			name:     "no stores",
+			expected: nil,
+		},
+		{
+			name: "single store",
+			statuses: []query.StoreStatus{
+				{Name: "a", StoreType: component.Store, MinTime: 100, MaxTime: 200},
+			},
+			expected: &TimeRange{MinTime: 100, MaxTime: 200},
+		},
+		{
+			name: "union of differing ranges",
+			statuses: []query.StoreStatus{
+				{Name: "sidecar", StoreType: component.Sidecar, MinTime: 1000, MaxTime: math.MaxInt64},
+				{Name: "store", StoreType: component.Store, MinTime: 10, MaxTime: 2000},
+				{Name: "rule", StoreType: component.Rule, MinTime: 500, MaxTime: 3000},
+			},
+			expected: &TimeRange{MinTime: 10, MaxTime: math.MaxInt64},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := NewTimeRangeHandler(func() []query.StoreStatus { return tc.statuses })
+			res, warnings, apiErr := handler(&http.Request{})
+			testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+			testutil.Equals(t, 0, len(warnings))
+			testutil.Equals(t, tc.expected, res)
+		})
+	}
+}
+
+func TestQueryRangeResolutionDowngradeWarning(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, db.Close()) }()
+
+	timeout := 100 * time.Second
+	qe := promql.NewEngine(promql.EngineOpts{
+		MaxSamples: 10000,
+		Timeout:    timeout,
+	})
+	newAPI := func(enableWarning bool) *QueryAPI {
+		return &QueryAPI{
+			baseAPI:         &baseAPI.BaseAPI{Now: time.Now},
+			queryableCreate: query.NewQueryableCreator(nil, nil, store.NewTSDBStore(nil, db, component.Query, nil), 2, timeout),
+			queryEngine: func(int64) *promql.Engine {
+				return qe
+			},
+			gate:                             gate.New(nil, 4),
+			defaultRangeQueryStep:            time.Second,
+			enableResolutionDowngradeWarning: enableWarning,
+			queryRangeHist: promauto.With(prometheus.NewRegistry()).NewHistogram(prometheus.HistogramOpts{
+				Name: "query_range_hist",
+			}),
+		}
+	}
+
+	for _, tc := range []struct {
+		name                string
+		enableWarning       bool
+		step                string
+		maxSourceResolution string
+		expectedWarning     string
+	}{
+		{
+			name:                "fine step over 1h data",
+			enableWarning:       true,
+			step:                "60",
+			maxSourceResolution: "1h",
+			expectedWarning:     "max_source_resolution 1h0m0s allows data downsampled to 1h0m0s resolution, which is coarser than the step 1m0s; results may lack detail",
+		},
+		{
+			name:                "fine step over 5m data",
+			enableWarning:       true,
+			step:                "60",
+			maxSourceResolution: "10m",
+			expectedWarning:     "max_source_resolution 10m0s allows data downsampled to 5m0s resolution, which is coarser than the step 1m0s; results may lack detail",
+		},
+		{
+			name:                "step matching resolution",
+			enableWarning:       true,
+			step:                "3600",
+			maxSourceResolution: "1h",
+		},
+		{
+			name:                "raw data only",
+			enableWarning:       true,
+			step:                "60",
+			maxSourceResolution: "2m",
+		},
+		{
+			name:                "warning disabled",
+			step:                "60",
+			maxSourceResolution: "1h",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "http://example.com?"+url.Values{
+				"query":                 []string{"vector(1)"},
+				"start":                 []string{"0"},
+				"end":                   []string{"7200"},
+				"step":                  []string{tc.step},
+				"max_source_resolution": []string{tc.maxSourceResolution},
+			}.Encode(), nil)
+			testutil.Ok(t, err)
+
+			_, warnings, apiErr := newAPI(tc.enableWarning).queryRange(req)
+			testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+			if tc.expectedWarning == "" {
+				testutil.Equals(t, 0, len(warnings), "got %v", warnings)
+				return
+			}
+			testutil.Equals(t, 1, len(warnings), "got %v", warnings)
+			testutil.Equals(t, tc.expectedWarning, warnings[0].Error())
+		})
+	}
+}
+
+// unavailableStore fails the given number of Series calls with the Unavailable code before delegating to the wrapped store.
+type unavailableStore struct {
+	storepb.StoreServer
+
+	failures *atomic.Int64
+}
+
+func (s unavailableStore) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesServer) error {
+	if s.failures.Dec() >= 0 {
+		return status.Error(codes.Unavailable, "store is restarting")
+	}
+	return s.StoreServer.Series(r, srv)
+}
+
+// countingGate counts the queries which entered and left the wrapped gate.
+type countingGate struct {
+	gate.Gate
+
+	starts, dones atomic.Int64
+}
+
+func (g *countingGate) Start(ctx context.Context) error {
+	g.starts.Inc()
+	return g.Gate.Start(ctx)
+}
+
+func (g *countingGate) Done() {
+	g.dones.Inc()
+	g.Gate.Done()
+}
+
+func TestQueryRetriesWhenStoresUnavailable(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, db.Close()) }()
+
+	app := db.Appender(context.Background())
+	_, err = app.Append(0, labels.FromStrings("__name__", "test_metric"), 0, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	timeout := 100 * time.Second
+	qe := promql.NewEngine(promql.EngineOpts{
+		MaxSamples: 10000,
+		Timeout:    timeout,
+	})
+	for _, tc := range []struct {
+		name             string
+		failures         int64
+		maxRetries       int
+		partialResponse  bool
+		expectErr        bool
+		expectWarning    bool
+		expectedAttempts int64
+	}{
+		{name: "no retries", failures: 2, expectErr: true, expectedAttempts: 1},
+		{name: "stores recover before retries run out", failures: 2, maxRetries: 3, expectedAttempts: 3},
+		{name: "stores do not recover before retries run out", failures: 2, maxRetries: 1, expectErr: true, expectedAttempts: 2},
+		// With partial response the proxy turns the failure into a warning, so there is nothing to retry.
+		{name: "partial response", failures: 2, maxRetries: 3, partialResponse: true, expectWarning: true, expectedAttempts: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			failures := atomic.NewInt64(tc.failures)
+			tsdbStore := unavailableStore{StoreServer: store.NewTSDBStore(nil, db, component.Query, nil), failures: failures}
+			proxy := store.NewProxyStore(nil, nil, func() []store.Client {
+				return []store.Client{query.NewInProcessClient(t, "tsdb", storepb.ServerAsClient(tsdbStore, 0), nil)}
+			}, component.Query, nil, 0)
+			// A single slot, so a gate held during the backoff would block the retry.
+			g := &countingGate{Gate: gate.New(nil, 1)}
+			api := &QueryAPI{
+				baseAPI:         &baseAPI.BaseAPI{Now: time.Now},
+				logger:          log.NewNopLogger(),
+				queryableCreate: query.NewQueryableCreator(nil, nil, proxy, 2, timeout),
+				queryEngine: func(int64) *promql.Engine {
+					return qe
+				},
+				gate:              g,
+				maxQueryRetries:   tc.maxRetries,
+				queryRetryBackoff: time.Millisecond,
+			}
+
+			req, err := http.NewRequest("GET", "http://example.com?"+url.Values{
+				"query":              []string{"test_metric"},
+				"time":               []string{"0"},
+				PartialResponseParam: []string{strconv.FormatBool(tc.partialResponse)},
+			}.Encode(), nil)
+			testutil.Ok(t, err)
+
+			res, warnings, apiErr := api.query(req)
+			// Each attempt enters the gate separately and leaves it before the backoff.
+			testutil.Equals(t, tc.expectedAttempts, g.starts.Load())
+			testutil.Equals(t, tc.expectedAttempts, g.dones.Load())
+			if tc.expectErr {
+				testutil.Assert(t, apiErr != nil, "expected error")
+				testutil.Assert(t, isUnavailableErr(apiErr.Err), "unexpected error %v", apiErr.Err)
+				return
+			}
+			testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+			if tc.expectWarning {
+				testutil.Equals(t, 1, len(warnings), "got %v", warnings)
+				testutil.Assert(t, strings.Contains(warnings[0].Error(), "store is restarting"), "unexpected warning %v", warnings[0])
+				testutil.Equals(t, 0, len(res.(*queryData).Result.(promql.Vector)))
+				return
+			}
+			testutil.Equals(t, 1, len(res.(*queryData).Result.(promql.Vector)))
+		})
+	}
+}
+
+func TestMetricIntervalEndpoint(t *testing.T) {
+	db, err := e2eutil.NewTSDB()
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, db.Close()) }()
+
+	end := time.Unix(3600, 0)
+	app := db.Appender(context.Background())
+	// Series a is scraped every 15s, series b every 30s with one missed scrape and series c only once.
+	for ts := end.Add(-20 * time.Minute); !ts.After(end); ts = ts.Add(15 * time.Second) {
+		_, err := app.Append(0, labels.FromStrings("__name__", "up", "job", "a"), timestamp.FromTime(ts), 1)
+		testutil.Ok(t, err)
+	}
+	for ts := end.Add(-20 * time.Minute); !ts.After(end); ts = ts.Add(30 * time.Second) {
+		if ts.Equal(end.Add(-5 * time.Minute)) {
+			continue
+		}
+		_, err := app.Append(0, labels.FromStrings("__name__", "up", "job", "b"), timestamp.FromTime(ts), 1)
+		testutil.Ok(t, err)
+	}
+	_, err = app.Append(0, labels.FromStrings("__name__", "up", "job", "c"), timestamp.FromTime(end), 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, app.Commit())
+
+	api := &QueryAPI{
+		baseAPI:         &baseAPI.BaseAPI{Now: func() time.Time { return end }},
+		queryableCreate: query.NewQueryableCreator(nil, nil, store.NewTSDBStore(nil, db, component.Query, nil), 2, 100*time.Second),
+		gate:            gate.New(nil, 4),
+	}
+
+	for _, tc := range []struct {
+		name     string
+		params   url.Values
+		expected []MetricInterval
+		errType  baseAPI.ErrorType
+	}{
+		{
+			name:   "default window",
+			params: url.Values{"match[]": []string{"up"}},
+			expected: []MetricInterval{
+				{Labels: labels.FromStrings("__name__", "up", "job", "a"), Interval: 15, Samples: 41},
+				{Labels: labels.FromStrings("__name__", "up", "job", "b"), Interval: 30, Samples: 20},
+			},
+		},
+		{
+			name:   "custom window and time",
+			params: url.Values{"match[]": []string{`up{job="a"}`}, "window": []string{"1m"}, "time": []string{"3000"}},
+			expected: []MetricInterval{
+				{Labels: labels.FromStrings("__name__", "up", "job", "a"), Interval: 15, Samples: 5},
+			},
+		},
+		{
+			name:     "no matching series",
+			params:   url.Values{"match[]": []string{"down"}},
+			expected: []MetricInterval{},
+		},
+		{
+			name:    "missing matcher",
+			params:  url.Values{},
+			errType: baseAPI.ErrorBadData,
+		},
+		{
+			name:    "invalid window",
+			params:  url.Values{"match[]": []string{"up"}, "window": []string{"-1m"}},
+			errType: baseAPI.ErrorBadData,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "http://example.com?"+tc.params.Encode(), nil)
+			testutil.Ok(t, err)
+
+			res, _, apiErr := api.metricInterval(req)
+			if tc.errType != "" {
+				testutil.Assert(t, apiErr != nil, "expected error")
+				testutil.Equals(t, tc.errType, apiErr.Typ)
+				return
+			}
+			testutil.Assert(t, apiErr == nil, "unexpected error %v", apiErr)
+			testutil.Equals(t, tc.expected, res)
+		})
+	}
+
+	t.Run("waits for the query gate", func(t *testing.T) {
+		api.gate = gate.New(nil, 1)
+		testutil.Ok(t, api.gate.Start(context.Background()))
+		defer api.gate.Done()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, "GET", "http://example.com?"+url.Values{"match[]": []string{"up"}}.Encode(), nil)
+		testutil.Ok(t, err)
+
+		_, _, apiErr := api.metricInterval(req)
+		testutil.Assert(t, apiErr != nil, "expected error")
+		testutil.Equals(t, baseAPI.ErrorExec, apiErr.Typ)
+	})
+}
+
+func TestMedianDelta(t *testing.T) {
+	testutil.Equals(t, 10.0, medianDelta([]int64{0, 10}))
+	testutil.Equals(t, 10.0, medianDelta([]int64{0, 10, 20, 50}))
+	testutil.Equals(t, 15.0, medianDelta([]int64{0, 10, 30, 50, 60}))
+}
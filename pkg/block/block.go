@@ -10,6 +10,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -47,6 +48,19 @@ const (
 // have a hash calculated in the meta file and it matches with what is in the destination path then
 // we do not download it. We always re-download the meta file.
 func Download(ctx context.Context, logger log.Logger, bucket objstore.Bucket, id ulid.ULID, dst string) error {
+	return DownloadWithProgress(ctx, logger, bucket, id, dst, nil)
+}
+
+// DownloadProgressFunc is called with the total number of bytes downloaded so far.
+type DownloadProgressFunc func(downloadedBytes int64)
+
+// DownloadWithProgress works like Download, additionally calling progress, if not nil, each time
+// a chunk of the block's files has been read from the bucket.
+func DownloadWithProgress(ctx context.Context, logger log.Logger, bucket objstore.Bucket, id ulid.ULID, dst string, progress DownloadProgressFunc) error {
+	if progress != nil {
+		bucket = &progressBucket{Bucket: bucket, progress: progress}
+	}
+
 	if err := os.MkdirAll(dst, 0750); err != nil {
 		return errors.Wrap(err, "create dir")
 	}
@@ -58,6 +72,9 @@ func Download(ctx context.Context, logger log.Logger, bucket objstore.Bucket, id
 	if err != nil {
 		return errors.Wrapf(err, "reading meta from %s", dst)
 	}
+	if err := decompressMetaInDir(logger, m, dst); err != nil {
+		return err
+	}
 
 	ignoredPaths := []string{MetaFilename}
 	for _, fl := range m.Thanos.Files {
@@ -93,23 +110,81 @@ func Download(ctx context.Context, logger log.Logger, bucket objstore.Bucket, id
 	return nil
 }
 
+// progressBucket reports the number of bytes read through readers returned by Get.
+type progressBucket struct {
+	objstore.Bucket
+
+	downloaded int64
+	progress   DownloadProgressFunc
+}
+
+func (b *progressBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	rc, err := b.Bucket.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &progressReader{ReadCloser: rc, bkt: b}, nil
+}
+
+type progressReader struct {
+	io.ReadCloser
+
+	bkt *progressBucket
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.bkt.downloaded += int64(n)
+		r.bkt.progress(r.bkt.downloaded)
+	}
+	return n, err
+}
+
+// UploadOption configures an upload of a block.
+type UploadOption func(*uploadOptions)
+
+type uploadOptions struct {
+	compressMeta bool
+}
+
+// WithCompressedMeta stores the meta.json of the uploaded block gzip-compressed to reduce storage and transfer for
+// large metas. Compressed metas are transparently decompressed when read by this package and metadata.Read.
+func WithCompressedMeta() UploadOption {
+	return func(o *uploadOptions) {
+		o.compressMeta = true
+	}
+}
+
 // Upload uploads a TSDB block to the object storage. It verifies basic
 // features of Thanos block.
-func Upload(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir string, hf metadata.HashFunc) error {
-	return upload(ctx, logger, bkt, bdir, hf, true)
+func Upload(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir string, hf metadata.HashFunc, opts ...UploadOption) error {
+	return upload(ctx, logger, bkt, bdir, hf, true, false, opts...)
+}
+
+// ResumeUpload uploads a TSDB block to the object storage like Upload, but skips block files which are already
+// present in the bucket with the same size. This way a failed upload of the same block directory is resumed
+// instead of started from scratch. Partially uploaded blocks are not cleaned up on failure, so that they can be resumed.
+func ResumeUpload(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir string, hf metadata.HashFunc, opts ...UploadOption) error {
+	return upload(ctx, logger, bkt, bdir, hf, true, true, opts...)
 }
 
 // UploadPromBlock uploads a TSDB block to the object storage. It assumes
 // the block is used in Prometheus so it doesn't check Thanos external labels.
 func UploadPromBlock(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir string, hf metadata.HashFunc) error {
-	return upload(ctx, logger, bkt, bdir, hf, false)
+	return upload(ctx, logger, bkt, bdir, hf, false, false)
 }
 
 // upload uploads block from given block dir that ends with block id.
 // It makes sure cleanup is done on error to avoid partial block uploads.
 // TODO(bplotka): Ensure bucket operations have reasonable backoff retries.
 // NOTE: Upload updates `meta.Thanos.File` section.
-func upload(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir string, hf metadata.HashFunc, checkExternalLabels bool) error {
+func upload(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir string, hf metadata.HashFunc, checkExternalLabels, resume bool, opts ...UploadOption) error {
+	var o uploadOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	df, err := os.Stat(bdir)
 	if err != nil {
 		return err
@@ -146,21 +221,47 @@ func upload(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir st
 		return errors.Wrap(err, "encode meta file")
 	}
 
+	cleanUpOnErr := func(err error) error {
+		if resume {
+			return err
+		}
+		return cleanUp(logger, bkt, id, err)
+	}
+
 	// TODO(yeya24): Remove this step.
 	if err := bkt.Upload(ctx, path.Join(DebugMetas, fmt.Sprintf("%s.json", id)), strings.NewReader(metaEncoded.String())); err != nil {
-		return cleanUp(logger, bkt, id, errors.Wrap(err, "upload debug meta file"))
+		return cleanUpOnErr(errors.Wrap(err, "upload debug meta file"))
 	}
 
-	if err := objstore.UploadDir(ctx, logger, bkt, path.Join(bdir, ChunksDirname), path.Join(id.String(), ChunksDirname)); err != nil {
-		return cleanUp(logger, bkt, id, errors.Wrap(err, "upload chunks"))
+	if resume {
+		err = resumeUploadDir(ctx, logger, bkt, path.Join(bdir, ChunksDirname), path.Join(id.String(), ChunksDirname))
+	} else {
+		err = objstore.UploadDir(ctx, logger, bkt, path.Join(bdir, ChunksDirname), path.Join(id.String(), ChunksDirname))
+	}
+	if err != nil {
+		return cleanUpOnErr(errors.Wrap(err, "upload chunks"))
 	}
 
-	if err := objstore.UploadFile(ctx, logger, bkt, path.Join(bdir, IndexFilename), path.Join(id.String(), IndexFilename)); err != nil {
-		return cleanUp(logger, bkt, id, errors.Wrap(err, "upload index"))
+	if resume {
+		err = resumeUploadFile(ctx, logger, bkt, path.Join(bdir, IndexFilename), path.Join(id.String(), IndexFilename))
+	} else {
+		err = objstore.UploadFile(ctx, logger, bkt, path.Join(bdir, IndexFilename), path.Join(id.String(), IndexFilename))
+	}
+	if err != nil {
+		return cleanUpOnErr(errors.Wrap(err, "upload index"))
+	}
+
+	var metaReader io.Reader = strings.NewReader(metaEncoded.String())
+	if o.compressMeta {
+		var compressed bytes.Buffer
+		if err := meta.WriteCompressed(&compressed); err != nil {
+			return cleanUpOnErr(errors.Wrap(err, "compress meta file"))
+		}
+		metaReader = &compressed
 	}
 
 	// Meta.json always need to be uploaded as a last item. This will allow to assume block directories without meta file to be pending uploads.
-	if err := bkt.Upload(ctx, path.Join(id.String(), MetaFilename), strings.NewReader(metaEncoded.String())); err != nil {
+	if err := bkt.Upload(ctx, path.Join(id.String(), MetaFilename), metaReader); err != nil {
 		// Don't call cleanUp here. Despite getting error, meta.json may have been uploaded in certain cases,
 		// and even though cleanUp will not see it yet, meta.json may appear in the bucket later.
 		// (Eg. S3 is known to behave this way when it returns 503 "SlowDown" error).
@@ -171,6 +272,44 @@ func upload(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir st
 	return nil
 }
 
+// resumeUploadDir uploads all files in srcdir to dstdir, skipping files already present in the bucket with the same size.
+func resumeUploadDir(ctx context.Context, logger log.Logger, bkt objstore.Bucket, srcdir, dstdir string) error {
+	df, err := os.Stat(srcdir)
+	if err != nil {
+		return errors.Wrap(err, "stat dir")
+	}
+	if !df.IsDir() {
+		return errors.Errorf("%s is not a directory", srcdir)
+	}
+	return filepath.Walk(srcdir, func(src string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		return resumeUploadFile(ctx, logger, bkt, src, filepath.Join(dstdir, strings.TrimPrefix(src, srcdir)))
+	})
+}
+
+// resumeUploadFile uploads src as dst, unless dst is already present in the bucket with the same size.
+func resumeUploadFile(ctx context.Context, logger log.Logger, bkt objstore.Bucket, src, dst string) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return errors.Wrapf(err, "stat file %s", src)
+	}
+
+	attrs, err := bkt.Attributes(ctx, dst)
+	if err == nil && attrs.Size == fi.Size() {
+		level.Debug(logger).Log("msg", "file already uploaded, skipping", "from", src, "dst", dst, "bucket", bkt.Name())
+		return nil
+	}
+	if err != nil && !bkt.IsObjNotFoundErr(err) {
+		return errors.Wrapf(err, "get attributes of %s", dst)
+	}
+	return objstore.UploadFile(ctx, logger, bkt, src, dst)
+}
+
 func cleanUp(logger log.Logger, bkt objstore.Bucket, id ulid.ULID, err error) error {
 	// Cleanup the dir with an uncancelable context.
 	cleanErr := Delete(context.Background(), logger, bkt, id)
@@ -278,6 +417,18 @@ func deleteDirRec(ctx context.Context, logger log.Logger, bkt objstore.Bucket, d
 	})
 }
 
+// decompressMetaInDir rewrites a gzip-compressed meta.json in dir uncompressed, as TSDB only reads plain meta files.
+func decompressMetaInDir(logger log.Logger, m *metadata.Meta, dir string) error {
+	b, err := ioutil.ReadFile(filepath.Join(dir, MetaFilename))
+	if err != nil {
+		return errors.Wrapf(err, "read meta from %s", dir)
+	}
+	if !metadata.IsCompressed(b) {
+		return nil
+	}
+	return errors.Wrapf(m.WriteToDir(logger, dir), "write decompressed meta to %s", dir)
+}
+
 // DownloadMeta downloads only meta file from bucket by block ID.
 // TODO(bwplotka): Differentiate between network error & partial upload.
 func DownloadMeta(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID) (metadata.Meta, error) {
@@ -294,6 +445,9 @@ func DownloadMeta(ctx context.Context, logger log.Logger, bkt objstore.Bucket, i
 		return metadata.Meta{}, errors.Wrapf(err, "read meta.json for block %s", id.String())
 	}
 
+	if obj, err = metadata.Decompress(obj); err != nil {
+		return metadata.Meta{}, errors.Wrapf(err, "decompress meta.json for block %s", id.String())
+	}
 	if err = json.Unmarshal(obj, &m); err != nil {
 		return metadata.Meta{}, errors.Wrapf(err, "unmarshal meta.json for block %s", id.String())
 	}
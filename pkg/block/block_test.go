@@ -489,6 +489,42 @@ func TestHashDownload(t *testing.T) {
 	}
 }
 
+func TestDownloadWithProgress(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-block-download-progress")
+	testutil.Ok(t, err)
+	t.Cleanup(func() {
+		testutil.Ok(t, os.RemoveAll(tmpDir))
+	})
+
+	bkt := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+		{{Name: "a", Value: "2"}},
+	}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "val1"}}, 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc))
+
+	var total int64
+	for _, obj := range bkt.Objects() {
+		total += int64(len(obj))
+	}
+
+	var progress []int64
+	testutil.Ok(t, DownloadWithProgress(ctx, log.NewNopLogger(), bkt, b1, path.Join(tmpDir, "download", b1.String()), func(downloaded int64) {
+		progress = append(progress, downloaded)
+	}))
+
+	testutil.Assert(t, len(progress) >= 3, "expected progress reported at least once per file, got %v", progress)
+	for i := 1; i < len(progress); i++ {
+		testutil.Assert(t, progress[i] > progress[i-1], "expected increasing progress, got %v", progress)
+	}
+	testutil.Equals(t, total, progress[len(progress)-1])
+}
+
 func TestUploadCleanup(t *testing.T) {
 	defer testutil.TolerantVerifyLeak(t)
 
@@ -534,6 +570,64 @@ func TestUploadCleanup(t *testing.T) {
 	}
 }
 
+func TestResumeUpload(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-block-resume-upload")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bkt := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+		{{Name: "a", Value: "2"}},
+		{{Name: "b", Value: "1"}},
+	}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "val1"}}, 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+
+	var (
+		debugMetaFile = path.Join(DebugMetas, fmt.Sprintf("%s.json", b1.String()))
+		chunkFile     = path.Join(b1.String(), ChunksDirname, "000001")
+		indexFile     = path.Join(b1.String(), IndexFilename)
+		metaFile      = path.Join(b1.String(), MetaFilename)
+	)
+
+	// Upload fails on the index, which never makes it to the bucket. The partial block is kept.
+	uploadErr := ResumeUpload(ctx, log.NewNopLogger(), errBucket{Bucket: bkt, failSuffix: "/index"}, path.Join(tmpDir, b1.String()), metadata.NoneFunc)
+	testutil.Assert(t, errors.Is(uploadErr, errUploadFailed))
+	testutil.Ok(t, bkt.Delete(ctx, indexFile))
+	testutil.Equals(t, 2, len(bkt.Objects()))
+
+	// Retry uploads only the missing files, plus the meta files which are always uploaded.
+	recBkt := &recordingBucket{Bucket: bkt}
+	testutil.Ok(t, ResumeUpload(ctx, log.NewNopLogger(), recBkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc))
+	testutil.Equals(t, []string{debugMetaFile, indexFile, metaFile}, recBkt.uploaded)
+	testutil.Equals(t, 4, len(bkt.Objects()))
+
+	// Files with a different size than the local ones are uploaded again.
+	testutil.Ok(t, bkt.Upload(ctx, chunkFile, strings.NewReader("truncated")))
+	recBkt = &recordingBucket{Bucket: bkt}
+	testutil.Ok(t, ResumeUpload(ctx, log.NewNopLogger(), recBkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc))
+	testutil.Equals(t, []string{debugMetaFile, chunkFile, metaFile}, recBkt.uploaded)
+
+	chunk, err := ioutil.ReadFile(path.Join(tmpDir, b1.String(), ChunksDirname, "000001"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, chunk, bkt.Objects()[chunkFile])
+}
+
+type recordingBucket struct {
+	objstore.Bucket
+
+	uploaded []string
+}
+
+func (rb *recordingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	rb.uploaded = append(rb.uploaded, name)
+	return rb.Bucket.Upload(ctx, name, r)
+}
+
 var errUploadFailed = errors.New("upload failed")
 
 type errBucket struct {
@@ -553,3 +647,53 @@ func (eb errBucket) Upload(ctx context.Context, name string, r io.Reader) error
 	}
 	return nil
 }
+
+func TestUpload_WithCompressedMeta(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-block-upload-compressed-meta")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bkt := objstore.NewInMemBucket()
+	b1, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+		{{Name: "a", Value: "2"}},
+	}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "val1"}}, 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b1.String()), metadata.NoneFunc, WithCompressedMeta()))
+
+	raw := bkt.Objects()[path.Join(b1.String(), MetaFilename)]
+	testutil.Assert(t, metadata.IsCompressed(raw), "expected meta.json to be stored compressed")
+
+	expected, err := metadata.ReadFromDir(path.Join(tmpDir, b1.String()))
+	testutil.Ok(t, err)
+
+	m, err := DownloadMeta(ctx, log.NewNopLogger(), bkt, b1)
+	testutil.Ok(t, err)
+	testutil.Equals(t, expected.BlockMeta, m.BlockMeta)
+	testutil.Equals(t, expected.Thanos.Labels, m.Thanos.Labels)
+
+	// Downloaded blocks get a plain meta.json, as TSDB does not read compressed ones.
+	dst := path.Join(tmpDir, "downloaded", b1.String())
+	testutil.Ok(t, Download(ctx, log.NewNopLogger(), bkt, b1, dst))
+	b, err := ioutil.ReadFile(path.Join(dst, MetaFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, !metadata.IsCompressed(b), "expected downloaded meta.json to be uncompressed")
+	downloaded, err := metadata.ReadFromDir(dst)
+	testutil.Ok(t, err)
+	testutil.Equals(t, m.BlockMeta, downloaded.BlockMeta)
+
+	// Blocks with legacy uncompressed metas keep working.
+	b2, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+	}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "val1"}}, 124, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, Upload(ctx, log.NewNopLogger(), bkt, path.Join(tmpDir, b2.String()), metadata.NoneFunc))
+	testutil.Assert(t, !metadata.IsCompressed(bkt.Objects()[path.Join(b2.String(), MetaFilename)]), "expected meta.json to be stored uncompressed")
+	m, err = DownloadMeta(ctx, log.NewNopLogger(), bkt, b2)
+	testutil.Ok(t, err)
+	testutil.Equals(t, b2, m.ULID)
+}
@@ -0,0 +1,135 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/index"
+
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// SeriesSamplesDiff describes a series present in both compared blocks, but with a different number of samples.
+type SeriesSamplesDiff struct {
+	Labels   labels.Labels
+	SamplesA int
+	SamplesB int
+}
+
+// SeriesDiff is the result of comparing series of two blocks.
+type SeriesDiff struct {
+	// OnlyInA contains series present in the first block only.
+	OnlyInA []labels.Labels
+	// OnlyInB contains series present in the second block only.
+	OnlyInB []labels.Labels
+	// SamplesMismatch contains series present in both blocks, but with a different number of samples.
+	SamplesMismatch []SeriesSamplesDiff
+}
+
+// Empty returns true if both blocks contain exactly the same series with the same number of samples.
+func (d SeriesDiff) Empty() bool {
+	return len(d.OnlyInA) == 0 && len(d.OnlyInB) == 0 && len(d.SamplesMismatch) == 0
+}
+
+// DiffSeries compares series of the two blocks in the given block directories using only their index and chunks.
+// It is meant as a debugging aid e.g. for comparing input and output blocks of deduplication or vertical compaction.
+// Sample values are not compared.
+func DiffSeries(dirA, dirB string) (SeriesDiff, error) {
+	a, err := gatherSeriesSamples(dirA)
+	if err != nil {
+		return SeriesDiff{}, errors.Wrapf(err, "gather series of block %s", dirA)
+	}
+	b, err := gatherSeriesSamples(dirB)
+	if err != nil {
+		return SeriesDiff{}, errors.Wrapf(err, "gather series of block %s", dirB)
+	}
+
+	// Series in index are sorted by labels, so both lists can be merged in a single pass.
+	var diff SeriesDiff
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		var cmp int
+		switch {
+		case i == len(a):
+			cmp = 1
+		case j == len(b):
+			cmp = -1
+		default:
+			cmp = labels.Compare(a[i].lset, b[j].lset)
+		}
+
+		switch {
+		case cmp < 0:
+			diff.OnlyInA = append(diff.OnlyInA, a[i].lset)
+			i++
+		case cmp > 0:
+			diff.OnlyInB = append(diff.OnlyInB, b[j].lset)
+			j++
+		default:
+			if a[i].samples != b[j].samples {
+				diff.SamplesMismatch = append(diff.SamplesMismatch, SeriesSamplesDiff{
+					Labels:   a[i].lset,
+					SamplesA: a[i].samples,
+					SamplesB: b[j].samples,
+				})
+			}
+			i++
+			j++
+		}
+	}
+	return diff, nil
+}
+
+type seriesSamples struct {
+	lset    labels.Labels
+	samples int
+}
+
+// gatherSeriesSamples returns all series of the block in the given directory with their number of samples, sorted by labels.
+func gatherSeriesSamples(dir string) (_ []seriesSamples, err error) {
+	ir, err := index.NewFileReader(filepath.Join(dir, IndexFilename))
+	if err != nil {
+		return nil, errors.Wrap(err, "open index file")
+	}
+	defer runutil.CloseWithErrCapture(&err, ir, "diff series index reader")
+
+	cr, err := chunks.NewDirReader(filepath.Join(dir, ChunksDirname), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "open chunks dir")
+	}
+	defer runutil.CloseWithErrCapture(&err, cr, "diff series chunk reader")
+
+	p, err := ir.Postings(index.AllPostingsKey())
+	if err != nil {
+		return nil, errors.Wrap(err, "get all postings")
+	}
+
+	var (
+		res  []seriesSamples
+		lset labels.Labels
+		chks []chunks.Meta
+	)
+	for p.Next() {
+		if err := ir.Series(p.At(), &lset, &chks); err != nil {
+			return nil, errors.Wrap(err, "read series")
+		}
+		s := seriesSamples{lset: append(labels.Labels(nil), lset...)}
+		for _, c := range chks {
+			chk, err := cr.Chunk(c.Ref)
+			if err != nil {
+				return nil, errors.Wrapf(err, "read chunk %d of series %s", c.Ref, lset)
+			}
+			s.samples += chk.NumSamples()
+		}
+		res = append(res, s)
+	}
+	if p.Err() != nil {
+		return nil, errors.Wrap(p.Err(), "walk postings")
+	}
+	return res, nil
+}
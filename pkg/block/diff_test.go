@@ -0,0 +1,71 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestDiffSeries(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-diff-series")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	a, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.FromStrings("a", "1"),
+		labels.FromStrings("a", "2"),
+		labels.FromStrings("a", "3"),
+	}, 100, 0, 1000, nil, 0, metadata.NoneFunc)
+	testutil.Ok(t, err)
+
+	b, err := e2eutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		labels.FromStrings("a", "2"),
+		labels.FromStrings("a", "3"),
+		labels.FromStrings("a", "4"),
+		labels.FromStrings("a", "5"),
+	}, 50, 0, 1000, nil, 0, metadata.NoneFunc)
+	testutil.Ok(t, err)
+
+	dirA, dirB := filepath.Join(tmpDir, a.String()), filepath.Join(tmpDir, b.String())
+
+	t.Run("same block", func(t *testing.T) {
+		diff, err := DiffSeries(dirA, dirA)
+		testutil.Ok(t, err)
+		testutil.Assert(t, diff.Empty(), "expected no difference, got %v", diff)
+	})
+	t.Run("different blocks", func(t *testing.T) {
+		diff, err := DiffSeries(dirA, dirB)
+		testutil.Ok(t, err)
+		testutil.Assert(t, !diff.Empty(), "expected differences")
+		testutil.Equals(t, []labels.Labels{labels.FromStrings("a", "1")}, diff.OnlyInA)
+		testutil.Equals(t, []labels.Labels{labels.FromStrings("a", "4"), labels.FromStrings("a", "5")}, diff.OnlyInB)
+		testutil.Equals(t, []SeriesSamplesDiff{
+			{Labels: labels.FromStrings("a", "2"), SamplesA: 100, SamplesB: 50},
+			{Labels: labels.FromStrings("a", "3"), SamplesA: 100, SamplesB: 50},
+		}, diff.SamplesMismatch)
+	})
+	t.Run("reversed", func(t *testing.T) {
+		diff, err := DiffSeries(dirB, dirA)
+		testutil.Ok(t, err)
+		testutil.Equals(t, []labels.Labels{labels.FromStrings("a", "4"), labels.FromStrings("a", "5")}, diff.OnlyInA)
+		testutil.Equals(t, []labels.Labels{labels.FromStrings("a", "1")}, diff.OnlyInB)
+		testutil.Equals(t, 2, len(diff.SamplesMismatch))
+	})
+	t.Run("missing block", func(t *testing.T) {
+		_, err := DiffSeries(dirA, filepath.Join(tmpDir, "missing"))
+		testutil.NotOk(t, err)
+	})
+}
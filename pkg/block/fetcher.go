@@ -73,6 +73,7 @@ const (
 	labelExcludedMeta = "label-excluded"
 	timeExcludedMeta  = "time-excluded"
 	tooFreshMeta      = "too-fresh"
+	gracePeriodMeta   = "in-grace-period"
 	duplicateMeta     = "duplicate"
 	// Blocks that are marked for deletion can be loaded as well. This is done to make sure that we load blocks that are meant to be deleted,
 	// but don't have a replacement block yet.
@@ -117,6 +118,7 @@ func NewFetcherMetrics(reg prometheus.Registerer, syncedExtraLabels, modifiedExt
 			{NoMeta},
 			{LoadedMeta},
 			{tooFreshMeta},
+			{gracePeriodMeta},
 			{FailedMeta},
 			{labelExcludedMeta},
 			{timeExcludedMeta},
@@ -220,9 +222,13 @@ var (
 	ErrorSyncMetaCorrupted = errors.New("meta.json corrupted")
 )
 
+// metaExistsBatchSize is the number of blocks whose meta.json existence is checked in a single batch.
+const metaExistsBatchSize = 100
+
 // loadMeta returns metadata from object storage or error.
 // It returns `ErrorSyncMetaNotFound` and `ErrorSyncMetaCorrupted` sentinel errors in those cases.
-func (f *BaseFetcher) loadMeta(ctx context.Context, id ulid.ULID) (*metadata.Meta, error) {
+// The existence of meta.json is only checked if checkExists is true, otherwise it is known to exist.
+func (f *BaseFetcher) loadMeta(ctx context.Context, id ulid.ULID, checkExists bool) (*metadata.Meta, error) {
 	var (
 		metaFile       = path.Join(id.String(), MetaFilename)
 		cachedBlockDir = filepath.Join(f.cacheDir, id.String())
@@ -231,12 +237,14 @@ func (f *BaseFetcher) loadMeta(ctx context.Context, id ulid.ULID) (*metadata.Met
 	// TODO(bwplotka): If that causes problems (obj store rate limits), add longer ttl to cached items.
 	// For 1y and 100 block sources this generates ~1.5-3k HEAD RPM. AWS handles 330k RPM per prefix.
 	// TODO(bwplotka): Consider filtering by consistency delay here (can't do until compactor healthyOverride work).
-	ok, err := f.bkt.Exists(ctx, metaFile)
-	if err != nil {
-		return nil, errors.Wrapf(err, "meta.json file exists: %v", metaFile)
-	}
-	if !ok {
-		return nil, ErrorSyncMetaNotFound
+	if checkExists {
+		ok, err := f.bkt.Exists(ctx, metaFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "meta.json file exists: %v", metaFile)
+		}
+		if !ok {
+			return nil, ErrorSyncMetaNotFound
+		}
 	}
 
 	if m, seen := f.cached[id]; seen {
@@ -274,6 +282,10 @@ func (f *BaseFetcher) loadMeta(ctx context.Context, id ulid.ULID) (*metadata.Met
 		return nil, errors.Wrapf(err, "read meta file: %v", metaFile)
 	}
 
+	if metaContent, err = metadata.Decompress(metaContent); err != nil {
+		return nil, errors.Wrapf(ErrorSyncMetaCorrupted, "meta.json %v decompress: %v", metaFile, err)
+	}
+
 	m := &metadata.Meta{}
 	if err := json.Unmarshal(metaContent, m); err != nil {
 		return nil, errors.Wrapf(ErrorSyncMetaCorrupted, "meta.json %v unmarshal: %v", metaFile, err)
@@ -306,6 +318,12 @@ type response struct {
 	corruptedMetas float64
 }
 
+// metaRequest is a block whose meta.json should be loaded by a fetcher worker.
+type metaRequest struct {
+	id          ulid.ULID
+	checkExists bool
+}
+
 func (f *BaseFetcher) fetchMetadata(ctx context.Context) (interface{}, error) {
 	f.syncs.Inc()
 
@@ -315,62 +333,90 @@ func (f *BaseFetcher) fetchMetadata(ctx context.Context) (interface{}, error) {
 			partial: make(map[ulid.ULID]error),
 		}
 		eg  errgroup.Group
-		ch  = make(chan ulid.ULID, f.concurrency)
+		ch  = make(chan metaRequest, f.concurrency)
 		mtx sync.Mutex
 	)
+	handleErr := func(id ulid.ULID, err error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		switch errors.Cause(err) {
+		default:
+			resp.metaErrs.Add(err)
+			return
+		case ErrorSyncMetaNotFound:
+			resp.noMetas++
+		case ErrorSyncMetaCorrupted:
+			resp.corruptedMetas++
+		}
+		resp.partial[id] = err
+	}
+
 	level.Debug(f.logger).Log("msg", "fetching meta data", "concurrency", f.concurrency)
 	for i := 0; i < f.concurrency; i++ {
 		eg.Go(func() error {
-			for id := range ch {
-				meta, err := f.loadMeta(ctx, id)
-				if err == nil {
-					mtx.Lock()
-					resp.metas[id] = meta
-					mtx.Unlock()
+			for req := range ch {
+				meta, err := f.loadMeta(ctx, req.id, req.checkExists)
+				if err != nil {
+					handleErr(req.id, err)
 					continue
 				}
-
-				switch errors.Cause(err) {
-				default:
-					mtx.Lock()
-					resp.metaErrs.Add(err)
-					mtx.Unlock()
-					continue
-				case ErrorSyncMetaNotFound:
-					mtx.Lock()
-					resp.noMetas++
-					mtx.Unlock()
-				case ErrorSyncMetaCorrupted:
-					mtx.Lock()
-					resp.corruptedMetas++
-					mtx.Unlock()
-				}
-
 				mtx.Lock()
-				resp.partial[id] = err
+				resp.metas[req.id] = meta
 				mtx.Unlock()
 			}
 			return nil
 		})
 	}
 
-	// Workers scheduled, distribute blocks.
+	// Workers scheduled, distribute blocks. The existence of their meta.json is checked in batches, which backends
+	// and caching buckets supporting it answer more efficiently than single checks.
 	eg.Go(func() error {
 		defer close(ch)
-		return f.bkt.Iter(ctx, "", func(name string) error {
-			id, ok := IsBlockDir(name)
-			if !ok {
+
+		batch := make([]ulid.ULID, 0, metaExistsBatchSize)
+		flush := func() error {
+			if len(batch) == 0 {
 				return nil
 			}
+			defer func() { batch = batch[:0] }()
 
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			case ch <- id:
+			names := make([]string, 0, len(batch))
+			for _, id := range batch {
+				names = append(names, path.Join(id.String(), MetaFilename))
+			}
+			exists, err := objstore.BatchExists(ctx, f.bkt, names)
+			if err != nil {
+				level.Warn(f.logger).Log("msg", "batch check of meta.json existence failed; checking blocks one by one", "err", err)
+			}
+			for i, id := range batch {
+				req := metaRequest{id: id, checkExists: err != nil}
+				if err == nil && !exists[names[i]] {
+					handleErr(id, ErrorSyncMetaNotFound)
+					continue
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case ch <- req:
+				}
 			}
-
 			return nil
-		})
+		}
+
+		if err := f.bkt.Iter(ctx, "", func(name string) error {
+			id, ok := IsBlockDir(name)
+			if !ok {
+				return nil
+			}
+			if batch = append(batch, id); len(batch) < metaExistsBatchSize {
+				return nil
+			}
+			return flush()
+		}); err != nil {
+			return err
+		}
+		return flush()
 	})
 
 	if err := eg.Wait(); err != nil {
@@ -728,6 +774,40 @@ func (r *ReplicaLabelRemover) Modify(_ context.Context, metas map[ulid.ULID]*met
 	return nil
 }
 
+// BlockGracePeriodMetaFilter is a BaseFetcher filter that filters out blocks younger than a grace period, based on
+// their ULID time. Unlike ConsistencyDelayMetaFilter it applies to blocks of all sources, including compacted ones, so
+// that a block produced by a compaction is only served once the compaction had time to settle.
+type BlockGracePeriodMetaFilter struct {
+	logger      log.Logger
+	gracePeriod time.Duration
+}
+
+// NewBlockGracePeriodMetaFilter creates BlockGracePeriodMetaFilter. A non-positive grace period disables the filter.
+func NewBlockGracePeriodMetaFilter(logger log.Logger, gracePeriod time.Duration) *BlockGracePeriodMetaFilter {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &BlockGracePeriodMetaFilter{
+		logger:      logger,
+		gracePeriod: gracePeriod,
+	}
+}
+
+// Filter filters out blocks which are younger than the grace period.
+func (f *BlockGracePeriodMetaFilter) Filter(_ context.Context, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) error {
+	if f.gracePeriod <= 0 {
+		return nil
+	}
+	for id := range metas {
+		if ulid.Now()-id.Time() < uint64(f.gracePeriod/time.Millisecond) {
+			level.Debug(f.logger).Log("msg", "block is in grace period for now", "block", id)
+			synced.WithLabelValues(gracePeriodMeta).Inc()
+			delete(metas, id)
+		}
+	}
+	return nil
+}
+
 // ConsistencyDelayMetaFilter is a BaseFetcher filter that filters out blocks that are created before a specified consistency delay.
 // Not go-routine safe.
 type ConsistencyDelayMetaFilter struct {
@@ -24,6 +24,8 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/prometheus/tsdb"
+	"go.uber.org/atomic"
+
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/extprom"
 	"github.com/thanos-io/thanos/pkg/model"
@@ -1072,6 +1074,54 @@ func TestConsistencyDelayMetaFilter_Filter_0(t *testing.T) {
 	})
 }
 
+func TestBlockGracePeriodMetaFilter_Filter(t *testing.T) {
+	ctx := context.Background()
+	u := &ulidBuilder{}
+	now := time.Now()
+
+	var (
+		fresh     = u.ULID(now)
+		compacted = u.ULID(now.Add(-1 * time.Minute))
+		old       = u.ULID(now.Add(-20 * time.Minute))
+	)
+	newInput := func() map[ulid.ULID]*metadata.Meta {
+		return map[ulid.ULID]*metadata.Meta{
+			fresh:     {Thanos: metadata.Thanos{Source: metadata.SidecarSource}},
+			compacted: {Thanos: metadata.Thanos{Source: metadata.CompactorSource}},
+			old:       {Thanos: metadata.Thanos{Source: metadata.CompactorSource}},
+		}
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		m := newTestFetcherMetrics()
+		input := newInput()
+		testutil.Ok(t, NewBlockGracePeriodMetaFilter(nil, 0).Filter(ctx, input, m.Synced))
+		testutil.Equals(t, newInput(), input)
+		testutil.Equals(t, 0.0, promtest.ToFloat64(m.Synced.WithLabelValues(gracePeriodMeta)))
+	})
+	t.Run("blocks of all sources younger than the grace period are filtered out", func(t *testing.T) {
+		m := newTestFetcherMetrics()
+		input := newInput()
+		testutil.Ok(t, NewBlockGracePeriodMetaFilter(nil, 10*time.Minute).Filter(ctx, input, m.Synced))
+		testutil.Equals(t, map[ulid.ULID]*metadata.Meta{old: newInput()[old]}, input)
+		testutil.Equals(t, 2.0, promtest.ToFloat64(m.Synced.WithLabelValues(gracePeriodMeta)))
+	})
+	t.Run("block is served once it ages past the grace period", func(t *testing.T) {
+		f := NewBlockGracePeriodMetaFilter(nil, 500*time.Millisecond)
+		id := u.ULID(time.Now())
+
+		input := map[ulid.ULID]*metadata.Meta{id: {}}
+		testutil.Ok(t, f.Filter(ctx, input, newTestFetcherMetrics().Synced))
+		testutil.Equals(t, 0, len(input))
+
+		time.Sleep(600 * time.Millisecond)
+
+		input = map[ulid.ULID]*metadata.Meta{id: {}}
+		testutil.Ok(t, f.Filter(ctx, input, newTestFetcherMetrics().Synced))
+		testutil.Equals(t, 1, len(input))
+	})
+}
+
 func TestIgnoreDeletionMarkFilter_Filter(t *testing.T) {
 	objtesting.ForeachStore(t, func(t *testing.T, bkt objstore.Bucket) {
 		ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
@@ -1209,3 +1259,54 @@ func Test_ParseRelabelConfig(t *testing.T) {
 	testutil.NotOk(t, err)
 	testutil.Equals(t, "unsupported relabel action: labelmap", err.Error())
 }
+
+type batchExistsBucket struct {
+	objstore.InstrumentedBucket
+	batches atomic.Int64
+	exists  atomic.Int64
+}
+
+func (b *batchExistsBucket) Exists(ctx context.Context, name string) (bool, error) {
+	b.exists.Inc()
+	return b.InstrumentedBucket.Exists(ctx, name)
+}
+
+func (b *batchExistsBucket) BatchExists(ctx context.Context, names []string) (map[string]bool, error) {
+	b.batches.Inc()
+	return objstore.BatchExists(ctx, b.InstrumentedBucket, names)
+}
+
+func TestBaseFetcher_Fetch_BatchesMetaExistenceChecks(t *testing.T) {
+	ctx := context.Background()
+	bkt := &batchExistsBucket{InstrumentedBucket: objstore.WithNoopInstr(objstore.NewInMemBucket())}
+
+	var expected []ulid.ULID
+	for i := 0; i < metaExistsBatchSize+50; i++ {
+		meta := metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(i + 1)}}
+		var buf bytes.Buffer
+		testutil.Ok(t, json.NewEncoder(&buf).Encode(&meta))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(meta.ULID.String(), metadata.MetaFilename), &buf))
+		expected = append(expected, meta.ULID)
+	}
+	// Partial upload without meta.json.
+	noMeta := ULID(metaExistsBatchSize + 51)
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(noMeta.String(), IndexFilename), bytes.NewBufferString("index")))
+
+	fetcher, err := NewMetaFetcher(log.NewNopLogger(), 10, bkt, "", nil, nil, nil)
+	testutil.Ok(t, err)
+	metas, partial, err := fetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+
+	var got []ulid.ULID
+	for id := range metas {
+		got = append(got, id)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].Compare(got[j]) < 0 })
+	testutil.Equals(t, expected, got)
+	testutil.Equals(t, 1, len(partial))
+	testutil.Equals(t, ErrorSyncMetaNotFound, errors.Cause(partial[noMeta]))
+
+	testutil.Equals(t, int64(2), bkt.batches.Load())
+	// No single existence checks are issued by the fetcher.
+	testutil.Equals(t, int64(0), bkt.exists.Load())
+}
@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"hash/crc32"
 	"math"
-	"math/rand"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -26,11 +25,12 @@ import (
 	"github.com/prometheus/prometheus/tsdb/chunks"
 	"github.com/prometheus/prometheus/tsdb/index"
 	"github.com/thanos-io/thanos/pkg/runutil"
+	"golang.org/x/sync/errgroup"
 )
 
 // VerifyIndex does a full run over a block index and verifies that it fulfills the order invariants.
 func VerifyIndex(logger log.Logger, fn string, minTime, maxTime int64) error {
-	stats, err := GatherIndexHealthStats(logger, fn, minTime, maxTime)
+	stats, err := GatherIndexHealthStats(logger, fn, minTime, maxTime, nil)
 	if err != nil {
 		return err
 	}
@@ -198,11 +198,86 @@ func (n *minMaxSumInt64) Avg() int64 {
 	return n.sum / n.cnt
 }
 
+// GatherLabelCardinality returns the number of distinct values for each label name present in the given index file.
+func GatherLabelCardinality(fn string) (_ map[string]int64, err error) {
+	r, err := index.NewFileReader(fn)
+	if err != nil {
+		return nil, errors.Wrap(err, "open index file")
+	}
+	defer runutil.CloseWithErrCapture(&err, r, "gather label cardinality file reader")
+
+	lnames, err := r.LabelNames()
+	if err != nil {
+		return nil, errors.Wrap(err, "label names")
+	}
+
+	card := make(map[string]int64, len(lnames))
+	for _, n := range lnames {
+		lvals, err := r.LabelValues(n)
+		if err != nil {
+			return nil, errors.Wrapf(err, "label values for %s", n)
+		}
+		card[n] = int64(len(lvals))
+	}
+	return card, nil
+}
+
+// IndexIssueType is a type of issue found in a single series of a block index.
+type IndexIssueType string
+
+const (
+	// IndexIssueOutOfOrderLabels means that labels of the series are not sorted. See HealthStats.OutOfOrderLabels.
+	IndexIssueOutOfOrderLabels IndexIssueType = "out-of-order-labels"
+	// IndexIssueOutOfOrderChunks means that chunks of the series partly overlap or are out of order.
+	IndexIssueOutOfOrderChunks IndexIssueType = "out-of-order-chunks"
+	// IndexIssueDuplicatedChunks means that the series has chunks with the same time range.
+	IndexIssueDuplicatedChunks IndexIssueType = "duplicated-chunks"
+	// IndexIssuePartlyOutsideChunks means that the series has chunks partly outside of the block time range.
+	IndexIssuePartlyOutsideChunks IndexIssueType = "partly-outside-chunks"
+	// IndexIssueCompleteOutsideChunks means that the series has chunks completely outside of the block time range.
+	IndexIssueCompleteOutsideChunks IndexIssueType = "complete-outside-chunks"
+	// IndexIssue347OutsideChunks means that the series has outsider chunks caused by https://github.com/prometheus/tsdb/issues/347.
+	IndexIssue347OutsideChunks IndexIssueType = "issue-347-outside-chunks"
+)
+
+// SeriesIssue describes an issue of a single series found while gathering index health stats.
+type SeriesIssue struct {
+	Ref    uint64
+	Labels labels.Labels
+	Type   IndexIssueType
+	// Count is the number of occurrences of the issue within the series, e.g. the number of affected chunks.
+	Count int
+}
+
+// SeriesIssueFunc is called for each issue of each problematic series.
+type SeriesIssueFunc func(SeriesIssue)
+
+type seriesIssueCount struct {
+	typ   IndexIssueType
+	count int
+}
+
+// reportSeriesIssues calls onIssue for each issue of the series that occurred at least once.
+func reportSeriesIssues(onIssue SeriesIssueFunc, ref uint64, lset labels.Labels, issues []seriesIssueCount) {
+	var lsetCopy labels.Labels
+	for _, i := range issues {
+		if i.count == 0 {
+			continue
+		}
+		if lsetCopy == nil {
+			// Label set is reused across series, so the callback gets its own copy.
+			lsetCopy = append(labels.Labels(nil), lset...)
+		}
+		onIssue(SeriesIssue{Ref: ref, Labels: lsetCopy, Type: i.typ, Count: i.count})
+	}
+}
+
 // GatherIndexHealthStats returns useful counters as well as outsider chunks (chunks outside of block time range) that
 // helps to assess index health.
 // It considers https://github.com/prometheus/tsdb/issues/347 as something that Thanos can handle.
 // See HealthStats.Issue347OutsideChunks for details.
-func GatherIndexHealthStats(logger log.Logger, fn string, minTime, maxTime int64) (stats HealthStats, err error) {
+// If onIssue is not nil, it is called with details of each issue of each problematic series, in index order.
+func GatherIndexHealthStats(logger log.Logger, fn string, minTime, maxTime int64, onIssue SeriesIssueFunc) (stats HealthStats, err error) {
 	r, err := index.NewFileReader(fn)
 	if err != nil {
 		return stats, errors.Wrap(err, "open index file")
@@ -253,10 +328,13 @@ func GatherIndexHealthStats(logger log.Logger, fn string, minTime, maxTime int64
 		if lastLset != nil && labels.Compare(lastLset, lset) >= 0 {
 			return stats, errors.Errorf("series %v out of order; previous %v", lset, lastLset)
 		}
+		var oooLabels, duplicated, partlyOutside, completeOutside, outside347 int
+
 		l0 := lset[0]
 		for _, l := range lset[1:] {
 			if l.Name < l0.Name {
 				stats.OutOfOrderLabels++
+				oooLabels++
 				level.Warn(logger).Log("msg",
 					"out-of-order label set: known bug in Prometheus 2.8.0 and below",
 					"labelset", lset.String(),
@@ -292,8 +370,12 @@ func GatherIndexHealthStats(logger log.Logger, fn string, minTime, maxTime int64
 				stats.OutsideChunks++
 				if c.MinTime > maxTime || c.MaxTime < minTime {
 					stats.CompleteOutsideChunks++
+					completeOutside++
 				} else if c.MinTime == maxTime {
 					stats.Issue347OutsideChunks++
+					outside347++
+				} else {
+					partlyOutside++
 				}
 			}
 
@@ -313,6 +395,7 @@ func GatherIndexHealthStats(logger log.Logger, fn string, minTime, maxTime int64
 				// The chunks can overlap 1:1 in time, but does not have same data.
 				// We assume same data for simplicity, but it can be a symptom of error.
 				stats.DuplicatedChunks++
+				duplicated++
 				continue
 			}
 			// Chunks partly overlaps or out of order.
@@ -323,6 +406,17 @@ func GatherIndexHealthStats(logger log.Logger, fn string, minTime, maxTime int64
 			stats.OutOfOrderChunks += ooo
 		}
 
+		if onIssue != nil {
+			reportSeriesIssues(onIssue, id, lset, []seriesIssueCount{
+				{typ: IndexIssueOutOfOrderLabels, count: oooLabels},
+				{typ: IndexIssueOutOfOrderChunks, count: ooo},
+				{typ: IndexIssueDuplicatedChunks, count: duplicated},
+				{typ: IndexIssuePartlyOutsideChunks, count: partlyOutside},
+				{typ: IndexIssueCompleteOutsideChunks, count: completeOutside},
+				{typ: IndexIssue347OutsideChunks, count: outside347},
+			})
+		}
+
 		seriesChunks.Add(int64(len(chks)))
 		seriesLifeDuration.Add(seriesLifeTimeMs)
 
@@ -366,15 +460,19 @@ type ignoreFnType func(mint, maxt int64, prev *chunks.Meta, curr *chunks.Meta) (
 // - all "complete" outsiders (they will not accessed anyway)
 // - removes all near "complete" outside chunks introduced by https://github.com/prometheus/tsdb/issues/347.
 // Fixable inconsistencies are resolved in the new block.
+// Chunks of up to concurrency series are read at once.
+// The ID of the new block is generated by newULID, NewULID is used if it is nil.
 // TODO(bplotka): https://github.com/thanos-io/thanos/issues/378.
-func Repair(logger log.Logger, dir string, id ulid.ULID, source metadata.SourceType, ignoreChkFns ...ignoreFnType) (resid ulid.ULID, err error) {
+func Repair(logger log.Logger, dir string, id ulid.ULID, source metadata.SourceType, concurrency int, newULID ULIDFunc, ignoreChkFns ...ignoreFnType) (resid ulid.ULID, err error) {
 	if len(ignoreChkFns) == 0 {
 		return resid, errors.New("no ignore chunk function specified")
 	}
+	if newULID == nil {
+		newULID = NewULID
+	}
 
 	bdir := filepath.Join(dir, id.String())
-	entropy := rand.New(rand.NewSource(time.Now().UnixNano()))
-	resid = ulid.MustNew(ulid.Now(), entropy)
+	resid = newULID()
 
 	meta, err := metadata.ReadFromDir(bdir)
 	if err != nil {
@@ -423,7 +521,7 @@ func Repair(logger log.Logger, dir string, id ulid.ULID, source metadata.SourceT
 	resmeta.Stats = tsdb.BlockStats{} // Reset stats.
 	resmeta.Thanos.Source = source    // Update source.
 
-	if err := rewrite(logger, indexr, chunkr, indexw, chunkw, &resmeta, ignoreChkFns); err != nil {
+	if err := rewrite(logger, indexr, chunkr, indexw, chunkw, &resmeta, ignoreChkFns, concurrency); err != nil {
 		return resid, errors.Wrap(err, "rewrite block")
 	}
 	resmeta.Thanos.SegmentFiles = GetSegmentFiles(resdir)
@@ -526,14 +624,59 @@ type seriesRepair struct {
 	chks []chunks.Meta
 }
 
+// readSeriesChunks reads the chunks of the given series and sanitizes them, handling up to concurrency series at once.
+// Each series is handled by a single goroutine, so the order of series and their chunks is preserved.
+func readSeriesChunks(series []seriesRepair, chunkr tsdb.ChunkReader, mint, maxt int64, ignoreChkFns []ignoreFnType, concurrency int) error {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	idxChan := make(chan int)
+	g, gctx := errgroup.WithContext(context.Background())
+	for w := 0; w < concurrency; w++ {
+		g.Go(func() error {
+			for idx := range idxChan {
+				s := &series[idx]
+				for i, c := range s.chks {
+					chk, err := chunkr.Chunk(c.Ref)
+					if err != nil {
+						return errors.Wrap(err, "chunk read")
+					}
+					s.chks[i].Chunk = chk
+				}
+
+				chks, err := sanitizeChunkSequence(s.chks, mint, maxt, ignoreChkFns)
+				if err != nil {
+					return err
+				}
+				s.chks = chks
+			}
+			return nil
+		})
+	}
+
+	func() {
+		defer close(idxChan)
+		for idx := range series {
+			select {
+			case idxChan <- idx:
+			case <-gctx.Done():
+				return
+			}
+		}
+	}()
+	return g.Wait()
+}
+
 // rewrite writes all data from the readers back into the writers while cleaning
-// up mis-ordered and duplicated chunks.
+// up mis-ordered and duplicated chunks. Chunks of up to concurrency series are read at once.
 func rewrite(
 	logger log.Logger,
 	indexr tsdb.IndexReader, chunkr tsdb.ChunkReader,
 	indexw tsdb.IndexWriter, chunkw tsdb.ChunkWriter,
 	meta *metadata.Meta,
 	ignoreChkFns []ignoreFnType,
+	concurrency int,
 ) error {
 	symbols := indexr.Symbols()
 	for symbols.Next() {
@@ -559,33 +702,19 @@ func rewrite(
 		series   = []seriesRepair{}
 	)
 
-	var lset labels.Labels
-	var chks []chunks.Meta
 	for all.Next() {
 		id := all.At()
 
+		var (
+			lset labels.Labels
+			chks []chunks.Meta
+		)
 		if err := indexr.Series(id, &lset, &chks); err != nil {
 			return errors.Wrap(err, "series")
 		}
 		// Make sure labels are in sorted order.
 		sort.Sort(lset)
 
-		for i, c := range chks {
-			chks[i].Chunk, err = chunkr.Chunk(c.Ref)
-			if err != nil {
-				return errors.Wrap(err, "chunk read")
-			}
-		}
-
-		chks, err := sanitizeChunkSequence(chks, meta.MinTime, meta.MaxTime, ignoreChkFns)
-		if err != nil {
-			return err
-		}
-
-		if len(chks) == 0 {
-			continue
-		}
-
 		series = append(series, seriesRepair{
 			lset: lset,
 			chks: chks,
@@ -596,6 +725,19 @@ func rewrite(
 		return errors.Wrap(all.Err(), "iterate series")
 	}
 
+	if err := readSeriesChunks(series, chunkr, meta.MinTime, meta.MaxTime, ignoreChkFns, concurrency); err != nil {
+		return err
+	}
+
+	// Drop series with no chunks left after sanitizing.
+	nonEmpty := series[:0]
+	for _, s := range series {
+		if len(s.chks) > 0 {
+			nonEmpty = append(nonEmpty, s)
+		}
+	}
+	series = nonEmpty
+
 	// Sort the series, if labels are re-ordered then the ordering of series
 	// will be different.
 	sort.Slice(series, func(i, j int) bool {
@@ -4,13 +4,18 @@
 package block
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/tsdb"
 	"github.com/prometheus/prometheus/tsdb/chunks"
@@ -63,7 +68,7 @@ func TestRewrite(t *testing.T) {
 
 	testutil.Ok(t, rewrite(log.NewNopLogger(), ir, cr, iw, cw, m, []ignoreFnType{func(mint, maxt int64, prev *chunks.Meta, curr *chunks.Meta) (bool, error) {
 		return curr.MaxTime == 696, nil
-	}}))
+	}}, 1))
 
 	testutil.Ok(t, iw.Close())
 	testutil.Ok(t, cw.Close())
@@ -85,3 +90,204 @@ func TestRewrite(t *testing.T) {
 	}
 
 }
+
+// rewriteBlock rewrites the block with the given id in dir into a new block with the given id, dropping all chunks
+// outside of [0, 500] and returns the meta of the new block.
+func rewriteBlock(t testing.TB, dir string, id, newID ulid.ULID, concurrency int) *metadata.Meta {
+	ir, err := index.NewFileReader(filepath.Join(dir, id.String(), IndexFilename))
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, ir.Close()) }()
+
+	cr, err := chunks.NewDirReader(filepath.Join(dir, id.String(), ChunksDirname), nil)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, cr.Close()) }()
+
+	m := &metadata.Meta{BlockMeta: tsdb.BlockMeta{ULID: newID, MinTime: 0, MaxTime: 500}}
+	testutil.Ok(t, os.MkdirAll(filepath.Join(dir, newID.String()), os.ModePerm))
+	iw, err := index.NewWriter(context.Background(), filepath.Join(dir, newID.String(), IndexFilename))
+	testutil.Ok(t, err)
+	cw, err := chunks.NewWriter(filepath.Join(dir, newID.String(), ChunksDirname))
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, rewrite(log.NewNopLogger(), ir, cr, iw, cw, m, []ignoreFnType{IgnoreCompleteOutsideChunk}, concurrency))
+	testutil.Ok(t, iw.Close())
+	testutil.Ok(t, cw.Close())
+	return m
+}
+
+func TestRewrite_ConcurrentChunkReads(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "test-rewrite-concurrent")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	var series []labels.Labels
+	for i := 0; i < 100; i++ {
+		series = append(series, labels.FromStrings("a", fmt.Sprintf("%d", i), "b", fmt.Sprintf("%d", i%7)))
+	}
+	b, err := e2eutil.CreateBlock(context.Background(), tmpDir, series, 600, 0, 1000, nil, 0, metadata.NoneFunc)
+	testutil.Ok(t, err)
+
+	serial := rewriteBlock(t, tmpDir, b, ULID(1), 1)
+	testutil.Assert(t, serial.Stats.NumSeries == 100, "expected all series, got %d", serial.Stats.NumSeries)
+
+	for _, concurrency := range []int{2, 8, 200} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			newID := ULID(concurrency)
+			concurrent := rewriteBlock(t, tmpDir, b, newID, concurrency)
+			testutil.Equals(t, serial.Stats, concurrent.Stats)
+
+			// The written block has to be identical to the one written serially.
+			for _, f := range []string{IndexFilename, filepath.Join(ChunksDirname, "000001")} {
+				exp, err := ioutil.ReadFile(filepath.Join(tmpDir, serial.ULID.String(), f))
+				testutil.Ok(t, err)
+				got, err := ioutil.ReadFile(filepath.Join(tmpDir, newID.String(), f))
+				testutil.Ok(t, err)
+				testutil.Assert(t, bytes.Equal(exp, got), "file %s differs from the serially written one", f)
+			}
+		})
+	}
+}
+
+func BenchmarkRewrite(b *testing.B) {
+	tmpDir, err := ioutil.TempDir("", "bench-rewrite")
+	testutil.Ok(b, err)
+	defer func() { testutil.Ok(b, os.RemoveAll(tmpDir)) }()
+
+	var series []labels.Labels
+	for i := 0; i < 10000; i++ {
+		series = append(series, labels.FromStrings("a", fmt.Sprintf("%d", i)))
+	}
+	id, err := e2eutil.CreateBlock(context.Background(), tmpDir, series, 480, 0, 1000, nil, 0, metadata.NoneFunc)
+	testutil.Ok(b, err)
+
+	for _, concurrency := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				newID := ULID(i + 1)
+				rewriteBlock(b, tmpDir, id, newID, concurrency)
+
+				b.StopTimer()
+				testutil.Ok(b, os.RemoveAll(filepath.Join(tmpDir, newID.String())))
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func TestGatherLabelCardinality(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "test-label-cardinality")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	b, err := e2eutil.CreateBlock(context.Background(), tmpDir, []labels.Labels{
+		{{Name: "__name__", Value: "up"}, {Name: "a", Value: "1"}},
+		{{Name: "__name__", Value: "up"}, {Name: "a", Value: "2"}},
+		{{Name: "__name__", Value: "up"}, {Name: "a", Value: "3"}, {Name: "b", Value: "1"}},
+		{{Name: "__name__", Value: "down"}, {Name: "a", Value: "1"}},
+	}, 100, 0, 1000, nil, 0, metadata.NoneFunc)
+	testutil.Ok(t, err)
+
+	card, err := GatherLabelCardinality(filepath.Join(tmpDir, b.String(), IndexFilename))
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]int64{"__name__": 2, "a": 3, "b": 1}, card)
+}
+
+func TestGatherIndexHealthStats_SeriesIssues(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "test-index-issues")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	fn := filepath.Join(tmpDir, IndexFilename)
+	iw, err := index.NewWriter(context.Background(), fn)
+	testutil.Ok(t, err)
+	for _, s := range []string{"1", "2", "3", "4", "a", "b"} {
+		testutil.Ok(t, iw.AddSymbol(s))
+	}
+	// Block time range is [0, 1000].
+	for i, s := range []struct {
+		lset labels.Labels
+		chks []chunks.Meta
+	}{
+		{
+			lset: labels.Labels{{Name: "a", Value: "1"}},
+			chks: []chunks.Meta{
+				{Ref: 8, MinTime: 0, MaxTime: 100},
+				{Ref: 16, MinTime: 50, MaxTime: 150},
+				{Ref: 24, MinTime: 200, MaxTime: 300},
+				{Ref: 32, MinTime: 200, MaxTime: 300},
+			},
+		},
+		{
+			lset: labels.Labels{{Name: "a", Value: "2"}},
+			chks: []chunks.Meta{
+				{Ref: 40, MinTime: 0, MaxTime: 100},
+				{Ref: 48, MinTime: 101, MaxTime: 200},
+			},
+		},
+		{
+			lset: labels.Labels{{Name: "a", Value: "3"}},
+			chks: []chunks.Meta{
+				{Ref: 56, MinTime: -100, MaxTime: 100},
+				{Ref: 64, MinTime: 1000, MaxTime: 1100},
+				{Ref: 72, MinTime: 2000, MaxTime: 2100},
+			},
+		},
+		{
+			lset: labels.Labels{{Name: "b", Value: "1"}, {Name: "a", Value: "4"}},
+			chks: []chunks.Meta{{Ref: 80, MinTime: 0, MaxTime: 100}},
+		},
+	} {
+		testutil.Ok(t, iw.AddSeries(uint64(i), s.lset, s.chks...))
+	}
+	testutil.Ok(t, iw.Close())
+
+	var issues []SeriesIssue
+	stats, err := GatherIndexHealthStats(log.NewNopLogger(), fn, 0, 1000, func(i SeriesIssue) {
+		testutil.Assert(t, i.Ref != 0, "expected series reference to be set")
+		i.Ref = 0
+		issues = append(issues, i)
+	})
+	testutil.Ok(t, err)
+	testutil.Equals(t, []SeriesIssue{
+		{Labels: labels.Labels{{Name: "a", Value: "1"}}, Type: IndexIssueOutOfOrderChunks, Count: 1},
+		{Labels: labels.Labels{{Name: "a", Value: "1"}}, Type: IndexIssueDuplicatedChunks, Count: 1},
+		{Labels: labels.Labels{{Name: "a", Value: "3"}}, Type: IndexIssuePartlyOutsideChunks, Count: 1},
+		{Labels: labels.Labels{{Name: "a", Value: "3"}}, Type: IndexIssueCompleteOutsideChunks, Count: 1},
+		{Labels: labels.Labels{{Name: "a", Value: "3"}}, Type: IndexIssue347OutsideChunks, Count: 1},
+		{Labels: labels.Labels{{Name: "b", Value: "1"}, {Name: "a", Value: "4"}}, Type: IndexIssueOutOfOrderLabels, Count: 1},
+	}, issues)
+
+	testutil.Equals(t, int64(4), stats.TotalSeries)
+	testutil.Equals(t, 1, stats.OutOfOrderSeries)
+	testutil.Equals(t, 1, stats.OutOfOrderChunks)
+	testutil.Equals(t, 1, stats.DuplicatedChunks)
+	testutil.Equals(t, 3, stats.OutsideChunks)
+	testutil.Equals(t, 1, stats.CompleteOutsideChunks)
+	testutil.Equals(t, 1, stats.Issue347OutsideChunks)
+	testutil.Equals(t, 1, stats.OutOfOrderLabels)
+
+	// Aggregates are the same without the callback.
+	statsWithoutCallback, err := GatherIndexHealthStats(log.NewNopLogger(), fn, 0, 1000, nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, stats, statsWithoutCallback)
+}
+
+func TestRepair_ULIDFunc(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "test-repair-ulid")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	id, err := e2eutil.CreateBlock(context.Background(), tmpDir, []labels.Labels{{{Name: "a", Value: "1"}}}, 100, 0, 1000, labels.Labels{{Name: "ext1", Value: "1"}}, 0, metadata.NoneFunc)
+	testutil.Ok(t, err)
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	newULID := NewULIDFunc(func() time.Time { return now }, rand.New(rand.NewSource(1)))
+	resid, err := Repair(log.NewNopLogger(), tmpDir, id, metadata.TestSource, 1, newULID, IgnoreIssue347OutsideChunk)
+	testutil.Ok(t, err)
+	testutil.Equals(t, ulid.MustNew(ulid.Timestamp(now), rand.New(rand.NewSource(1))), resid)
+
+	meta, err := metadata.ReadFromDir(filepath.Join(tmpDir, resid.String()))
+	testutil.Ok(t, err)
+	testutil.Equals(t, resid, meta.ULID)
+}
@@ -69,8 +69,28 @@ type BinaryTOC struct {
 	PostingsOffsetTable uint64
 }
 
+// BinaryStats describes the content of the written index-header file.
+type BinaryStats struct {
+	// LabelNames is the number of distinct label names.
+	LabelNames int
+	// LabelValues is the total number of label values across all label names.
+	LabelValues int
+	// PostingsRanges is the number of entries in the postings offset table, including the all postings one.
+	PostingsRanges int
+	// SizeBytes is the size of the index-header file.
+	SizeBytes int64
+}
+
 // WriteBinary build index-header file from the pieces of index in object storage.
-func WriteBinary(ctx context.Context, bkt objstore.BucketReader, id ulid.ULID, filename string) (err error) {
+// It returns statistics of the written file.
+func WriteBinary(ctx context.Context, bkt objstore.BucketReader, id ulid.ULID, filename string) (stats BinaryStats, err error) {
+	if err := writeBinary(ctx, bkt, id, filename); err != nil {
+		return stats, err
+	}
+	return readBinaryStats(filename)
+}
+
+func writeBinary(ctx context.Context, bkt objstore.BucketReader, id ulid.ULID, filename string) (err error) {
 	ir, indexVersion, err := newChunkedIndexReader(ctx, bkt, id)
 	if err != nil {
 		return errors.Wrap(err, "new index reader")
@@ -122,6 +142,44 @@ func WriteBinary(ctx context.Context, bkt objstore.BucketReader, id ulid.ULID, f
 	return os.Rename(tmpFilename, filename)
 }
 
+// readBinaryStats gathers BinaryStats from the postings offset table of the given index-header file.
+func readBinaryStats(filename string) (stats BinaryStats, err error) {
+	f, err := fileutil.OpenMmapFile(filename)
+	if err != nil {
+		return stats, errors.Wrap(err, "open index header")
+	}
+	defer runutil.CloseWithErrCapture(&err, f, "close index header %s", filename)
+
+	b := realByteSlice(f.Bytes())
+	toc, err := newBinaryTOCFromByteSlice(b)
+	if err != nil {
+		return stats, errors.Wrap(err, "read index header TOC")
+	}
+
+	// Postings offset table is sorted by label name, so a change of name means a new label name.
+	var lastName string
+	if err := index.ReadOffsetTable(b, toc.PostingsOffsetTable, func(key []string, _ uint64, _ int) error {
+		if len(key) != 2 {
+			return errors.Errorf("unexpected key length for posting table %d", len(key))
+		}
+		stats.PostingsRanges++
+		if key[0] == "" {
+			// All postings entry.
+			return nil
+		}
+		stats.LabelValues++
+		if stats.LabelNames == 0 || key[0] != lastName {
+			stats.LabelNames++
+			lastName = key[0]
+		}
+		return nil
+	}); err != nil {
+		return stats, errors.Wrap(err, "read postings offset table")
+	}
+	stats.SizeBytes = int64(b.Len())
+	return stats, nil
+}
+
 type chunkedIndexReader struct {
 	ctx  context.Context
 	path string
@@ -467,11 +525,13 @@ func NewBinaryReader(ctx context.Context, logger log.Logger, bkt objstore.Bucket
 	level.Debug(logger).Log("msg", "failed to read index-header from disk; recreating", "path", binfn, "err", err)
 
 	start := time.Now()
-	if err := WriteBinary(ctx, bkt, id, binfn); err != nil {
+	stats, err := WriteBinary(ctx, bkt, id, binfn)
+	if err != nil {
 		return nil, errors.Wrap(err, "write index header")
 	}
 
-	level.Debug(logger).Log("msg", "built index-header file", "path", binfn, "elapsed", time.Since(start))
+	level.Debug(logger).Log("msg", "built index-header file", "path", binfn, "elapsed", time.Since(start),
+		"label_names", stats.LabelNames, "label_values", stats.LabelValues, "postings_ranges", stats.PostingsRanges, "size_bytes", stats.SizeBytes)
 	return newFileBinaryReader(binfn, postingOffsetsInMemSampling)
 }
 
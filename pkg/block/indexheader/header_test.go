@@ -101,7 +101,12 @@ func TestReaders(t *testing.T) {
 
 			t.Run("binary reader", func(t *testing.T) {
 				fn := filepath.Join(tmpDir, id.String(), block.IndexHeaderFilename)
-				testutil.Ok(t, WriteBinary(ctx, bkt, id, fn))
+				stats, err := WriteBinary(ctx, bkt, id, fn)
+				testutil.Ok(t, err)
+
+				fi, err := os.Stat(fn)
+				testutil.Ok(t, err)
+				testutil.Equals(t, fi.Size(), stats.SizeBytes)
 
 				br, err := NewBinaryReader(ctx, log.NewNopLogger(), nil, tmpDir, id, 3)
 				testutil.Ok(t, err)
@@ -109,6 +114,7 @@ func TestReaders(t *testing.T) {
 				defer func() { testutil.Ok(t, br.Close()) }()
 
 				if id == id1 {
+					testutil.Equals(t, BinaryStats{LabelNames: 2, LabelValues: 14, PostingsRanges: 15, SizeBytes: fi.Size()}, stats)
 					testutil.Equals(t, 1, br.version)
 					testutil.Equals(t, 2, br.indexVersion)
 					testutil.Equals(t, &BinaryTOC{Symbols: headerLen, PostingsOffsetTable: 69}, br.toc)
@@ -174,7 +180,8 @@ func TestReaders(t *testing.T) {
 
 			t.Run("lazy binary reader", func(t *testing.T) {
 				fn := filepath.Join(tmpDir, id.String(), block.IndexHeaderFilename)
-				testutil.Ok(t, WriteBinary(ctx, bkt, id, fn))
+				_, err := WriteBinary(ctx, bkt, id, fn)
+				testutil.Ok(t, err)
 
 				br, err := NewLazyBinaryReader(ctx, log.NewNopLogger(), nil, tmpDir, id, 3, NewLazyBinaryReaderMetrics(nil), nil)
 				testutil.Ok(t, err)
@@ -346,7 +353,8 @@ func BenchmarkBinaryWrite(t *testing.B) {
 
 	t.ResetTimer()
 	for i := 0; i < t.N; i++ {
-		testutil.Ok(t, WriteBinary(ctx, bkt, m.ULID, fn))
+		_, err := WriteBinary(ctx, bkt, m.ULID, fn)
+		testutil.Ok(t, err)
 	}
 }
 
@@ -361,7 +369,8 @@ func BenchmarkBinaryReader(t *testing.B) {
 
 	m := prepareIndexV2Block(t, tmpDir, bkt)
 	fn := filepath.Join(tmpDir, m.ULID.String(), block.IndexHeaderFilename)
-	testutil.Ok(t, WriteBinary(ctx, bkt, m.ULID, fn))
+	_, err = WriteBinary(ctx, bkt, m.ULID, fn)
+	testutil.Ok(t, err)
 
 	t.ResetTimer()
 	for i := 0; i < t.N; i++ {
@@ -110,11 +110,13 @@ func NewLazyBinaryReader(
 		level.Debug(logger).Log("msg", "the index-header doesn't exist on disk; recreating", "path", filepath)
 
 		start := time.Now()
-		if err := WriteBinary(ctx, bkt, id, filepath); err != nil {
+		stats, err := WriteBinary(ctx, bkt, id, filepath)
+		if err != nil {
 			return nil, errors.Wrap(err, "write index header")
 		}
 
-		level.Debug(logger).Log("msg", "built index-header file", "path", filepath, "elapsed", time.Since(start))
+		level.Debug(logger).Log("msg", "built index-header file", "path", filepath, "elapsed", time.Since(start),
+			"label_names", stats.LabelNames, "label_values", stats.LabelValues, "postings_ranges", stats.PostingsRanges, "size_bytes", stats.SizeBytes)
 	}
 
 	return &LazyBinaryReader{
@@ -9,9 +9,12 @@ package metadata
 // this package.
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 
@@ -90,6 +93,10 @@ type Thanos struct {
 
 	// Rewrites is present when any rewrite (deletion, relabel etc) were applied to this block. Optional.
 	Rewrites []Rewrite `json:"rewrites,omitempty"`
+
+	// LabelCardinality maps each label name in the block index to the number of its distinct values.
+	// Useful for analysing cardinality without downloading the index. Optional, set by compactor if enabled.
+	LabelCardinality map[string]int64 `json:"label_cardinality,omitempty"`
 }
 
 type Rewrite struct {
@@ -178,6 +185,35 @@ func (m Meta) Write(w io.Writer) error {
 	return enc.Encode(&m)
 }
 
+// WriteCompressed writes the given encoded meta to writer, gzip-compressed.
+func (m Meta) WriteCompressed(w io.Writer) error {
+	gw := gzip.NewWriter(w)
+	if err := m.Write(gw); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// IsCompressed reports whether the given meta file content is gzip-compressed. JSON never starts with the gzip magic
+// number, so compressed and uncompressed meta files can be told apart.
+func IsCompressed(b []byte) bool {
+	return len(b) >= 2 && b[0] == 0x1f && b[1] == 0x8b
+}
+
+// Decompress returns the JSON content of the given meta file content, which might be gzip-compressed.
+func Decompress(b []byte) (_ []byte, err error) {
+	if !IsCompressed(b) {
+		return b, nil
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrap(err, "create gzip reader")
+	}
+	defer runutil.CloseWithErrCapture(&err, gr, "close gzip reader")
+
+	return ioutil.ReadAll(gr)
+}
+
 func renameFile(logger log.Logger, from, to string) error {
 	if err := os.RemoveAll(to); err != nil {
 		return err
@@ -208,12 +244,20 @@ func ReadFromDir(dir string) (*Meta, error) {
 	return Read(f)
 }
 
-// Read the block meta from the given reader.
+// Read the block meta from the given reader. The meta might be gzip-compressed.
 func Read(rc io.ReadCloser) (_ *Meta, err error) {
 	defer runutil.ExhaustCloseWithErrCapture(&err, rc, "close meta JSON")
 
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = Decompress(b); err != nil {
+		return nil, err
+	}
+
 	var m Meta
-	if err = json.NewDecoder(rc).Decode(&m); err != nil {
+	if err = json.Unmarshal(b, &m); err != nil {
 		return nil, err
 	}
 
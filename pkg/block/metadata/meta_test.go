@@ -211,4 +211,37 @@ func TestMeta_ReadWrite(t *testing.T) {
 		m1.Thanos.Labels = map[string]string{}
 		testutil.Equals(t, m1, *retMeta)
 	})
+
+	t.Run("compressed write/read", func(t *testing.T) {
+		b := bytes.Buffer{}
+		m1 := Meta{
+			BlockMeta: tsdb.BlockMeta{
+				ULID:    ulid.MustNew(5, nil),
+				MinTime: 2424,
+				MaxTime: 134,
+				Version: 1,
+				Stats:   tsdb.BlockStats{NumChunks: 14, NumSamples: 245, NumSeries: 4},
+			},
+			Thanos: Thanos{
+				Version: 1,
+				Labels:  map[string]string{"ext": "lset1"},
+				Source:  ReceiveSource,
+				Files:   []File{{RelPath: "index", SizeBytes: 401}},
+			},
+		}
+		testutil.Ok(t, m1.WriteCompressed(&b))
+		testutil.Assert(t, IsCompressed(b.Bytes()), "expected gzip-compressed meta")
+
+		uncompressed := bytes.Buffer{}
+		testutil.Ok(t, m1.Write(&uncompressed))
+		testutil.Assert(t, !IsCompressed(uncompressed.Bytes()), "expected uncompressed meta")
+
+		decompressed, err := Decompress(b.Bytes())
+		testutil.Ok(t, err)
+		testutil.Equals(t, uncompressed.String(), string(decompressed))
+
+		retMeta, err := Read(ioutil.NopCloser(&b))
+		testutil.Ok(t, err)
+		testutil.Equals(t, m1, *retMeta)
+	})
 }
@@ -0,0 +1,28 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"io"
+	"math/rand"
+	"time"
+
+	"github.com/oklog/ulid"
+)
+
+// ULIDFunc returns a new ID for a produced block.
+type ULIDFunc func() ulid.ULID
+
+// NewULID returns a new ULID for the current time with random entropy. It is the default ULIDFunc.
+func NewULID() ulid.ULID {
+	return ulid.MustNew(ulid.Now(), rand.New(rand.NewSource(time.Now().UnixNano())))
+}
+
+// NewULIDFunc returns a ULIDFunc with timestamps taken from now and entropy read from entropy, so that the
+// produced IDs can be made deterministic, e.g. in tests. It is only safe for concurrent use if entropy is.
+func NewULIDFunc(now func() time.Time, entropy io.Reader) ULIDFunc {
+	return func() ulid.ULID {
+		return ulid.MustNew(ulid.Timestamp(now()), entropy)
+	}
+}
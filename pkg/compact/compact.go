@@ -10,12 +10,15 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/jpillora/backoff"
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
@@ -24,6 +27,7 @@ import (
 	"github.com/prometheus/prometheus/tsdb"
 	"github.com/thanos-io/thanos/pkg/extprom"
 	"github.com/thanos-io/thanos/pkg/runutil"
+	"go.uber.org/atomic"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/thanos-io/thanos/pkg/block"
@@ -41,12 +45,21 @@ const (
 	ResolutionLevel1h  = ResolutionLevel(downsample.ResLevel2)
 )
 
+const (
+	// denylistedMeta is the syncer filtered state of blocks excluded by the denylist.
+	denylistedMeta = "denylisted"
+)
+
 const (
 	// DedupAlgorithmPenalty is the penalty based compactor series merge algorithm.
 	// This is the same as the online deduplication of querier except counter reset handling.
 	DedupAlgorithmPenalty = "penalty"
 )
 
+// DefaultDeleteTimeout is the default time allowed for marking a single block for deletion. Deletion is done with
+// a context detached from the caller's, so that a block is always marked in full on shutdown.
+const DefaultDeleteTimeout = 5 * time.Minute
+
 // Syncer synchronizes block metas from a bucket into a local directory.
 // It sorts them into compaction groups based on equal label sets.
 type Syncer struct {
@@ -61,6 +74,10 @@ type Syncer struct {
 	metrics                  *syncerMetrics
 	duplicateBlocksFilter    *block.DeduplicateFilter
 	ignoreDeletionMarkFilter *block.IgnoreDeletionMarkFilter
+	filters                  []block.MetadataFilter
+	denylist                 map[ulid.ULID]struct{}
+	gcConcurrency            int
+	deleteTimeout            time.Duration
 }
 
 type syncerMetrics struct {
@@ -69,6 +86,7 @@ type syncerMetrics struct {
 	garbageCollectionFailures prometheus.Counter
 	garbageCollectionDuration prometheus.Histogram
 	blocksMarkedForDeletion   prometheus.Counter
+	filtered                  *extprom.TxGaugeVec
 }
 
 func newSyncerMetrics(reg prometheus.Registerer, blocksMarkedForDeletion, garbageCollectedBlocks prometheus.Counter) *syncerMetrics {
@@ -90,17 +108,70 @@ func newSyncerMetrics(reg prometheus.Registerer, blocksMarkedForDeletion, garbag
 	})
 
 	m.blocksMarkedForDeletion = blocksMarkedForDeletion
+	m.filtered = extprom.NewTxGaugeVec(reg, prometheus.GaugeOpts{
+		Name: "thanos_compact_syncer_filtered_blocks",
+		Help: "Number of block metadata excluded by syncer filters during last sync.",
+	}, []string{"state"})
 
 	return &m
 }
 
+// SyncerOption configures optional Syncer behaviour.
+type SyncerOption func(s *Syncer)
+
+// WithSyncerFilters sets filters applied in the given order on every SyncMetas call, after the fetcher's filters.
+// The fetcher's filters must include the syncer's ignoreDeletionMarkFilter followed by its duplicateBlocksFilter,
+// as garbage collection and the BlocksCleaner rely on what they found. The compactor's fetcher applies, in order:
+// the label sharded, consistency delay, ignore deletion mark, deduplicate and no-compact mark filters. Filters given
+// to the syncer thus only see blocks that are neither marked for deletion nor duplicates.
+// To own only a subset of blocks by external labels, pass a block.NewLabelShardedMetaFilter with the selector relabel
+// config to the fetcher, ahead of the deduplicate filter. Blocks it drops are then neither grouped, planned nor
+// garbage collected. Passed as one of the syncer's filters instead, it would run after deduplication, so duplicates
+// owned by other compactors would still be garbage collected.
+func WithSyncerFilters(filters ...block.MetadataFilter) SyncerOption {
+	return func(s *Syncer) {
+		s.filters = filters
+	}
+}
+
+// WithDenylist sets blocks that are never returned by the syncer, neither as complete nor as partial blocks, nor
+// garbage collected. As compaction, downsampling, retention and partial upload cleanup work on the synced blocks,
+// they skip denylisted blocks too. Blocks already marked for deletion are still deleted by the BlocksCleaner.
+func WithDenylist(ids ...ulid.ULID) SyncerOption {
+	return func(s *Syncer) {
+		for _, id := range ids {
+			s.denylist[id] = struct{}{}
+		}
+	}
+}
+
+// WithGarbageCollectionConcurrency sets how many blocks are marked for deletion concurrently during garbage
+// collection. Defaults to 1.
+func WithGarbageCollectionConcurrency(concurrency int) SyncerOption {
+	return func(s *Syncer) {
+		if concurrency > 0 {
+			s.gcConcurrency = concurrency
+		}
+	}
+}
+
+// WithSyncerDeleteTimeout sets the time allowed for marking a single block for deletion during garbage collection.
+// Non-positive values mean DefaultDeleteTimeout, which is the default.
+func WithSyncerDeleteTimeout(timeout time.Duration) SyncerOption {
+	return func(s *Syncer) {
+		if timeout > 0 {
+			s.deleteTimeout = timeout
+		}
+	}
+}
+
 // NewMetaSyncer returns a new Syncer for the given Bucket and directory.
 // Blocks must be at least as old as the sync delay for being considered.
-func NewMetaSyncer(logger log.Logger, reg prometheus.Registerer, bkt objstore.Bucket, fetcher block.MetadataFetcher, duplicateBlocksFilter *block.DeduplicateFilter, ignoreDeletionMarkFilter *block.IgnoreDeletionMarkFilter, blocksMarkedForDeletion, garbageCollectedBlocks prometheus.Counter, blockSyncConcurrency int) (*Syncer, error) {
+func NewMetaSyncer(logger log.Logger, reg prometheus.Registerer, bkt objstore.Bucket, fetcher block.MetadataFetcher, duplicateBlocksFilter *block.DeduplicateFilter, ignoreDeletionMarkFilter *block.IgnoreDeletionMarkFilter, blocksMarkedForDeletion, garbageCollectedBlocks prometheus.Counter, blockSyncConcurrency int, opts ...SyncerOption) (*Syncer, error) {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
-	return &Syncer{
+	s := &Syncer{
 		logger:                   logger,
 		reg:                      reg,
 		bkt:                      bkt,
@@ -109,12 +180,19 @@ func NewMetaSyncer(logger log.Logger, reg prometheus.Registerer, bkt objstore.Bu
 		metrics:                  newSyncerMetrics(reg, blocksMarkedForDeletion, garbageCollectedBlocks),
 		duplicateBlocksFilter:    duplicateBlocksFilter,
 		ignoreDeletionMarkFilter: ignoreDeletionMarkFilter,
+		denylist:                 map[ulid.ULID]struct{}{},
 		blockSyncConcurrency:     blockSyncConcurrency,
-	}, nil
+		gcConcurrency:            1,
+		deleteTimeout:            DefaultDeleteTimeout,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
 }
 
 // UntilNextDownsampling calculates how long it will take until the next downsampling operation.
-// Returns an error if there will be no downsampling.
+// Returns an error if there will be no downsampling, including for blocks with an unknown resolution.
 func UntilNextDownsampling(m *metadata.Meta) (time.Duration, error) {
 	timeRange := time.Duration((m.MaxTime - m.MinTime) * int64(time.Millisecond))
 	switch m.Thanos.Downsample.Resolution {
@@ -125,7 +203,7 @@ func UntilNextDownsampling(m *metadata.Meta) (time.Duration, error) {
 	case downsample.ResLevel0:
 		return time.Duration(downsample.DownsampleRange0*time.Millisecond) - timeRange, nil
 	default:
-		panic(errors.Errorf("invalid resolution %v", m.Thanos.Downsample.Resolution))
+		return time.Duration(0), errors.Errorf("invalid resolution %d of block %s", m.Thanos.Downsample.Resolution, m.ULID)
 	}
 }
 
@@ -138,11 +216,64 @@ func (s *Syncer) SyncMetas(ctx context.Context) error {
 	if err != nil {
 		return retry(err)
 	}
+
+	s.metrics.filtered.ResetTx()
+	for _, f := range s.filters {
+		// NOTE: filter can update filtered metric accordingly to the reason of the exclude.
+		if err := f.Filter(ctx, metas, s.metrics.filtered); err != nil {
+			return retry(errors.Wrap(err, "filter metas"))
+		}
+	}
+	for id := range metas {
+		if _, ok := s.denylist[id]; ok {
+			s.metrics.filtered.WithLabelValues(denylistedMeta).Inc()
+			delete(metas, id)
+		}
+	}
+	// Partial denylisted blocks must not be cleaned up as aborted uploads either.
+	for id := range partial {
+		if _, ok := s.denylist[id]; ok {
+			delete(partial, id)
+		}
+	}
+	s.metrics.filtered.Submit()
+
 	s.blocks = metas
 	s.partial = partial
 	return nil
 }
 
+// RefreshBlock re-reads the metadata of a single block from the bucket and updates it in the synced metas,
+// e.g. after the block was repaired out of band, without the cost of a full SyncMetas. Only blocks known from
+// the last sync are refreshed, as filters are not applied. A block whose meta.json no longer exists is dropped.
+func (s *Syncer) RefreshBlock(ctx context.Context, id ulid.ULID) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if _, ok := s.blocks[id]; !ok {
+		return errors.Errorf("block %s is not known from the last sync", id)
+	}
+
+	m, err := block.DownloadMeta(ctx, s.logger, s.bkt, id)
+	if err != nil && !s.bkt.IsObjNotFoundErr(errors.Cause(err)) {
+		return retry(errors.Wrapf(err, "refresh meta of block %s", id))
+	}
+
+	// Metas returned so far might still be in use, so the synced metas are replaced rather than modified.
+	metas := make(map[ulid.ULID]*metadata.Meta, len(s.blocks))
+	for bid, bm := range s.blocks {
+		metas[bid] = bm
+	}
+	if err != nil {
+		level.Info(s.logger).Log("msg", "block meta not found in bucket on refresh, dropping block", "block", id)
+		delete(metas, id)
+	} else {
+		metas[id] = &m
+	}
+	s.blocks = metas
+	return nil
+}
+
 // Partial returns partial blocks since last sync.
 func (s *Syncer) Partial() map[ulid.ULID]error {
 	s.mtx.Lock()
@@ -179,29 +310,58 @@ func (s *Syncer) GarbageCollect(ctx context.Context) error {
 		if _, exists := deletionMarkMap[id]; exists {
 			continue
 		}
+		if _, denied := s.denylist[id]; denied {
+			level.Debug(s.logger).Log("msg", "skipping garbage collection of denylisted block", "block", id)
+			continue
+		}
 		garbageIDs = append(garbageIDs, id)
 	}
 
-	for _, id := range garbageIDs {
-		if ctx.Err() != nil {
-			return ctx.Err()
-		}
+	var (
+		idsChan   = make(chan ulid.ULID)
+		blocksMtx sync.Mutex
+	)
+	g, gctx := errgroup.WithContext(ctx)
+	for i := 0; i < s.gcConcurrency; i++ {
+		g.Go(func() error {
+			for id := range idsChan {
+				// Spawn a new context so we always mark a block for deletion in full on shutdown.
+				delCtx, cancel := context.WithTimeout(context.Background(), s.deleteTimeout)
+
+				level.Info(s.logger).Log("msg", "marking outdated block for deletion", "block", id)
+				err := block.MarkForDeletion(delCtx, s.logger, s.bkt, id, "outdated block", s.metrics.blocksMarkedForDeletion)
+				cancel()
+				if err != nil {
+					s.metrics.garbageCollectionFailures.Inc()
+					return retry(errors.Wrapf(err, "mark block %s for deletion", id))
+				}
 
-		// Spawn a new context so we always mark a block for deletion in full on shutdown.
-		delCtx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+				// Immediately update our in-memory state so no further call to SyncMetas is needed
+				// after running garbage collection.
+				blocksMtx.Lock()
+				delete(s.blocks, id)
+				blocksMtx.Unlock()
+				s.metrics.garbageCollectedBlocks.Inc()
+			}
+			return nil
+		})
+	}
 
-		level.Info(s.logger).Log("msg", "marking outdated block for deletion", "block", id)
-		err := block.MarkForDeletion(delCtx, s.logger, s.bkt, id, "outdated block", s.metrics.blocksMarkedForDeletion)
-		cancel()
-		if err != nil {
-			s.metrics.garbageCollectionFailures.Inc()
-			return retry(errors.Wrapf(err, "mark block %s for deletion", id))
+dispatchLoop:
+	for _, id := range garbageIDs {
+		select {
+		case idsChan <- id:
+		case <-gctx.Done():
+			break dispatchLoop
 		}
+	}
+	close(idsChan)
 
-		// Immediately update our in-memory state so no further call to SyncMetas is needed
-		// after running garbage collection.
-		delete(s.blocks, id)
-		s.metrics.garbageCollectedBlocks.Inc()
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
 	}
 	s.metrics.garbageCollections.Inc()
 	s.metrics.garbageCollectionDuration.Observe(time.Since(begin).Seconds())
@@ -238,9 +398,18 @@ type DefaultGrouper struct {
 	compactionRunsCompleted  *prometheus.CounterVec
 	compactionFailures       *prometheus.CounterVec
 	verticalCompactions      *prometheus.CounterVec
+	lastSuccessfulRun        *prometheus.GaugeVec
 	garbageCollectedBlocks   prometheus.Counter
 	blocksMarkedForDeletion  prometheus.Counter
 	hashFunc                 metadata.HashFunc
+	downloadedBytes          *prometheus.GaugeVec
+	groupBlocks              *prometheus.GaugeVec
+	groupSizeBytes           *prometheus.GaugeVec
+	compactionInputBytes     *prometheus.CounterVec
+	compactionOutputBytes    *prometheus.CounterVec
+	verticalDedupedSamples   *prometheus.CounterVec
+	workDirCleanupFailures   *prometheus.CounterVec
+	groupOpts                []GroupOption
 }
 
 // NewDefaultGrouper makes a new DefaultGrouper.
@@ -253,6 +422,7 @@ func NewDefaultGrouper(
 	blocksMarkedForDeletion prometheus.Counter,
 	garbageCollectedBlocks prometheus.Counter,
 	hashFunc metadata.HashFunc,
+	groupOpts ...GroupOption,
 ) *DefaultGrouper {
 	return &DefaultGrouper{
 		bkt:                      bkt,
@@ -279,15 +449,52 @@ func NewDefaultGrouper(
 			Name: "thanos_compact_group_vertical_compactions_total",
 			Help: "Total number of group compaction attempts that resulted in a new block based on overlapping blocks.",
 		}, []string{"group"}),
+		lastSuccessfulRun: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_group_last_successful_run_timestamp_seconds",
+			Help: "Unix timestamp of the last successful group compaction run.",
+		}, []string{"group"}),
+		downloadedBytes: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_group_downloaded_bytes",
+			Help: "Number of bytes of source blocks downloaded so far for the current group compaction.",
+		}, []string{"group"}),
+		groupBlocks: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_group_blocks",
+			Help: "Number of blocks in the compaction group as of the last grouping.",
+		}, []string{"group"}),
+		groupSizeBytes: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_group_size_bytes",
+			Help: "Total size of the block files in the compaction group according to their meta.json, as of the last grouping.",
+		}, []string{"group"}),
+		compactionInputBytes: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_group_compaction_input_bytes_total",
+			Help: "Total on-disk size of the source blocks downloaded for group compactions.",
+		}, []string{"group"}),
+		compactionOutputBytes: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_group_compaction_output_bytes_total",
+			Help: "Total on-disk size of the blocks produced and uploaded by group compactions.",
+		}, []string{"group"}),
+		verticalDedupedSamples: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_vertical_deduplicated_samples_total",
+			Help: "Total number of samples dropped as duplicates by group compactions of overlapping blocks.",
+		}, []string{"group"}),
+		workDirCleanupFailures: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_group_workdir_cleanup_failures_total",
+			Help: "Total number of failures to remove the work directory of a group after its compaction, which might leak disk space.",
+		}, []string{"group"}),
 		garbageCollectedBlocks:  garbageCollectedBlocks,
 		blocksMarkedForDeletion: blocksMarkedForDeletion,
 		hashFunc:                hashFunc,
+		groupOpts:               groupOpts,
 	}
 }
 
 // Groups returns the compaction groups for all blocks currently known to the syncer.
-// It creates all groups from the scratch on every call.
+// It creates all groups from the scratch on every call and updates the group size metrics accordingly.
 func (g *DefaultGrouper) Groups(blocks map[ulid.ULID]*metadata.Meta) (res []*Group, err error) {
+	// Groups are only compacted after they were all created, so no download is in progress here.
+	// Drop the download series of groups which no longer exist.
+	g.downloadedBytes.Reset()
+
 	groups := map[string]*Group{}
 	for _, m := range blocks {
 		groupKey := DefaultGroupKey(m.Thanos)
@@ -310,6 +517,14 @@ func (g *DefaultGrouper) Groups(blocks map[ulid.ULID]*metadata.Meta) (res []*Gro
 				g.garbageCollectedBlocks,
 				g.blocksMarkedForDeletion,
 				g.hashFunc,
+				append([]GroupOption{WithGroupMetrics(GroupMetrics{
+					LastSuccessfulRun:      g.lastSuccessfulRun.WithLabelValues(groupKey),
+					DownloadedBytes:        g.downloadedBytes.WithLabelValues(groupKey),
+					CompactionInputBytes:   g.compactionInputBytes.WithLabelValues(groupKey),
+					CompactionOutputBytes:  g.compactionOutputBytes.WithLabelValues(groupKey),
+					VerticalDedupedSamples: g.verticalDedupedSamples.WithLabelValues(groupKey),
+					WorkDirCleanupFailures: g.workDirCleanupFailures.WithLabelValues(groupKey),
+				})}, g.groupOpts...)...,
 			)
 			if err != nil {
 				return nil, errors.Wrap(err, "create compaction group")
@@ -324,6 +539,20 @@ func (g *DefaultGrouper) Groups(blocks map[ulid.ULID]*metadata.Meta) (res []*Gro
 	sort.Slice(res, func(i, j int) bool {
 		return res[i].Key() < res[j].Key()
 	})
+
+	// Drop groups which no longer exist.
+	g.groupBlocks.Reset()
+	g.groupSizeBytes.Reset()
+	for _, group := range res {
+		var size int64
+		for _, m := range group.metasByMinTime {
+			for _, f := range m.Thanos.Files {
+				size += f.SizeBytes
+			}
+		}
+		g.groupBlocks.WithLabelValues(group.Key()).Set(float64(len(group.metasByMinTime)))
+		g.groupSizeBytes.WithLabelValues(group.Key()).Set(float64(size))
+	}
 	return res, nil
 }
 
@@ -344,9 +573,137 @@ type Group struct {
 	compactionRunsCompleted     prometheus.Counter
 	compactionFailures          prometheus.Counter
 	verticalCompactions         prometheus.Counter
+	lastSuccessfulRun           prometheus.Gauge
 	groupGarbageCollectedBlocks prometheus.Counter
 	blocksMarkedForDeletion     prometheus.Counter
 	hashFunc                    metadata.HashFunc
+	gatherLabelCardinality      bool
+	uploadOpts                  []block.UploadOption
+	downloadedBytes             prometheus.Gauge
+	downloadStallTimeout        time.Duration
+	deleteTimeout               time.Duration
+	uploadRetryBackoff          RetryBackoffConfig
+	retrySleep                  func(ctx context.Context, d time.Duration) error
+	downloadConcurrency         int
+	compactionInputBytes        prometheus.Counter
+	compactionOutputBytes       prometheus.Counter
+	onEvent                     GroupCompactEventCallback
+	verticalDedupedSamples      prometheus.Counter
+	removeAll                   func(path string) error
+	workDirCleanupFailures      prometheus.Counter
+}
+
+// GroupCompactEventType is the stage of a group compaction a GroupCompactEvent reports.
+type GroupCompactEventType string
+
+const (
+	// GroupCompactEventPlanned is reported once blocks were planned for compaction, before they are downloaded.
+	GroupCompactEventPlanned GroupCompactEventType = "planned"
+	// GroupCompactEventDownloaded is reported once the planned blocks were downloaded and verified.
+	GroupCompactEventDownloaded GroupCompactEventType = "downloaded"
+	// GroupCompactEventCompacted is reported once the downloaded blocks were compacted into a new block.
+	GroupCompactEventCompacted GroupCompactEventType = "compacted"
+	// GroupCompactEventUploaded is reported once the new block was uploaded.
+	GroupCompactEventUploaded GroupCompactEventType = "uploaded"
+	// GroupCompactEventFailed is reported once the compaction of the planned blocks failed.
+	GroupCompactEventFailed GroupCompactEventType = "failed"
+)
+
+// GroupCompactEvent describes progress of a single group compaction.
+type GroupCompactEvent struct {
+	Type       GroupCompactEventType
+	GroupKey   string
+	Resolution int64
+	// Blocks are the planned source blocks.
+	Blocks []ulid.ULID
+	// EstimatedSizeBytes is the total size of the planned blocks, based on the file sizes recorded in their meta.json.
+	EstimatedSizeBytes int64
+	// Result is the compacted block. It is only set for compacted and uploaded events, and for failed events once the
+	// blocks were compacted.
+	Result ulid.ULID
+	// Duration is the time spent in the reported stage. For failed events, it is the time spent in the whole compaction.
+	Duration time.Duration
+	// Err is the error the compaction failed with. It is only set for failed events.
+	Err error
+}
+
+// GroupCompactEventCallback is invoked synchronously from the compacting goroutine as a group compaction progresses,
+// so it must bound the time it blocks. It might be invoked concurrently for different groups.
+type GroupCompactEventCallback func(GroupCompactEvent)
+
+// GroupOption configures optional Group behaviour.
+type GroupOption func(g *Group)
+
+// WithLabelCardinality makes the group record the label cardinality of compacted blocks in their meta.json.
+func WithLabelCardinality() GroupOption {
+	return func(g *Group) {
+		g.gatherLabelCardinality = true
+	}
+}
+
+// WithCompressedMeta makes the group upload the meta.json of compacted blocks gzip-compressed.
+func WithCompressedMeta() GroupOption {
+	return func(g *Group) {
+		g.uploadOpts = append(g.uploadOpts, block.WithCompressedMeta())
+	}
+}
+
+// WithEventCallback sets the callback invoked as a group compaction progresses.
+func WithEventCallback(onEvent GroupCompactEventCallback) GroupOption {
+	return func(g *Group) {
+		g.onEvent = onEvent
+	}
+}
+
+// WithDownloadStallTimeout aborts a block download once no progress was made for the given duration.
+// Zero, the default, disables the check.
+func WithDownloadStallTimeout(timeout time.Duration) GroupOption {
+	return func(g *Group) {
+		g.downloadStallTimeout = timeout
+	}
+}
+
+// WithGroupDeleteTimeout sets the timeout for deleting blocks and partial uploads. Defaults to DefaultDeleteTimeout.
+func WithGroupDeleteTimeout(timeout time.Duration) GroupOption {
+	return func(g *Group) {
+		g.deleteTimeout = timeout
+	}
+}
+
+// WithUploadRetryBackoff sets how failed uploads of compacted blocks are retried. Defaults to DefaultUploadRetryBackoff.
+func WithUploadRetryBackoff(cfg RetryBackoffConfig) GroupOption {
+	return func(g *Group) {
+		g.uploadRetryBackoff = cfg
+	}
+}
+
+// WithDownloadConcurrency sets the number of planned blocks downloaded in parallel. Defaults to 1.
+func WithDownloadConcurrency(concurrency int) GroupOption {
+	return func(g *Group) {
+		g.downloadConcurrency = concurrency
+	}
+}
+
+// GroupMetrics are the optional per-group metrics. Nil metrics are not exposed.
+type GroupMetrics struct {
+	LastSuccessfulRun      prometheus.Gauge
+	DownloadedBytes        prometheus.Gauge
+	CompactionInputBytes   prometheus.Counter
+	CompactionOutputBytes  prometheus.Counter
+	VerticalDedupedSamples prometheus.Counter
+	WorkDirCleanupFailures prometheus.Counter
+}
+
+// WithGroupMetrics sets the optional per-group metrics.
+func WithGroupMetrics(m GroupMetrics) GroupOption {
+	return func(g *Group) {
+		g.lastSuccessfulRun = m.LastSuccessfulRun
+		g.downloadedBytes = m.DownloadedBytes
+		g.compactionInputBytes = m.CompactionInputBytes
+		g.compactionOutputBytes = m.CompactionOutputBytes
+		g.verticalDedupedSamples = m.VerticalDedupedSamples
+		g.workDirCleanupFailures = m.WorkDirCleanupFailures
+	}
 }
 
 // NewGroup returns a new compaction group.
@@ -366,6 +723,7 @@ func NewGroup(
 	groupGarbageCollectedBlocks prometheus.Counter,
 	blocksMarkedForDeletion prometheus.Counter,
 	hashFunc metadata.HashFunc,
+	opts ...GroupOption,
 ) (*Group, error) {
 	if logger == nil {
 		logger = log.NewNopLogger()
@@ -386,10 +744,90 @@ func NewGroup(
 		groupGarbageCollectedBlocks: groupGarbageCollectedBlocks,
 		blocksMarkedForDeletion:     blocksMarkedForDeletion,
 		hashFunc:                    hashFunc,
+		deleteTimeout:               DefaultDeleteTimeout,
+		uploadRetryBackoff:          DefaultUploadRetryBackoff,
+		retrySleep:                  sleepWithContext,
+		downloadConcurrency:         1,
+		removeAll:                   os.RemoveAll,
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	if g.deleteTimeout <= 0 {
+		g.deleteTimeout = DefaultDeleteTimeout
+	}
+	if g.downloadConcurrency <= 0 {
+		g.downloadConcurrency = 1
+	}
+
+	// Metrics not passed via WithGroupMetrics are kept unregistered.
+	if g.lastSuccessfulRun == nil {
+		g.lastSuccessfulRun = promauto.With(nil).NewGauge(prometheus.GaugeOpts{})
+	}
+	if g.downloadedBytes == nil {
+		g.downloadedBytes = promauto.With(nil).NewGauge(prometheus.GaugeOpts{})
+	}
+	if g.compactionInputBytes == nil {
+		g.compactionInputBytes = promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	}
+	if g.compactionOutputBytes == nil {
+		g.compactionOutputBytes = promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	}
+	if g.verticalDedupedSamples == nil {
+		g.verticalDedupedSamples = promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	}
+	if g.workDirCleanupFailures == nil {
+		g.workDirCleanupFailures = promauto.With(nil).NewCounter(prometheus.CounterOpts{})
 	}
 	return g, nil
 }
 
+// downloadBlock downloads the block into dir, adding the downloaded bytes to total and reporting total in the group's
+// download metric. If the download stall timeout is positive, the download is aborted once no progress was made for that long.
+func (cg *Group) downloadBlock(ctx context.Context, id ulid.ULID, dir string, total *atomic.Int64) error {
+	var (
+		downloaded   int64
+		lastProgress = atomic.NewInt64(time.Now().UnixNano())
+		stalled      atomic.Bool
+	)
+	progress := func(n int64) {
+		cg.downloadedBytes.Set(float64(total.Add(n - downloaded)))
+		downloaded = n
+		lastProgress.Store(time.Now().UnixNano())
+	}
+
+	if cg.downloadStallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+
+		go func() {
+			tick := time.NewTicker(cg.downloadStallTimeout / 4)
+			defer tick.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-tick.C:
+					if time.Since(time.Unix(0, lastProgress.Load())) > cg.downloadStallTimeout {
+						stalled.Store(true)
+						cancel()
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	if err := block.DownloadWithProgress(ctx, cg.logger, cg.bkt, id, dir, progress); err != nil {
+		if stalled.Load() {
+			return errors.Errorf("download stalled, no progress for %s", cg.downloadStallTimeout)
+		}
+		return err
+	}
+	return nil
+}
+
 // Key returns an identifier for the group.
 func (cg *Group) Key() string {
 	return cg.key
@@ -502,7 +940,8 @@ func (cg *Group) Compact(ctx context.Context, dir string, planner Planner, comp
 		if rerr != nil {
 			return
 		}
-		if err := os.RemoveAll(subDir); err != nil {
+		if err := cg.removeAll(subDir); err != nil {
+			cg.workDirCleanupFailures.Inc()
 			level.Error(cg.logger).Log("msg", "failed to remove compaction group work directory", "path", subDir, "err", err)
 		}
 	}()
@@ -517,6 +956,7 @@ func (cg *Group) Compact(ctx context.Context, dir string, planner Planner, comp
 		return false, ulid.ULID{}, err
 	}
 	cg.compactionRunsCompleted.Inc()
+	cg.lastSuccessfulRun.SetToCurrentTime()
 	return shouldRerun, compID, nil
 }
 
@@ -633,8 +1073,34 @@ func (cg *Group) areBlocksOverlapping(include *metadata.Meta, exclude ...*metada
 	return nil
 }
 
+// repairDirPrefix is the prefix of the directories RepairIssue347 works in.
+const repairDirPrefix = "repair-issue-347-id-"
+
+// removeStaleRepairDirs removes repair directories left in dir by repairs that were interrupted
+// before they could clean up after themselves (e.g. on panic or process kill).
+func removeStaleRepairDirs(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "read dir")
+	}
+
+	var merr errutil.MultiError
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), repairDirPrefix) {
+			continue
+		}
+		merr.Add(os.RemoveAll(filepath.Join(dir, e.Name())))
+	}
+	return merr.Err()
+}
+
 // RepairIssue347 repairs the https://github.com/prometheus/tsdb/issues/347 issue when having issue347Error.
-func RepairIssue347(ctx context.Context, logger log.Logger, bkt objstore.Bucket, blocksMarkedForDeletion prometheus.Counter, issue347Err error) error {
+// The broken block is downloaded and repaired in a deterministic directory under the given dir.
+// The broken block is marked for deletion within deleteTimeout, or DefaultDeleteTimeout if it is not positive.
+func RepairIssue347(ctx context.Context, logger log.Logger, bkt objstore.Bucket, blocksMarkedForDeletion prometheus.Counter, dir string, issue347Err error, deleteTimeout time.Duration) error {
 	ie, ok := errors.Cause(issue347Err).(Issue347Error)
 	if !ok {
 		return errors.Errorf("Given error is not an issue347 error: %v", issue347Err)
@@ -642,9 +1108,13 @@ func RepairIssue347(ctx context.Context, logger log.Logger, bkt objstore.Bucket,
 
 	level.Info(logger).Log("msg", "Repairing block broken by https://github.com/prometheus/tsdb/issues/347", "id", ie.id, "err", issue347Err)
 
-	tmpdir, err := ioutil.TempDir("", fmt.Sprintf("repair-issue-347-id-%s-", ie.id))
-	if err != nil {
-		return err
+	tmpdir := filepath.Join(dir, repairDirPrefix+ie.id.String())
+	// Whatever was left by a previous, interrupted repair of the same block cannot be trusted.
+	if err := os.RemoveAll(tmpdir); err != nil {
+		return errors.Wrapf(err, "remove stale repair dir %s", tmpdir)
+	}
+	if err := os.MkdirAll(tmpdir, 0750); err != nil {
+		return errors.Wrapf(err, "create repair dir %s", tmpdir)
 	}
 
 	defer func() {
@@ -663,7 +1133,7 @@ func RepairIssue347(ctx context.Context, logger log.Logger, bkt objstore.Bucket,
 		return errors.Wrapf(err, "read meta from %s", bdir)
 	}
 
-	resid, err := block.Repair(logger, tmpdir, ie.id, metadata.CompactorRepairSource, block.IgnoreIssue347OutsideChunk)
+	resid, err := block.Repair(logger, tmpdir, ie.id, metadata.CompactorRepairSource, runtime.GOMAXPROCS(0), nil, block.IgnoreIssue347OutsideChunk)
 	if err != nil {
 		return errors.Wrapf(err, "repair failed for block %s", ie.id)
 	}
@@ -681,7 +1151,10 @@ func RepairIssue347(ctx context.Context, logger log.Logger, bkt objstore.Bucket,
 	level.Info(logger).Log("msg", "deleting broken block", "id", ie.id)
 
 	// Spawn a new context so we always mark a block for deletion in full on shutdown.
-	delCtx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	if deleteTimeout <= 0 {
+		deleteTimeout = DefaultDeleteTimeout
+	}
+	delCtx, cancel := context.WithTimeout(context.Background(), deleteTimeout)
 	defer cancel()
 
 	// TODO(bplotka): Issue with this will introduce overlap that will halt compactor. Automate that (fix duplicate overlaps caused by this).
@@ -691,75 +1164,159 @@ func RepairIssue347(ctx context.Context, logger log.Logger, bkt objstore.Bucket,
 	return nil
 }
 
-func (cg *Group) compact(ctx context.Context, dir string, planner Planner, comp Compactor) (shouldRerun bool, compID ulid.ULID, err error) {
-	cg.mtx.Lock()
-	defer cg.mtx.Unlock()
+// reportEvent invokes the group's event callback, if any.
+func (cg *Group) reportEvent(typ GroupCompactEventType, toCompact []*metadata.Meta, result ulid.ULID, duration time.Duration, err error) {
+	if cg.onEvent == nil {
+		return
+	}
+	e := GroupCompactEvent{
+		Type:       typ,
+		GroupKey:   cg.key,
+		Resolution: cg.resolution,
+		Blocks:     make([]ulid.ULID, 0, len(toCompact)),
+		Result:     result,
+		Duration:   duration,
+		Err:        err,
+	}
+	for _, m := range toCompact {
+		e.Blocks = append(e.Blocks, m.ULID)
+		for _, f := range m.Thanos.Files {
+			e.EstimatedSizeBytes += f.SizeBytes
+		}
+	}
+	cg.onEvent(e)
+}
 
+// plan returns the blocks of the group which should be compacted next, or none if there is nothing to compact.
+// It also reports whether the blocks of the group overlap, which is only allowed with vertical compaction.
+// Planning never downloads nor uploads blocks, but the planner might, e.g. to mark blocks for no compaction.
+// Must be called with the group's mutex held.
+func (cg *Group) plan(ctx context.Context, planner Planner) (toCompact []*metadata.Meta, overlappingBlocks bool, err error) {
 	// Check for overlapped blocks.
-	overlappingBlocks := false
 	if err := cg.areBlocksOverlapping(nil); err != nil {
 		// TODO(bwplotka): It would really nice if we could still check for other overlaps than replica. In fact this should be checked
 		// in syncer itself. Otherwise with vertical compaction enabled we will sacrifice this important check.
 		if !cg.enableVerticalCompaction {
-			return false, ulid.ULID{}, halt(errors.Wrap(err, "pre compaction overlap check"))
+			return nil, false, halt(errors.Wrap(err, "pre compaction overlap check"))
 		}
 
 		overlappingBlocks = true
 	}
 
-	toCompact, err := planner.Plan(ctx, cg.metasByMinTime)
+	toCompact, err = planner.Plan(ctx, cg.metasByMinTime)
 	if err != nil {
-		return false, ulid.ULID{}, errors.Wrap(err, "plan compaction")
+		return nil, false, errors.Wrap(err, "plan compaction")
 	}
 	if len(toCompact) == 0 {
 		// Nothing to do.
-		return false, ulid.ULID{}, nil
+		return nil, overlappingBlocks, nil
 	}
 
-	level.Info(cg.logger).Log("msg", "compaction available and planned; downloading blocks", "plan", fmt.Sprintf("%v", toCompact))
+	// Groups are built by label hash, so verify that every planned block really has the external labels and
+	// resolution of the group before merging anything.
+	for _, meta := range toCompact {
+		if lset := labels.FromMap(meta.Thanos.Labels); !labels.Equal(cg.labels, lset) {
+			return nil, false, halt(errors.Errorf("external labels %s of block %s do not match labels %s of group %s", lset, meta.ULID, cg.labels, cg.key))
+		}
+		if meta.Thanos.Downsample.Resolution != cg.resolution {
+			return nil, false, halt(errors.Errorf("resolution %d of block %s does not match resolution %d of group %s", meta.Thanos.Downsample.Resolution, meta.ULID, cg.resolution, cg.key))
+		}
+	}
 
 	// Due to #183 we verify that none of the blocks in the plan have overlapping sources.
 	// This is one potential source of how we could end up with duplicated chunks.
 	uniqueSources := map[ulid.ULID]struct{}{}
-
-	// Once we have a plan we need to download the actual data.
-	begin := time.Now()
-
-	toCompactDirs := make([]string, 0, len(toCompact))
 	for _, meta := range toCompact {
-		bdir := filepath.Join(dir, meta.ULID.String())
 		for _, s := range meta.Compaction.Sources {
 			if _, ok := uniqueSources[s]; ok {
-				return false, ulid.ULID{}, halt(errors.Errorf("overlapping sources detected for plan %v", toCompact))
+				return nil, false, halt(errors.Errorf("overlapping sources detected for plan %v", toCompact))
 			}
 			uniqueSources[s] = struct{}{}
 		}
+	}
+	return toCompact, overlappingBlocks, nil
+}
+
+// downloadAndVerifyBlocks downloads and verifies the given blocks into dir, up to the group's download concurrency
+// at once. It returns the block directories in the order of the given blocks. The first failure cancels the
+// remaining downloads.
+func (cg *Group) downloadAndVerifyBlocks(ctx context.Context, dir string, metas []*metadata.Meta) ([]string, error) {
+	cg.downloadedBytes.Set(0)
+
+	var (
+		downloaded atomic.Int64
+		bdirs      = make([]string, len(metas))
+		idxChan    = make(chan int)
+	)
+	g, gctx := errgroup.WithContext(ctx)
+	for i := 0; i < cg.downloadConcurrency; i++ {
+		g.Go(func() error {
+			for idx := range idxChan {
+				meta := metas[idx]
+				bdir := filepath.Join(dir, meta.ULID.String())
+				if err := cg.downloadBlock(gctx, meta.ULID, bdir, &downloaded); err != nil {
+					return retry(errors.Wrapf(err, "download block %s", meta.ULID))
+				}
+
+				// Ensure all input blocks are valid.
+				if err := cg.verifyBlock(meta, bdir); err != nil {
+					return err
+				}
+				bdirs[idx] = bdir
+			}
+			return nil
+		})
+	}
 
-		if err := block.Download(ctx, cg.logger, cg.bkt, meta.ULID, bdir); err != nil {
-			return false, ulid.ULID{}, retry(errors.Wrapf(err, "download block %s", meta.ULID))
+	func() {
+		defer close(idxChan)
+		for idx := range metas {
+			select {
+			case idxChan <- idx:
+			case <-gctx.Done():
+				return
+			}
 		}
+	}()
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return bdirs, nil
+}
+
+func (cg *Group) compact(ctx context.Context, dir string, planner Planner, comp Compactor) (shouldRerun bool, compID ulid.ULID, err error) {
+	cg.mtx.Lock()
+	defer cg.mtx.Unlock()
 
-		// Ensure all input blocks are valid.
-		stats, err := block.GatherIndexHealthStats(cg.logger, filepath.Join(bdir, block.IndexFilename), meta.MinTime, meta.MaxTime)
+	begin := time.Now()
+	toCompact, overlappingBlocks, err := cg.plan(ctx, planner)
+	if err != nil {
+		return false, ulid.ULID{}, err
+	}
+	if len(toCompact) == 0 {
+		// Nothing to do.
+		return false, ulid.ULID{}, nil
+	}
+	defer func(begin time.Time) {
 		if err != nil {
-			return false, ulid.ULID{}, errors.Wrapf(err, "gather index issues for block %s", bdir)
+			cg.reportEvent(GroupCompactEventFailed, toCompact, compID, time.Since(begin), err)
 		}
+	}(begin)
 
-		if err := stats.CriticalErr(); err != nil {
-			return false, ulid.ULID{}, halt(errors.Wrapf(err, "block with not healthy index found %s; Compaction level %v; Labels: %v", bdir, meta.Compaction.Level, meta.Thanos.Labels))
-		}
+	level.Info(cg.logger).Log("msg", "compaction available and planned; downloading blocks", "plan", blockIDs(toCompact))
+	cg.reportEvent(GroupCompactEventPlanned, toCompact, ulid.ULID{}, time.Since(begin), nil)
 
-		if err := stats.Issue347OutsideChunksErr(); err != nil {
-			return false, ulid.ULID{}, issue347Error(errors.Wrapf(err, "invalid, but reparable block %s", bdir), meta.ULID)
-		}
+	// Once we have a plan we need to download the actual data.
+	begin = time.Now()
 
-		if err := stats.PrometheusIssue5372Err(); !cg.acceptMalformedIndex && err != nil {
-			return false, ulid.ULID{}, errors.Wrapf(err,
-				"block id %s, try running with --debug.accept-malformed-index", meta.ULID)
-		}
-		toCompactDirs = append(toCompactDirs, bdir)
+	toCompactDirs, err := cg.downloadAndVerifyBlocks(ctx, dir, toCompact)
+	if err != nil {
+		return false, ulid.ULID{}, err
 	}
-	level.Info(cg.logger).Log("msg", "downloaded and verified blocks; compacting blocks", "plan", fmt.Sprintf("%v", toCompactDirs), "duration", time.Since(begin))
+	level.Info(cg.logger).Log("msg", "downloaded and verified blocks; compacting blocks", "plan", blockIDs(toCompact), "duration", time.Since(begin))
+	cg.reportEvent(GroupCompactEventDownloaded, toCompact, ulid.ULID{}, time.Since(begin), nil)
+	cg.addDirSizes(cg.compactionInputBytes, toCompactDirs...)
 
 	begin = time.Now()
 	compID, err = comp.Compact(dir, toCompactDirs, nil)
@@ -768,7 +1325,7 @@ func (cg *Group) compact(ctx context.Context, dir string, planner Planner, comp
 	}
 	if compID == (ulid.ULID{}) {
 		// Prometheus compactor found that the compacted block would have no samples.
-		level.Info(cg.logger).Log("msg", "compacted block would have no samples, deleting source blocks", "blocks", fmt.Sprintf("%v", toCompactDirs))
+		level.Info(cg.logger).Log("msg", "compacted block would have no samples, deleting source blocks", "blocks", blockIDs(toCompact))
 		for _, meta := range toCompact {
 			if meta.Stats.NumSamples == 0 {
 				if err := cg.deleteBlock(meta.ULID, filepath.Join(dir, meta.ULID.String())); err != nil {
@@ -784,21 +1341,36 @@ func (cg *Group) compact(ctx context.Context, dir string, planner Planner, comp
 		cg.verticalCompactions.Inc()
 	}
 	level.Info(cg.logger).Log("msg", "compacted blocks", "new", compID,
-		"blocks", fmt.Sprintf("%v", toCompactDirs), "duration", time.Since(begin), "overlapping_blocks", overlappingBlocks)
+		"blocks", blockIDs(toCompact), "duration", time.Since(begin), "overlapping_blocks", overlappingBlocks)
+	cg.reportEvent(GroupCompactEventCompacted, toCompact, compID, time.Since(begin), nil)
 
 	bdir := filepath.Join(dir, compID.String())
 	index := filepath.Join(bdir, block.IndexFilename)
 
+	var labelCardinality map[string]int64
+	if cg.gatherLabelCardinality {
+		if labelCardinality, err = block.GatherLabelCardinality(index); err != nil {
+			return false, ulid.ULID{}, errors.Wrapf(err, "gather label cardinality of %s", bdir)
+		}
+	}
+
 	newMeta, err := metadata.InjectThanos(cg.logger, bdir, metadata.Thanos{
-		Labels:       cg.labels.Map(),
-		Downsample:   metadata.ThanosDownsample{Resolution: cg.resolution},
-		Source:       metadata.CompactorSource,
-		SegmentFiles: block.GetSegmentFiles(bdir),
+		Labels:           cg.labels.Map(),
+		Downsample:       metadata.ThanosDownsample{Resolution: cg.resolution},
+		Source:           metadata.CompactorSource,
+		SegmentFiles:     block.GetSegmentFiles(bdir),
+		LabelCardinality: labelCardinality,
 	}, nil)
 	if err != nil {
 		return false, ulid.ULID{}, errors.Wrapf(err, "failed to finalize the block %s", bdir)
 	}
+	if overlappingBlocks {
+		cg.countDedupedSamples(toCompact, newMeta)
+	}
 
+	// Tombstones of the source blocks, if they were present in the bucket, are downloaded along with them and applied
+	// by the compactor, so deleted series and samples are not part of the result block. The result block always gets an
+	// empty tombstones file which is not uploaded anyway.
 	if err = os.Remove(filepath.Join(bdir, "tombstones")); err != nil {
 		return false, ulid.ULID{}, errors.Wrap(err, "remove tombstones")
 	}
@@ -818,10 +1390,12 @@ func (cg *Group) compact(ctx context.Context, dir string, planner Planner, comp
 
 	begin = time.Now()
 
-	if err := block.Upload(ctx, cg.logger, cg.bkt, bdir, cg.hashFunc); err != nil {
+	if err := cg.uploadBlock(ctx, compID, bdir); err != nil {
 		return false, ulid.ULID{}, retry(errors.Wrapf(err, "upload of %s failed", compID))
 	}
 	level.Info(cg.logger).Log("msg", "uploaded block", "result_block", compID, "duration", time.Since(begin))
+	cg.reportEvent(GroupCompactEventUploaded, toCompact, compID, time.Since(begin), nil)
+	cg.addDirSizes(cg.compactionOutputBytes, bdir)
 
 	// Mark for deletion the blocks we just compacted from the group and bucket so they do not get included
 	// into the next planning cycle.
@@ -835,13 +1409,135 @@ func (cg *Group) compact(ctx context.Context, dir string, planner Planner, comp
 	return true, compID, nil
 }
 
+// countDedupedSamples adds the number of samples dropped by the vertical compaction of the source blocks into the
+// result block to the group's metric. Samples deleted by tombstones of the source blocks are dropped too, but cannot be
+// told apart from duplicates, so compactions of such blocks are not counted.
+func (cg *Group) countDedupedSamples(sources []*metadata.Meta, result *metadata.Meta) {
+	var in uint64
+	for _, m := range sources {
+		if m.Stats.NumTombstones > 0 {
+			return
+		}
+		in += m.Stats.NumSamples
+	}
+	if in > result.Stats.NumSamples {
+		cg.verticalDedupedSamples.Add(float64(in - result.Stats.NumSamples))
+	}
+}
+
+// DefaultUploadRetryBackoff is how failed uploads of compacted blocks are retried by default.
+var DefaultUploadRetryBackoff = RetryBackoffConfig{
+	MaxRetries: 2,
+	Min:        time.Second,
+	Max:        10 * time.Second,
+	Factor:     2,
+	Jitter:     true,
+}
+
+// uploadBlock uploads the compacted block in bdir. Failed uploads are retried with the group's upload retry backoff,
+// resuming from the files which already made it to the bucket, since the compacted block directory doesn't change
+// between attempts. Once all attempts failed, or the context is done, the partially uploaded block is deleted from
+// the bucket.
+func (cg *Group) uploadBlock(ctx context.Context, id ulid.ULID, bdir string) (err error) {
+	retryBackoff := backoff.Backoff{
+		Min:    cg.uploadRetryBackoff.Min,
+		Max:    cg.uploadRetryBackoff.Max,
+		Factor: cg.uploadRetryBackoff.Factor,
+		Jitter: cg.uploadRetryBackoff.Jitter,
+	}
+	for attempt := 1; ; attempt++ {
+		if err = block.ResumeUpload(ctx, cg.logger, cg.bkt, bdir, cg.hashFunc, cg.uploadOpts...); err == nil {
+			return nil
+		}
+		if ctx.Err() != nil || attempt > cg.uploadRetryBackoff.MaxRetries {
+			break
+		}
+		d := retryBackoff.Duration()
+		level.Warn(cg.logger).Log("msg", "failed to upload compacted block, retrying", "block", id, "attempt", attempt, "backoff", d, "err", err)
+		if cg.retrySleep(ctx, d) != nil {
+			break
+		}
+	}
+
+	// Retrying the compaction produces a new block, so the partial upload would be left behind. Clean it up with an
+	// uncancelable context, as the given one might be the reason of the failure.
+	delCtx, cancel := context.WithTimeout(context.Background(), cg.deleteTimeout)
+	defer cancel()
+	if derr := block.Delete(delCtx, cg.logger, cg.bkt, id); derr != nil {
+		return errors.Wrapf(err, "failed to clean up partially uploaded block %s, partial block left in bucket: %v", id, derr)
+	}
+	return err
+}
+
+// addDirSizes adds the on-disk size of the given block directories to the counter.
+// The counters are informational only, so failures are logged and do not fail the compaction.
+func (cg *Group) addDirSizes(c prometheus.Counter, dirs ...string) {
+	var total int64
+	for _, dir := range dirs {
+		size, err := dirSize(dir)
+		if err != nil {
+			level.Warn(cg.logger).Log("msg", "failed to get size of block directory", "dir", dir, "err", err)
+			continue
+		}
+		total += size
+	}
+	c.Add(float64(total))
+}
+
+// blockIDs returns the IDs of the given blocks, so that they are logged as a list rather than a formatted string.
+func blockIDs(metas []*metadata.Meta) []string {
+	ids := make([]string, 0, len(metas))
+	for _, m := range metas {
+		ids = append(ids, m.ULID.String())
+	}
+	return ids
+}
+
+// verifiedMarkerFilename is the name of the file created in the local block directory once the downloaded
+// block passed verification. Blocks are immutable, so the result stays valid as long as the directory is kept,
+// e.g. when compaction is retried after a transient failure.
+const verifiedMarkerFilename = "thanos-compact-verified"
+
+// verifyBlock ensures that the downloaded block in bdir has a healthy index. Blocks that were already verified
+// in bdir by a previous compaction attempt are not verified again.
+func (cg *Group) verifyBlock(meta *metadata.Meta, bdir string) error {
+	marker := filepath.Join(bdir, verifiedMarkerFilename)
+	if _, err := os.Stat(marker); err == nil {
+		level.Debug(cg.logger).Log("msg", "block was already verified, skipping verification", "block", meta.ULID)
+		return nil
+	}
+
+	stats, err := block.GatherIndexHealthStats(cg.logger, filepath.Join(bdir, block.IndexFilename), meta.MinTime, meta.MaxTime, nil)
+	if err != nil {
+		return errors.Wrapf(err, "gather index issues for block %s", bdir)
+	}
+
+	if err := stats.CriticalErr(); err != nil {
+		return halt(errors.Wrapf(err, "block with not healthy index found %s; Compaction level %v; Labels: %v", bdir, meta.Compaction.Level, meta.Thanos.Labels))
+	}
+
+	if err := stats.Issue347OutsideChunksErr(); err != nil {
+		return issue347Error(errors.Wrapf(err, "invalid, but reparable block %s", bdir), meta.ULID)
+	}
+
+	if err := stats.PrometheusIssue5372Err(); !cg.acceptMalformedIndex && err != nil {
+		return errors.Wrapf(err,
+			"block id %s, try running with --debug.accept-malformed-index", meta.ULID)
+	}
+
+	if err := ioutil.WriteFile(marker, nil, 0600); err != nil {
+		level.Warn(cg.logger).Log("msg", "failed to mark block as verified", "block", meta.ULID, "err", err)
+	}
+	return nil
+}
+
 func (cg *Group) deleteBlock(id ulid.ULID, bdir string) error {
 	if err := os.RemoveAll(bdir); err != nil {
 		return errors.Wrapf(err, "remove old block dir %s", id)
 	}
 
 	// Spawn a new context so we always mark a block for deletion in full on shutdown.
-	delCtx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	delCtx, cancel := context.WithTimeout(context.Background(), cg.deleteTimeout)
 	defer cancel()
 	level.Info(cg.logger).Log("msg", "marking compacted block for deletion", "old_block", id)
 	if err := block.MarkForDeletion(delCtx, cg.logger, cg.bkt, id, "source of compacted block", cg.blocksMarkedForDeletion); err != nil {
@@ -860,6 +1556,129 @@ type BucketCompactor struct {
 	compactDir  string
 	bkt         objstore.Bucket
 	concurrency int
+	groupOrder  GroupOrder
+	reg         prometheus.Registerer
+
+	deleteTimeout time.Duration
+
+	retryBackoff RetryBackoffConfig
+	retrySleep   func(ctx context.Context, d time.Duration) error
+
+	garbageCollect bool
+
+	// maxGroupsPerRun is the maximum number of groups compacted during a single Compact call, 0 means unlimited.
+	maxGroupsPerRun int
+
+	maxCompactDirBytes int64
+	dirUsage           DirUsageFunc
+	dirUsageInterval   time.Duration
+	inflightGroups     atomic.Int64
+	compactDirBytes    prometheus.Gauge
+	dispatchPauses     prometheus.Counter
+
+	removeAll              func(path string) error
+	workDirCleanupFailures prometheus.Counter
+}
+
+// RetryBackoffConfig configures how failed operations are retried with backoff, i.e. compaction iterations of
+// BucketCompactor.Compact that failed with a RetryError only, or uploads of compacted blocks.
+type RetryBackoffConfig struct {
+	// MaxRetries is the number of consecutive failures that are retried before the error is returned.
+	// Zero disables retrying, so the error is returned right away.
+	MaxRetries int
+	// Min is the backoff before the first retry.
+	Min time.Duration
+	// Max caps the backoff between retries.
+	Max time.Duration
+	// Factor multiplies the backoff after each retry.
+	Factor float64
+	// Jitter randomizes each backoff between Min and the current backoff.
+	Jitter bool
+}
+
+// GroupOrder determines the order in which compaction groups are started.
+type GroupOrder string
+
+const (
+	// GroupOrderKey starts groups in the order returned by the grouper, which is by group key for the default grouper.
+	GroupOrderKey GroupOrder = "key"
+	// GroupOrderOldestFirst starts groups with the oldest data first, finalizing history as quickly as possible.
+	GroupOrderOldestFirst GroupOrder = "oldest-first"
+	// GroupOrderLargestFirst starts groups with the most blocks first, reducing the number of blocks as quickly as possible.
+	GroupOrderLargestFirst GroupOrder = "largest-first"
+)
+
+// sortGroups sorts groups in place according to the given order. Groups which are equal in that order keep their
+// relative order.
+func sortGroups(groups []*Group, order GroupOrder) {
+	switch order {
+	case GroupOrderOldestFirst:
+		sort.SliceStable(groups, func(i, j int) bool {
+			return groups[i].MinTime() < groups[j].MinTime()
+		})
+	case GroupOrderLargestFirst:
+		sort.SliceStable(groups, func(i, j int) bool {
+			return len(groups[i].IDs()) > len(groups[j].IDs())
+		})
+	}
+}
+
+// DirUsageFunc returns the number of bytes used by the files in the given directory.
+type DirUsageFunc func(dir string) (int64, error)
+
+// BucketCompactorOption configures optional BucketCompactor behaviour.
+type BucketCompactorOption func(c *BucketCompactor)
+
+// WithCompactorRegisterer registers the bucket compactor metrics with reg.
+func WithCompactorRegisterer(reg prometheus.Registerer) BucketCompactorOption {
+	return func(c *BucketCompactor) {
+		c.reg = reg
+	}
+}
+
+// WithMaxCompactDirBytes makes the compactor not start new compaction groups while the compaction work directory uses
+// more than maxBytes and other groups are still in progress. Zero, the default, disables the limit.
+func WithMaxCompactDirBytes(maxBytes int64) BucketCompactorOption {
+	return func(c *BucketCompactor) {
+		c.maxCompactDirBytes = maxBytes
+	}
+}
+
+// WithGroupOrder sets the order in which compaction groups are started. Defaults to GroupOrderKey.
+func WithGroupOrder(order GroupOrder) BucketCompactorOption {
+	return func(c *BucketCompactor) {
+		c.groupOrder = order
+	}
+}
+
+// WithCompactorDeleteTimeout sets the timeout for marking blocks replaced by repairs for deletion.
+// Defaults to DefaultDeleteTimeout.
+func WithCompactorDeleteTimeout(timeout time.Duration) BucketCompactorOption {
+	return func(c *BucketCompactor) {
+		c.deleteTimeout = timeout
+	}
+}
+
+// WithRetryBackoff sets how compaction iterations failed with a RetryError only are retried. By default they are not.
+func WithRetryBackoff(cfg RetryBackoffConfig) BucketCompactorOption {
+	return func(c *BucketCompactor) {
+		c.retryBackoff = cfg
+	}
+}
+
+// WithGarbageCollection sets whether blocks replaced by compacted blocks are garbage collected before each
+// compaction iteration. Enabled by default.
+func WithGarbageCollection(enabled bool) BucketCompactorOption {
+	return func(c *BucketCompactor) {
+		c.garbageCollect = enabled
+	}
+}
+
+// WithMaxGroupsPerRun limits the number of groups compacted during a single Compact call. Zero, the default, means unlimited.
+func WithMaxGroupsPerRun(n int) BucketCompactorOption {
+	return func(c *BucketCompactor) {
+		c.maxGroupsPerRun = n
+	}
 }
 
 // NewBucketCompactor creates a new bucket compactor.
@@ -872,20 +1691,213 @@ func NewBucketCompactor(
 	compactDir string,
 	bkt objstore.Bucket,
 	concurrency int,
+	opts ...BucketCompactorOption,
 ) (*BucketCompactor, error) {
 	if concurrency <= 0 {
 		return nil, errors.Errorf("invalid concurrency level (%d), concurrency level must be > 0", concurrency)
 	}
-	return &BucketCompactor{
-		logger:      logger,
-		sy:          sy,
-		grouper:     grouper,
-		planner:     planner,
-		comp:        comp,
-		compactDir:  compactDir,
-		bkt:         bkt,
-		concurrency: concurrency,
-	}, nil
+	c := &BucketCompactor{
+		logger:           logger,
+		sy:               sy,
+		grouper:          grouper,
+		planner:          planner,
+		comp:             comp,
+		compactDir:       compactDir,
+		bkt:              bkt,
+		concurrency:      concurrency,
+		groupOrder:       GroupOrderKey,
+		deleteTimeout:    DefaultDeleteTimeout,
+		retrySleep:       sleepWithContext,
+		garbageCollect:   true,
+		dirUsage:         dirSize,
+		dirUsageInterval: 10 * time.Second,
+		removeAll:        os.RemoveAll,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	switch c.groupOrder {
+	case GroupOrderKey, GroupOrderOldestFirst, GroupOrderLargestFirst:
+	default:
+		return nil, errors.Errorf("unknown compaction group order %q", c.groupOrder)
+	}
+	if c.deleteTimeout <= 0 {
+		c.deleteTimeout = DefaultDeleteTimeout
+	}
+
+	c.compactDirBytes = promauto.With(c.reg).NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_compact_dir_bytes",
+		Help: "Number of bytes used by the files in the compaction work directory.",
+	})
+	c.dispatchPauses = promauto.With(c.reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_compact_group_dispatch_pauses_total",
+		Help: "Total number of times starting new compaction groups was paused because the compaction work directory exceeded its size limit.",
+	})
+	c.workDirCleanupFailures = promauto.With(c.reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_compact_workdir_cleanup_failures_total",
+		Help: "Total number of failures to remove the compaction work directory or parts of it, which might leak disk space.",
+	})
+	return c, nil
+}
+
+// sleepWithContext waits for the given duration or until the context is done.
+func sleepWithContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// dirSize returns the total size of the regular files in dir, or 0 if dir does not exist.
+// Files and directories removed during the walk, e.g. by concurrent group workers, are skipped.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path != dir {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	return size, err
+}
+
+// updateCompactDirUsage refreshes the compaction work directory usage metric and returns the current usage.
+func (c *BucketCompactor) updateCompactDirUsage() (int64, error) {
+	size, err := c.dirUsage(c.compactDir)
+	if err != nil {
+		return 0, errors.Wrapf(err, "get disk usage of %s", c.compactDir)
+	}
+	c.compactDirBytes.Set(float64(size))
+	return size, nil
+}
+
+// compactDirFull returns true if the compaction work directory exceeds its size limit while groups are in progress.
+// Without groups in progress, usage cannot decrease by waiting, so dispatching is never held back.
+func (c *BucketCompactor) compactDirFull() bool {
+	if c.maxCompactDirBytes <= 0 || c.inflightGroups.Load() == 0 {
+		return false
+	}
+	size, err := c.updateCompactDirUsage()
+	if err != nil {
+		level.Warn(c.logger).Log("msg", "failed to check compaction work directory usage, not limiting compactions", "err", err)
+		return false
+	}
+	return size > c.maxCompactDirBytes
+}
+
+// dispatchGroups sends groups to the compaction workers in the configured group order, pausing while the compaction
+// work directory is full. It stops at the first error reported by workers or when ctx is done.
+func (c *BucketCompactor) dispatchGroups(ctx context.Context, groups []*Group, groupChan chan<- *Group, errChan <-chan error) error {
+	sortGroups(groups, c.groupOrder)
+	for _, g := range groups {
+		if c.compactDirFull() {
+			level.Info(c.logger).Log("msg", "compaction work directory exceeds size limit, waiting for running compactions before starting new ones", "limit_bytes", c.maxCompactDirBytes)
+			c.dispatchPauses.Inc()
+			for full := true; full; full = c.compactDirFull() {
+				select {
+				case groupErr := <-errChan:
+					return groupErr
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(c.dirUsageInterval):
+				}
+			}
+		}
+
+		c.inflightGroups.Inc()
+		select {
+		case groupErr := <-errChan:
+			c.inflightGroups.Dec()
+			return groupErr
+		case groupChan <- g:
+		}
+	}
+	return nil
+}
+
+// PlannedCompaction describes the next compaction planned for a compaction group.
+type PlannedCompaction struct {
+	Group      string
+	Resolution int64
+	Labels     labels.Labels
+	// Blocks are the IDs of the blocks to compact, in the order returned by the planner.
+	Blocks []ulid.ULID
+	// MinTime and MaxTime are the time range of the block resulting from the compaction.
+	MinTime int64
+	MaxTime int64
+}
+
+// Plan syncs the block metas and returns the compactions that the next pass of Compact would start with, sorted by
+// group key. Groups with nothing to compact are omitted. No block is downloaded, compacted or garbage collected.
+// Planning is only free of side effects if the compactor's planner is, so for dry runs build the planner with
+// WithLargeTotalIndexSizeDryRunFilter instead of WithLargeTotalIndexSizeFilter.
+func (c *BucketCompactor) Plan(ctx context.Context) ([]PlannedCompaction, error) {
+	if err := c.sy.SyncMetas(ctx); err != nil {
+		return nil, errors.Wrap(err, "sync")
+	}
+
+	groups, err := c.grouper.Groups(c.sy.Metas())
+	if err != nil {
+		return nil, errors.Wrap(err, "build compaction groups")
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Key() < groups[j].Key()
+	})
+
+	var plans []PlannedCompaction
+	for _, g := range groups {
+		p, ok, err := g.planCompaction(ctx, c.planner)
+		if err != nil {
+			return nil, errors.Wrapf(err, "group %s", g.Key())
+		}
+		if ok {
+			plans = append(plans, p)
+		}
+	}
+	return plans, nil
+}
+
+// planCompaction returns the next compaction planned for the group, if any.
+func (cg *Group) planCompaction(ctx context.Context, planner Planner) (PlannedCompaction, bool, error) {
+	cg.mtx.Lock()
+	defer cg.mtx.Unlock()
+
+	toCompact, _, err := cg.plan(ctx, planner)
+	if err != nil || len(toCompact) == 0 {
+		return PlannedCompaction{}, false, err
+	}
+
+	p := PlannedCompaction{
+		Group:      cg.key,
+		Resolution: cg.resolution,
+		Labels:     cg.labels,
+		MinTime:    toCompact[0].MinTime,
+		MaxTime:    toCompact[0].MaxTime,
+	}
+	for _, m := range toCompact {
+		p.Blocks = append(p.Blocks, m.ULID)
+		if m.MinTime < p.MinTime {
+			p.MinTime = m.MinTime
+		}
+		if m.MaxTime > p.MaxTime {
+			p.MaxTime = m.MaxTime
+		}
+	}
+	return p, true, nil
 }
 
 // Compact runs compaction over bucket.
@@ -897,11 +1909,41 @@ func (c *BucketCompactor) Compact(ctx context.Context) (rerr error) {
 		if rerr != nil {
 			return
 		}
-		if err := os.RemoveAll(c.compactDir); err != nil {
+		if err := c.removeAll(c.compactDir); err != nil {
+			c.workDirCleanupFailures.Inc()
 			level.Error(c.logger).Log("msg", "failed to remove compaction work directory", "path", c.compactDir, "err", err)
 		}
 	}()
 
+	// Repairs interrupted in a previous run might have left their work directories behind.
+	if err := removeStaleRepairDirs(c.compactDir); err != nil {
+		c.workDirCleanupFailures.Inc()
+		level.Warn(c.logger).Log("msg", "failed to remove stale repair directories, some disk space usage might have leaked. Continuing", "err", err, "dir", c.compactDir)
+	}
+
+	// Keep the compaction work directory usage metric up to date while compacting.
+	monitorCtx, monitorCancel := context.WithCancel(ctx)
+	defer monitorCancel()
+	go func() {
+		_ = runutil.Repeat(c.dirUsageInterval, monitorCtx.Done(), func() error {
+			if _, err := c.updateCompactDirUsage(); err != nil {
+				level.Warn(c.logger).Log("msg", "failed to update compaction work directory usage", "err", err)
+			}
+			return nil
+		})
+	}()
+
+	retryBackoff := backoff.Backoff{
+		Min:    c.retryBackoff.Min,
+		Max:    c.retryBackoff.Max,
+		Factor: c.retryBackoff.Factor,
+		Jitter: c.retryBackoff.Jitter,
+	}
+	retries := 0
+
+	// compactedGroups counts groups which compacted blocks during this call, including the ones still running.
+	compactedGroups := 0
+
 	// Loop over bucket and compact until there's no work left.
 	for {
 		var (
@@ -921,18 +1963,34 @@ func (c *BucketCompactor) Compact(ctx context.Context) (rerr error) {
 			go func() {
 				defer wg.Done()
 				for g := range groupChan {
+					mtx.Lock()
+					if c.maxGroupsPerRun > 0 && compactedGroups >= c.maxGroupsPerRun {
+						// Another group might turn out to have nothing to compact, so revisit this one
+						// in the next iteration if the limit is not reached by then.
+						finishedAllGroups = false
+						mtx.Unlock()
+						c.inflightGroups.Dec()
+						continue
+					}
+					compactedGroups++
+					mtx.Unlock()
+
 					shouldRerunGroup, _, err := g.Compact(workCtx, c.compactDir, c.planner, c.comp)
+					c.inflightGroups.Dec()
 					if err == nil {
+						mtx.Lock()
 						if shouldRerunGroup {
-							mtx.Lock()
 							finishedAllGroups = false
-							mtx.Unlock()
+						} else {
+							// Nothing was compacted, so the group does not count against the limit.
+							compactedGroups--
 						}
+						mtx.Unlock()
 						continue
 					}
 
 					if IsIssue347Error(err) {
-						if err := RepairIssue347(workCtx, c.logger, c.bkt, c.sy.metrics.blocksMarkedForDeletion, err); err == nil {
+						if err := RepairIssue347(workCtx, c.logger, c.bkt, c.sy.metrics.blocksMarkedForDeletion, c.compactDir, err, c.deleteTimeout); err == nil {
 							mtx.Lock()
 							finishedAllGroups = false
 							mtx.Unlock()
@@ -950,11 +2008,15 @@ func (c *BucketCompactor) Compact(ctx context.Context) (rerr error) {
 			return errors.Wrap(err, "sync")
 		}
 
-		level.Info(c.logger).Log("msg", "start of GC")
 		// Blocks that were compacted are garbage collected after each Compaction.
 		// However if compactor crashes we need to resolve those on startup.
-		if err := c.sy.GarbageCollect(ctx); err != nil {
-			return errors.Wrap(err, "garbage")
+		// Duplicates are still filtered out of the compaction groups when garbage collection is disabled,
+		// they are just not marked for deletion.
+		if c.garbageCollect {
+			level.Info(c.logger).Log("msg", "start of GC")
+			if err := c.sy.GarbageCollect(ctx); err != nil {
+				return errors.Wrap(err, "garbage")
+			}
 		}
 
 		groups, err := c.grouper.Groups(c.sy.Metas())
@@ -970,6 +2032,7 @@ func (c *BucketCompactor) Compact(ctx context.Context) (rerr error) {
 		}
 
 		if err := runutil.DeleteAll(c.compactDir, ignoreDirs...); err != nil {
+			c.workDirCleanupFailures.Inc()
 			level.Warn(c.logger).Log("msg", "failed deleting non-compaction group directories/files, some disk space usage might have leaked. Continuing", "err", err, "dir", c.compactDir)
 		}
 
@@ -977,15 +2040,7 @@ func (c *BucketCompactor) Compact(ctx context.Context) (rerr error) {
 
 		// Send all groups found during this pass to the compaction workers.
 		var groupErrs errutil.MultiError
-	groupLoop:
-		for _, g := range groups {
-			select {
-			case groupErr := <-errChan:
-				groupErrs.Add(groupErr)
-				break groupLoop
-			case groupChan <- g:
-			}
-		}
+		groupErrs.Add(c.dispatchGroups(workCtx, groups, groupChan, errChan))
 		close(groupChan)
 		wg.Wait()
 
@@ -998,9 +2053,26 @@ func (c *BucketCompactor) Compact(ctx context.Context) (rerr error) {
 
 		workCtxCancel()
 		if len(groupErrs) > 0 {
-			return groupErrs.Err()
+			err := groupErrs.Err()
+			// Only retry iterations in which all errors are retriable, so halt errors are returned as before.
+			if !IsRetryError(err) || retries >= c.retryBackoff.MaxRetries {
+				return err
+			}
+			retries++
+			d := retryBackoff.Duration()
+			level.Warn(c.logger).Log("msg", "retriable error during compaction, retrying", "err", err, "retry", retries, "backoff", d)
+			if serr := c.retrySleep(ctx, d); serr != nil {
+				return errors.Wrap(serr, "wait for compaction retry")
+			}
+			continue
 		}
+		retries = 0
+		retryBackoff.Reset()
 
+		if c.maxGroupsPerRun > 0 && compactedGroups >= c.maxGroupsPerRun {
+			level.Info(c.logger).Log("msg", "compacted maximum number of groups for this run, leaving remaining work for the next one", "limit", c.maxGroupsPerRun)
+			break
+		}
 		if finishedAllGroups {
 			break
 		}
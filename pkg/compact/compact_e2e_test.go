@@ -8,11 +8,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -149,6 +152,169 @@ func TestSyncer_GarbageCollect_e2e(t *testing.T) {
 	})
 }
 
+func TestSyncer_Denylist_e2e(t *testing.T) {
+	objtesting.ForeachStore(t, func(t *testing.T, bkt objstore.Bucket) {
+		ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+		defer cancel()
+
+		newMeta := func(id uint64, level int, sources ...ulid.ULID) *metadata.Meta {
+			var m metadata.Meta
+			m.Version = 1
+			m.ULID = ulid.MustNew(id, nil)
+			m.Compaction.Level = level
+			m.Compaction.Sources = sources
+			if len(sources) == 0 {
+				m.Compaction.Sources = []ulid.ULID{m.ULID}
+			}
+			return &m
+		}
+		a := newMeta(1, 1)
+		b := newMeta(2, 1)
+		c := newMeta(3, 2, a.ULID, b.ULID) // Makes a and b duplicates.
+		d := newMeta(4, 1)
+
+		for _, m := range []*metadata.Meta{a, b, c, d} {
+			var buf bytes.Buffer
+			testutil.Ok(t, json.NewEncoder(&buf).Encode(m))
+			testutil.Ok(t, bkt.Upload(ctx, path.Join(m.ULID.String(), metadata.MetaFilename), &buf))
+		}
+		// Partial uploads, missing meta.json.
+		e := ulid.MustNew(5, nil)
+		f := ulid.MustNew(6, nil)
+		for _, id := range []ulid.ULID{e, f} {
+			testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), block.IndexFilename), bytes.NewReader([]byte("index"))))
+		}
+
+		duplicateBlocksFilter := block.NewDeduplicateFilter()
+		metaFetcher, err := block.NewMetaFetcher(nil, 32, objstore.WithNoopInstr(bkt), "", nil, []block.MetadataFilter{
+			duplicateBlocksFilter,
+		}, nil)
+		testutil.Ok(t, err)
+
+		blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+		garbageCollectedBlocks := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+		ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(nil, nil, 48*time.Hour, fetcherConcurrency)
+		sy, err := NewMetaSyncer(nil, nil, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, garbageCollectedBlocks, 1, WithDenylist(a.ULID, d.ULID, e))
+		testutil.Ok(t, err)
+
+		testutil.Ok(t, sy.SyncMetas(ctx))
+
+		// Denylisted partial blocks are not subject to partial upload cleanup.
+		partial := sy.Partial()
+		testutil.Equals(t, 1, len(partial))
+		_, ok := partial[f]
+		testutil.Assert(t, ok, "expected non-denylisted partial block %s, got %v", f, partial)
+		testutil.Ok(t, sy.GarbageCollect(ctx))
+
+		// Only the non-denylisted duplicate is garbage collected.
+		testutil.Equals(t, 1.0, promtest.ToFloat64(garbageCollectedBlocks))
+		for _, m := range []*metadata.Meta{a, b, c, d} {
+			marked, err := bkt.Exists(ctx, path.Join(m.ULID.String(), metadata.DeletionMarkFilename))
+			testutil.Ok(t, err)
+			testutil.Equals(t, m.ULID == b.ULID, marked)
+		}
+
+		// Denylisted blocks are never grouped, thus never planned.
+		grouper := NewDefaultGrouper(nil, bkt, false, false, nil, blocksMarkedForDeletion, garbageCollectedBlocks, metadata.NoneFunc)
+		groups, err := grouper.Groups(sy.Metas())
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(groups))
+		testutil.Equals(t, []ulid.ULID{c.ULID}, groups[0].IDs())
+	})
+}
+
+// inFlightMarkBucket tracks the maximum number of deletion marks being uploaded at the same time.
+type inFlightMarkBucket struct {
+	objstore.Bucket
+
+	mtx      sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (b *inFlightMarkBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if !strings.HasSuffix(name, metadata.DeletionMarkFilename) {
+		return b.Bucket.Upload(ctx, name, r)
+	}
+
+	b.mtx.Lock()
+	b.inFlight++
+	if b.inFlight > b.max {
+		b.max = b.inFlight
+	}
+	b.mtx.Unlock()
+
+	defer func() {
+		b.mtx.Lock()
+		b.inFlight--
+		b.mtx.Unlock()
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func TestSyncer_GarbageCollect_Concurrency(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := &inFlightMarkBucket{Bucket: objstore.NewInMemBucket()}
+
+	// Generate 6 source blocks, all covered by a single level 2 block.
+	var sources []ulid.ULID
+	for i := 0; i < 6; i++ {
+		var m metadata.Meta
+		m.Version = 1
+		m.ULID = ulid.MustNew(uint64(i), nil)
+		m.Compaction.Level = 1
+		m.Compaction.Sources = []ulid.ULID{m.ULID}
+
+		var buf bytes.Buffer
+		testutil.Ok(t, json.NewEncoder(&buf).Encode(&m))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(m.ULID.String(), metadata.MetaFilename), &buf))
+		sources = append(sources, m.ULID)
+	}
+	var compacted metadata.Meta
+	compacted.Version = 1
+	compacted.ULID = ulid.MustNew(100, nil)
+	compacted.Compaction.Level = 2
+	compacted.Compaction.Sources = sources
+
+	var buf bytes.Buffer
+	testutil.Ok(t, json.NewEncoder(&buf).Encode(&compacted))
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(compacted.ULID.String(), metadata.MetaFilename), &buf))
+
+	duplicateBlocksFilter := block.NewDeduplicateFilter()
+	metaFetcher, err := block.NewMetaFetcher(nil, 32, objstore.WithNoopInstr(bkt), "", nil, []block.MetadataFilter{
+		duplicateBlocksFilter,
+	}, nil)
+	testutil.Ok(t, err)
+
+	blocksMarkedForDeletion := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	garbageCollectedBlocks := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(nil, nil, 48*time.Hour, fetcherConcurrency)
+	sy, err := NewMetaSyncer(nil, nil, bkt, metaFetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, blocksMarkedForDeletion, garbageCollectedBlocks, 1, WithGarbageCollectionConcurrency(3))
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, sy.SyncMetas(ctx))
+	testutil.Ok(t, sy.GarbageCollect(ctx))
+
+	testutil.Equals(t, 6.0, promtest.ToFloat64(garbageCollectedBlocks))
+	testutil.Equals(t, 6.0, promtest.ToFloat64(blocksMarkedForDeletion))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(sy.metrics.garbageCollectionFailures))
+	for _, id := range sources {
+		marked, err := bkt.Exists(ctx, path.Join(id.String(), metadata.DeletionMarkFilename))
+		testutil.Ok(t, err)
+		testutil.Assert(t, marked, "block %s should be marked for deletion", id)
+	}
+	testutil.Assert(t, bkt.max > 1 && bkt.max <= 3, "expected between 2 and 3 concurrent deletion marks, got %d", bkt.max)
+
+	// Marked blocks are removed from the in-memory state right away.
+	testutil.Equals(t, 1, len(sy.Metas()))
+	_, ok := sy.Metas()[compacted.ULID]
+	testutil.Assert(t, ok, "compacted block should remain synced")
+}
+
 func MetricCount(c prometheus.Collector) int {
 	var (
 		mCount int
@@ -211,8 +377,8 @@ func testGroupCompactE2e(t *testing.T, mergeFunc storage.VerticalChunkSeriesMerg
 
 		planner := NewTSDBBasedPlanner(logger, []int64{1000, 3000})
 
-		grouper := NewDefaultGrouper(logger, bkt, false, false, reg, blocksMarkedForDeletion, garbageCollectedBlocks, metadata.NoneFunc)
-		bComp, err := NewBucketCompactor(logger, sy, grouper, planner, comp, dir, bkt, 2)
+		grouper := NewDefaultGrouper(logger, bkt, false, false, reg, blocksMarkedForDeletion, garbageCollectedBlocks, metadata.NoneFunc, WithLabelCardinality())
+		bComp, err := NewBucketCompactor(logger, sy, grouper, planner, comp, dir, bkt, 2, WithCompactorRegisterer(reg))
 		testutil.Ok(t, err)
 
 		// Compaction on empty should not fail.
@@ -385,6 +551,7 @@ func testGroupCompactE2e(t *testing.T, mergeFunc storage.VerticalChunkSeriesMerg
 			testutil.Assert(t, labels.Equal(extLabels, labels.FromMap(meta.Thanos.Labels)), "ext labels does not match")
 			testutil.Equals(t, int64(124), meta.Thanos.Downsample.Resolution)
 			testutil.Assert(t, len(meta.Thanos.SegmentFiles) > 0, "compacted blocks have segment files set")
+			testutil.Equals(t, map[string]int64{"a": 6, "b": 1}, meta.Thanos.LabelCardinality)
 		}
 		{
 			meta, ok := others[defaultGroupKey(124, extLabels2)]
@@ -401,6 +568,7 @@ func testGroupCompactE2e(t *testing.T, mergeFunc storage.VerticalChunkSeriesMerg
 			testutil.Assert(t, labels.Equal(extLabels2, labels.FromMap(meta.Thanos.Labels)), "ext labels does not match")
 			testutil.Equals(t, int64(124), meta.Thanos.Downsample.Resolution)
 			testutil.Assert(t, len(meta.Thanos.SegmentFiles) > 0, "compacted blocks have segment files set")
+			testutil.Equals(t, map[string]int64{"a": 5, "b": 1}, meta.Thanos.LabelCardinality)
 		}
 	})
 }
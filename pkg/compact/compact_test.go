@@ -4,14 +4,39 @@
 package compact
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/tsdb"
+	"go.uber.org/atomic"
 
+	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
 	"github.com/thanos-io/thanos/pkg/errutil"
+	"github.com/thanos-io/thanos/pkg/extprom"
+	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
 )
 
 func TestHaltError(t *testing.T) {
@@ -125,3 +150,1627 @@ func TestGroupMaxMinTime(t *testing.T) {
 	testutil.Equals(t, int64(0), g.MinTime())
 	testutil.Equals(t, int64(30), g.MaxTime())
 }
+
+func TestRemoveStaleRepairDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-repair-dirs")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	stale := filepath.Join(dir, repairDirPrefix+ulid.MustNew(1, nil).String())
+	testutil.Ok(t, os.MkdirAll(filepath.Join(stale, ulid.MustNew(1, nil).String()), 0750))
+	groupDir := filepath.Join(dir, "0@17241709254077376921")
+	testutil.Ok(t, os.MkdirAll(groupDir, 0750))
+
+	testutil.Ok(t, removeStaleRepairDirs(dir))
+
+	_, err = os.Stat(stale)
+	testutil.Assert(t, os.IsNotExist(err), "stale repair dir %s should be removed", stale)
+	_, err = os.Stat(groupDir)
+	testutil.Ok(t, err)
+
+	// Missing work directory is not an error.
+	testutil.Ok(t, removeStaleRepairDirs(filepath.Join(dir, "not-existing")))
+}
+
+func TestGroupVerifyBlock_SkipsAlreadyVerified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-verify-block")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	id, err := e2eutil.CreateBlock(context.Background(), dir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+		{{Name: "a", Value: "2"}},
+	}, 100, 0, 1000, labels.Labels{{Name: "e1", Value: "1"}}, 0, metadata.NoneFunc)
+	testutil.Ok(t, err)
+
+	bdir := filepath.Join(dir, id.String())
+	meta, err := metadata.ReadFromDir(bdir)
+	testutil.Ok(t, err)
+
+	g := &Group{logger: log.NewNopLogger()}
+	testutil.Ok(t, g.verifyBlock(meta, bdir))
+	_, err = os.Stat(filepath.Join(bdir, verifiedMarkerFilename))
+	testutil.Ok(t, err)
+
+	// Second attempt must not touch the index again, so it succeeds even without one.
+	testutil.Ok(t, os.Remove(filepath.Join(bdir, block.IndexFilename)))
+	testutil.Ok(t, g.verifyBlock(meta, bdir))
+
+	// Without the marker the block is verified again.
+	testutil.Ok(t, os.Remove(filepath.Join(bdir, verifiedMarkerFilename)))
+	testutil.NotOk(t, g.verifyBlock(meta, bdir))
+}
+
+type staticFetcher map[ulid.ULID]*metadata.Meta
+
+func (f staticFetcher) Fetch(context.Context) (map[ulid.ULID]*metadata.Meta, map[ulid.ULID]error, error) {
+	metas := make(map[ulid.ULID]*metadata.Meta, len(f))
+	for id, m := range f {
+		metas[id] = m
+	}
+	return metas, nil, nil
+}
+
+func (f staticFetcher) UpdateOnChange(func([]metadata.Meta, error)) {}
+
+type filterFunc func(metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) error
+
+func (f filterFunc) Filter(_ context.Context, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) error {
+	return f(metas, synced)
+}
+
+func TestSyncer_FiltersOrder(t *testing.T) {
+	var (
+		downsampledID = ulid.MustNew(1, nil)
+		rawID1        = ulid.MustNew(2, nil)
+		rawID2        = ulid.MustNew(3, nil)
+		calls         []string
+	)
+	fetcher := staticFetcher{
+		downsampledID: {BlockMeta: tsdb.BlockMeta{ULID: downsampledID}, Thanos: metadata.Thanos{Downsample: metadata.ThanosDownsample{Resolution: 300000}}},
+		rawID1:        {BlockMeta: tsdb.BlockMeta{ULID: rawID1}},
+		rawID2:        {BlockMeta: tsdb.BlockMeta{ULID: rawID2}},
+	}
+
+	dropDownsampled := filterFunc(func(metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) error {
+		calls = append(calls, "drop-downsampled")
+		for id, m := range metas {
+			if m.Thanos.Downsample.Resolution != 0 {
+				synced.WithLabelValues("downsampled").Inc()
+				delete(metas, id)
+			}
+		}
+		return nil
+	})
+	// Keeps only the block with the lowest ULID, so the result depends on what previous filters left.
+	keepOldest := filterFunc(func(metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) error {
+		calls = append(calls, "keep-oldest")
+		var oldest ulid.ULID
+		for id := range metas {
+			if oldest == (ulid.ULID{}) || id.Compare(oldest) < 0 {
+				oldest = id
+			}
+		}
+		for id := range metas {
+			if id != oldest {
+				synced.WithLabelValues("not-oldest").Inc()
+				delete(metas, id)
+			}
+		}
+		return nil
+	})
+
+	counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	sy, err := NewMetaSyncer(nil, nil, nil, fetcher, nil, nil, counter, counter, 1, WithSyncerFilters(dropDownsampled, keepOldest))
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, sy.SyncMetas(context.Background()))
+	testutil.Equals(t, []string{"drop-downsampled", "keep-oldest"}, calls)
+	testutil.Equals(t, map[ulid.ULID]*metadata.Meta{rawID1: fetcher[rawID1]}, sy.Metas())
+	testutil.Equals(t, 1.0, promtest.ToFloat64(sy.metrics.filtered.WithLabelValues("downsampled")))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(sy.metrics.filtered.WithLabelValues("not-oldest")))
+
+	// Filters are applied on a fresh copy on every sync, in the same order.
+	testutil.Ok(t, sy.SyncMetas(context.Background()))
+	testutil.Equals(t, []string{"drop-downsampled", "keep-oldest", "drop-downsampled", "keep-oldest"}, calls)
+	testutil.Equals(t, map[ulid.ULID]*metadata.Meta{rawID1: fetcher[rawID1]}, sy.Metas())
+	testutil.Equals(t, 3, len(fetcher))
+}
+
+type errPlanner struct{ err error }
+
+func (p errPlanner) Plan(context.Context, []*metadata.Meta) ([]*metadata.Meta, error) {
+	return nil, p.err
+}
+
+func TestGroupCompact_LastSuccessfulRunTimestamp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-last-successful-run")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	grouper := NewDefaultGrouper(nil, nil, false, false, nil, counter, counter, metadata.NoneFunc)
+	groups, err := grouper.Groups(map[ulid.ULID]*metadata.Meta{
+		ulid.MustNew(1, nil): {BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(1, nil), MinTime: 0, MaxTime: 20}},
+	})
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(groups))
+	g := groups[0]
+	gauge := grouper.lastSuccessfulRun.WithLabelValues(g.Key())
+	testutil.Equals(t, 0.0, promtest.ToFloat64(gauge))
+
+	// Successful run, even without anything to compact, updates the timestamp.
+	before := float64(time.Now().UnixNano()) / 1e9
+	_, _, err = g.Compact(context.Background(), dir, staticPlanner(nil), nil)
+	testutil.Ok(t, err)
+	lastRun := promtest.ToFloat64(gauge)
+	testutil.Assert(t, lastRun >= before, "expected timestamp %v to be not older than %v", lastRun, before)
+
+	// Failed run leaves the timestamp unchanged.
+	_, _, err = g.Compact(context.Background(), dir, errPlanner{err: errors.New("planning failed")}, nil)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, lastRun, promtest.ToFloat64(gauge))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(grouper.compactionFailures.WithLabelValues(g.Key())))
+}
+
+func TestGroupCompact_EventCallback_Planned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-planned-event")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	var (
+		id1 = ulid.MustNew(1, nil)
+		id2 = ulid.MustNew(2, nil)
+		id3 = ulid.MustNew(3, nil)
+	)
+	newMeta := func(id ulid.ULID, mint, maxt int64, sizes ...int64) *metadata.Meta {
+		m := &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{ULID: id, MinTime: mint, MaxTime: maxt},
+			Thanos: metadata.Thanos{
+				Labels:     map[string]string{"a": "1"},
+				Downsample: metadata.ThanosDownsample{Resolution: 300000},
+			},
+		}
+		for _, s := range sizes {
+			m.Thanos.Files = append(m.Thanos.Files, metadata.File{SizeBytes: s})
+		}
+		return m
+	}
+	metas := map[ulid.ULID]*metadata.Meta{
+		id1: newMeta(id1, 0, 20, 100, 20),
+		id2: newMeta(id2, 20, 40, 200),
+		id3: newMeta(id3, 40, 60, 400),
+	}
+
+	var events []GroupCompactEvent
+	counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	grouper := NewDefaultGrouper(nil, objstore.NewInMemBucket(), false, false, nil, counter, counter, metadata.NoneFunc, WithEventCallback(func(e GroupCompactEvent) {
+		e.Duration = 0
+		events = append(events, e)
+	}))
+	groups, err := grouper.Groups(metas)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(groups))
+	g := groups[0]
+
+	// Planned event is reported before downloading, so it is seen even though blocks are missing in the bucket,
+	// which fails the compaction.
+	_, _, err = g.Compact(context.Background(), dir, staticPlanner{metas[id1], metas[id2]}, nil)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 2, len(events))
+	testutil.Equals(t, err, events[1].Err)
+	events[1].Err = nil
+	testutil.Equals(t, []GroupCompactEvent{{
+		Type:               GroupCompactEventPlanned,
+		GroupKey:           g.Key(),
+		Resolution:         300000,
+		Blocks:             []ulid.ULID{id1, id2},
+		EstimatedSizeBytes: 320,
+	}, {
+		Type:               GroupCompactEventFailed,
+		GroupKey:           g.Key(),
+		Resolution:         300000,
+		Blocks:             []ulid.ULID{id1, id2},
+		EstimatedSizeBytes: 320,
+	}}, events)
+
+	// Nothing planned, nothing reported.
+	_, _, err = g.Compact(context.Background(), dir, staticPlanner(nil), nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(events))
+
+	// Nil callback is allowed.
+	grouper = NewDefaultGrouper(nil, objstore.NewInMemBucket(), false, false, nil, counter, counter, metadata.NoneFunc)
+	groups, err = grouper.Groups(metas)
+	testutil.Ok(t, err)
+	_, _, err = groups[0].Compact(context.Background(), dir, staticPlanner{metas[id1], metas[id2]}, nil)
+	testutil.NotOk(t, err)
+}
+
+func TestGroupCompact_LogsBlockIDsAsList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-structured-logs")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	var (
+		id1 = ulid.MustNew(1, nil)
+		id2 = ulid.MustNew(2, nil)
+	)
+	metas := map[ulid.ULID]*metadata.Meta{
+		id1: {BlockMeta: tsdb.BlockMeta{ULID: id1, MinTime: 0, MaxTime: 20}},
+		id2: {BlockMeta: tsdb.BlockMeta{ULID: id2, MinTime: 20, MaxTime: 40}},
+	}
+
+	var buf bytes.Buffer
+	counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	grouper := NewDefaultGrouper(log.NewJSONLogger(&buf), objstore.NewInMemBucket(), false, false, nil, counter, counter, metadata.NoneFunc)
+	groups, err := grouper.Groups(metas)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(groups))
+
+	// Blocks are missing in the bucket, so compaction fails after planning.
+	_, _, err = groups[0].Compact(context.Background(), dir, staticPlanner{metas[id1], metas[id2]}, nil)
+	testutil.NotOk(t, err)
+
+	var planned map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		testutil.Ok(t, json.Unmarshal([]byte(line), &entry))
+		if entry["msg"] == "compaction available and planned; downloading blocks" {
+			planned = entry
+		}
+	}
+	testutil.Assert(t, planned != nil, "planning not logged: %s", buf.String())
+	testutil.Equals(t, []interface{}{id1.String(), id2.String()}, planned["plan"])
+	testutil.Equals(t, groups[0].Key(), planned["groupKey"])
+}
+
+func TestGroupCompact_HaltsOnPlannedBlockWithMismatchedLabels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-mismatched-labels")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	var (
+		id1  = ulid.MustNew(1, nil)
+		id2  = ulid.MustNew(2, nil)
+		lset = map[string]string{"a": "1"}
+	)
+	metas := map[ulid.ULID]*metadata.Meta{
+		id1: {BlockMeta: tsdb.BlockMeta{ULID: id1, MinTime: 0, MaxTime: 20}, Thanos: metadata.Thanos{Labels: lset}},
+		id2: {BlockMeta: tsdb.BlockMeta{ULID: id2, MinTime: 20, MaxTime: 40}, Thanos: metadata.Thanos{Labels: lset}},
+	}
+
+	counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	grouper := NewDefaultGrouper(log.NewNopLogger(), objstore.NewInMemBucket(), false, false, nil, counter, counter, metadata.NoneFunc)
+	groups, err := grouper.Groups(metas)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(groups))
+
+	// Labels of a block are changed after it was added to the group, so it keeps the group's key.
+	metas[id2].Thanos.Labels = map[string]string{"a": "2"}
+
+	_, _, err = groups[0].Compact(context.Background(), dir, staticPlanner{metas[id1], metas[id2]}, nil)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, IsHaltError(err), "expected halt error, got %v", err)
+}
+
+func TestDirSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-compact-dir-size")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	size, err := dirSize(filepath.Join(dir, "missing"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(0), size)
+
+	const n = 500
+	for i := 0; i < n; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("group-%d", i%10))
+		testutil.Ok(t, os.MkdirAll(sub, os.ModePerm))
+		testutil.Ok(t, ioutil.WriteFile(filepath.Join(sub, fmt.Sprintf("file-%d", i)), []byte("abcd"), os.ModePerm))
+	}
+	size, err = dirSize(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(4*n), size)
+
+	// Files removed by other workers while walking are skipped instead of failing or zeroing the whole walk.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			_ = os.RemoveAll(filepath.Join(dir, fmt.Sprintf("group-%d", i)))
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			size, err = dirSize(dir)
+			testutil.Ok(t, err)
+			testutil.Equals(t, int64(0), size)
+			return
+		default:
+		}
+		_, err := dirSize(dir)
+		testutil.Ok(t, err)
+	}
+}
+
+func TestBucketCompactor_DispatchPausesAboveCompactDirLimit(t *testing.T) {
+	c, err := NewBucketCompactor(log.NewNopLogger(), nil, nil, nil, nil, "", nil, 2, WithMaxCompactDirBytes(100))
+	testutil.Ok(t, err)
+
+	usage := atomic.NewInt64(200)
+	c.dirUsage = func(string) (int64, error) { return usage.Load(), nil }
+	c.dirUsageInterval = 10 * time.Millisecond
+
+	var (
+		g1, g2    = &Group{key: "g1"}, &Group{key: "g2"}
+		groupChan = make(chan *Group)
+		errChan   = make(chan error, 1)
+		done      = make(chan error, 1)
+	)
+	go func() { done <- c.dispatchGroups(context.Background(), []*Group{g1, g2}, groupChan, errChan) }()
+
+	// Nothing is in progress, so the first group is dispatched despite the limit being exceeded.
+	testutil.Equals(t, g1, <-groupChan)
+
+	// The second one waits for the usage to go below the limit while the first one is in progress.
+	select {
+	case <-groupChan:
+		t.Fatal("group dispatched while compaction work directory exceeds its limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+	testutil.Equals(t, 200.0, promtest.ToFloat64(c.compactDirBytes))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(c.dispatchPauses))
+
+	usage.Store(50)
+	testutil.Equals(t, g2, <-groupChan)
+	testutil.Ok(t, <-done)
+	testutil.Equals(t, 50.0, promtest.ToFloat64(c.compactDirBytes))
+	testutil.Equals(t, int64(2), c.inflightGroups.Load())
+}
+
+func TestBucketCompactor_DispatchesGroupsInConfiguredOrder(t *testing.T) {
+	newGroup := func(key string, minTimes ...int64) *Group {
+		g := &Group{key: key}
+		for _, mint := range minTimes {
+			g.metasByMinTime = append(g.metasByMinTime, &metadata.Meta{BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(uint64(mint), nil), MinTime: mint, MaxTime: mint + 10}})
+		}
+		return g
+	}
+
+	for _, tc := range []struct {
+		order    GroupOrder
+		expected []string
+	}{
+		{order: GroupOrderKey, expected: []string{"a", "b", "c", "d"}},
+		{order: GroupOrderOldestFirst, expected: []string{"c", "a", "d", "b"}},
+		{order: GroupOrderLargestFirst, expected: []string{"b", "d", "a", "c"}},
+	} {
+		t.Run(string(tc.order), func(t *testing.T) {
+			c, err := NewBucketCompactor(log.NewNopLogger(), nil, nil, nil, nil, "", nil, 1, WithGroupOrder(tc.order))
+			testutil.Ok(t, err)
+
+			groups := []*Group{
+				newGroup("a", 20, 30),
+				newGroup("b", 40, 50, 60, 70),
+				newGroup("c", 10),
+				newGroup("d", 20, 30, 40),
+			}
+			groupChan := make(chan *Group, len(groups))
+			testutil.Ok(t, c.dispatchGroups(context.Background(), groups, groupChan, make(chan error)))
+			close(groupChan)
+
+			var dispatched []string
+			for g := range groupChan {
+				dispatched = append(dispatched, g.Key())
+			}
+			testutil.Equals(t, tc.expected, dispatched)
+		})
+	}
+
+	_, err := NewBucketCompactor(log.NewNopLogger(), nil, nil, nil, nil, "", nil, 1, WithGroupOrder("newest-first"))
+	testutil.NotOk(t, err)
+}
+
+// deadlineBucket records the time left until the context deadline of every upload.
+type deadlineBucket struct {
+	objstore.Bucket
+
+	mtx       sync.Mutex
+	remaining []time.Duration
+}
+
+func (b *deadlineBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return errors.Errorf("upload of %s has no deadline", name)
+	}
+	b.mtx.Lock()
+	b.remaining = append(b.remaining, time.Until(deadline))
+	b.mtx.Unlock()
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func (b *deadlineBucket) assertRemaining(t *testing.T, expectedUploads int, timeout time.Duration) {
+	t.Helper()
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	testutil.Equals(t, expectedUploads, len(b.remaining))
+	for _, r := range b.remaining {
+		testutil.Assert(t, r <= timeout && r > timeout-time.Minute, "expected deletion deadline of about %v, got %v", timeout, r)
+	}
+}
+
+func TestDeleteTimeout(t *testing.T) {
+	const deleteTimeout = 3 * time.Hour
+	counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+
+	t.Run("garbage collection", func(t *testing.T) {
+		bkt := &deadlineBucket{Bucket: objstore.NewInMemBucket()}
+		var (
+			sourceID    = ulid.MustNew(1, nil)
+			compactedID = ulid.MustNew(2, nil)
+		)
+		fetcher := staticFetcher{
+			sourceID: {BlockMeta: tsdb.BlockMeta{ULID: sourceID, Compaction: tsdb.BlockMetaCompaction{Level: 1, Sources: []ulid.ULID{sourceID}}}},
+			compactedID: {BlockMeta: tsdb.BlockMeta{ULID: compactedID, Compaction: tsdb.BlockMetaCompaction{
+				Level: 2, Sources: []ulid.ULID{sourceID, ulid.MustNew(3, nil)},
+			}}},
+		}
+		duplicateBlocksFilter := block.NewDeduplicateFilter()
+		ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(nil, objstore.WithNoopInstr(bkt), 0, 1)
+		sy, err := NewMetaSyncer(nil, nil, bkt, fetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, counter, counter, 1, WithSyncerFilters(duplicateBlocksFilter), WithSyncerDeleteTimeout(deleteTimeout))
+		testutil.Ok(t, err)
+
+		testutil.Ok(t, sy.SyncMetas(context.Background()))
+		testutil.Ok(t, sy.GarbageCollect(context.Background()))
+		bkt.assertRemaining(t, 1, deleteTimeout)
+	})
+	t.Run("compacted block deletion", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "test-delete-timeout")
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+		bkt := &deadlineBucket{Bucket: objstore.NewInMemBucket()}
+		id := ulid.MustNew(1, nil)
+		grouper := NewDefaultGrouper(nil, bkt, false, false, nil, counter, counter, metadata.NoneFunc, WithGroupDeleteTimeout(deleteTimeout))
+		groups, err := grouper.Groups(map[ulid.ULID]*metadata.Meta{id: {BlockMeta: tsdb.BlockMeta{ULID: id}}})
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(groups))
+
+		testutil.Ok(t, groups[0].deleteBlock(id, filepath.Join(dir, id.String())))
+		bkt.assertRemaining(t, 1, deleteTimeout)
+	})
+	t.Run("default", func(t *testing.T) {
+		g, err := NewGroup(nil, nil, "", nil, 0, false, false, counter, counter, counter, counter, counter, counter, counter, metadata.NoneFunc)
+		testutil.Ok(t, err)
+		testutil.Equals(t, DefaultDeleteTimeout, g.deleteTimeout)
+
+		c, err := NewBucketCompactor(log.NewNopLogger(), nil, nil, nil, nil, "", nil, 1)
+		testutil.Ok(t, err)
+		testutil.Equals(t, DefaultDeleteTimeout, c.deleteTimeout)
+	})
+}
+
+// planAllPlanner plans all blocks of a group for compaction if there is more than one.
+type planAllPlanner struct{}
+
+func (planAllPlanner) Plan(_ context.Context, metasByMinTime []*metadata.Meta) ([]*metadata.Meta, error) {
+	if len(metasByMinTime) < 2 {
+		return nil, nil
+	}
+	return metasByMinTime, nil
+}
+
+func TestBucketCompactor_Plan(t *testing.T) {
+	newMeta := func(id uint64, minTime, maxTime int64, lset map[string]string) *metadata.Meta {
+		return &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(id, nil), MinTime: minTime, MaxTime: maxTime},
+			Thanos:    metadata.Thanos{Labels: lset},
+		}
+	}
+	var (
+		lsetA = map[string]string{"a": "1"}
+		lsetB = map[string]string{"a": "2"}
+		lsetC = map[string]string{"a": "3"}
+		metas = []*metadata.Meta{
+			newMeta(1, 0, 20, lsetA),
+			newMeta(2, 20, 40, lsetA),
+			newMeta(3, 10, 30, lsetB),
+			newMeta(4, 0, 10, lsetB),
+			newMeta(5, 30, 50, lsetB),
+			newMeta(6, 0, 20, lsetC),
+		}
+		fetcher = staticFetcher{}
+	)
+	for _, m := range metas {
+		fetcher[m.ULID] = m
+	}
+
+	bkt := objstore.NewInMemBucket()
+	counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	sy, err := NewMetaSyncer(nil, nil, bkt, fetcher, nil, nil, counter, counter, 1)
+	testutil.Ok(t, err)
+	grouper := NewDefaultGrouper(nil, bkt, false, false, nil, counter, counter, metadata.NoneFunc)
+	c, err := NewBucketCompactor(log.NewNopLogger(), sy, grouper, planAllPlanner{}, nil, "", bkt, 1)
+	testutil.Ok(t, err)
+
+	expected := []PlannedCompaction{
+		{
+			Group:   DefaultGroupKey(metas[0].Thanos),
+			Labels:  labels.FromMap(lsetA),
+			Blocks:  []ulid.ULID{metas[0].ULID, metas[1].ULID},
+			MinTime: 0,
+			MaxTime: 40,
+		},
+		{
+			Group:   DefaultGroupKey(metas[2].Thanos),
+			Labels:  labels.FromMap(lsetB),
+			Blocks:  []ulid.ULID{metas[3].ULID, metas[2].ULID, metas[4].ULID},
+			MinTime: 0,
+			MaxTime: 50,
+		},
+	}
+	sort.Slice(expected, func(i, j int) bool { return expected[i].Group < expected[j].Group })
+
+	// Group with a single block has nothing to compact and is omitted.
+	plans, err := c.Plan(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, expected, plans)
+
+	// Planning is repeatable and does not touch the bucket.
+	plans, err = c.Plan(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, expected, plans)
+	testutil.Equals(t, 0, len(bkt.Objects()))
+}
+
+func TestDefaultGrouper_GroupSizeMetrics(t *testing.T) {
+	newMeta := func(id uint64, lset map[string]string, size int64) *metadata.Meta {
+		return &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(id, nil), MinTime: int64(id) * 10, MaxTime: int64(id+1) * 10},
+			Thanos: metadata.Thanos{
+				Labels: lset,
+				Files:  []metadata.File{{RelPath: block.IndexFilename, SizeBytes: size}, {RelPath: block.MetaFilename}},
+			},
+		}
+	}
+	var (
+		lsetA = map[string]string{"a": "1"}
+		lsetB = map[string]string{"a": "2"}
+		lsetC = map[string]string{"a": "3"}
+		metas = map[ulid.ULID]*metadata.Meta{}
+	)
+	for _, m := range []*metadata.Meta{
+		newMeta(1, lsetA, 100),
+		newMeta(2, lsetA, 200),
+		newMeta(3, lsetA, 300),
+		newMeta(4, lsetB, 50),
+		newMeta(5, lsetC, 10),
+		newMeta(6, lsetC, 20),
+	} {
+		metas[m.ULID] = m
+	}
+	keyA := DefaultGroupKey(metadata.Thanos{Labels: lsetA})
+	keyB := DefaultGroupKey(metadata.Thanos{Labels: lsetB})
+	keyC := DefaultGroupKey(metadata.Thanos{Labels: lsetC})
+
+	counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	grouper := NewDefaultGrouper(nil, nil, false, false, nil, counter, counter, metadata.NoneFunc)
+	groups, err := grouper.Groups(metas)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, len(groups))
+
+	testutil.Equals(t, 3, promtest.CollectAndCount(grouper.groupBlocks))
+	testutil.Equals(t, 3.0, promtest.ToFloat64(grouper.groupBlocks.WithLabelValues(keyA)))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(grouper.groupBlocks.WithLabelValues(keyB)))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(grouper.groupBlocks.WithLabelValues(keyC)))
+	testutil.Equals(t, 3, promtest.CollectAndCount(grouper.groupSizeBytes))
+	testutil.Equals(t, 600.0, promtest.ToFloat64(grouper.groupSizeBytes.WithLabelValues(keyA)))
+	testutil.Equals(t, 50.0, promtest.ToFloat64(grouper.groupSizeBytes.WithLabelValues(keyB)))
+	testutil.Equals(t, 30.0, promtest.ToFloat64(grouper.groupSizeBytes.WithLabelValues(keyC)))
+	for _, g := range groups {
+		g.downloadedBytes.Set(1)
+	}
+	testutil.Equals(t, 3, promtest.CollectAndCount(grouper.downloadedBytes))
+
+	// Groups which are gone are not reported anymore.
+	for id, m := range metas {
+		if m.Thanos.Labels["a"] == "2" {
+			delete(metas, id)
+		}
+	}
+	delete(metas, ulid.MustNew(1, nil))
+	_, err = grouper.Groups(metas)
+	testutil.Ok(t, err)
+
+	testutil.Equals(t, 2, promtest.CollectAndCount(grouper.groupBlocks))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(grouper.groupBlocks.WithLabelValues(keyA)))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(grouper.groupBlocks.WithLabelValues(keyC)))
+	testutil.Equals(t, 2, promtest.CollectAndCount(grouper.groupSizeBytes))
+	testutil.Equals(t, 500.0, promtest.ToFloat64(grouper.groupSizeBytes.WithLabelValues(keyA)))
+	testutil.Equals(t, 30.0, promtest.ToFloat64(grouper.groupSizeBytes.WithLabelValues(keyC)))
+	testutil.Equals(t, 2, promtest.CollectAndCount(grouper.downloadedBytes))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(grouper.downloadedBytes.WithLabelValues(keyA)))
+}
+
+// slowGetBucket delays every Get and records the maximum number of Gets in flight at once.
+type slowGetBucket struct {
+	objstore.Bucket
+
+	inflight    atomic.Int64
+	maxInflight atomic.Int64
+}
+
+func (b *slowGetBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	n := b.inflight.Inc()
+	defer b.inflight.Dec()
+	for {
+		if m := b.maxInflight.Load(); n <= m || b.maxInflight.CAS(m, n) {
+			break
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	return b.Bucket.Get(ctx, name)
+}
+
+// recordingCompactor records the block directories it is asked to compact and pretends the result is empty.
+type recordingCompactor struct {
+	dirs []string
+}
+
+func (c *recordingCompactor) Write(string, tsdb.BlockReader, int64, int64, *tsdb.BlockMeta) (ulid.ULID, error) {
+	return ulid.ULID{}, errors.New("not implemented")
+}
+
+func (c *recordingCompactor) Compact(_ string, dirs []string, _ []*tsdb.Block) (ulid.ULID, error) {
+	c.dirs = dirs
+	return ulid.ULID{}, nil
+}
+
+func TestGroupCompact_DownloadsBlocksConcurrently(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "test-concurrent-download")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt := &slowGetBucket{Bucket: objstore.NewInMemBucket()}
+	extLset := labels.Labels{{Name: "e1", Value: "1"}}
+	var metas []*metadata.Meta
+	for i := int64(0); i < 3; i++ {
+		id, err := e2eutil.CreateBlock(ctx, filepath.Join(dir, "src"), []labels.Labels{{{Name: "a", Value: "1"}}}, 10, i*100, (i+1)*100, extLset, 0, metadata.NoneFunc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt, filepath.Join(dir, "src", id.String()), metadata.NoneFunc))
+		m, err := block.DownloadMeta(ctx, log.NewNopLogger(), bkt, id)
+		testutil.Ok(t, err)
+		metas = append(metas, &m)
+	}
+	metasByID := map[ulid.ULID]*metadata.Meta{}
+	for _, m := range metas {
+		metasByID[m.ULID] = m
+	}
+
+	counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	grouper := NewDefaultGrouper(nil, bkt, false, false, nil, counter, counter, metadata.NoneFunc, WithDownloadConcurrency(3))
+
+	t.Run("all blocks downloaded", func(t *testing.T) {
+		groups, err := grouper.Groups(metasByID)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(groups))
+
+		comp := &recordingCompactor{}
+		_, _, err = groups[0].Compact(ctx, filepath.Join(dir, "compact"), staticPlanner(metas), comp)
+		testutil.Ok(t, err)
+		testutil.Assert(t, bkt.maxInflight.Load() > 1, "expected concurrent downloads, got at most %d", bkt.maxInflight.Load())
+
+		// Block directories are passed in the planned order regardless of the download order.
+		var expected []string
+		for _, m := range metas {
+			expected = append(expected, filepath.Join(dir, "compact", groups[0].Key(), m.ULID.String()))
+		}
+		testutil.Equals(t, expected, comp.dirs)
+	})
+	t.Run("failed download", func(t *testing.T) {
+		groups, err := grouper.Groups(metasByID)
+		testutil.Ok(t, err)
+
+		missing := &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(1, nil), MinTime: 300, MaxTime: 400},
+			Thanos:    metadata.Thanos{Labels: extLset.Map()},
+		}
+		testutil.Ok(t, groups[0].AppendMeta(missing))
+
+		comp := &recordingCompactor{}
+		_, _, err = groups[0].Compact(ctx, filepath.Join(dir, "compact"), staticPlanner(append(metas, missing)), comp)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, IsRetryError(err), "expected retry error, got %v", err)
+		testutil.Assert(t, strings.Contains(err.Error(), "download block "+missing.ULID.String()), "unexpected error %v", err)
+		testutil.Equals(t, 0, len(comp.dirs))
+	})
+}
+
+// stallingBucket serves block indexes with a reader that blocks until the request context is done.
+type stallingBucket struct {
+	objstore.Bucket
+}
+
+func (b stallingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if path.Base(name) != block.IndexFilename {
+		return b.Bucket.Get(ctx, name)
+	}
+	return ioutil.NopCloser(stallingReader{ctx: ctx}), nil
+}
+
+type stallingReader struct {
+	ctx context.Context
+}
+
+func (r stallingReader) Read([]byte) (int, error) {
+	<-r.ctx.Done()
+	return 0, r.ctx.Err()
+}
+
+func TestGroup_DownloadBlock_AbortsStalledDownload(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test-stalled-download")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	inmem := objstore.NewInMemBucket()
+	id, err := e2eutil.CreateBlock(ctx, filepath.Join(dir, "src"), []labels.Labels{{{Name: "a", Value: "1"}}}, 10, 0, 100, labels.Labels{{Name: "e1", Value: "1"}}, 0, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), inmem, filepath.Join(dir, "src", id.String()), metadata.NoneFunc))
+
+	// Groups created without WithGroupMetrics must not panic on download progress.
+	counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	g, err := NewGroup(nil, stallingBucket{Bucket: inmem}, "", nil, 0, false, false, counter, counter, counter, counter, counter, counter, counter, metadata.NoneFunc, WithDownloadStallTimeout(100*time.Millisecond))
+	testutil.Ok(t, err)
+
+	err = g.downloadBlock(ctx, id, filepath.Join(dir, "stalled", id.String()), atomic.NewInt64(0))
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(err.Error(), "download stalled"), "unexpected error %v", err)
+	testutil.Ok(t, ctx.Err())
+
+	g, err = NewGroup(nil, inmem, "", nil, 0, false, false, counter, counter, counter, counter, counter, counter, counter, metadata.NoneFunc, WithDownloadStallTimeout(time.Minute))
+	testutil.Ok(t, err)
+
+	total := atomic.NewInt64(0)
+	testutil.Ok(t, g.downloadBlock(ctx, id, filepath.Join(dir, "ok", id.String()), total))
+	testutil.Assert(t, total.Load() > 0, "expected downloaded bytes to be counted")
+}
+
+func TestGroupCompact_CappedBlocksAreCheckedForOverlaps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-compact-capped-overlaps")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	newMeta := func(id uint64, minTime, maxTime int64, level int) *metadata.Meta {
+		return &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(id, nil), MinTime: minTime, MaxTime: maxTime, Compaction: tsdb.BlockMetaCompaction{Level: level}},
+			Thanos:    metadata.Thanos{Labels: map[string]string{"e1": "1"}},
+		}
+	}
+	metas := map[ulid.ULID]*metadata.Meta{}
+	for _, m := range []*metadata.Meta{newMeta(1, 0, 20, 1), newMeta(2, 20, 40, 1), newMeta(3, 30, 60, 4)} {
+		metas[m.ULID] = m
+	}
+
+	counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	grouper := NewDefaultGrouper(nil, objstore.NewInMemBucket(), false, false, nil, counter, counter, metadata.NoneFunc)
+	groups, err := grouper.Groups(metas)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(groups))
+	// Capped blocks are still part of their group, e.g. for garbage collection, retention and the overlap checks.
+	testutil.Equals(t, 3, len(groups[0].IDs()))
+
+	_, _, err = groups[0].Compact(context.Background(), dir, WithMaxCompactionLevel(NewTSDBBasedPlanner(nil, []int64{20, 60}), 4), nil)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, IsHaltError(err), "expected halt error, got %v", err)
+	testutil.Assert(t, strings.Contains(err.Error(), "pre compaction overlap check"), "unexpected error %v", err)
+}
+
+// filteredFetcher applies the given filters to the static metas, like block.MetaFetcher does.
+type filteredFetcher struct {
+	metas   staticFetcher
+	filters []block.MetadataFilter
+}
+
+func (f filteredFetcher) Fetch(ctx context.Context) (map[ulid.ULID]*metadata.Meta, map[ulid.ULID]error, error) {
+	metas, _, _ := f.metas.Fetch(ctx)
+	synced := extprom.NewTxGaugeVec(nil, prometheus.GaugeOpts{}, []string{"state"})
+	for _, filter := range f.filters {
+		if err := filter.Filter(ctx, metas, synced); err != nil {
+			return nil, nil, err
+		}
+	}
+	return metas, nil, nil
+}
+
+func (f filteredFetcher) UpdateOnChange(func([]metadata.Meta, error)) {}
+
+func TestBucketCompactor_Plan_DisjointSelectors(t *testing.T) {
+	metas := staticFetcher{}
+	for i, lset := range []map[string]string{
+		{"tenant": "a", "replica": "1"},
+		{"tenant": "a", "replica": "2"},
+		{"tenant": "b", "replica": "1"},
+		{"tenant": "c", "replica": "1"},
+	} {
+		for j := 0; j < 3; j++ {
+			id := ulid.MustNew(uint64(i*10+j), nil)
+			metas[id] = &metadata.Meta{
+				BlockMeta: tsdb.BlockMeta{ULID: id, MinTime: int64(j) * 10, MaxTime: int64(j+1) * 10},
+				Thanos:    metadata.Thanos{Labels: lset},
+			}
+		}
+	}
+
+	plan := func(selector string) []PlannedCompaction {
+		relabelConfig, err := block.ParseRelabelConfig([]byte(selector), block.SelectorSupportedRelabelActions)
+		testutil.Ok(t, err)
+
+		fetcher := filteredFetcher{metas: metas, filters: []block.MetadataFilter{block.NewLabelShardedMetaFilter(relabelConfig)}}
+		bkt := objstore.NewInMemBucket()
+		counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+		sy, err := NewMetaSyncer(nil, nil, bkt, fetcher, nil, nil, counter, counter, 1)
+		testutil.Ok(t, err)
+		grouper := NewDefaultGrouper(nil, bkt, false, false, nil, counter, counter, metadata.NoneFunc)
+		c, err := NewBucketCompactor(log.NewNopLogger(), sy, grouper, planAllPlanner{}, nil, "", bkt, 1)
+		testutil.Ok(t, err)
+
+		plans, err := c.Plan(context.Background())
+		testutil.Ok(t, err)
+		return plans
+	}
+
+	first := plan(`
+- action: keep
+  source_labels: ["tenant"]
+  regex: "a"
+`)
+	second := plan(`
+- action: drop
+  source_labels: ["tenant"]
+  regex: "a"
+`)
+
+	planned := map[ulid.ULID]struct{}{}
+	groups := map[string]struct{}{}
+	for _, p := range append(first, second...) {
+		_, ok := groups[p.Group]
+		testutil.Assert(t, !ok, "group %s planned by both compactors", p.Group)
+		groups[p.Group] = struct{}{}
+
+		for _, id := range p.Blocks {
+			_, ok := planned[id]
+			testutil.Assert(t, !ok, "block %s planned by both compactors", id)
+			planned[id] = struct{}{}
+		}
+	}
+	testutil.Equals(t, 2, len(first))
+	testutil.Equals(t, 2, len(second))
+	// Together, both compactors cover every block in the bucket.
+	testutil.Equals(t, len(metas), len(planned))
+}
+
+func TestSyncer_GarbageCollect_DisjointSelectors(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+
+	// Each tenant has two source blocks which were already compacted, but not yet garbage collected.
+	metas := staticFetcher{}
+	sources := map[string][]ulid.ULID{}
+	for i, tenant := range []string{"a", "b"} {
+		var ids []ulid.ULID
+		for j := 0; j < 2; j++ {
+			id := ulid.MustNew(uint64(i*10+j), nil)
+			metas[id] = &metadata.Meta{
+				BlockMeta: tsdb.BlockMeta{ULID: id, MinTime: int64(j) * 10, MaxTime: int64(j+1) * 10, Compaction: tsdb.BlockMetaCompaction{Level: 1, Sources: []ulid.ULID{id}}},
+				Thanos:    metadata.Thanos{Labels: map[string]string{"tenant": tenant}},
+			}
+			ids = append(ids, id)
+		}
+		compacted := ulid.MustNew(uint64(i*10+9), nil)
+		metas[compacted] = &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{ULID: compacted, MinTime: 0, MaxTime: 20, Compaction: tsdb.BlockMetaCompaction{Level: 2, Sources: ids}},
+			Thanos:    metadata.Thanos{Labels: map[string]string{"tenant": tenant}},
+		}
+		sources[tenant] = ids
+	}
+
+	relabelConfig, err := block.ParseRelabelConfig([]byte(`
+- action: keep
+  source_labels: ["tenant"]
+  regex: "a"
+`), block.SelectorSupportedRelabelActions)
+	testutil.Ok(t, err)
+
+	duplicateBlocksFilter := block.NewDeduplicateFilter()
+	ignoreDeletionMarkFilter := block.NewIgnoreDeletionMarkFilter(nil, objstore.WithNoopInstr(bkt), 0, 1)
+	fetcher := filteredFetcher{metas: metas, filters: []block.MetadataFilter{
+		block.NewLabelShardedMetaFilter(relabelConfig),
+		ignoreDeletionMarkFilter,
+		duplicateBlocksFilter,
+	}}
+	counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	sy, err := NewMetaSyncer(nil, nil, bkt, fetcher, duplicateBlocksFilter, ignoreDeletionMarkFilter, counter, counter, 1)
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, sy.SyncMetas(ctx))
+	testutil.Ok(t, sy.GarbageCollect(ctx))
+
+	// Only the duplicates of the compactor's own shard are marked for deletion.
+	for tenant, ids := range sources {
+		for _, id := range ids {
+			marked, err := bkt.Exists(ctx, path.Join(id.String(), metadata.DeletionMarkFilename))
+			testutil.Ok(t, err)
+			testutil.Equals(t, tenant == "a", marked)
+		}
+	}
+}
+
+type planFunc func(ctx context.Context, metasByMinTime []*metadata.Meta) ([]*metadata.Meta, error)
+
+func (f planFunc) Plan(ctx context.Context, metasByMinTime []*metadata.Meta) ([]*metadata.Meta, error) {
+	return f(ctx, metasByMinTime)
+}
+
+// flakyGetBucket fails the given number of Get calls before passing them through.
+type flakyGetBucket struct {
+	objstore.Bucket
+
+	failures atomic.Int64
+	attempts atomic.Int64
+}
+
+func (b *flakyGetBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	b.attempts.Inc()
+	if b.failures.Dec() >= 0 {
+		return nil, errors.New("503 Service Unavailable")
+	}
+	return b.Bucket.Get(ctx, name)
+}
+
+func TestBucketCompactor_Compact_RetryBackoff(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "test-compact-retry-backoff")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt := &flakyGetBucket{Bucket: objstore.NewInMemBucket()}
+	fetcher := staticFetcher{}
+	for i := int64(0); i < 2; i++ {
+		id, err := e2eutil.CreateBlock(ctx, filepath.Join(dir, "src"), []labels.Labels{{{Name: "a", Value: "1"}}}, 10, i*100, (i+1)*100, labels.Labels{{Name: "e1", Value: "1"}}, 0, metadata.NoneFunc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt.Bucket, filepath.Join(dir, "src", id.String()), metadata.NoneFunc))
+		m, err := block.DownloadMeta(ctx, log.NewNopLogger(), bkt.Bucket, id)
+		testutil.Ok(t, err)
+		fetcher[id] = &m
+	}
+
+	newCompactor := func(t *testing.T, comp *recordingCompactor, cfg RetryBackoffConfig) (*BucketCompactor, *[]time.Duration) {
+		counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+		sy, err := NewMetaSyncer(nil, nil, bkt, fetcher, block.NewDeduplicateFilter(), block.NewIgnoreDeletionMarkFilter(nil, nil, 0, 1), counter, counter, 1)
+		testutil.Ok(t, err)
+		grouper := NewDefaultGrouper(nil, bkt, false, false, nil, counter, counter, metadata.NoneFunc)
+		// Plan all blocks until the first successful compaction, so the test does not loop forever.
+		planner := planFunc(func(_ context.Context, metas []*metadata.Meta) ([]*metadata.Meta, error) {
+			if comp.dirs != nil {
+				return nil, nil
+			}
+			return metas, nil
+		})
+		c, err := NewBucketCompactor(log.NewNopLogger(), sy, grouper, planner, comp, filepath.Join(dir, "compact"), bkt, 1, WithRetryBackoff(cfg))
+		testutil.Ok(t, err)
+
+		var delays []time.Duration
+		c.retrySleep = func(_ context.Context, d time.Duration) error {
+			delays = append(delays, d)
+			return nil
+		}
+		return c, &delays
+	}
+	cfg := RetryBackoffConfig{MaxRetries: 5, Min: time.Second, Max: 5 * time.Second, Factor: 2}
+
+	t.Run("recovers after transient errors", func(t *testing.T) {
+		bkt.failures.Store(4)
+		bkt.attempts.Store(0)
+		comp := &recordingCompactor{}
+		c, delays := newCompactor(t, comp, cfg)
+
+		testutil.Ok(t, c.Compact(ctx))
+		testutil.Equals(t, 2, len(comp.dirs))
+		// Each failed iteration stops at the first failed download.
+		testutil.Equals(t, []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}, *delays)
+	})
+	t.Run("gives up after max retries", func(t *testing.T) {
+		bkt.failures.Store(100)
+		bkt.attempts.Store(0)
+		comp := &recordingCompactor{}
+		c, delays := newCompactor(t, comp, cfg)
+
+		err := c.Compact(ctx)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, IsRetryError(err), "expected retry error, got %v", err)
+		testutil.Equals(t, int64(cfg.MaxRetries+1), bkt.attempts.Load())
+		testutil.Equals(t, cfg.MaxRetries, len(*delays))
+		for i := 1; i < len(*delays); i++ {
+			testutil.Assert(t, (*delays)[i] >= (*delays)[i-1], "expected growing delays, got %v", *delays)
+		}
+		testutil.Equals(t, cfg.Max, (*delays)[len(*delays)-1])
+		testutil.Equals(t, 0, len(comp.dirs))
+	})
+	t.Run("disabled", func(t *testing.T) {
+		bkt.failures.Store(1)
+		bkt.attempts.Store(0)
+		comp := &recordingCompactor{}
+		c, delays := newCompactor(t, comp, RetryBackoffConfig{})
+
+		err := c.Compact(ctx)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, IsRetryError(err), "expected retry error, got %v", err)
+		testutil.Equals(t, 0, len(*delays))
+	})
+}
+
+func TestBucketCompactor_Compact_MaxGroupsPerRun(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "test-compact-max-groups-per-run")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt := objstore.NewInMemBucket()
+	fetcher := staticFetcher{}
+	// Three groups with two blocks each.
+	for g := 0; g < 3; g++ {
+		for i := int64(0); i < 2; i++ {
+			id, err := e2eutil.CreateBlock(ctx, filepath.Join(dir, "src"), []labels.Labels{{{Name: "a", Value: "1"}}}, 10, i*100, (i+1)*100, labels.Labels{{Name: "e1", Value: fmt.Sprintf("%d", g)}}, 0, metadata.NoneFunc)
+			testutil.Ok(t, err)
+			testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt, filepath.Join(dir, "src", id.String()), metadata.NoneFunc))
+			m, err := block.DownloadMeta(ctx, log.NewNopLogger(), bkt, id)
+			testutil.Ok(t, err)
+			fetcher[id] = &m
+		}
+	}
+
+	counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	sy, err := NewMetaSyncer(nil, nil, bkt, fetcher, nil, nil, counter, counter, 1)
+	testutil.Ok(t, err)
+	grouper := NewDefaultGrouper(nil, bkt, false, false, nil, counter, counter, metadata.NoneFunc)
+	// Plan each group only once, the recording compactor does not produce any block.
+	var compacted []string
+	planner := planFunc(func(_ context.Context, metas []*metadata.Meta) ([]*metadata.Meta, error) {
+		g := metas[0].Thanos.Labels["e1"]
+		for _, c := range compacted {
+			if c == g {
+				return nil, nil
+			}
+		}
+		compacted = append(compacted, g)
+		return metas, nil
+	})
+	c, err := NewBucketCompactor(log.NewNopLogger(), sy, grouper, planner, &recordingCompactor{}, filepath.Join(dir, "compact"), bkt, 1, WithMaxGroupsPerRun(1))
+	testutil.Ok(t, err)
+
+	testutil.Ok(t, c.Compact(ctx))
+	testutil.Equals(t, []string{"0"}, compacted)
+	// Groups with nothing left to compact do not count against the limit.
+	testutil.Ok(t, c.Compact(ctx))
+	testutil.Equals(t, []string{"0", "1"}, compacted)
+	testutil.Ok(t, c.Compact(ctx))
+	testutil.Equals(t, []string{"0", "1", "2"}, compacted)
+	testutil.Ok(t, c.Compact(ctx))
+	testutil.Equals(t, []string{"0", "1", "2"}, compacted)
+}
+
+func TestBucketCompactor_Compact_WorkDirCleanupFailures(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "test-compact-workdir-cleanup")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt := objstore.NewInMemBucket()
+	fetcher := staticFetcher{}
+	for i := int64(0); i < 2; i++ {
+		id, err := e2eutil.CreateBlock(ctx, filepath.Join(dir, "src"), []labels.Labels{{{Name: "a", Value: "1"}}}, 10, i*100, (i+1)*100, labels.Labels{{Name: "e1", Value: "1"}}, 0, metadata.NoneFunc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt, filepath.Join(dir, "src", id.String()), metadata.NoneFunc))
+		m, err := block.DownloadMeta(ctx, log.NewNopLogger(), bkt, id)
+		testutil.Ok(t, err)
+		fetcher[id] = &m
+	}
+
+	counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	sy, err := NewMetaSyncer(nil, nil, bkt, fetcher, nil, nil, counter, counter, 1)
+	testutil.Ok(t, err)
+
+	var removed []string
+	removeAll := func(path string) error {
+		removed = append(removed, path)
+		return errors.New("device or resource busy")
+	}
+	grouper := NewDefaultGrouper(nil, bkt, false, false, nil, counter, counter, metadata.NoneFunc, func(g *Group) { g.removeAll = removeAll })
+	comp := &recordingCompactor{}
+	// Plan all blocks until the first compaction, so the test does not loop forever.
+	planner := planFunc(func(_ context.Context, metas []*metadata.Meta) ([]*metadata.Meta, error) {
+		if comp.dirs != nil {
+			return nil, nil
+		}
+		return metas, nil
+	})
+	compactDir := filepath.Join(dir, "compact")
+	c, err := NewBucketCompactor(log.NewNopLogger(), sy, grouper, planner, comp, compactDir, bkt, 1)
+	testutil.Ok(t, err)
+	c.removeAll = removeAll
+
+	// Failed cleanups do not fail the compaction.
+	testutil.Ok(t, c.Compact(ctx))
+	groupKey := DefaultGroupKey(metadata.Thanos{Labels: map[string]string{"e1": "1"}})
+	groupDir := filepath.Join(compactDir, groupKey)
+	// The group directory is removed by the group after each of its successful compactions, the work directory at the end.
+	testutil.Equals(t, []string{groupDir, groupDir, compactDir}, removed)
+	testutil.Equals(t, 2.0, promtest.ToFloat64(grouper.workDirCleanupFailures.WithLabelValues(groupKey)))
+	testutil.Equals(t, 1.0, promtest.ToFloat64(c.workDirCleanupFailures))
+	_, err = os.Stat(groupDir)
+	testutil.Ok(t, err)
+}
+
+func TestGroupCompact_CompactionBytes(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "test-compaction-bytes")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt := objstore.NewInMemBucket()
+	extLset := labels.Labels{{Name: "e1", Value: "1"}}
+	var (
+		metas         []*metadata.Meta
+		expectedInput int64
+	)
+	for i := int64(0); i < 3; i++ {
+		id, err := e2eutil.CreateBlock(ctx, filepath.Join(dir, "src"), []labels.Labels{{{Name: "a", Value: "1"}}, {{Name: "a", Value: "2"}}}, 10, i*100, (i+1)*100, extLset, 0, metadata.NoneFunc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt, filepath.Join(dir, "src", id.String()), metadata.NoneFunc))
+		m, err := block.DownloadMeta(ctx, log.NewNopLogger(), bkt, id)
+		testutil.Ok(t, err)
+		metas = append(metas, &m)
+
+		for name, b := range bkt.Objects() {
+			if strings.HasPrefix(name, id.String()+"/") {
+				expectedInput += int64(len(b))
+			}
+		}
+	}
+	metasByID := map[ulid.ULID]*metadata.Meta{}
+	for _, m := range metas {
+		metasByID[m.ULID] = m
+	}
+
+	counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	grouper := NewDefaultGrouper(nil, bkt, false, false, nil, counter, counter, metadata.NoneFunc)
+	groups, err := grouper.Groups(metasByID)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(groups))
+
+	comp, err := tsdb.NewLeveledCompactor(ctx, nil, log.NewNopLogger(), []int64{1000, 3000}, nil, nil)
+	testutil.Ok(t, err)
+
+	// Compact in a directory which is kept afterwards, so that the result block can be inspected.
+	groupDir := filepath.Join(dir, "compact", groups[0].Key())
+	testutil.Ok(t, os.MkdirAll(groupDir, 0750))
+	_, compID, err := groups[0].compact(ctx, groupDir, staticPlanner(metas), comp)
+	testutil.Ok(t, err)
+	testutil.Assert(t, compID != ulid.ULID{}, "expected compacted block")
+
+	// The uploaded meta.json additionally lists the block files, so it is taken from disk.
+	fi, err := os.Stat(filepath.Join(groupDir, compID.String(), metadata.MetaFilename))
+	testutil.Ok(t, err)
+	expectedOutput := fi.Size()
+	for name, b := range bkt.Objects() {
+		if strings.HasPrefix(name, compID.String()+"/") && name != path.Join(compID.String(), metadata.MetaFilename) {
+			expectedOutput += int64(len(b))
+		}
+	}
+
+	testutil.Equals(t, float64(expectedInput), promtest.ToFloat64(grouper.compactionInputBytes.WithLabelValues(groups[0].Key())))
+	testutil.Equals(t, float64(expectedOutput), promtest.ToFloat64(grouper.compactionOutputBytes.WithLabelValues(groups[0].Key())))
+}
+
+func TestGroupCompact_VerticalDeduplicatedSamples(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "test-vertical-dedup")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt := objstore.NewInMemBucket()
+	extLset := labels.Labels{{Name: "e1", Value: "1"}}
+	metasByID := map[ulid.ULID]*metadata.Meta{}
+	var metas []*metadata.Meta
+	// Two replicas scraping the same series at the same timestamps, with replica labels already removed.
+	for i := 0; i < 2; i++ {
+		id, err := e2eutil.CreateBlock(ctx, filepath.Join(dir, "src"), []labels.Labels{{{Name: "a", Value: "1"}}, {{Name: "a", Value: "2"}}}, 10, 0, 100, extLset, 0, metadata.NoneFunc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt, filepath.Join(dir, "src", id.String()), metadata.NoneFunc))
+		m, err := block.DownloadMeta(ctx, log.NewNopLogger(), bkt, id)
+		testutil.Ok(t, err)
+		testutil.Equals(t, uint64(20), m.Stats.NumSamples)
+		metas = append(metas, &m)
+		metasByID[m.ULID] = &m
+	}
+
+	counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	grouper := NewDefaultGrouper(nil, bkt, false, true, nil, counter, counter, metadata.NoneFunc)
+	groups, err := grouper.Groups(metasByID)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(groups))
+
+	comp, err := tsdb.NewLeveledCompactor(ctx, nil, log.NewNopLogger(), []int64{1000, 3000}, nil, nil)
+	testutil.Ok(t, err)
+
+	groupDir := filepath.Join(dir, "compact", groups[0].Key())
+	testutil.Ok(t, os.MkdirAll(groupDir, 0750))
+	_, compID, err := groups[0].compact(ctx, groupDir, staticPlanner(metas), comp)
+	testutil.Ok(t, err)
+	testutil.Assert(t, compID != ulid.ULID{}, "expected compacted block")
+
+	m, err := block.DownloadMeta(ctx, log.NewNopLogger(), bkt, compID)
+	testutil.Ok(t, err)
+	testutil.Equals(t, uint64(20), m.Stats.NumSamples)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(grouper.verticalCompactions.WithLabelValues(groups[0].Key())))
+	testutil.Equals(t, 20.0, promtest.ToFloat64(grouper.verticalDedupedSamples.WithLabelValues(groups[0].Key())))
+}
+
+func TestSyncer_RefreshBlock(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+	upload := func(m *metadata.Meta) {
+		var buf bytes.Buffer
+		testutil.Ok(t, json.NewEncoder(&buf).Encode(m))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(m.ULID.String(), metadata.MetaFilename), &buf))
+	}
+
+	fetcher := staticFetcher{}
+	for i := uint64(1); i <= 2; i++ {
+		m := &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(i, nil), MinTime: int64(i) * 10, MaxTime: int64(i+1) * 10, Compaction: tsdb.BlockMetaCompaction{Level: 1}, Version: 1},
+			Thanos:    metadata.Thanos{Labels: map[string]string{"a": "1"}, Version: metadata.ThanosVersion1},
+		}
+		upload(m)
+		fetcher[m.ULID] = m
+	}
+	id1, id2 := ulid.MustNew(1, nil), ulid.MustNew(2, nil)
+
+	counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	sy, err := NewMetaSyncer(nil, nil, bkt, fetcher, nil, nil, counter, counter, 1)
+	testutil.Ok(t, err)
+	testutil.Ok(t, sy.SyncMetas(ctx))
+	before := sy.Metas()
+
+	// Repair the first block out of band.
+	repaired := *fetcher[id1]
+	repaired.Compaction.Level = 2
+	repaired.Thanos.Labels = map[string]string{"a": "1", "repaired": "true"}
+	upload(&repaired)
+
+	testutil.Ok(t, sy.RefreshBlock(ctx, id1))
+	after := sy.Metas()
+	testutil.Equals(t, 2, len(after))
+	testutil.Equals(t, 2, after[id1].Compaction.Level)
+	testutil.Equals(t, map[string]string{"a": "1", "repaired": "true"}, after[id1].Thanos.Labels)
+	testutil.Assert(t, after[id2] == before[id2], "expected other block to be left untouched")
+	// Metas returned before the refresh are not modified.
+	testutil.Equals(t, 1, before[id1].Compaction.Level)
+
+	// Blocks not known from the last sync are not refreshed.
+	testutil.NotOk(t, sy.RefreshBlock(ctx, ulid.MustNew(3, nil)))
+
+	// Blocks deleted from the bucket are dropped.
+	testutil.Ok(t, bkt.Delete(ctx, path.Join(id1.String(), metadata.MetaFilename)))
+	testutil.Ok(t, sy.RefreshBlock(ctx, id1))
+	testutil.Equals(t, 1, len(sy.Metas()))
+	testutil.Assert(t, sy.Metas()[id2] == before[id2], "expected other block to be left untouched")
+}
+
+// uploadRecordingBucket records names of all uploaded objects.
+type uploadRecordingBucket struct {
+	objstore.Bucket
+
+	mtx     sync.Mutex
+	uploads []string
+}
+
+func (b *uploadRecordingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	b.mtx.Lock()
+	b.uploads = append(b.uploads, name)
+	b.mtx.Unlock()
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func (b *uploadRecordingBucket) deletionMarks() []string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	var marks []string
+	for _, name := range b.uploads {
+		if path.Base(name) == metadata.DeletionMarkFilename {
+			marks = append(marks, name)
+		}
+	}
+	sort.Strings(marks)
+	return marks
+}
+
+func TestBucketCompactor_Compact_GarbageCollection(t *testing.T) {
+	ctx := context.Background()
+
+	// The third block was compacted from the first two, which makes them duplicates.
+	a, b, c := ulid.MustNew(1, nil), ulid.MustNew(2, nil), ulid.MustNew(3, nil)
+	metas := staticFetcher{
+		a: {BlockMeta: tsdb.BlockMeta{ULID: a, MinTime: 0, MaxTime: 10, Compaction: tsdb.BlockMetaCompaction{Level: 1, Sources: []ulid.ULID{a}}}},
+		b: {BlockMeta: tsdb.BlockMeta{ULID: b, MinTime: 10, MaxTime: 20, Compaction: tsdb.BlockMetaCompaction{Level: 1, Sources: []ulid.ULID{b}}}},
+		c: {BlockMeta: tsdb.BlockMeta{ULID: c, MinTime: 0, MaxTime: 20, Compaction: tsdb.BlockMetaCompaction{Level: 2, Sources: []ulid.ULID{a, b}}}},
+	}
+	expectedMarks := []string{path.Join(a.String(), metadata.DeletionMarkFilename), path.Join(b.String(), metadata.DeletionMarkFilename)}
+
+	for _, garbageCollect := range []bool{true, false} {
+		t.Run(fmt.Sprintf("garbage collection %v", garbageCollect), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "test-compact-garbage-collection")
+			testutil.Ok(t, err)
+			defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+			bkt := &uploadRecordingBucket{Bucket: objstore.NewInMemBucket()}
+			dupFilter := block.NewDeduplicateFilter()
+			fetcher := filteredFetcher{metas: metas, filters: []block.MetadataFilter{dupFilter}}
+			counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+			sy, err := NewMetaSyncer(nil, nil, bkt, fetcher, dupFilter, block.NewIgnoreDeletionMarkFilter(nil, nil, 0, 1), counter, counter, 1)
+			testutil.Ok(t, err)
+			grouper := NewDefaultGrouper(nil, bkt, false, false, nil, counter, counter, metadata.NoneFunc)
+			planner := planFunc(func(context.Context, []*metadata.Meta) ([]*metadata.Meta, error) { return nil, nil })
+			bc, err := NewBucketCompactor(log.NewNopLogger(), sy, grouper, planner, nil, dir, bkt, 1, WithGarbageCollection(garbageCollect))
+			testutil.Ok(t, err)
+
+			testutil.Ok(t, bc.Compact(ctx))
+
+			// Duplicates are filtered out of compaction regardless of garbage collection.
+			duplicates := dupFilter.DuplicateIDs()
+			sort.Slice(duplicates, func(i, j int) bool { return duplicates[i].Compare(duplicates[j]) < 0 })
+			testutil.Equals(t, []ulid.ULID{a, b}, duplicates)
+			testutil.Equals(t, 1, len(sy.Metas()))
+
+			if garbageCollect {
+				testutil.Equals(t, expectedMarks, bkt.deletionMarks())
+				return
+			}
+			testutil.Equals(t, 0, len(bkt.deletionMarks()))
+		})
+	}
+}
+
+// failingIndexUploadBucket fails all uploads of block indexes.
+type failingIndexUploadBucket struct {
+	objstore.Bucket
+
+	attempts atomic.Int64
+}
+
+func (b *failingIndexUploadBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if path.Base(name) == block.IndexFilename {
+		b.attempts.Inc()
+		return errors.New("upload failed")
+	}
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func TestGroup_UploadBlock_CleansUpPartialUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-compact-upload-cleanup")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	id, err := e2eutil.CreateBlock(context.Background(), dir, []labels.Labels{{{Name: "a", Value: "1"}}}, 10, 0, 100, labels.Labels{{Name: "e1", Value: "1"}}, 0, metadata.NoneFunc)
+	testutil.Ok(t, err)
+
+	cfg := RetryBackoffConfig{MaxRetries: 2, Min: time.Second, Max: 5 * time.Second, Factor: 2}
+	for _, tcase := range []struct {
+		name             string
+		cancel           bool
+		expectedAttempts int64
+		expectedBackoffs []time.Duration
+	}{
+		{name: "all attempts failed", expectedAttempts: 3, expectedBackoffs: []time.Duration{time.Second, 2 * time.Second}},
+		{name: "context canceled", cancel: true, expectedAttempts: 1},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tcase.cancel {
+				cancel()
+			}
+
+			inner := objstore.NewInMemBucket()
+			bkt := &failingIndexUploadBucket{Bucket: inner}
+			var backoffs []time.Duration
+			g := &Group{
+				logger: log.NewNopLogger(), bkt: bkt, hashFunc: metadata.NoneFunc, deleteTimeout: time.Minute, uploadRetryBackoff: cfg,
+				retrySleep: func(_ context.Context, d time.Duration) error {
+					backoffs = append(backoffs, d)
+					return nil
+				},
+			}
+
+			testutil.NotOk(t, g.uploadBlock(ctx, id, filepath.Join(dir, id.String())))
+			testutil.Equals(t, tcase.expectedAttempts, bkt.attempts.Load())
+			testutil.Equals(t, tcase.expectedBackoffs, backoffs)
+			testutil.Ok(t, inner.Iter(context.Background(), id.String(), func(name string) error {
+				return errors.Errorf("partially uploaded block left in bucket: %s", name)
+			}))
+		})
+	}
+}
+
+func TestGroup_UploadBlock_CompressedMeta(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "test-compact-upload-compressed-meta")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	id, err := e2eutil.CreateBlock(ctx, dir, []labels.Labels{{{Name: "a", Value: "1"}}}, 10, 0, 100, labels.Labels{{Name: "e1", Value: "1"}}, 0, metadata.NoneFunc)
+	testutil.Ok(t, err)
+
+	bkt := objstore.NewInMemBucket()
+	g := &Group{logger: log.NewNopLogger(), bkt: bkt, hashFunc: metadata.NoneFunc, deleteTimeout: time.Minute}
+	WithCompressedMeta()(g)
+
+	testutil.Ok(t, g.uploadBlock(ctx, id, filepath.Join(dir, id.String())))
+	testutil.Assert(t, metadata.IsCompressed(bkt.Objects()[path.Join(id.String(), block.MetaFilename)]), "expected meta.json to be stored compressed")
+
+	m, err := block.DownloadMeta(ctx, log.NewNopLogger(), bkt, id)
+	testutil.Ok(t, err)
+	testutil.Equals(t, id, m.ULID)
+}
+
+func TestGroupCompact_AppliesSourceTombstones(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "test-compact-tombstones")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt := objstore.NewInMemBucket()
+	extLset := labels.Labels{{Name: "e1", Value: "1"}}
+	var metas []*metadata.Meta
+	for i := int64(0); i < 2; i++ {
+		id, err := e2eutil.CreateBlock(ctx, filepath.Join(dir, "src"), []labels.Labels{{{Name: "a", Value: "1"}}, {{Name: "a", Value: "2"}}}, 10, i*100, (i+1)*100, extLset, 0, metadata.NoneFunc)
+		testutil.Ok(t, err)
+		bdir := filepath.Join(dir, "src", id.String())
+
+		if i == 0 {
+			// Deleting rewrites meta.json without the Thanos section, so it has to be injected again.
+			b, err := tsdb.OpenBlock(nil, bdir, nil)
+			testutil.Ok(t, err)
+			testutil.Ok(t, b.Delete(0, 100, labels.MustNewMatcher(labels.MatchEqual, "a", "1")))
+			testutil.Ok(t, b.Close())
+			_, err = metadata.InjectThanos(log.NewNopLogger(), bdir, metadata.Thanos{Labels: extLset.Map(), Source: metadata.TestSource}, nil)
+			testutil.Ok(t, err)
+		}
+
+		testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt, bdir, metadata.NoneFunc))
+		if i == 0 {
+			// Tombstones are never uploaded by Thanos, but may be present in the bucket if blocks were uploaded otherwise.
+			testutil.Ok(t, objstore.UploadFile(ctx, log.NewNopLogger(), bkt, filepath.Join(bdir, "tombstones"), path.Join(id.String(), "tombstones")))
+		}
+		m, err := block.DownloadMeta(ctx, log.NewNopLogger(), bkt, id)
+		testutil.Ok(t, err)
+		metas = append(metas, &m)
+	}
+
+	counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	grouper := NewDefaultGrouper(nil, bkt, false, false, nil, counter, counter, metadata.NoneFunc)
+	groups, err := grouper.Groups(map[ulid.ULID]*metadata.Meta{metas[0].ULID: metas[0], metas[1].ULID: metas[1]})
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(groups))
+
+	comp, err := tsdb.NewLeveledCompactor(ctx, nil, log.NewNopLogger(), []int64{1000, 3000}, nil, nil)
+	testutil.Ok(t, err)
+
+	groupDir := filepath.Join(dir, "compact", groups[0].Key())
+	testutil.Ok(t, os.MkdirAll(groupDir, 0750))
+	_, compID, err := groups[0].compact(ctx, groupDir, staticPlanner(metas), comp)
+	testutil.Ok(t, err)
+	testutil.Assert(t, compID != ulid.ULID{}, "expected compacted block")
+
+	_, err = os.Stat(filepath.Join(groupDir, compID.String(), "tombstones"))
+	testutil.Assert(t, os.IsNotExist(err), "expected no tombstones file in result block, got %v", err)
+
+	// Only the samples of the deleted series from the first block are gone.
+	m, err := block.DownloadMeta(ctx, log.NewNopLogger(), bkt, compID)
+	testutil.Ok(t, err)
+	testutil.Equals(t, uint64(2), m.Stats.NumSeries)
+	testutil.Equals(t, uint64(30), m.Stats.NumSamples)
+	testutil.Equals(t, uint64(0), m.Stats.NumTombstones)
+}
+
+func TestGroupCompact_EventCallback(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "test-compact-events")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt := objstore.NewInMemBucket()
+	var (
+		metas []*metadata.Meta
+		ids   []ulid.ULID
+	)
+	metasByID := map[ulid.ULID]*metadata.Meta{}
+	for i := int64(0); i < 2; i++ {
+		id, err := e2eutil.CreateBlock(ctx, filepath.Join(dir, "src"), []labels.Labels{{{Name: "a", Value: "1"}}}, 10, i*100, (i+1)*100, labels.Labels{{Name: "e1", Value: "1"}}, 0, metadata.NoneFunc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt, filepath.Join(dir, "src", id.String()), metadata.NoneFunc))
+		m, err := block.DownloadMeta(ctx, log.NewNopLogger(), bkt, id)
+		testutil.Ok(t, err)
+		metas = append(metas, &m)
+		ids = append(ids, id)
+		metasByID[id] = &m
+	}
+
+	var events []GroupCompactEvent
+	counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	grouper := NewDefaultGrouper(nil, bkt, false, false, nil, counter, counter, metadata.NoneFunc, WithEventCallback(func(e GroupCompactEvent) {
+		events = append(events, e)
+	}))
+	groups, err := grouper.Groups(metasByID)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(groups))
+
+	comp, err := tsdb.NewLeveledCompactor(ctx, nil, log.NewNopLogger(), []int64{1000, 3000}, nil, nil)
+	testutil.Ok(t, err)
+
+	_, compID, err := groups[0].Compact(ctx, filepath.Join(dir, "compact"), staticPlanner(metas), comp)
+	testutil.Ok(t, err)
+	testutil.Assert(t, compID != ulid.ULID{}, "expected compacted block")
+
+	var types []GroupCompactEventType
+	for _, e := range events {
+		types = append(types, e.Type)
+		testutil.Equals(t, groups[0].Key(), e.GroupKey)
+		testutil.Equals(t, ids, e.Blocks)
+		testutil.Assert(t, e.Duration >= 0, "expected non-negative duration, got %v", e.Duration)
+	}
+	testutil.Equals(t, []GroupCompactEventType{GroupCompactEventPlanned, GroupCompactEventDownloaded, GroupCompactEventCompacted, GroupCompactEventUploaded}, types)
+	testutil.Equals(t, ulid.ULID{}, events[0].Result)
+	testutil.Equals(t, ulid.ULID{}, events[1].Result)
+	testutil.Equals(t, compID, events[2].Result)
+	testutil.Equals(t, compID, events[3].Result)
+
+	// Nothing planned, nothing reported.
+	events = nil
+	_, _, err = groups[0].Compact(ctx, filepath.Join(dir, "compact"), staticPlanner(nil), comp)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(events))
+}
+
+func TestUntilNextDownsampling(t *testing.T) {
+	newMeta := func(res int64) *metadata.Meta {
+		return &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(1, nil), MinTime: 0, MaxTime: int64(time.Hour / time.Millisecond)},
+			Thanos:    metadata.Thanos{Downsample: metadata.ThanosDownsample{Resolution: res}},
+		}
+	}
+
+	until, err := UntilNextDownsampling(newMeta(downsample.ResLevel0))
+	testutil.Ok(t, err)
+	testutil.Equals(t, time.Duration(downsample.DownsampleRange0)*time.Millisecond-time.Hour, until)
+
+	until, err = UntilNextDownsampling(newMeta(downsample.ResLevel1))
+	testutil.Ok(t, err)
+	testutil.Equals(t, time.Duration(downsample.DownsampleRange1)*time.Millisecond-time.Hour, until)
+
+	_, err = UntilNextDownsampling(newMeta(downsample.ResLevel2))
+	testutil.NotOk(t, err)
+
+	_, err = UntilNextDownsampling(newMeta(123456))
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(err.Error(), "123456"), "expected resolution in error, got %v", err)
+}
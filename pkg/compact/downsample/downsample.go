@@ -4,13 +4,14 @@
 package downsample
 
 import (
+	"context"
 	"math"
-	"math/rand"
 	"os"
 	"path/filepath"
-	"time"
+	"strings"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 	"github.com/prometheus/prometheus/pkg/labels"
@@ -20,13 +21,16 @@ import (
 	"github.com/prometheus/prometheus/tsdb/chunks"
 	"github.com/prometheus/prometheus/tsdb/index"
 	"github.com/prometheus/prometheus/tsdb/tsdbutil"
+	"golang.org/x/sync/errgroup"
 
+	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/errutil"
 	"github.com/thanos-io/thanos/pkg/runutil"
 )
 
-// Standard downsampling resolution levels in Thanos.
+// Standard downsampling resolution levels in Thanos. Downsample supports any other resolution
+// as long as it is a multiple of the source resolution.
 const (
 	ResLevel0 = int64(0)              // Raw data.
 	ResLevel1 = int64(5 * 60 * 1000)  // 5 minutes in milliseconds.
@@ -39,37 +43,100 @@ const (
 	DownsampleRange1 = 10 * 24 * 60 * 60 * 1000 // 10 days.
 )
 
+// Option configures optional Downsample behaviour.
+type Option func(*options)
+
+type options struct {
+	significantDigits  int
+	concurrency        int
+	streamingThreshold int
+	newULID            block.ULIDFunc
+}
+
+// WithSignificantDigits makes Downsample round sum, min and max aggregates to the given number of significant
+// digits, which is lossy, but makes the downsampled chunks compress better. See RoundSignificant.
+// Non-positive values disable rounding, which is the default.
+func WithSignificantDigits(digits int) Option {
+	return func(o *options) {
+		o.significantDigits = digits
+	}
+}
+
+// WithConcurrency makes Downsample downsample up to the given number of series at once. The series are still
+// written in index order. Defaults to 1.
+func WithConcurrency(concurrency int) Option {
+	return func(o *options) {
+		o.concurrency = concurrency
+	}
+}
+
+// WithStreamingThreshold makes Downsample downsample raw series with more samples than the given threshold in parts
+// of about that many samples, so that they are never fully loaded into memory. Non-positive values disable this,
+// which is the default.
+func WithStreamingThreshold(samples int) Option {
+	return func(o *options) {
+		o.streamingThreshold = samples
+	}
+}
+
+// WithULIDFunc sets the function generating the ID of the new block. Defaults to block.NewULID.
+func WithULIDFunc(newULID block.ULIDFunc) Option {
+	return func(o *options) {
+		o.newULID = newULID
+	}
+}
+
 // Downsample downsamples the given block. It writes a new block into dir and returns its ID.
+// The target resolution has to be greater than the resolution of the block and, unless the block
+// contains raw data, a multiple of it, so that every source window falls into a single target window.
+// Raw series with no samples left after skipping stale markers are not written to the new block
+// and are counted by the DroppedSeries stat instead.
+// Along with the ID, it returns stats of the downsampling, which are only meaningful if no error is returned.
 func Downsample(
 	logger log.Logger,
 	origMeta *metadata.Meta,
 	b tsdb.BlockReader,
 	dir string,
 	resolution int64,
-) (id ulid.ULID, err error) {
+	opts ...Option,
+) (id ulid.ULID, stats DownsampleStats, err error) {
+	o := options{concurrency: 1, newULID: block.NewULID}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.concurrency <= 0 {
+		o.concurrency = 1
+	}
+	if o.newULID == nil {
+		o.newULID = block.NewULID
+	}
+
 	if origMeta.Thanos.Downsample.Resolution >= resolution {
-		return id, errors.New("target resolution not lower than existing one")
+		return id, stats, errors.New("target resolution not lower than existing one")
+	}
+	if srcRes := origMeta.Thanos.Downsample.Resolution; srcRes > 0 && resolution%srcRes != 0 {
+		return id, stats, errors.Errorf("target resolution %d is not a multiple of source resolution %d", resolution, srcRes)
 	}
 
 	indexr, err := b.Index()
 	if err != nil {
-		return id, errors.Wrap(err, "open index reader")
+		return id, stats, errors.Wrap(err, "open index reader")
 	}
 	defer runutil.CloseWithErrCapture(&err, indexr, "downsample index reader")
 
 	chunkr, err := b.Chunks()
 	if err != nil {
-		return id, errors.Wrap(err, "open chunk reader")
+		return id, stats, errors.Wrap(err, "open chunk reader")
 	}
 	defer runutil.CloseWithErrCapture(&err, chunkr, "downsample chunk reader")
 
 	// Generate new block id.
-	uid := ulid.MustNew(ulid.Now(), rand.New(rand.NewSource(time.Now().UnixNano())))
+	uid := o.newULID()
 
 	// Create block directory to populate with chunks, meta and index files into.
 	blockDir := filepath.Join(dir, uid.String())
 	if err := os.MkdirAll(blockDir, 0750); err != nil {
-		return id, errors.Wrap(err, "mkdir block dir")
+		return id, stats, errors.Wrap(err, "mkdir block dir")
 	}
 
 	// Remove blockDir in case of errors.
@@ -91,96 +158,216 @@ func Downsample(
 	// Flushes index and meta data after aggregations.
 	streamedBlockWriter, err := NewStreamedBlockWriter(blockDir, indexr, logger, newMeta)
 	if err != nil {
-		return id, errors.Wrap(err, "get streamed block writer")
+		return id, stats, errors.Wrap(err, "get streamed block writer")
 	}
 	defer runutil.CloseWithErrCapture(&err, streamedBlockWriter, "close stream block writer")
 
 	postings, err := indexr.Postings(index.AllPostingsKey())
 	if err != nil {
-		return id, errors.Wrap(err, "get all postings list")
+		return id, stats, errors.Wrap(err, "get all postings list")
 	}
 
 	var (
-		aggrChunks []*AggrChunk
-		all        []sample
-		chks       []chunks.Meta
-		lset       labels.Labels
-		reuseIt    chunkenc.Iterator
+		jobs    = make(chan *downsampleJob)
+		ordered = make(chan *downsampleJob, o.concurrency)
 	)
-	for postings.Next() {
-		lset = lset[:0]
-		chks = chks[:0]
-		all = all[:0]
-		aggrChunks = aggrChunks[:0]
-
-		// Get series labels and chunks. Downsampled data is sensitive to chunk boundaries
-		// and we need to preserve them to properly downsample previously downsampled data.
-		if err := indexr.Series(postings.At(), &lset, &chks); err != nil {
-			return id, errors.Wrapf(err, "get series %d", postings.At())
-		}
-
-		for i, c := range chks[1:] {
-			if chks[i].MaxTime >= c.MinTime {
-				return id, errors.Errorf("found overlapping chunks within series %d. Chunks expected to be ordered by min time and non-overlapping, got: %v", postings.At(), chks)
+	g, gctx := errgroup.WithContext(context.Background())
+	for i := 0; i < o.concurrency; i++ {
+		g.Go(func() error {
+			// Buffers are reused across the series handled by this worker.
+			var (
+				all     []sample
+				reuseIt chunkenc.Iterator
+			)
+			for job := range jobs {
+				job.res, job.inSamples, job.resets, job.err = downsampleSeries(job, chunkr, origMeta.Thanos.Downsample.Resolution, resolution, o.significantDigits, o.streamingThreshold, &all, &reuseIt)
+				close(job.done)
 			}
-		}
-
-		// While #183 exists, we sanitize the chunks we retrieved from the block
-		// before retrieving their samples.
-		for i, c := range chks {
-			chk, err := chunkr.Chunk(c.Ref)
-			if err != nil {
-				return id, errors.Wrapf(err, "get chunk %d, series %d", c.Ref, postings.At())
+			return nil
+		})
+	}
+	// A single goroutine writes the series in postings order, as the streamed block writer requires it.
+	g.Go(func() error {
+		for job := range ordered {
+			select {
+			case <-job.done:
+			case <-gctx.Done():
+				return gctx.Err()
 			}
-			chks[i].Chunk = chk
-		}
-
-		// Raw and already downsampled data need different processing.
-		if origMeta.Thanos.Downsample.Resolution == 0 {
-			for _, c := range chks {
-				// TODO(bwplotka): We can optimze this further by using in WriteSeries iterators of each chunk instead of
-				// samples. Also ensure 120 sample limit, otherwise we have gigantic chunks.
-				// https://github.com/thanos-io/thanos/issues/2542.
-				if err := expandChunkIterator(c.Chunk.Iterator(reuseIt), &all); err != nil {
-					return id, errors.Wrapf(err, "expand chunk %d, series %d", c.Ref, postings.At())
-				}
+			if job.err != nil {
+				return job.err
 			}
-			if err := streamedBlockWriter.WriteSeries(lset, DownsampleRaw(all, resolution)); err != nil {
-				return id, errors.Wrapf(err, "downsample raw data, series: %d", postings.At())
+			stats.Series++
+			stats.InputSamples += int64(job.inSamples)
+			if isCounter(job.lset) {
+				stats.CounterResets += int64(job.resets)
 			}
-		} else {
-			// Downsample a block that contains aggregated chunks already.
-			for _, c := range chks {
-				ac, ok := c.Chunk.(*AggrChunk)
-				if !ok {
-					return id, errors.Errorf("expected downsampled chunk (*downsample.AggrChunk) got %T instead for series: %d", c.Chunk, postings.At())
-				}
-				aggrChunks = append(aggrChunks, ac)
+			if len(job.res) == 0 {
+				level.Debug(logger).Log("msg", "dropping series with no samples left after downsampling", "series", job.lset.String())
+				stats.DroppedSeries++
+				continue
 			}
-			downsampledChunks, err := downsampleAggr(
-				aggrChunks,
-				&all,
-				chks[0].MinTime,
-				chks[len(chks)-1].MaxTime,
-				origMeta.Thanos.Downsample.Resolution,
-				resolution,
-			)
-			if err != nil {
-				return id, errors.Wrapf(err, "downsample aggregate block, series: %d", postings.At())
+			for _, c := range job.res {
+				stats.OutputSamples += int64(c.Chunk.NumSamples())
 			}
-			if err := streamedBlockWriter.WriteSeries(lset, downsampledChunks); err != nil {
-				return id, errors.Wrapf(err, "write series: %d", postings.At())
+			if err := streamedBlockWriter.WriteSeries(job.lset, job.res); err != nil {
+				return errors.Wrapf(err, "write series: %d", job.ref)
 			}
 		}
+		return nil
+	})
+
+	err = func() error {
+		defer close(jobs)
+		defer close(ordered)
+
+		for postings.Next() {
+			job := &downsampleJob{ref: postings.At(), done: make(chan struct{})}
+
+			// Get series labels and chunks. Downsampled data is sensitive to chunk boundaries
+			// and we need to preserve them to properly downsample previously downsampled data.
+			if err := indexr.Series(job.ref, &job.lset, &job.chks); err != nil {
+				return errors.Wrapf(err, "get series %d", job.ref)
+			}
+
+			select {
+			case ordered <- job:
+			case <-gctx.Done():
+				return nil
+			}
+			select {
+			case jobs <- job:
+			case <-gctx.Done():
+				return nil
+			}
+		}
+		return errors.Wrap(postings.Err(), "iterate series set")
+	}()
+	if werr := g.Wait(); werr != nil {
+		return id, stats, werr
 	}
-	if postings.Err() != nil {
-		return id, errors.Wrap(postings.Err(), "iterate series set")
+	if err != nil {
+		return id, stats, err
 	}
 
 	id = uid
 	return
 }
 
+// DownsampleStats describes the work done by Downsample. Unusual ratios of output to input samples
+// can point to pathological data, e.g. series with very irregular scrape intervals.
+type DownsampleStats struct {
+	// Series is the number of series read from the source block.
+	Series int
+	// DroppedSeries is the number of series not written to the new block, as no samples were left after downsampling.
+	DroppedSeries int
+	// InputSamples is the number of samples in chunks of the source block. For downsampled source blocks,
+	// these are samples of the count aggregate, like for OutputSamples.
+	InputSamples int64
+	// OutputSamples is the number of samples written to the new block, i.e. the number of downsampling windows.
+	OutputSamples int64
+	// CounterResets is the number of counter resets in series that are counters by the Prometheus naming
+	// conventions, as blocks do not record metric types. See isCounter.
+	CounterResets int64
+}
+
+// isCounter reports whether the series is a counter, i.e. whether its metric name has a suffix that Prometheus
+// naming conventions reserve for counters and for the cumulative series of histograms and summaries.
+func isCounter(lset labels.Labels) bool {
+	name := lset.Get(labels.MetricName)
+	for _, suffix := range []string{"_total", "_count", "_sum", "_bucket"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// downsampleJob is a single series to downsample.
+type downsampleJob struct {
+	ref  uint64
+	lset labels.Labels
+	chks []chunks.Meta
+
+	// res, inSamples, resets and err are set once done is closed.
+	res       []chunks.Meta
+	inSamples int
+	resets    int
+	err       error
+	done      chan struct{}
+}
+
+// downsampleSeries reads the chunks of the job's series and downsamples them from inRes to outRes.
+// It returns no chunks for raw series without samples left after skipping stale markers.
+// Along with the chunks, it returns the number of input samples and of counter resets applied.
+func downsampleSeries(job *downsampleJob, chunkr tsdb.ChunkReader, inRes, outRes int64, significantDigits, streamingThreshold int, all *[]sample, reuseIt *chunkenc.Iterator) (_ []chunks.Meta, inSamples, resets int, _ error) {
+	chks := job.chks
+	for i, c := range chks[1:] {
+		if chks[i].MaxTime >= c.MinTime {
+			return nil, 0, 0, errors.Errorf("found overlapping chunks within series %d. Chunks expected to be ordered by min time and non-overlapping, got: %v", job.ref, chks)
+		}
+	}
+
+	// While #183 exists, we sanitize the chunks we retrieved from the block
+	// before retrieving their samples.
+	for i, c := range chks {
+		chk, err := chunkr.Chunk(c.Ref)
+		if err != nil {
+			return nil, 0, 0, errors.Wrapf(err, "get chunk %d, series %d", c.Ref, job.ref)
+		}
+		chks[i].Chunk = chk
+		inSamples += chk.NumSamples()
+	}
+
+	// Raw and already downsampled data need different processing.
+	if inRes == 0 {
+		if streamingThreshold > 0 && inSamples > streamingThreshold {
+			res, resets, err := downsampleRawStreamed(chks, outRes, significantDigits, streamingThreshold, all, reuseIt)
+			if err != nil {
+				return nil, 0, 0, errors.Wrapf(err, "downsample series %d", job.ref)
+			}
+			return res, inSamples, resets, nil
+		}
+
+		*all = (*all)[:0]
+		for _, c := range chks {
+			// TODO(bwplotka): We can optimze this further by using in WriteSeries iterators of each chunk instead of
+			// samples. Also ensure 120 sample limit, otherwise we have gigantic chunks.
+			// https://github.com/thanos-io/thanos/issues/2542.
+			*reuseIt = c.Chunk.Iterator(*reuseIt)
+			if err := expandChunkIterator(*reuseIt, all); err != nil {
+				return nil, 0, 0, errors.Wrapf(err, "expand chunk %d, series %d", c.Ref, job.ref)
+			}
+		}
+		res, resets := downsampleRaw(*all, outRes, significantDigits, nil)
+		return res, inSamples, resets, nil
+	}
+
+	// Downsample a block that contains aggregated chunks already.
+	aggrChunks := make([]*AggrChunk, 0, len(chks))
+	for _, c := range chks {
+		ac, ok := c.Chunk.(*AggrChunk)
+		if !ok {
+			return nil, 0, 0, errors.Errorf("expected downsampled chunk (*downsample.AggrChunk) got %T instead for series: %d", c.Chunk, job.ref)
+		}
+		aggrChunks = append(aggrChunks, ac)
+	}
+	*all = (*all)[:0]
+	downsampledChunks, resets, err := downsampleAggr(
+		aggrChunks,
+		all,
+		chks[0].MinTime,
+		chks[len(chks)-1].MaxTime,
+		inRes,
+		outRes,
+		significantDigits,
+	)
+	if err != nil {
+		return nil, 0, 0, errors.Wrapf(err, "downsample aggregate block, series: %d", job.ref)
+	}
+	return downsampledChunks, inSamples, resets, nil
+}
+
 // currentWindow returns the end timestamp of the window that t falls into.
 func currentWindow(t, r int64) int64 {
 	// The next timestamp is the next number after s.t that's aligned with window.
@@ -203,11 +390,7 @@ func rangeFullness(mint, maxt, step int64, count int) float64 {
 // targetChunkCount calculates how many chunks should be produced when downsampling a series.
 // It consider the total time range, the number of input sample, the input and output resolution.
 func targetChunkCount(mint, maxt, inRes, outRes int64, count int) (x int) {
-	// We compute how many samples we could produce for the given time range and adjust
-	// it by how densely the range is actually filled given the number of input samples and their
-	// resolution.
-	maxSamples := float64((maxt - mint) / outRes)
-	expSamples := int(maxSamples*rangeFullness(mint, maxt, inRes, count)) + 1
+	expSamples := expectedSampleCount(mint, maxt, inRes, outRes, count)
 
 	// Increase the number of target chunks until each chunk will have less than
 	// 140 samples on average.
@@ -216,6 +399,60 @@ func targetChunkCount(mint, maxt, inRes, outRes int64, count int) (x int) {
 	return x
 }
 
+// expectedSampleCount calculates how many samples downsampling a series is expected to produce.
+func expectedSampleCount(mint, maxt, inRes, outRes int64, count int) int {
+	// We compute how many samples we could produce for the given time range and adjust
+	// it by how densely the range is actually filled given the number of input samples and their
+	// resolution.
+	maxSamples := float64((maxt - mint) / outRes)
+	return int(maxSamples*rangeFullness(mint, maxt, inRes, count)) + 1
+}
+
+// estimatedAggrValues is the number of aggregates in a downsampled sample which take roughly as much space as a raw
+// sample value. The count aggregate compresses to almost nothing, so it is not accounted for.
+const estimatedAggrValues = 4
+
+// EstimateDownsampledSize estimates the size in bytes of the block produced by downsampling the block described
+// by meta to the given resolution, e.g. to check disk space or prioritize work before downsampling. It applies the
+// sample count heuristic of Downsample to the block stats, assumes chunk bytes per value stay the same as in the
+// source block and that the index keeps its size, as the series don't change.
+func EstimateDownsampledSize(meta *metadata.Meta, resolution int64) (int64, error) {
+	inRes := meta.Thanos.Downsample.Resolution
+	if resolution <= inRes {
+		return 0, errors.Errorf("target resolution %d is not lower than resolution %d of block %s", resolution, inRes, meta.ULID)
+	}
+	if meta.Stats.NumSeries == 0 || meta.Stats.NumSamples == 0 {
+		return 0, nil
+	}
+
+	var chunksBytes, indexBytes int64
+	for _, f := range meta.Thanos.Files {
+		switch {
+		case f.RelPath == block.IndexFilename:
+			indexBytes = f.SizeBytes
+		case strings.HasPrefix(f.RelPath, block.ChunksDirname+"/"):
+			chunksBytes += f.SizeBytes
+		}
+	}
+	if chunksBytes == 0 || indexBytes == 0 {
+		return 0, errors.Errorf("meta of block %s does not contain sizes of its chunks and index", meta.ULID)
+	}
+
+	srcValues := float64(meta.Stats.NumSamples)
+	if inRes == ResLevel0 {
+		// We assume a raw resolution of 1 minute, same as DownsampleRaw.
+		inRes = 1 * 60 * 1000
+	} else {
+		srcValues *= estimatedAggrValues
+	}
+	bytesPerValue := float64(chunksBytes) / srcValues
+
+	samplesPerSeries := int(meta.Stats.NumSamples / meta.Stats.NumSeries)
+	outValues := float64(meta.Stats.NumSeries) * float64(expectedSampleCount(meta.MinTime, meta.MaxTime, inRes, resolution, samplesPerSeries)) * estimatedAggrValues
+
+	return indexBytes + int64(outValues*bytesPerValue), nil
+}
+
 // aggregator collects cumulative stats for a stream of values.
 type aggregator struct {
 	total   int     // Total samples processed.
@@ -264,19 +501,45 @@ func (a *aggregator) add(v float64) {
 	}
 }
 
+// RoundSignificant rounds v to the given number of significant decimal digits, so that the relative
+// rounding error is at most 5*10^-digits. Consecutive values that are equal after rounding compress
+// to almost nothing in XOR chunks. Non-positive digits, zero, NaN and infinite values are returned unchanged.
+func RoundSignificant(v float64, digits int) float64 {
+	if digits <= 0 || v == 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return v
+	}
+	// Scale by an exact power of ten, so that values already within the precision stay unchanged.
+	e := digits - int(math.Ceil(math.Log10(math.Abs(v))))
+	if e < 0 {
+		p := math.Pow10(-e)
+		if math.IsInf(p, 0) {
+			return v
+		}
+		return math.Round(v/p) * p
+	}
+	p := math.Pow10(e)
+	if math.IsInf(p, 0) {
+		return v
+	}
+	return math.Round(v*p) / p
+}
+
 // aggrChunkBuilder builds chunks for multiple different aggregates.
 type aggrChunkBuilder struct {
 	mint, maxt int64
 	added      int
+	// significantDigits, if positive, is the number of significant digits sum, min and max aggregates are rounded to.
+	significantDigits int
 
 	chunks [5]chunkenc.Chunk
 	apps   [5]chunkenc.Appender
 }
 
-func newAggrChunkBuilder() *aggrChunkBuilder {
+func newAggrChunkBuilder(significantDigits int) *aggrChunkBuilder {
 	b := &aggrChunkBuilder{
-		mint: math.MaxInt64,
-		maxt: math.MinInt64,
+		mint:              math.MaxInt64,
+		maxt:              math.MinInt64,
+		significantDigits: significantDigits,
 	}
 	b.chunks[AggrCount] = chunkenc.NewXORChunk()
 	b.chunks[AggrSum] = chunkenc.NewXORChunk()
@@ -299,9 +562,10 @@ func (b *aggrChunkBuilder) add(t int64, aggr *aggregator) {
 	if t > b.maxt {
 		b.maxt = t
 	}
-	b.apps[AggrSum].Append(t, aggr.sum)
-	b.apps[AggrMin].Append(t, aggr.min)
-	b.apps[AggrMax].Append(t, aggr.max)
+	b.apps[AggrSum].Append(t, RoundSignificant(aggr.sum, b.significantDigits))
+	b.apps[AggrMin].Append(t, RoundSignificant(aggr.min, b.significantDigits))
+	b.apps[AggrMax].Append(t, RoundSignificant(aggr.max, b.significantDigits))
+	// Count and counter are kept exact, as counter resets are detected by comparing raw values.
 	b.apps[AggrCount].Append(t, float64(aggr.count))
 	b.apps[AggrCounter].Append(t, aggr.counter)
 
@@ -318,20 +582,49 @@ func (b *aggrChunkBuilder) encode() chunks.Meta {
 
 // DownsampleRaw create a series of aggregation chunks for the given sample data.
 func DownsampleRaw(data []sample, resolution int64) []chunks.Meta {
+	chks, _ := downsampleRaw(data, resolution, 0, nil)
+	return chks
+}
+
+// counterCarry carries the last raw counter value of a batch over to the next batch of the same series, so that
+// counter resets at batch boundaries are counted too.
+type counterCarry struct {
+	ok   bool
+	last float64
+}
+
+// next returns the number of counter resets between the previous batch and a batch starting with the value first.
+// It remembers last as the last value of the batch.
+func (c *counterCarry) next(first, last float64) int {
+	resets := 0
+	if c.ok && first < c.last {
+		resets = 1
+	}
+	c.ok, c.last = true, last
+	return resets
+}
+
+// downsampleRaw is like DownsampleRaw, but additionally returns the number of counter resets within the data.
+// Resets against the last value of previously downsampled data of the same series are counted if carry is given.
+func downsampleRaw(data []sample, resolution int64, significantDigits int, carry *counterCarry) ([]chunks.Meta, int) {
 	if len(data) == 0 {
-		return nil
+		return nil, 0
+	}
+	if carry == nil {
+		carry = &counterCarry{}
 	}
 
 	mint, maxt := data[0].t, data[len(data)-1].t
 	// We assume a raw resolution of 1 minute. In practice it will often be lower
 	// but this is sufficient for our heuristic to produce well-sized chunks.
 	numChunks := targetChunkCount(mint, maxt, 1*60*1000, resolution, len(data))
-	return downsampleRawLoop(data, resolution, numChunks)
+	return downsampleRawLoop(data, resolution, numChunks, significantDigits, carry)
 }
 
-func downsampleRawLoop(data []sample, resolution int64, numChunks int) []chunks.Meta {
+func downsampleRawLoop(data []sample, resolution int64, numChunks int, significantDigits int, carry *counterCarry) ([]chunks.Meta, int) {
 	batchSize := (len(data) / numChunks) + 1
 	chks := make([]chunks.Meta, 0, numChunks)
+	resets := 0
 
 	for len(data) > 0 {
 		j := batchSize
@@ -348,12 +641,13 @@ func downsampleRawLoop(data []sample, resolution int64, numChunks int) []chunks.
 		batch := data[:j]
 		data = data[j:]
 
-		ab := newAggrChunkBuilder()
+		ab := newAggrChunkBuilder(significantDigits)
 
 		// Encode first raw value; see ApplyCounterResetsSeriesIterator.
 		ab.apps[AggrCounter].Append(batch[0].t, batch[0].v)
 
-		lastT := downsampleBatch(batch, resolution, ab.add)
+		lastT, batchResets := downsampleBatch(batch, resolution, ab.add)
+		resets += batchResets + carry.next(batch[0].v, batch[len(batch)-1].v)
 
 		// Encode last raw value; see ApplyCounterResetsSeriesIterator.
 		ab.apps[AggrCounter].Append(lastT, batch[len(batch)-1].v)
@@ -361,12 +655,65 @@ func downsampleRawLoop(data []sample, resolution int64, numChunks int) []chunks.
 		chks = append(chks, ab.encode())
 	}
 
-	return chks
+	return chks, resets
+}
+
+// downsampleRawStreamed downsamples the raw chunks like downsampleRaw does for their expanded samples, but in parts of
+// at least partSamples samples, which always end with a full window, so that at most that many samples plus one window
+// are kept in buf at once. Except for the last window of each part, which ends with its last sample like the last
+// window of every chunk, the windows are the same as for downsampleRaw.
+func downsampleRawStreamed(chks []chunks.Meta, resolution int64, significantDigits, partSamples int, buf *[]sample, reuseIt *chunkenc.Iterator) ([]chunks.Meta, int, error) {
+	var (
+		res       []chunks.Meta
+		resets    int
+		windowEnd = int64(math.MaxInt64)
+		carry     counterCarry
+	)
+	flush := func() {
+		part, partResets := downsampleRaw(*buf, resolution, significantDigits, &carry)
+		res = append(res, part...)
+		resets += partResets
+		*buf = (*buf)[:0]
+	}
+
+	*buf = (*buf)[:0]
+	for _, c := range chks {
+		*reuseIt = c.Chunk.Iterator(*reuseIt)
+		it := *reuseIt
+
+		// Same filtering as in expandChunkIterator.
+		lastT := int64(0)
+		for it.Next() {
+			t, v := it.At()
+			if value.IsStaleNaN(v) || t < lastT {
+				continue
+			}
+			lastT = t
+
+			if t > windowEnd {
+				flush()
+				windowEnd = math.MaxInt64
+			}
+			*buf = append(*buf, sample{t, v})
+			if len(*buf) >= partSamples && windowEnd == math.MaxInt64 {
+				// Complete the window of the last sample before flushing the part.
+				windowEnd = currentWindow(t, resolution)
+			}
+		}
+		if err := it.Err(); err != nil {
+			return nil, 0, errors.Wrapf(err, "expand chunk %d", c.Ref)
+		}
+	}
+	if len(*buf) > 0 {
+		flush()
+	}
+	return res, resets, nil
 }
 
 // downsampleBatch aggregates the data over the given resolution and calls add each time
-// the end of a resolution was reached.
-func downsampleBatch(data []sample, resolution int64, add func(int64, *aggregator)) int64 {
+// the end of a resolution was reached. It returns the timestamp of the last window and
+// the number of counter resets the aggregator applied.
+func downsampleBatch(data []sample, resolution int64, add func(int64, *aggregator)) (int64, int) {
 	var (
 		aggr  aggregator
 		nextT = int64(-1)
@@ -396,26 +743,29 @@ func downsampleBatch(data []sample, resolution int64, add func(int64, *aggregato
 	// Add the last sample.
 	add(nextT, &aggr)
 
-	return nextT
+	return nextT, aggr.resets
 }
 
 // downsampleAggr downsamples a sequence of aggregation chunks to the given resolution.
-func downsampleAggr(chks []*AggrChunk, buf *[]sample, mint, maxt, inRes, outRes int64) ([]chunks.Meta, error) {
+// Along with the chunks, it returns the number of counter resets applied to the counter aggregate.
+func downsampleAggr(chks []*AggrChunk, buf *[]sample, mint, maxt, inRes, outRes int64, significantDigits int) ([]chunks.Meta, int, error) {
 	var numSamples int
 	for _, c := range chks {
 		numSamples += c.NumSamples()
 	}
 	numChunks := targetChunkCount(mint, maxt, inRes, outRes, numSamples)
-	return downsampleAggrLoop(chks, buf, outRes, numChunks)
+	return downsampleAggrLoop(chks, buf, outRes, numChunks, significantDigits)
 }
 
-func downsampleAggrLoop(chks []*AggrChunk, buf *[]sample, resolution int64, numChunks int) ([]chunks.Meta, error) {
+func downsampleAggrLoop(chks []*AggrChunk, buf *[]sample, resolution int64, numChunks int, significantDigits int) ([]chunks.Meta, int, error) {
 	// We downsample aggregates only along chunk boundaries. This is required
 	// for counters to be downsampled correctly since a chunk's first and last
 	// counter values are the true values of the original series. We need
 	// to preserve them even across multiple aggregation iterations.
 	res := make([]chunks.Meta, 0, numChunks)
+	resets := 0
 	batchSize := len(chks) / numChunks
+	var carry counterCarry
 
 	for len(chks) > 0 {
 		j := batchSize
@@ -425,14 +775,15 @@ func downsampleAggrLoop(chks []*AggrChunk, buf *[]sample, resolution int64, numC
 		part := chks[:j]
 		chks = chks[j:]
 
-		chk, err := downsampleAggrBatch(part, buf, resolution)
+		chk, batchResets, err := downsampleAggrBatch(part, buf, resolution, significantDigits, &carry)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		res = append(res, chk)
+		resets += batchResets
 	}
 
-	return res, nil
+	return res, resets, nil
 }
 
 // expandChunkIterator reads all samples from the iterator and appends them to buf.
@@ -455,8 +806,10 @@ func expandChunkIterator(it chunkenc.Iterator, buf *[]sample) error {
 	return it.Err()
 }
 
-func downsampleAggrBatch(chks []*AggrChunk, buf *[]sample, resolution int64) (chk chunks.Meta, err error) {
-	ab := &aggrChunkBuilder{}
+// downsampleAggrBatch downsamples the given aggregation chunks into a single one. Along with it, it returns the number
+// of counter resets within the chunks and against the last counter value of the previous batch, kept in carry.
+func downsampleAggrBatch(chks []*AggrChunk, buf *[]sample, resolution int64, significantDigits int, carry *counterCarry) (chk chunks.Meta, resets int, err error) {
+	ab := &aggrChunkBuilder{significantDigits: significantDigits}
 	mint, maxt := int64(math.MaxInt64), int64(math.MinInt64)
 	var reuseIt chunkenc.Iterator
 
@@ -497,22 +850,22 @@ func downsampleAggrBatch(chks []*AggrChunk, buf *[]sample, resolution int64) (ch
 		// we have to sum those values.
 		return a.sum
 	}); err != nil {
-		return chk, err
+		return chk, 0, err
 	}
 	if err = do(AggrSum, func(a *aggregator) float64 {
-		return a.sum
+		return RoundSignificant(a.sum, ab.significantDigits)
 	}); err != nil {
-		return chk, err
+		return chk, 0, err
 	}
 	if err := do(AggrMin, func(a *aggregator) float64 {
-		return a.min
+		return RoundSignificant(a.min, ab.significantDigits)
 	}); err != nil {
-		return chk, err
+		return chk, 0, err
 	}
 	if err := do(AggrMax, func(a *aggregator) float64 {
-		return a.max
+		return RoundSignificant(a.max, ab.significantDigits)
 	}); err != nil {
-		return chk, err
+		return chk, 0, err
 	}
 
 	// Handle counters by applying resets directly.
@@ -522,7 +875,7 @@ func downsampleAggrBatch(chks []*AggrChunk, buf *[]sample, resolution int64) (ch
 		if err == ErrAggrNotExist {
 			continue
 		} else if err != nil {
-			return chk, err
+			return chk, 0, err
 		}
 		acs = append(acs, c.Iterator(reuseIt))
 	}
@@ -530,20 +883,22 @@ func downsampleAggrBatch(chks []*AggrChunk, buf *[]sample, resolution int64) (ch
 	it := NewApplyCounterResetsIterator(acs...)
 
 	if err := expandChunkIterator(it, buf); err != nil {
-		return chk, err
+		return chk, 0, err
 	}
 	if len(*buf) == 0 {
 		ab.mint = mint
 		ab.maxt = maxt
-		return ab.encode(), nil
+		return ab.encode(), it.resets, nil
 	}
 	ab.chunks[AggrCounter] = chunkenc.NewXORChunk()
 	ab.apps[AggrCounter], _ = ab.chunks[AggrCounter].Appender()
 
 	// Retain first raw value; see ApplyCounterResetsSeriesIterator.
 	ab.apps[AggrCounter].Append((*buf)[0].t, (*buf)[0].v)
+	// The first value with resets applied is still the first raw value.
+	boundaryResets := carry.next((*buf)[0].v, it.lastV)
 
-	lastT := downsampleBatch(*buf, resolution, func(t int64, a *aggregator) {
+	lastT, batchResets := downsampleBatch(*buf, resolution, func(t int64, a *aggregator) {
 		if t < mint {
 			mint = t
 		} else if t > maxt {
@@ -557,7 +912,7 @@ func downsampleAggrBatch(chks []*AggrChunk, buf *[]sample, resolution int64) (ch
 
 	ab.mint = mint
 	ab.maxt = maxt
-	return ab.encode(), nil
+	return ab.encode(), it.resets + batchResets + boundaryResets, nil
 }
 
 type sample struct {
@@ -590,6 +945,7 @@ type ApplyCounterResetsSeriesIterator struct {
 	lastT  int64   // Timestamp of the last sample.
 	lastV  float64 // Value of the last sample.
 	totalV float64 // Total counter state since beginning of series.
+	resets int     // Number of counter resets applied.
 }
 
 func NewApplyCounterResetsIterator(chks ...chunkenc.Iterator) *ApplyCounterResetsSeriesIterator {
@@ -626,6 +982,7 @@ func (it *ApplyCounterResetsSeriesIterator) Next() bool {
 				it.totalV += v - it.lastV
 			} else {
 				it.totalV += v
+				it.resets++
 			}
 			it.lastT, it.lastV = t, v
 			it.total++
@@ -665,6 +1022,11 @@ func (it *ApplyCounterResetsSeriesIterator) Err() error {
 	return it.chks[it.i].Err()
 }
 
+// Resets returns the number of counter resets observed so far, including resets between chunks.
+func (it *ApplyCounterResetsSeriesIterator) Resets() int {
+	return it.resets
+}
+
 // AverageChunkIterator emits an artificial series of average samples based in aggregate
 // chunks with sum and count aggregates.
 type AverageChunkIterator struct {
@@ -672,6 +1034,7 @@ type AverageChunkIterator struct {
 	sumIt chunkenc.Iterator
 	t     int64
 	v     float64
+	ok    bool // Whether t and v hold a sample.
 	err   error
 }
 
@@ -680,6 +1043,7 @@ func NewAverageChunkIterator(cnt, sum chunkenc.Iterator) *AverageChunkIterator {
 }
 
 func (it *AverageChunkIterator) Next() bool {
+	it.ok = false
 	cok, sok := it.cntIt.Next(), it.sumIt.Next()
 	if cok != sok {
 		it.err = errors.New("sum and count iterator not aligned")
@@ -696,11 +1060,25 @@ func (it *AverageChunkIterator) Next() bool {
 		return false
 	}
 	it.t, it.v = cntT, sumV/cntV
+	it.ok = true
 	return true
 }
 
+// Seek advances the iterator to the first sample with a timestamp of at least t. It does not move the iterator
+// back if the current sample is already there. Both underlying iterators are advanced in lockstep using Next, so
+// that their alignment keeps being checked.
 func (it *AverageChunkIterator) Seek(t int64) bool {
-	it.err = errors.New("seek used, but not implemented")
+	if it.err != nil {
+		return false
+	}
+	if it.ok && it.t >= t {
+		return true
+	}
+	for it.Next() {
+		if it.t >= t {
+			return true
+		}
+	}
 	return false
 }
 
@@ -4,14 +4,21 @@
 package downsample
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"io/ioutil"
 	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/pkg/value"
@@ -27,6 +34,7 @@ import (
 	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
 )
 
 func TestMain(m *testing.M) {
@@ -130,7 +138,7 @@ func TestDownsampleCounterBoundaryReset(t *testing.T) {
 	doTest := func(t *testing.T, test *test) {
 		// Asking for more chunks than raw samples ensures that downsampleRawLoop
 		// will create chunks with samples from a single window.
-		cm := downsampleRawLoop(test.raw, test.rawAggrResolution, len(test.raw)+1)
+		cm, _ := downsampleRawLoop(test.raw, test.rawAggrResolution, len(test.raw)+1, 0, &counterCarry{})
 		testutil.Equals(t, test.expectedRawAggrChunks, len(cm))
 
 		rawAggrChunks := toAggrChunks(t, cm)
@@ -138,7 +146,7 @@ func TestDownsampleCounterBoundaryReset(t *testing.T) {
 		testutil.Equals(t, test.rawCounterIterate, counterIterate(t, rawAggrChunks))
 
 		var buf []sample
-		acm, err := downsampleAggrLoop(rawAggrChunks, &buf, test.aggrAggrResolution, test.aggrChunks)
+		acm, _, err := downsampleAggrLoop(rawAggrChunks, &buf, test.aggrAggrResolution, test.aggrChunks, 0)
 		testutil.Ok(t, err)
 		testutil.Equals(t, test.aggrChunks, len(acm))
 
@@ -445,10 +453,11 @@ func TestDownsample(t *testing.T) {
 
 			fakeMeta := &metadata.Meta{}
 			if len(tcase.inAggr) > 0 {
-				fakeMeta.Thanos.Downsample.Resolution = tcase.resolution - 1
+				// Any lower resolution the target resolution is aligned to.
+				fakeMeta.Thanos.Downsample.Resolution = tcase.resolution / 2
 			}
 
-			id, err := Downsample(logger, fakeMeta, mb, dir, tcase.resolution)
+			id, _, err := Downsample(logger, fakeMeta, mb, dir, tcase.resolution)
 			if tcase.expectedDownsamplingErr != nil {
 				testutil.NotOk(t, err)
 				testutil.Equals(t, tcase.expectedDownsamplingErr(ser.chunks).Error(), err.Error())
@@ -506,6 +515,391 @@ func TestDownsample(t *testing.T) {
 	}
 }
 
+func TestDownsample_DroppedSeries(t *testing.T) {
+	logger := log.NewLogfmtLogger(os.Stderr)
+
+	dir, err := ioutil.TempDir("", "downsample-dropped")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	stale := math.Float64frombits(value.StaleNaN)
+	mb := newMemBlock()
+	mb.addSeries(&series{
+		lset:   labels.FromStrings("__name__", "a"),
+		chunks: chunksToSeriesIteratable(t, [][]sample{{{t: 100, v: 1}, {t: 200, v: 2}}}, nil).chunks,
+	})
+	mb.addSeries(&series{
+		lset:   labels.FromStrings("__name__", "b"),
+		chunks: chunksToSeriesIteratable(t, [][]sample{{{t: 100, v: stale}, {t: 200, v: stale}}}, nil).chunks,
+	})
+
+	id, stats, err := Downsample(logger, &metadata.Meta{}, mb, dir, ResLevel1)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, stats.DroppedSeries)
+
+	indexr, err := index.NewFileReader(filepath.Join(dir, id.String(), block.IndexFilename))
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, indexr.Close()) }()
+
+	pall, err := indexr.Postings(index.AllPostingsKey())
+	testutil.Ok(t, err)
+
+	var lsets []labels.Labels
+	for pall.Next() {
+		var lset labels.Labels
+		var chks []chunks.Meta
+		testutil.Ok(t, indexr.Series(pall.At(), &lset, &chks))
+		lsets = append(lsets, lset)
+	}
+	testutil.Ok(t, pall.Err())
+	testutil.Equals(t, []labels.Labels{labels.FromStrings("__name__", "a")}, lsets)
+}
+
+func TestDownsample_Stats(t *testing.T) {
+	logger := log.NewLogfmtLogger(os.Stderr)
+
+	dir, err := ioutil.TempDir("", "downsample-stats")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	t.Run("raw input", func(t *testing.T) {
+		stale := math.Float64frombits(value.StaleNaN)
+		mb := newMemBlock()
+		// Counter with two resets, spanning two 5m windows.
+		mb.addSeries(&series{
+			lset: labels.FromStrings("__name__", "a_total"),
+			chunks: chunksToSeriesIteratable(t, [][]sample{{
+				{t: 0, v: 1}, {t: 60000, v: 2}, {t: 120000, v: 3}, {t: 180000, v: 1}, {t: 240000, v: 2}, {t: 300000, v: 3}, {t: 360000, v: 0},
+			}}, nil).chunks,
+		})
+		mb.addSeries(&series{
+			lset:   labels.FromStrings("__name__", "b"),
+			chunks: chunksToSeriesIteratable(t, [][]sample{{{t: 100, v: stale}, {t: 200, v: stale}}}, nil).chunks,
+		})
+		// Decreasing gauge values are no counter resets.
+		mb.addSeries(&series{
+			lset:   labels.FromStrings("__name__", "c"),
+			chunks: chunksToSeriesIteratable(t, [][]sample{{{t: 0, v: 3}, {t: 60000, v: 2}, {t: 120000, v: 1}}}, nil).chunks,
+		})
+
+		_, stats, err := Downsample(logger, &metadata.Meta{}, mb, dir, ResLevel1)
+		testutil.Ok(t, err)
+		testutil.Equals(t, DownsampleStats{
+			Series:        3,
+			DroppedSeries: 1,
+			InputSamples:  12,
+			OutputSamples: 3,
+			CounterResets: 2,
+		}, stats)
+	})
+	t.Run("aggregated input", func(t *testing.T) {
+		mb := newMemBlock()
+		// Two 5m chunks with a counter reset between them, each chunk keeps its first and last raw counter value.
+		s := chunksToSeriesIteratable(t, nil, []map[AggrType][]sample{
+			{
+				AggrCount:   {{t: 299999, v: 5}},
+				AggrCounter: {{t: 0, v: 1}, {t: 299999, v: 5}, {t: 299999, v: 5}},
+			},
+			{
+				AggrCount:   {{t: 599999, v: 5}},
+				AggrCounter: {{t: 300000, v: 1}, {t: 599999, v: 3}, {t: 599999, v: 3}},
+			},
+		})
+		s.lset = labels.FromStrings("__name__", "a_total")
+		mb.addSeries(s)
+
+		meta := &metadata.Meta{}
+		meta.Thanos.Downsample.Resolution = ResLevel1
+		_, stats, err := Downsample(logger, meta, mb, dir, ResLevel2)
+		testutil.Ok(t, err)
+		testutil.Equals(t, DownsampleStats{
+			Series:        1,
+			InputSamples:  2,
+			OutputSamples: 1,
+			CounterResets: 1,
+		}, stats)
+	})
+}
+
+func TestDownsample_ULIDFunc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "downsample-ulid")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Downsampling the same block with the same clock and entropy results in the same ID.
+	for i := 0; i < 2; i++ {
+		mb := newMemBlock()
+		mb.addSeries(chunksToSeriesIteratable(t, [][]sample{{{t: 100, v: 1}, {t: 200, v: 2}}}, nil))
+
+		outDir := filepath.Join(dir, fmt.Sprintf("%d", i))
+		testutil.Ok(t, os.MkdirAll(outDir, os.ModePerm))
+		newULID := block.NewULIDFunc(func() time.Time { return now }, rand.New(rand.NewSource(1)))
+		id, _, err := Downsample(log.NewNopLogger(), &metadata.Meta{}, mb, outDir, ResLevel1, WithULIDFunc(newULID))
+		testutil.Ok(t, err)
+		testutil.Equals(t, ulid.MustNew(ulid.Timestamp(now), rand.New(rand.NewSource(1))), id)
+
+		meta, err := metadata.ReadFromDir(filepath.Join(outDir, id.String()))
+		testutil.Ok(t, err)
+		testutil.Equals(t, id, meta.ULID)
+	}
+}
+
+func TestDownsample_CustomResolution(t *testing.T) {
+	const (
+		sixHours = int64(6 * 60 * 60 * 1000)
+		oneDay   = int64(24 * 60 * 60 * 1000)
+		minute   = int64(60 * 1000)
+		// Two days of samples scraped every minute.
+		numSamples = 2 * 24 * 60
+		// Counter reset after 30h, in the middle of the 6h window [24h, 30h].
+		resetAt = 30*60 + 17
+	)
+	logger := log.NewNopLogger()
+
+	dir, err := ioutil.TempDir("", "downsample-custom-resolution")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	var raw [][]sample
+	for i := 0; i < numSamples; i++ {
+		if i%120 == 0 {
+			raw = append(raw, nil)
+		}
+		v := float64(i)
+		if i >= resetAt {
+			v = float64(i - resetAt)
+		}
+		raw[len(raw)-1] = append(raw[len(raw)-1], sample{t: int64(i) * minute, v: v})
+	}
+	// The counter increased by one each minute, except for the reset.
+	expectedIncrease := float64(numSamples - 2)
+
+	// readAggr returns the count samples and the counter value with resets applied of the only series in the block.
+	readAggr := func(t *testing.T, id ulid.ULID) (counts []sample, counter float64) {
+		indexr, err := index.NewFileReader(filepath.Join(dir, id.String(), block.IndexFilename))
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, indexr.Close()) }()
+
+		chunkr, err := chunks.NewDirReader(filepath.Join(dir, id.String(), block.ChunksDirname), NewPool())
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, chunkr.Close()) }()
+
+		pall, err := indexr.Postings(index.AllPostingsKey())
+		testutil.Ok(t, err)
+		testutil.Assert(t, pall.Next(), "expected a series")
+
+		var (
+			lset  labels.Labels
+			chks  []chunks.Meta
+			iters []chunkenc.Iterator
+		)
+		testutil.Ok(t, indexr.Series(pall.At(), &lset, &chks))
+		testutil.Assert(t, !pall.Next(), "expected a single series")
+		for _, c := range chks {
+			chk, err := chunkr.Chunk(c.Ref)
+			testutil.Ok(t, err)
+
+			cc, err := chk.(*AggrChunk).Get(AggrCount)
+			testutil.Ok(t, err)
+			testutil.Ok(t, expandChunkIterator(cc.Iterator(nil), &counts))
+
+			cr, err := chk.(*AggrChunk).Get(AggrCounter)
+			testutil.Ok(t, err)
+			iters = append(iters, cr.Iterator(nil))
+		}
+
+		it := NewApplyCounterResetsIterator(iters...)
+		for it.Next() {
+			_, counter = it.At()
+		}
+		testutil.Ok(t, it.Err())
+		return counts, counter
+	}
+
+	mb := newMemBlock()
+	mb.addSeries(chunksToSeriesIteratable(t, raw, nil))
+	sixHoursID, _, err := Downsample(logger, &metadata.Meta{}, mb, dir, sixHours)
+	testutil.Ok(t, err)
+
+	counts, counter := readAggr(t, sixHoursID)
+	testutil.Equals(t, 8, len(counts))
+	for i, s := range counts[:len(counts)-1] {
+		testutil.Equals(t, sample{t: int64(i+1)*sixHours - 1, v: 360}, s)
+	}
+	// The last window ends with the last sample.
+	testutil.Equals(t, sample{t: (numSamples - 1) * minute, v: 360}, counts[len(counts)-1])
+	testutil.Equals(t, expectedIncrease, counter)
+
+	meta, err := metadata.ReadFromDir(filepath.Join(dir, sixHoursID.String()))
+	testutil.Ok(t, err)
+	testutil.Equals(t, sixHours, meta.Thanos.Downsample.Resolution)
+
+	b, err := tsdb.OpenBlock(logger, filepath.Join(dir, sixHoursID.String()), NewPool())
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, b.Close()) }()
+
+	t.Run("further downsampling to an aligned resolution", func(t *testing.T) {
+		oneDayID, _, err := Downsample(logger, meta, b, dir, oneDay)
+		testutil.Ok(t, err)
+
+		counts, counter := readAggr(t, oneDayID)
+		testutil.Equals(t, []sample{{t: oneDay - 1, v: 1440}, {t: (numSamples - 1) * minute, v: 1440}}, counts)
+		testutil.Equals(t, expectedIncrease, counter)
+	})
+	t.Run("unaligned resolution", func(t *testing.T) {
+		_, _, err := Downsample(logger, meta, b, dir, 9*60*60*1000)
+		testutil.NotOk(t, err)
+		testutil.Equals(t, fmt.Sprintf("target resolution %d is not a multiple of source resolution %d", 9*60*60*1000, sixHours), err.Error())
+	})
+}
+
+func TestDownsample_Concurrency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "downsample-concurrency")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	logger := log.NewLogfmtLogger(os.Stderr)
+	bdir := createDownsampleTestBlock(t, dir, 500)
+	meta, err := metadata.ReadFromDir(bdir)
+	testutil.Ok(t, err)
+
+	// downsample downsamples the block in bdir with the given concurrency and returns the directory of the result.
+	downsample := func(t *testing.T, bdir string, meta *metadata.Meta, resolution int64, concurrency int) string {
+		b, err := tsdb.OpenBlock(logger, bdir, NewPool())
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, b.Close()) }()
+
+		outDir := filepath.Join(dir, fmt.Sprintf("out-%d-%d", resolution, concurrency))
+		testutil.Ok(t, os.MkdirAll(outDir, os.ModePerm))
+		id, _, err := Downsample(logger, meta, b, outDir, resolution, WithConcurrency(concurrency))
+		testutil.Ok(t, err)
+		return filepath.Join(outDir, id.String())
+	}
+	// assertSameBlock asserts that the index and chunks of both blocks are byte-identical.
+	assertSameBlock := func(t *testing.T, expected, actual string) {
+		expectedFiles, actualFiles := blockFileSizes(t, expected), blockFileSizes(t, actual)
+		testutil.Equals(t, expectedFiles, actualFiles)
+		for _, f := range expectedFiles {
+			exp, err := ioutil.ReadFile(filepath.Join(expected, f.RelPath))
+			testutil.Ok(t, err)
+			act, err := ioutil.ReadFile(filepath.Join(actual, f.RelPath))
+			testutil.Ok(t, err)
+			testutil.Assert(t, bytes.Equal(exp, act), "file %s differs", f.RelPath)
+		}
+	}
+
+	sequential := downsample(t, bdir, meta, ResLevel1, 1)
+	for _, concurrency := range []int{2, 8} {
+		t.Run(fmt.Sprintf("raw input with concurrency %d", concurrency), func(t *testing.T) {
+			assertSameBlock(t, sequential, downsample(t, bdir, meta, ResLevel1, concurrency))
+		})
+	}
+
+	aggrMeta, err := metadata.ReadFromDir(sequential)
+	testutil.Ok(t, err)
+	aggrSequential := downsample(t, sequential, aggrMeta, ResLevel2, 1)
+	for _, concurrency := range []int{2, 8} {
+		t.Run(fmt.Sprintf("aggregated input with concurrency %d", concurrency), func(t *testing.T) {
+			assertSameBlock(t, aggrSequential, downsample(t, sequential, aggrMeta, ResLevel2, concurrency))
+		})
+	}
+}
+
+func BenchmarkDownsample(b *testing.B) {
+	dir, err := ioutil.TempDir("", "bench-downsample")
+	testutil.Ok(b, err)
+	defer func() { testutil.Ok(b, os.RemoveAll(dir)) }()
+
+	bdir := createDownsampleTestBlock(b, dir, 5000)
+	meta, err := metadata.ReadFromDir(bdir)
+	testutil.Ok(b, err)
+
+	blk, err := tsdb.OpenBlock(log.NewNopLogger(), bdir, NewPool())
+	testutil.Ok(b, err)
+	defer func() { testutil.Ok(b, blk.Close()) }()
+
+	for _, concurrency := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			outDir := filepath.Join(dir, fmt.Sprintf("out-%d", concurrency))
+			testutil.Ok(b, os.MkdirAll(outDir, os.ModePerm))
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				id, _, err := Downsample(log.NewNopLogger(), meta, blk, outDir, ResLevel1, WithConcurrency(concurrency))
+				testutil.Ok(b, err)
+				testutil.Ok(b, os.RemoveAll(filepath.Join(outDir, id.String())))
+			}
+		})
+	}
+}
+
+// createDownsampleTestBlock creates a raw block in dir with the given number of series, each with 12h of samples
+// scraped every 15 seconds, and returns its directory.
+func createDownsampleTestBlock(t testing.TB, dir string, numSeries int) string {
+	var series []labels.Labels
+	for i := 0; i < numSeries; i++ {
+		series = append(series, labels.FromStrings("__name__", "a", "i", fmt.Sprintf("%d", i)))
+	}
+	id, err := e2eutil.CreateBlock(context.Background(), dir, series, 2880, 0, 12*60*60*1000, labels.FromStrings("ext1", "1"), ResLevel0, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	return filepath.Join(dir, id.String())
+}
+
+func TestEstimateDownsampledSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "downsample-estimate")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	var series []labels.Labels
+	for i := 0; i < 20; i++ {
+		series = append(series, labels.FromStrings("__name__", "a", "i", fmt.Sprintf("%d", i)))
+	}
+	// 12h of samples scraped every minute.
+	id, err := e2eutil.CreateBlock(context.Background(), dir, series, 720, 0, 12*60*60*1000, labels.FromStrings("ext1", "1"), ResLevel0, metadata.NoneFunc)
+	testutil.Ok(t, err)
+
+	bdir := filepath.Join(dir, id.String())
+	meta, err := metadata.ReadFromDir(bdir)
+	testutil.Ok(t, err)
+	meta.Thanos.Files = blockFileSizes(t, bdir)
+
+	_, err = EstimateDownsampledSize(meta, ResLevel0)
+	testutil.NotOk(t, err)
+
+	estimate, err := EstimateDownsampledSize(meta, ResLevel1)
+	testutil.Ok(t, err)
+
+	b, err := tsdb.OpenBlock(log.NewNopLogger(), bdir, chunkenc.NewPool())
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, b.Close()) }()
+
+	outDir := filepath.Join(dir, "out")
+	testutil.Ok(t, os.MkdirAll(outDir, os.ModePerm))
+	outID, _, err := Downsample(log.NewNopLogger(), meta, b, outDir, ResLevel1)
+	testutil.Ok(t, err)
+
+	var actual int64
+	for _, f := range blockFileSizes(t, filepath.Join(outDir, outID.String())) {
+		actual += f.SizeBytes
+	}
+	testutil.Assert(t, estimate > actual/2 && estimate < actual*2, "estimate %d is too far from actual size %d", estimate, actual)
+}
+
+// blockFileSizes returns the sizes of the chunks and index files of the block in bdir.
+func blockFileSizes(t *testing.T, bdir string) (files []metadata.File) {
+	chunkFiles, err := ioutil.ReadDir(filepath.Join(bdir, block.ChunksDirname))
+	testutil.Ok(t, err)
+	for _, f := range chunkFiles {
+		files = append(files, metadata.File{RelPath: filepath.Join(block.ChunksDirname, f.Name()), SizeBytes: f.Size()})
+	}
+
+	index, err := os.Stat(filepath.Join(bdir, block.IndexFilename))
+	testutil.Ok(t, err)
+	return append(files, metadata.File{RelPath: block.IndexFilename, SizeBytes: index.Size()})
+}
+
 func chunksToSeriesIteratable(t *testing.T, inRaw [][]sample, inAggr []map[AggrType][]sample) *series {
 	if len(inRaw) > 0 && len(inAggr) > 0 {
 		t.Fatalf("test must not have raw and aggregate input data at once")
@@ -535,7 +929,7 @@ func chunksToSeriesIteratable(t *testing.T, inRaw [][]sample, inAggr []map[AggrT
 	return ser
 }
 func encodeTestAggrSeries(v map[AggrType][]sample) chunks.Meta {
-	b := newAggrChunkBuilder()
+	b := newAggrChunkBuilder(0)
 	// we cannot use `b.add` as we have separate samples, do it manually, but make sure to
 	// calculate overall chunk time ranges.
 	for at, d := range v {
@@ -552,6 +946,189 @@ func encodeTestAggrSeries(v map[AggrType][]sample) chunks.Meta {
 	return b.encode()
 }
 
+func TestRoundSignificant(t *testing.T) {
+	for _, tcase := range []struct {
+		v        float64
+		digits   int
+		expected float64
+	}{
+		{v: 123.456, digits: 0, expected: 123.456},
+		{v: 123.456, digits: 2, expected: 120},
+		{v: 123.456, digits: 4, expected: 123.5},
+		{v: -123.456, digits: 4, expected: -123.5},
+		{v: 0.00123456, digits: 3, expected: 0.00123},
+		{v: 987654321, digits: 3, expected: 988000000},
+		{v: 100, digits: 1, expected: 100},
+		{v: 0, digits: 3, expected: 0},
+		{v: math.Inf(1), digits: 3, expected: math.Inf(1)},
+		{v: 5e-324, digits: 3, expected: 5e-324},
+	} {
+		t.Run(fmt.Sprintf("%v/%d", tcase.v, tcase.digits), func(t *testing.T) {
+			testutil.Equals(t, tcase.expected, RoundSignificant(tcase.v, tcase.digits))
+		})
+	}
+	testutil.Assert(t, math.IsNaN(RoundSignificant(math.NaN(), 3)), "expected NaN to be kept")
+}
+
+func TestDownsampleRaw_SignificantDigits(t *testing.T) {
+	// Noisy, slowly changing gauge scraped every 15s for two days.
+	rnd := rand.New(rand.NewSource(1))
+	var data []sample
+	for i := int64(0); i < 2*24*60*4; i++ {
+		data = append(data, sample{t: i * 15 * 1000, v: 1000 + 100*math.Sin(float64(i)/500) + rnd.Float64()})
+	}
+
+	aggrSize := func(chks []chunks.Meta) (size int) {
+		for _, c := range chks {
+			for _, at := range []AggrType{AggrSum, AggrMin, AggrMax} {
+				chk, err := c.Chunk.(*AggrChunk).Get(at)
+				testutil.Ok(t, err)
+				size += len(chk.Bytes())
+			}
+		}
+		return size
+	}
+	exact, _ := downsampleRaw(data, ResLevel1, 0, nil)
+	testutil.Equals(t, exact, DownsampleRaw(data, ResLevel1))
+
+	const digits = 4
+	rounded, _ := downsampleRaw(data, ResLevel1, digits, nil)
+	testutil.Equals(t, len(exact), len(rounded))
+	testutil.Assert(t, aggrSize(rounded) < aggrSize(exact), "expected rounded aggregates to compress better, got %d >= %d bytes", aggrSize(rounded), aggrSize(exact))
+
+	maxRelErr := 5 * math.Pow(10, -digits)
+	for i := range exact {
+		for _, at := range []AggrType{AggrCount, AggrSum, AggrMin, AggrMax, AggrCounter} {
+			exactChk, err := exact[i].Chunk.(*AggrChunk).Get(at)
+			testutil.Ok(t, err)
+			roundedChk, err := rounded[i].Chunk.(*AggrChunk).Get(at)
+			testutil.Ok(t, err)
+
+			var exactSamples, roundedSamples []sample
+			testutil.Ok(t, expandChunkIterator(exactChk.Iterator(nil), &exactSamples))
+			testutil.Ok(t, expandChunkIterator(roundedChk.Iterator(nil), &roundedSamples))
+			testutil.Equals(t, len(exactSamples), len(roundedSamples))
+
+			for j := range exactSamples {
+				testutil.Equals(t, exactSamples[j].t, roundedSamples[j].t)
+				if at == AggrCount || at == AggrCounter {
+					// Count and counter aggregates are never rounded.
+					testutil.Equals(t, exactSamples[j].v, roundedSamples[j].v)
+					continue
+				}
+				relErr := math.Abs(roundedSamples[j].v-exactSamples[j].v) / math.Abs(exactSamples[j].v)
+				testutil.Assert(t, relErr <= maxRelErr, "relative error %v above %v for %v aggregate: %v vs %v", relErr, maxRelErr, at, roundedSamples[j].v, exactSamples[j].v)
+			}
+		}
+	}
+}
+
+func TestDownsampleRawStreamed(t *testing.T) {
+	// A year of samples scraped every 15s, with a counter reset every day and some stale markers.
+	const (
+		numSamples   = 365 * 24 * 60 * 4
+		partSamples  = 10000
+		samplesInDay = 24 * 60 * 4
+	)
+	var chks []chunks.Meta
+	for i := 0; i < numSamples; i += 120 {
+		chk := chunkenc.NewXORChunk()
+		app, err := chk.Appender()
+		testutil.Ok(t, err)
+
+		j := i
+		for ; j < i+120 && j < numSamples; j++ {
+			v := float64(j % samplesInDay)
+			if j%1000 == 999 {
+				v = math.Float64frombits(value.StaleNaN)
+			}
+			app.Append(int64(j)*15000, v)
+		}
+		chks = append(chks, chunks.Meta{MinTime: int64(i) * 15000, MaxTime: int64(j-1) * 15000, Chunk: chk})
+	}
+
+	var all []sample
+	for _, c := range chks {
+		testutil.Ok(t, expandChunkIterator(c.Chunk.Iterator(nil), &all))
+	}
+	exact, exactResets := downsampleRaw(all, ResLevel1, 0, nil)
+
+	var (
+		buf            []sample
+		reuseIt        chunkenc.Iterator
+		before         runtime.MemStats
+		after          runtime.MemStats
+		streamed       []chunks.Meta
+		streamedResets int
+		err            error
+	)
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	streamed, streamedResets, err = downsampleRawStreamed(chks, ResLevel1, 0, partSamples, &buf, &reuseIt)
+	runtime.ReadMemStats(&after)
+	testutil.Ok(t, err)
+
+	// Only about a part of samples is buffered at once and, including the output, less is allocated than
+	// materializing the series once, which takes 16 bytes per sample.
+	testutil.Assert(t, cap(buf) < 4*partSamples, "expected buffer to stay bounded, got capacity %d", cap(buf))
+	allocated := after.TotalAlloc - before.TotalAlloc
+	testutil.Assert(t, allocated < numSamples*16, "expected allocations to stay bounded, got %d bytes", allocated)
+
+	expand := func(chks []chunks.Meta, at AggrType) (res []sample) {
+		for _, c := range chks {
+			ac, err := c.Chunk.(*AggrChunk).Get(at)
+			testutil.Ok(t, err)
+			testutil.Ok(t, expandChunkIterator(ac.Iterator(nil), &res))
+		}
+		return res
+	}
+	// The windows are the same, only the last window of a part ends with its last sample.
+	for _, at := range []AggrType{AggrCount, AggrSum, AggrMin, AggrMax} {
+		exactSamples, streamedSamples := expand(exact, at), expand(streamed, at)
+		testutil.Equals(t, len(exactSamples), len(streamedSamples))
+		for i := range exactSamples {
+			testutil.Equals(t, currentWindow(exactSamples[i].t, ResLevel1), currentWindow(streamedSamples[i].t, ResLevel1))
+			testutil.Equals(t, exactSamples[i].v, streamedSamples[i].v)
+		}
+	}
+
+	// Counter aggregates keep the first and last raw value of each chunk, so the counter increase is the same.
+	counterIncrease := func(chks []chunks.Meta) float64 {
+		var its []chunkenc.Iterator
+		for _, c := range chks {
+			ac, err := c.Chunk.(*AggrChunk).Get(AggrCounter)
+			testutil.Ok(t, err)
+			its = append(its, ac.Iterator(nil))
+		}
+		var v float64
+		for it := NewApplyCounterResetsIterator(its...); it.Next(); {
+			_, v = it.At()
+		}
+		return v
+	}
+	testutil.Equals(t, counterIncrease(exact), counterIncrease(streamed))
+
+	// Resets at chunk and part boundaries are counted as well.
+	testutil.Equals(t, numSamples/samplesInDay-1, exactResets)
+	testutil.Equals(t, numSamples/samplesInDay-1, streamedResets)
+}
+
+func TestDownsampleRawLoop_CounterResetsAcrossBatches(t *testing.T) {
+	// With a resolution of 1, every sample is its own window, so the data is split into batches of 3 and 1 samples,
+	// with the counter reset between them.
+	data := []sample{{t: 0, v: 1}, {t: 1, v: 2}, {t: 2, v: 3}, {t: 3, v: 1}}
+	chks, resets := downsampleRawLoop(data, 1, 2, 0, &counterCarry{})
+	testutil.Equals(t, 2, len(chks))
+	testutil.Equals(t, 1, resets)
+
+	// The last value of previously downsampled data of the same series is carried over.
+	carry := &counterCarry{}
+	_, resets = downsampleRaw(data[:3], 1, 0, carry)
+	testutil.Equals(t, 0, resets)
+	_, resets = downsampleRaw(data[3:], 1, 0, carry)
+	testutil.Equals(t, 1, resets)
+}
+
 func TestAverageChunkIterator(t *testing.T) {
 	sum := []sample{{100, 30}, {200, 40}, {300, 5}, {400, -10}}
 	cnt := []sample{{100, 1}, {200, 5}, {300, 2}, {400, 10}}
@@ -568,6 +1145,53 @@ func TestAverageChunkIterator(t *testing.T) {
 	testutil.Equals(t, exp, res)
 }
 
+func TestAverageChunkIteratorSeek(t *testing.T) {
+	sum := []sample{{100, 30}, {200, 40}, {300, 5}, {400, -10}}
+	cnt := []sample{{100, 1}, {200, 5}, {300, 2}, {400, 10}}
+
+	for _, tcase := range []struct {
+		name string
+		seek int64
+		exp  []sample
+	}{
+		{name: "before first sample", seek: 50, exp: []sample{{100, 30}, {200, 8}, {300, 2.5}, {400, -1}}},
+		{name: "at a sample", seek: 200, exp: []sample{{200, 8}, {300, 2.5}, {400, -1}}},
+		{name: "between samples", seek: 250, exp: []sample{{300, 2.5}, {400, -1}}},
+		{name: "at last sample", seek: 400, exp: []sample{{400, -1}}},
+		{name: "past last sample", seek: 500},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			x := NewAverageChunkIterator(newSampleIterator(cnt), newSampleIterator(sum))
+
+			var res []sample
+			if x.Seek(tcase.seek) {
+				ts, v := x.At()
+				res = append(res, sample{ts, v})
+				for x.Next() {
+					ts, v := x.At()
+					res = append(res, sample{ts, v})
+				}
+			}
+			testutil.Ok(t, x.Err())
+			testutil.Equals(t, tcase.exp, res)
+		})
+	}
+
+	t.Run("seek does not go back", func(t *testing.T) {
+		x := NewAverageChunkIterator(newSampleIterator(cnt), newSampleIterator(sum))
+		testutil.Assert(t, x.Seek(300), "expected sample")
+		testutil.Assert(t, x.Seek(100), "expected sample")
+		ts, v := x.At()
+		testutil.Equals(t, sample{300, 2.5}, sample{ts, v})
+	})
+	t.Run("misaligned iterators", func(t *testing.T) {
+		x := NewAverageChunkIterator(newSampleIterator(cnt), newSampleIterator([]sample{{100, 30}, {250, 40}}))
+		testutil.Assert(t, !x.Seek(300), "expected no sample")
+		testutil.NotOk(t, x.Err())
+		testutil.Assert(t, !x.Seek(300), "expected no sample after error")
+	})
+}
+
 var (
 	realisticChkDataWithCounterResetsAfterCounterSeriesIterating = []sample{
 		{t: 1587690005791, v: 461968}, {t: 1587690020791, v: 462151}, {t: 1587690035797, v: 462336}, {t: 1587690050791, v: 462650}, {t: 1587690065791, v: 462813}, {t: 1587690080791, v: 462987}, {t: 1587690095791, v: 463095}, {t: 1587690110791, v: 463247}, {t: 1587690125791, v: 463440}, {t: 1587690140791, v: 463642}, {t: 1587690155791, v: 463811},
@@ -709,6 +1333,32 @@ func TestCounterSeriesIteratorSeek(t *testing.T) {
 	testutil.Equals(t, exp, res)
 }
 
+func TestCounterSeriesIteratorResets(t *testing.T) {
+	chunks := [][]sample{
+		// Reset within the chunk, the last sample carries the true last value.
+		{{100, 10}, {200, 20}, {300, 5}, {400, 15}, {400, 15}},
+		// Reset between chunks.
+		{{500, 3}, {600, 8}},
+	}
+
+	var its []chunkenc.Iterator
+	for _, c := range chunks {
+		its = append(its, newSampleIterator(c))
+	}
+
+	x := NewApplyCounterResetsIterator(its...)
+	testutil.Equals(t, 0, x.Resets())
+
+	var res []sample
+	for x.Next() {
+		ts, v := x.At()
+		res = append(res, sample{ts, v})
+	}
+	testutil.Ok(t, x.Err())
+	testutil.Equals(t, []sample{{100, 10}, {200, 20}, {300, 25}, {400, 35}, {500, 38}, {600, 43}}, res)
+	testutil.Equals(t, 2, x.Resets())
+}
+
 func TestCounterSeriesIteratorSeekExtendTs(t *testing.T) {
 	chunks := [][]sample{
 		{{100, 10}, {200, 20}, {300, 10}, {400, 20}, {400, 5}},
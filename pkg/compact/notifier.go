@@ -0,0 +1,138 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// EventType is the kind of operation an Event reports.
+type EventType string
+
+const (
+	// EventCompaction is reported once a group compaction finished or failed.
+	EventCompaction EventType = "compaction"
+	// EventDownsample is reported once downsampling of a block finished or failed.
+	EventDownsample EventType = "downsample"
+)
+
+// Event describes a finished compaction or downsample operation.
+type Event struct {
+	Type  EventType `json:"type"`
+	Group string    `json:"group"`
+	// Blocks are the source blocks of the operation.
+	Blocks []ulid.ULID `json:"blocks"`
+	// Result is the block produced by the operation, if it is known.
+	Result          *ulid.ULID `json:"result,omitempty"`
+	DurationSeconds float64    `json:"duration_seconds"`
+	Success         bool       `json:"success"`
+	Error           string     `json:"error,omitempty"`
+}
+
+// NewEvent returns an event of the given type for the given group and source blocks. The result block is only set
+// if it is non-zero, success and error are derived from err.
+func NewEvent(typ EventType, group string, blocks []ulid.ULID, result ulid.ULID, duration time.Duration, err error) Event {
+	e := Event{
+		Type:            typ,
+		Group:           group,
+		Blocks:          blocks,
+		DurationSeconds: duration.Seconds(),
+		Success:         err == nil,
+	}
+	if result != (ulid.ULID{}) {
+		e.Result = &result
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return e
+}
+
+// Notifier is notified by the compactor after each compaction and downsample operation.
+// It is called synchronously from the compacting goroutine, so implementations should bound the time they block.
+type Notifier interface {
+	Notify(ctx context.Context, e Event) error
+}
+
+// NewNotifierEventCallback returns a GroupCompactEventCallback notifying the given notifier once a group compaction
+// finished or failed, i.e. on uploaded and failed events. The notified duration is the time spent in the whole
+// compaction, since it was planned. Failed notifications are logged only.
+func NewNotifierEventCallback(logger log.Logger, notifier Notifier) GroupCompactEventCallback {
+	var (
+		mtx sync.Mutex
+		// Start of the compaction in progress, by group key.
+		begins = map[string]time.Time{}
+	)
+	return func(e GroupCompactEvent) {
+		mtx.Lock()
+		switch e.Type {
+		case GroupCompactEventPlanned:
+			begins[e.GroupKey] = time.Now().Add(-e.Duration)
+			mtx.Unlock()
+			return
+		case GroupCompactEventUploaded, GroupCompactEventFailed:
+		default:
+			mtx.Unlock()
+			return
+		}
+		duration := e.Duration
+		if begin, ok := begins[e.GroupKey]; ok {
+			duration = time.Since(begin)
+			delete(begins, e.GroupKey)
+		}
+		mtx.Unlock()
+
+		if err := notifier.Notify(context.Background(), NewEvent(EventCompaction, e.GroupKey, e.Blocks, e.Result, duration, e.Err)); err != nil {
+			level.Warn(logger).Log("msg", "failed to notify about compaction", "group", e.GroupKey, "err", err)
+		}
+	}
+}
+
+// HTTPNotifier is a Notifier that POSTs events as JSON to a webhook URL.
+type HTTPNotifier struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPNotifier returns a Notifier posting events to the given URL. Each request is aborted after the given timeout,
+// zero means no timeout.
+func NewHTTPNotifier(url string, timeout time.Duration) *HTTPNotifier {
+	return &HTTPNotifier{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+// Notify implements Notifier.
+func (n *HTTPNotifier) Notify(ctx context.Context, e Event) (err error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "marshal event")
+	}
+	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "post event to %s", n.url)
+	}
+	defer runutil.ExhaustCloseWithErrCapture(&err, resp.Body, "close webhook response body")
+
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("post event to %s: unexpected status %s", n.url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package compact
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/testutil/e2eutil"
+)
+
+func TestHTTPNotifier_GroupCompact(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "test-compact-notifier")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	var (
+		mtx      sync.Mutex
+		payloads []map[string]interface{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		testutil.Equals(t, http.MethodPost, r.Method)
+		testutil.Equals(t, "application/json", r.Header.Get("Content-Type"))
+
+		var p map[string]interface{}
+		testutil.Ok(t, json.NewDecoder(r.Body).Decode(&p))
+		mtx.Lock()
+		payloads = append(payloads, p)
+		mtx.Unlock()
+	}))
+	defer srv.Close()
+
+	bkt := objstore.NewInMemBucket()
+	var (
+		metas []*metadata.Meta
+		ids   []interface{}
+	)
+	metasByID := map[ulid.ULID]*metadata.Meta{}
+	for i := int64(0); i < 2; i++ {
+		id, err := e2eutil.CreateBlock(ctx, filepath.Join(dir, "src"), []labels.Labels{{{Name: "a", Value: "1"}}}, 10, i*100, (i+1)*100, labels.Labels{{Name: "e1", Value: "1"}}, 0, metadata.NoneFunc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt, filepath.Join(dir, "src", id.String()), metadata.NoneFunc))
+		m, err := block.DownloadMeta(ctx, log.NewNopLogger(), bkt, id)
+		testutil.Ok(t, err)
+		metas = append(metas, &m)
+		ids = append(ids, id.String())
+		metasByID[id] = &m
+	}
+
+	counter := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
+	grouper := NewDefaultGrouper(nil, bkt, false, false, nil, counter, counter, metadata.NoneFunc, WithEventCallback(NewNotifierEventCallback(log.NewNopLogger(), NewHTTPNotifier(srv.URL, 5*time.Second))))
+	groups, err := grouper.Groups(metasByID)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(groups))
+
+	comp, err := tsdb.NewLeveledCompactor(ctx, nil, log.NewNopLogger(), []int64{1000, 3000}, nil, nil)
+	testutil.Ok(t, err)
+
+	_, compID, err := groups[0].Compact(ctx, filepath.Join(dir, "compact"), staticPlanner(metas), comp)
+	testutil.Ok(t, err)
+	testutil.Assert(t, compID != ulid.ULID{}, "expected compacted block")
+
+	mtx.Lock()
+	testutil.Equals(t, 1, len(payloads))
+	p := payloads[0]
+	mtx.Unlock()
+
+	testutil.Equals(t, "compaction", p["type"])
+	testutil.Equals(t, groups[0].Key(), p["group"])
+	testutil.Equals(t, ids, p["blocks"])
+	testutil.Equals(t, compID.String(), p["result"])
+	testutil.Equals(t, true, p["success"])
+	_, ok := p["error"]
+	testutil.Assert(t, !ok, "expected no error in payload, got %v", p)
+	d, ok := p["duration_seconds"].(float64)
+	testutil.Assert(t, ok && d >= 0, "expected non-negative duration, got %v", p["duration_seconds"])
+
+	// Nothing planned, nothing notified.
+	_, _, err = groups[0].Compact(ctx, filepath.Join(dir, "compact"), staticPlanner(nil), comp)
+	testutil.Ok(t, err)
+	mtx.Lock()
+	testutil.Equals(t, 1, len(payloads))
+	mtx.Unlock()
+}
+
+type recordingNotifier struct {
+	events []Event
+}
+
+func (n *recordingNotifier) Notify(_ context.Context, e Event) error {
+	n.events = append(n.events, e)
+	return errors.New("notification failed")
+}
+
+func TestNotifierEventCallback(t *testing.T) {
+	n := &recordingNotifier{}
+	onEvent := NewNotifierEventCallback(log.NewNopLogger(), n)
+	id, result := ulid.MustNew(1, nil), ulid.MustNew(2, nil)
+
+	// Only finished and failed compactions are notified, with the duration of the whole compaction.
+	onEvent(GroupCompactEvent{Type: GroupCompactEventPlanned, GroupKey: "a", Blocks: []ulid.ULID{id}, Duration: time.Hour})
+	onEvent(GroupCompactEvent{Type: GroupCompactEventDownloaded, GroupKey: "a", Blocks: []ulid.ULID{id}})
+	onEvent(GroupCompactEvent{Type: GroupCompactEventFailed, GroupKey: "a", Blocks: []ulid.ULID{id}, Result: result, Err: errors.New("upload failed")})
+	testutil.Equals(t, 1, len(n.events))
+	testutil.Assert(t, n.events[0].DurationSeconds >= time.Hour.Seconds(), "expected duration since planning, got %v", n.events[0].DurationSeconds)
+	n.events[0].DurationSeconds = 0
+	testutil.Equals(t, Event{Type: EventCompaction, Group: "a", Blocks: []ulid.ULID{id}, Result: &result, Error: "upload failed"}, n.events[0])
+
+	// Events of compactions whose planning wasn't seen keep their own duration.
+	onEvent(GroupCompactEvent{Type: GroupCompactEventUploaded, GroupKey: "b", Blocks: []ulid.ULID{id}, Result: result, Duration: time.Second})
+	testutil.Equals(t, Event{Type: EventCompaction, Group: "b", Blocks: []ulid.ULID{id}, Result: &result, DurationSeconds: 1, Success: true}, n.events[1])
+}
+
+func TestHTTPNotifier_Notify(t *testing.T) {
+	ctx := context.Background()
+
+	events := make(chan Event, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e Event
+		testutil.Ok(t, json.NewDecoder(r.Body).Decode(&e))
+		events <- e
+		if e.Group == "broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	n := NewHTTPNotifier(srv.URL, 5*time.Second)
+	id := ulid.MustNew(1, nil)
+
+	e := NewEvent(EventDownsample, "0@{}", []ulid.ULID{id}, ulid.ULID{}, 2*time.Second, errors.New("download failed"))
+	testutil.Ok(t, n.Notify(ctx, e))
+	got := <-events
+	testutil.Equals(t, e, got)
+	testutil.Equals(t, Event{
+		Type:            EventDownsample,
+		Group:           "0@{}",
+		Blocks:          []ulid.ULID{id},
+		DurationSeconds: 2,
+		Success:         false,
+		Error:           "download failed",
+	}, got)
+
+	testutil.NotOk(t, n.Notify(ctx, NewEvent(EventCompaction, "broken", nil, ulid.ULID{}, 0, nil)))
+}
@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
@@ -23,7 +24,8 @@ type tsdbBasedPlanner struct {
 
 	ranges []int64
 
-	noCompBlocksFunc func() map[ulid.ULID]*metadata.NoCompactMark
+	noCompBlocksFunc   func() map[ulid.ULID]*metadata.NoCompactMark
+	maxCompactionLevel int
 }
 
 var _ Planner = &tsdbBasedPlanner{}
@@ -47,12 +49,34 @@ func NewPlanner(logger log.Logger, ranges []int64, noCompBlocks *GatherNoCompact
 	return &tsdbBasedPlanner{logger: logger, ranges: ranges, noCompBlocksFunc: noCompBlocks.NoCompactMarkedBlocks}
 }
 
+// WithMaxCompactionLevel returns a copy of the given planner which does not compact blocks that reached maxLevel any
+// further. Such blocks are excluded from planning like blocks marked for no compaction: no planned compaction spans
+// them, while the blocks around them are planned as usual. Non-positive maxLevel means no limit.
+func WithMaxCompactionLevel(with *tsdbBasedPlanner, maxLevel int) *tsdbBasedPlanner {
+	p := *with
+	p.maxCompactionLevel = maxLevel
+	return &p
+}
+
 // TODO(bwplotka): Consider smarter algorithm, this prefers smaller iterative compactions vs big single one: https://github.com/thanos-io/thanos/issues/3405
 func (p *tsdbBasedPlanner) Plan(_ context.Context, metasByMinTime []*metadata.Meta) ([]*metadata.Meta, error) {
 	return p.plan(p.noCompBlocksFunc(), metasByMinTime)
 }
 
 func (p *tsdbBasedPlanner) plan(noCompactMarked map[ulid.ULID]*metadata.NoCompactMark, metasByMinTime []*metadata.Meta) ([]*metadata.Meta, error) {
+	if p.maxCompactionLevel > 0 {
+		excluded := make(map[ulid.ULID]*metadata.NoCompactMark, len(noCompactMarked))
+		for id, m := range noCompactMarked {
+			excluded[id] = m
+		}
+		for _, meta := range metasByMinTime {
+			if meta.Compaction.Level >= p.maxCompactionLevel {
+				excluded[meta.ULID] = &metadata.NoCompactMark{ID: meta.ULID, Version: metadata.NoCompactMarkVersion1}
+			}
+		}
+		noCompactMarked = excluded
+	}
+
 	notExcludedMetasByMinTime := make([]*metadata.Meta, 0, len(metasByMinTime))
 	for _, meta := range metasByMinTime {
 		if _, excluded := noCompactMarked[meta.ULID]; excluded {
@@ -229,6 +253,7 @@ type largeTotalIndexSizeFilter struct {
 	bkt                    objstore.Bucket
 	markedForNoCompact     prometheus.Counter
 	totalMaxIndexSizeBytes int64
+	dryRun                 bool
 }
 
 var _ Planner = &largeTotalIndexSizeFilter{}
@@ -242,6 +267,12 @@ func WithLargeTotalIndexSizeFilter(with *tsdbBasedPlanner, bkt objstore.Bucket,
 	return &largeTotalIndexSizeFilter{tsdbBasedPlanner: with, bkt: bkt, totalMaxIndexSizeBytes: totalMaxIndexSizeBytes, markedForNoCompact: markedForNoCompact}
 }
 
+// WithLargeTotalIndexSizeDryRunFilter is like WithLargeTotalIndexSizeFilter, but it only excludes blocks which would be
+// marked for no compaction from the plan, without placing no-compact-mark.json. It is meant for dry-run planning.
+func WithLargeTotalIndexSizeDryRunFilter(with *tsdbBasedPlanner, bkt objstore.Bucket, totalMaxIndexSizeBytes int64) *largeTotalIndexSizeFilter {
+	return &largeTotalIndexSizeFilter{tsdbBasedPlanner: with, bkt: bkt, totalMaxIndexSizeBytes: totalMaxIndexSizeBytes, dryRun: true}
+}
+
 func (t *largeTotalIndexSizeFilter) Plan(ctx context.Context, metasByMinTime []*metadata.Meta) ([]*metadata.Meta, error) {
 	noCompactMarked := t.noCompBlocksFunc()
 	copiedNoCompactMarked := make(map[ulid.ULID]*metadata.NoCompactMark, len(noCompactMarked))
@@ -282,7 +313,9 @@ PlanLoop:
 			if totalIndexBytes >= int64(float64(t.totalMaxIndexSizeBytes)*0.85) {
 				// Marking blocks for no compact to limit size.
 				// TODO(bwplotka): Make sure to reset cache once this is done: https://github.com/thanos-io/thanos/issues/3408
-				if err := block.MarkForNoCompact(
+				if t.dryRun {
+					level.Info(t.logger).Log("msg", "dry run: block would be marked for no compaction", "block", plan[biggestIndex].ULID, "reason", metadata.IndexSizeExceedingNoCompactReason)
+				} else if err := block.MarkForNoCompact(
 					ctx,
 					t.logger,
 					t.bkt,
@@ -302,3 +335,79 @@ PlanLoop:
 		return plan, nil
 	}
 }
+
+type maxBlockDurationFilter struct {
+	Planner
+
+	maxBlockDuration int64
+}
+
+var _ Planner = &maxBlockDurationFilter{}
+
+// WithMaxBlockDurationFilter wraps Planner with maxBlockDurationFilter that trims the given plans, so the resulted block
+// does not span more than maxBlockDuration (in milliseconds). Blocks are kept in minTime order starting from the first
+// planned one. If less than two blocks are left after trimming, nothing is planned.
+// Non-positive maxBlockDuration disables the filter.
+func WithMaxBlockDurationFilter(with Planner, maxBlockDuration int64) *maxBlockDurationFilter {
+	return &maxBlockDurationFilter{Planner: with, maxBlockDuration: maxBlockDuration}
+}
+
+func (f *maxBlockDurationFilter) Plan(ctx context.Context, metasByMinTime []*metadata.Meta) ([]*metadata.Meta, error) {
+	plan, err := f.Planner.Plan(ctx, metasByMinTime)
+	if err != nil || f.maxBlockDuration <= 0 || len(plan) == 0 {
+		return plan, err
+	}
+
+	minTime := plan[0].MinTime
+	var trimmed []*metadata.Meta
+	for _, p := range plan {
+		if p.MaxTime-minTime > f.maxBlockDuration {
+			break
+		}
+		trimmed = append(trimmed, p)
+	}
+	if len(trimmed) < 2 {
+		return nil, nil
+	}
+	return trimmed, nil
+}
+
+type minGroupSizeFilter struct {
+	Planner
+
+	minBlocks int
+	minBytes  int64
+}
+
+var _ Planner = &minGroupSizeFilter{}
+
+// WithMinGroupSizeFilter wraps Planner with minGroupSizeFilter that defers compactions which are too small to be
+// worth doing yet, so that more data can accumulate first. The thresholds apply to the blocks planned by the wrapped
+// planner, not to the whole group, whose already compacted history would satisfy them anyway. A plan is returned once
+// it has at least minBlocks blocks or its blocks take at least minBytes in total, based on the file sizes recorded in
+// their meta.json. Non-positive thresholds are disabled and the filter is disabled if both are.
+func WithMinGroupSizeFilter(with Planner, minBlocks int, minBytes int64) *minGroupSizeFilter {
+	return &minGroupSizeFilter{Planner: with, minBlocks: minBlocks, minBytes: minBytes}
+}
+
+func (f *minGroupSizeFilter) Plan(ctx context.Context, metasByMinTime []*metadata.Meta) ([]*metadata.Meta, error) {
+	plan, err := f.Planner.Plan(ctx, metasByMinTime)
+	if err != nil || len(plan) == 0 || (f.minBlocks <= 0 && f.minBytes <= 0) {
+		return plan, err
+	}
+	if f.minBlocks > 0 && len(plan) >= f.minBlocks {
+		return plan, nil
+	}
+	if f.minBytes > 0 {
+		var size int64
+		for _, m := range plan {
+			for _, file := range m.Thanos.Files {
+				size += file.SizeBytes
+			}
+		}
+		if size >= f.minBytes {
+			return plan, nil
+		}
+	}
+	return nil, nil
+}
@@ -659,6 +659,7 @@ func TestLargeTotalIndexSizeFilter_Plan(t *testing.T) {
 
 	marked := promauto.With(nil).NewCounter(prometheus.CounterOpts{})
 	planner := WithLargeTotalIndexSizeFilter(NewPlanner(log.NewNopLogger(), ranges, g), bkt, 100, marked)
+	dryRunPlanner := WithLargeTotalIndexSizeDryRunFilter(NewPlanner(log.NewNopLogger(), ranges, g), bkt, 100)
 	var lastMarkValue float64
 	for _, c := range []struct {
 		name  string
@@ -854,7 +855,284 @@ func TestLargeTotalIndexSizeFilter_Plan(t *testing.T) {
 
 				lastMarkValue = promtest.ToFloat64(marked)
 			})
+			t.Run("dry run from meta", func(t *testing.T) {
+				obj := bkt.Objects()
+				for o := range obj {
+					delete(obj, o)
+				}
+
+				metasByMinTime := make([]*metadata.Meta, len(c.metas))
+				for i := range metasByMinTime {
+					orig := c.metas[i]
+					m := &metadata.Meta{}
+					*m = *orig
+					metasByMinTime[i] = m
+				}
+				sort.Slice(metasByMinTime, func(i, j int) bool {
+					return metasByMinTime[i].MinTime < metasByMinTime[j].MinTime
+				})
+
+				plan, err := dryRunPlanner.Plan(context.Background(), metasByMinTime)
+				testutil.Ok(t, err)
+
+				for _, m := range plan {
+					m.Thanos = metadata.Thanos{}
+				}
+				// Same plan, but no block is marked for no compaction.
+				testutil.Equals(t, c.expected, plan)
+				testutil.Equals(t, 0, len(bkt.Objects()))
+			})
+
+		}) {
+			return
+		}
+	}
+}
+
+type staticPlanner []*metadata.Meta
+
+func (p staticPlanner) Plan(context.Context, []*metadata.Meta) ([]*metadata.Meta, error) {
+	return p, nil
+}
+
+func TestMaxBlockDurationFilter_Plan(t *testing.T) {
+	metas := []*metadata.Meta{
+		{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ulid.MustNew(1, nil), MinTime: 0, MaxTime: 20}},
+		{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ulid.MustNew(2, nil), MinTime: 20, MaxTime: 40}},
+		{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ulid.MustNew(3, nil), MinTime: 40, MaxTime: 60}},
+		{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ulid.MustNew(4, nil), MinTime: 60, MaxTime: 80}},
+	}
+
+	for _, c := range []struct {
+		name             string
+		plan             []*metadata.Meta
+		maxBlockDuration int64
+
+		expected []*metadata.Meta
+	}{
+		{
+			name:             "Disabled",
+			plan:             metas,
+			maxBlockDuration: 0,
+			expected:         metas,
+		},
+		{
+			name:             "Plan within the cap",
+			plan:             metas,
+			maxBlockDuration: 80,
+			expected:         metas,
+		},
+		{
+			name:             "Plan spanning beyond the cap is trimmed",
+			plan:             metas,
+			maxBlockDuration: 50,
+			expected:         metas[:2],
+		},
+		{
+			name:             "Plan trimmed to the window of the first planned block",
+			plan:             metas[1:],
+			maxBlockDuration: 40,
+			expected:         metas[1:3],
+		},
+		{
+			name:             "Less than two blocks left after trimming",
+			plan:             metas,
+			maxBlockDuration: 30,
+		},
+		{
+			name:             "Empty plan",
+			maxBlockDuration: 30,
+		},
+	} {
+		if !t.Run(c.name, func(t *testing.T) {
+			plan, err := WithMaxBlockDurationFilter(staticPlanner(c.plan), c.maxBlockDuration).Plan(context.Background(), metas)
+			testutil.Ok(t, err)
+			testutil.Equals(t, c.expected, plan)
+		}) {
+			return
+		}
+	}
+}
+
+func TestTSDBBasedPlanner_PlanWithMaxCompactionLevel(t *testing.T) {
+	ranges := []int64{
+		20,
+		60,
+		180,
+		540,
+		1620,
+	}
+	newMeta := func(id uint64, minTime, maxTime int64, level int) *metadata.Meta {
+		return &metadata.Meta{BlockMeta: tsdb.BlockMeta{
+			Version:    1,
+			ULID:       ulid.MustNew(id, nil),
+			MinTime:    minTime,
+			MaxTime:    maxTime,
+			Compaction: tsdb.BlockMetaCompaction{Level: level},
+		}}
+	}
+	metas := []*metadata.Meta{
+		newMeta(1, 0, 20, 1),
+		newMeta(2, 20, 40, 2),
+		newMeta(3, 40, 60, 3),
+		newMeta(4, 60, 80, 4),
+		newMeta(5, 80, 100, 1),
+	}
+
+	for _, c := range []struct {
+		name     string
+		maxLevel int
 
+		expected []*metadata.Meta
+	}{
+		{
+			name:     "No limit",
+			expected: metas[:3],
+		},
+		{
+			name:     "Capped block outside of the planned range",
+			maxLevel: 4,
+			expected: metas[:3],
+		},
+		{
+			// The last block before the capped one is compacted, although it is the newest block of its run.
+			name:     "Blocks before a capped block are planned",
+			maxLevel: 3,
+			expected: metas[:2],
+		},
+		{
+			name:     "Single block left between capped ones",
+			maxLevel: 2,
+		},
+		{
+			name:     "All blocks capped",
+			maxLevel: 1,
+		},
+	} {
+		if !t.Run(c.name, func(t *testing.T) {
+			planner := WithMaxCompactionLevel(NewTSDBBasedPlanner(log.NewNopLogger(), ranges), c.maxLevel)
+			plan, err := planner.Plan(context.Background(), metas)
+			testutil.Ok(t, err)
+			testutil.Equals(t, c.expected, plan)
+		}) {
+			return
+		}
+	}
+}
+
+func TestMinGroupSizeFilter_Plan(t *testing.T) {
+	newMeta := func(id uint64, size int64) *metadata.Meta {
+		return &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ulid.MustNew(id, nil), MinTime: int64(id) * 20, MaxTime: int64(id+1) * 20},
+			Thanos:    metadata.Thanos{Files: []metadata.File{{RelPath: block.IndexFilename, SizeBytes: size}}},
+		}
+	}
+	metas := []*metadata.Meta{newMeta(1, 10), newMeta(2, 10), newMeta(3, 10)}
+
+	for _, c := range []struct {
+		name      string
+		metas     []*metadata.Meta
+		minBlocks int
+		minBytes  int64
+
+		expected []*metadata.Meta
+	}{
+		{
+			name:     "Disabled",
+			metas:    metas[:2],
+			expected: metas[:2],
+		},
+		{
+			name:      "Plan below block count threshold is skipped",
+			metas:     metas[:2],
+			minBlocks: 3,
+		},
+		{
+			name:      "Plan reaching block count threshold is returned",
+			metas:     metas,
+			minBlocks: 3,
+			expected:  metas,
+		},
+		{
+			name:     "Plan below size threshold is skipped",
+			metas:    metas[:2],
+			minBytes: 30,
+		},
+		{
+			name:     "Plan reaching size threshold is returned",
+			metas:    metas,
+			minBytes: 30,
+			expected: metas,
+		},
+		{
+			name:      "Plan reaching only one of the thresholds is returned",
+			metas:     metas[:2],
+			minBlocks: 3,
+			minBytes:  20,
+			expected:  metas[:2],
+		},
+	} {
+		if !t.Run(c.name, func(t *testing.T) {
+			plan, err := WithMinGroupSizeFilter(staticPlanner(c.metas), c.minBlocks, c.minBytes).Plan(context.Background(), metas)
+			testutil.Ok(t, err)
+			testutil.Equals(t, c.expected, plan)
+		}) {
+			return
+		}
+	}
+}
+
+func TestMinGroupSizeFilter_Plan_CompactedHistory(t *testing.T) {
+	newMeta := func(id uint64, minTime, maxTime, size int64) *metadata.Meta {
+		return &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ulid.MustNew(id, nil), MinTime: minTime, MaxTime: maxTime},
+			Thanos:    metadata.Thanos{Files: []metadata.File{{RelPath: block.IndexFilename, SizeBytes: size}}},
+		}
+	}
+	// A large block compacted long ago, three small blocks filling the next range and a fresh one.
+	metas := []*metadata.Meta{
+		newMeta(1, 0, 180, 1000),
+		newMeta(2, 180, 200, 10),
+		newMeta(3, 200, 220, 10),
+		newMeta(4, 220, 240, 10),
+		newMeta(5, 240, 260, 10),
+	}
+	planner := NewTSDBBasedPlanner(log.NewNopLogger(), []int64{20, 60, 180, 540})
+
+	plan, err := planner.Plan(context.Background(), metas)
+	testutil.Ok(t, err)
+	testutil.Equals(t, metas[1:4], plan)
+
+	for _, c := range []struct {
+		name      string
+		minBlocks int
+		minBytes  int64
+
+		expected []*metadata.Meta
+	}{
+		{
+			name:      "Group history does not count towards block count threshold",
+			minBlocks: 4,
+		},
+		{
+			name:     "Group history does not count towards size threshold",
+			minBytes: 100,
+		},
+		{
+			name:      "Plan reaching block count threshold is returned",
+			minBlocks: 3,
+			expected:  metas[1:4],
+		},
+		{
+			name:     "Plan reaching size threshold is returned",
+			minBytes: 30,
+			expected: metas[1:4],
+		},
+	} {
+		if !t.Run(c.name, func(t *testing.T) {
+			plan, err := WithMinGroupSizeFilter(planner, c.minBlocks, c.minBytes).Plan(context.Background(), metas)
+			testutil.Ok(t, err)
+			testutil.Equals(t, c.expected, plan)
 		}) {
 			return
 		}
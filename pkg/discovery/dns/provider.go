@@ -8,6 +8,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -78,6 +79,16 @@ func NewProvider(logger log.Logger, reg prometheus.Registerer, resolverType Reso
 	return p
 }
 
+// NewCachingProvider returns a new empty provider like NewProvider, which only looks up again addresses that were
+// not resolved successfully within the last ttl. A non-positive ttl disables caching.
+func NewCachingProvider(logger log.Logger, reg prometheus.Registerer, resolverType ResolverType, ttl time.Duration) *Provider {
+	p := NewProvider(logger, reg, resolverType)
+	if ttl > 0 {
+		p.resolver = NewCachingResolver(p.resolver, ttl)
+	}
+	return p
+}
+
 // Clone returns a new provider from an existing one.
 func (p *Provider) Clone() *Provider {
 	return &Provider{
@@ -8,6 +8,8 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -142,3 +144,69 @@ func appendScheme(scheme, host string) string {
 	}
 	return scheme + "//" + host
 }
+
+type cacheKey struct {
+	name  string
+	qtype QType
+}
+
+type cacheEntry struct {
+	records []string
+	expires time.Time
+}
+
+// cachingResolver returns previous results of successful lookups until their TTL expires.
+type cachingResolver struct {
+	resolver Resolver
+	ttl      time.Duration
+	now      func() time.Time
+
+	mtx       sync.Mutex
+	entries   map[cacheKey]cacheEntry
+	nextSweep time.Time
+}
+
+// NewCachingResolver returns a resolver which only looks up names through the given resolver if they were not
+// resolved successfully within the last ttl. This reduces the number of DNS queries for large lists of addresses
+// that are resolved frequently. Failed lookups are not cached, expired entries of names that are no longer resolved
+// are evicted.
+func NewCachingResolver(resolver Resolver, ttl time.Duration) Resolver {
+	return &cachingResolver{
+		resolver: resolver,
+		ttl:      ttl,
+		now:      time.Now,
+		entries:  map[cacheKey]cacheEntry{},
+	}
+}
+
+func (r *cachingResolver) Resolve(ctx context.Context, name string, qtype QType) ([]string, error) {
+	key := cacheKey{name: name, qtype: qtype}
+
+	r.mtx.Lock()
+	e, ok := r.entries[key]
+	r.mtx.Unlock()
+	if ok && r.now().Before(e.expires) {
+		return e.records, nil
+	}
+
+	records, err := r.resolver.Resolve(ctx, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	now := r.now()
+	r.entries[key] = cacheEntry{records: records, expires: now.Add(r.ttl)}
+	// Sweep at most once per TTL, so that names removed from the configuration do not stay cached forever.
+	if !now.Before(r.nextSweep) {
+		for k, e := range r.entries {
+			if !now.Before(e.expires) {
+				delete(r.entries, k)
+			}
+		}
+		r.nextSweep = now.Add(r.ttl)
+	}
+	return records, nil
+}
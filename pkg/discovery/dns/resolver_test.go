@@ -8,6 +8,7 @@ import (
 	"net"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
 
@@ -202,3 +203,66 @@ func testDnsSd(t *testing.T, tt DNSSDTest) {
 	sort.Strings(result)
 	testutil.Equals(t, tt.expectedResult, result)
 }
+
+type countingResolver struct {
+	mockResolver
+	lookups map[string]int
+}
+
+func (r *countingResolver) Resolve(ctx context.Context, name string, qtype QType) ([]string, error) {
+	r.lookups[name]++
+	return r.mockResolver.Resolve(ctx, name, qtype)
+}
+
+func TestCachingResolver(t *testing.T) {
+	ctx := context.Background()
+	stub := &countingResolver{
+		mockResolver: mockResolver{res: map[string][]string{
+			"a": {"1.1.1.1:9090"},
+			"b": {"2.2.2.2:9090", "3.3.3.3:9090"},
+		}},
+		lookups: map[string]int{},
+	}
+	now := time.Unix(0, 0)
+	r := NewCachingResolver(stub, time.Minute).(*cachingResolver)
+	r.now = func() time.Time { return now }
+
+	res, err := r.Resolve(ctx, "a", A)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"1.1.1.1:9090"}, res)
+
+	now = now.Add(30 * time.Second)
+	res, err = r.Resolve(ctx, "b", SRV)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"2.2.2.2:9090", "3.3.3.3:9090"}, res)
+
+	// Entries within their TTL are not looked up again.
+	stub.res["a"] = []string{"4.4.4.4:9090"}
+	res, err = r.Resolve(ctx, "a", A)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"1.1.1.1:9090"}, res)
+	testutil.Equals(t, map[string]int{"a": 1, "b": 1}, stub.lookups)
+
+	// Only the expired entry is looked up again.
+	now = now.Add(31 * time.Second)
+	res, err = r.Resolve(ctx, "a", A)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"4.4.4.4:9090"}, res)
+	_, err = r.Resolve(ctx, "b", SRV)
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]int{"a": 2, "b": 1}, stub.lookups)
+
+	// Failed lookups are not cached.
+	now = now.Add(time.Hour)
+	stub.err = errors.New("lookup failed")
+	_, err = r.Resolve(ctx, "a", A)
+	testutil.NotOk(t, err)
+	stub.err = nil
+	res, err = r.Resolve(ctx, "a", A)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"4.4.4.4:9090"}, res)
+	testutil.Equals(t, map[string]int{"a": 4, "b": 1}, stub.lookups)
+
+	// Names which are no longer resolved are evicted once expired.
+	testutil.Equals(t, 1, len(r.entries))
+}
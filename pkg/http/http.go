@@ -63,8 +63,36 @@ func (b BasicAuth) IsZero() bool {
 	return b.Username == "" && b.Password == "" && b.PasswordFile == ""
 }
 
-// NewHTTPClient returns a new HTTP client.
-func NewHTTPClient(cfg ClientConfig, name string) (*http.Client, error) {
+// ClientOption configures optional behavior of clients returned by NewHTTPClient.
+type ClientOption func(*clientOptions)
+
+type clientOptions struct {
+	http2Enabled       bool
+	keepAlivesDisabled bool
+}
+
+// WithHTTP2Enabled allows the client to negotiate HTTP/2 with targets reached over TLS,
+// multiplexing concurrent requests over a single connection.
+func WithHTTP2Enabled() ClientOption {
+	return func(o *clientOptions) {
+		o.http2Enabled = true
+	}
+}
+
+// WithKeepAlivesDisabled makes the client use a new connection for every request.
+func WithKeepAlivesDisabled() ClientOption {
+	return func(o *clientOptions) {
+		o.keepAlivesDisabled = true
+	}
+}
+
+// NewHTTPClient returns a new HTTP client. HTTP/2 is disabled unless WithHTTP2Enabled is given.
+func NewHTTPClient(cfg ClientConfig, name string, opts ...ClientOption) (*http.Client, error) {
+	var o clientOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	httpClientConfig := config_util.HTTPClientConfig{
 		BearerToken:     config_util.Secret(cfg.BearerToken),
 		BearerTokenFile: cfg.BearerTokenFile,
@@ -95,7 +123,14 @@ func NewHTTPClient(cfg ClientConfig, name string) (*http.Client, error) {
 		return nil, err
 	}
 
-	client, err := config_util.NewClientFromConfig(httpClientConfig, name, config_util.WithHTTP2Disabled())
+	var clientOpts []config_util.HTTPClientOption
+	if !o.http2Enabled {
+		clientOpts = append(clientOpts, config_util.WithHTTP2Disabled())
+	}
+	if o.keepAlivesDisabled {
+		clientOpts = append(clientOpts, config_util.WithKeepAlivesDisabled())
+	}
+	client, err := config_util.NewClientFromConfig(httpClientConfig, name, clientOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -20,6 +20,7 @@ import (
 	"github.com/thanos-io/thanos/pkg/objstore/oss"
 	"github.com/thanos-io/thanos/pkg/objstore/s3"
 	"github.com/thanos-io/thanos/pkg/objstore/swift"
+	"golang.org/x/sync/semaphore"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -38,6 +39,8 @@ const (
 type BucketConfig struct {
 	Type   ObjProvider `yaml:"type"`
 	Config interface{} `yaml:"config"`
+	// MaxConcurrentOperations caps the number of concurrent operations of all users of the bucket client.
+	MaxConcurrentOperations int `yaml:"max_concurrent_operations"`
 }
 
 // NewBucket initializes and returns new object storage clients.
@@ -59,7 +62,7 @@ func NewBucket(logger log.Logger, confContentYaml []byte, reg prometheus.Registe
 	case string(GCS):
 		bucket, err = gcs.NewBucket(context.Background(), logger, config, component)
 	case string(S3):
-		bucket, err = s3.NewBucket(logger, config, component)
+		bucket, err = s3.NewBucket(logger, config, reg, component)
 	case string(AZURE):
 		bucket, err = azure.NewBucket(logger, config, component)
 	case string(SWIFT):
@@ -76,5 +79,8 @@ func NewBucket(logger log.Logger, confContentYaml []byte, reg prometheus.Registe
 	if err != nil {
 		return nil, errors.Wrap(err, fmt.Sprintf("create %s client", bucketConf.Type))
 	}
+	if bucketConf.MaxConcurrentOperations > 0 {
+		bucket = objstore.NewConcurrencyLimitedBucket(bucket, semaphore.NewWeighted(int64(bucketConf.MaxConcurrentOperations)))
+	}
 	return objstore.NewTracingBucket(objstore.BucketWithMetrics(bucket.Name(), bucket, reg)), nil
 }
@@ -156,6 +156,18 @@ func (b *InMemBucket) Exists(_ context.Context, name string) (bool, error) {
 	return ok, nil
 }
 
+// BatchExists checks if the given objects exist in the bucket.
+func (b *InMemBucket) BatchExists(_ context.Context, names []string) (map[string]bool, error) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	res := make(map[string]bool, len(names))
+	for _, name := range names {
+		_, res[name] = b.objects[name]
+	}
+	return res, nil
+}
+
 // Attributes returns information about the specified object.
 func (b *InMemBucket) Attributes(_ context.Context, name string) (ObjectAttributes, error) {
 	b.mtx.RLock()
@@ -0,0 +1,154 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// ConcurrencyLimitedBucket caps the number of concurrent operations on the wrapped bucket. The semaphore can be
+// shared by many buckets, e.g. by all components of a single process, to cap their total number of operations.
+type ConcurrencyLimitedBucket struct {
+	bkt Bucket
+	sem *semaphore.Weighted
+}
+
+// NewConcurrencyLimitedBucket returns a Bucket which acquires a unit of sem for each operation on bkt, blocking
+// until one is available or the operation's context is done.
+// Readers returned by Get and GetRange hold their unit until they are closed, as reading is part of the operation.
+// Iter holds its unit only while listing, it is released while the callback handles each name, so that the callback
+// can perform operations itself without risking a deadlock.
+func NewConcurrencyLimitedBucket(bkt Bucket, sem *semaphore.Weighted) *ConcurrencyLimitedBucket {
+	return &ConcurrencyLimitedBucket{bkt: bkt, sem: sem}
+}
+
+func (b *ConcurrencyLimitedBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...IterOption) error {
+	if err := b.sem.Acquire(ctx, 1); err != nil {
+		return err
+	}
+	held := true
+	defer func() {
+		if held {
+			b.sem.Release(1)
+		}
+	}()
+
+	return b.bkt.Iter(ctx, dir, func(name string) error {
+		b.sem.Release(1)
+		held = false
+		if err := f(name); err != nil {
+			return err
+		}
+		if err := b.sem.Acquire(ctx, 1); err != nil {
+			return err
+		}
+		held = true
+		return nil
+	}, options...)
+}
+
+func (b *ConcurrencyLimitedBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := b.sem.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	rc, err := b.bkt.Get(ctx, name)
+	if err != nil {
+		b.sem.Release(1)
+		return nil, err
+	}
+	return &releasingReadCloser{ReadCloser: rc, release: func() { b.sem.Release(1) }}, nil
+}
+
+func (b *ConcurrencyLimitedBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if err := b.sem.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	rc, err := b.bkt.GetRange(ctx, name, off, length)
+	if err != nil {
+		b.sem.Release(1)
+		return nil, err
+	}
+	return &releasingReadCloser{ReadCloser: rc, release: func() { b.sem.Release(1) }}, nil
+}
+
+func (b *ConcurrencyLimitedBucket) Exists(ctx context.Context, name string) (bool, error) {
+	if err := b.sem.Acquire(ctx, 1); err != nil {
+		return false, err
+	}
+	defer b.sem.Release(1)
+
+	return b.bkt.Exists(ctx, name)
+}
+
+// BatchExists checks the given objects using a single unit if the wrapped bucket supports batch checks,
+// otherwise each check acquires its own unit.
+func (b *ConcurrencyLimitedBucket) BatchExists(ctx context.Context, names []string) (map[string]bool, error) {
+	bb, ok := b.bkt.(BatchExistsBucketReader)
+	if !ok {
+		return BatchExists(ctx, struct{ BucketReader }{b}, names)
+	}
+	if err := b.sem.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	defer b.sem.Release(1)
+
+	return bb.BatchExists(ctx, names)
+}
+
+func (b *ConcurrencyLimitedBucket) IsObjNotFoundErr(err error) bool {
+	return b.bkt.IsObjNotFoundErr(err)
+}
+
+func (b *ConcurrencyLimitedBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	if err := b.sem.Acquire(ctx, 1); err != nil {
+		return ObjectAttributes{}, err
+	}
+	defer b.sem.Release(1)
+
+	return b.bkt.Attributes(ctx, name)
+}
+
+func (b *ConcurrencyLimitedBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if err := b.sem.Acquire(ctx, 1); err != nil {
+		return err
+	}
+	defer b.sem.Release(1)
+
+	return b.bkt.Upload(ctx, name, r)
+}
+
+func (b *ConcurrencyLimitedBucket) Delete(ctx context.Context, name string) error {
+	if err := b.sem.Acquire(ctx, 1); err != nil {
+		return err
+	}
+	defer b.sem.Release(1)
+
+	return b.bkt.Delete(ctx, name)
+}
+
+func (b *ConcurrencyLimitedBucket) Close() error {
+	return b.bkt.Close()
+}
+
+func (b *ConcurrencyLimitedBucket) Name() string {
+	return b.bkt.Name()
+}
+
+// releasingReadCloser calls release once it is closed for the first time.
+type releasingReadCloser struct {
+	io.ReadCloser
+
+	once    sync.Once
+	release func()
+}
+
+func (rc *releasingReadCloser) Close() error {
+	err := rc.ReadCloser.Close()
+	rc.once.Do(rc.release)
+	return err
+}
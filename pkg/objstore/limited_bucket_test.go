@@ -0,0 +1,167 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
+	"golang.org/x/sync/semaphore"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+// inflightBucket tracks the maximum number of concurrent operations, including open readers.
+type inflightBucket struct {
+	Bucket
+
+	inflight    atomic.Int64
+	maxInflight atomic.Int64
+}
+
+func (b *inflightBucket) start() {
+	n := b.inflight.Inc()
+	for {
+		max := b.maxInflight.Load()
+		if n <= max || b.maxInflight.CAS(max, n) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond)
+}
+
+func (b *inflightBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	b.start()
+	rc, err := b.Bucket.Get(ctx, name)
+	if err != nil {
+		b.inflight.Dec()
+		return nil, err
+	}
+	return &releasingReadCloser{ReadCloser: rc, release: func() { b.inflight.Dec() }}, nil
+}
+
+func (b *inflightBucket) Exists(ctx context.Context, name string) (bool, error) {
+	b.start()
+	defer b.inflight.Dec()
+	return b.Bucket.Exists(ctx, name)
+}
+
+func (b *inflightBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	b.start()
+	defer b.inflight.Dec()
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func TestConcurrencyLimitedBucket(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("total concurrency is capped across buckets sharing the semaphore", func(t *testing.T) {
+		inner := &inflightBucket{Bucket: NewInMemBucket()}
+		sem := semaphore.NewWeighted(3)
+
+		var wg sync.WaitGroup
+		// Simulate a few components, each with its own wrapper and many concurrent callers.
+		for c := 0; c < 3; c++ {
+			bkt := NewConcurrencyLimitedBucket(inner, sem)
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(name string) {
+					defer wg.Done()
+
+					testutil.Ok(t, bkt.Upload(ctx, name, strings.NewReader(name)))
+					ok, err := bkt.Exists(ctx, name)
+					testutil.Ok(t, err)
+					testutil.Assert(t, ok, "expected %s to exist", name)
+
+					r, err := bkt.Get(ctx, name)
+					testutil.Ok(t, err)
+					// Readers hold their unit until closed.
+					time.Sleep(time.Millisecond)
+					content, err := ioutil.ReadAll(r)
+					testutil.Ok(t, err)
+					testutil.Ok(t, r.Close())
+					testutil.Equals(t, name, string(content))
+				}(fmt.Sprintf("component-%d/obj-%d", c, i))
+			}
+		}
+		wg.Wait()
+
+		testutil.Assert(t, inner.maxInflight.Load() <= 3, "expected at most 3 concurrent operations, got %d", inner.maxInflight.Load())
+		testutil.Equals(t, int64(0), inner.inflight.Load())
+		// All units are released again.
+		testutil.Assert(t, sem.TryAcquire(3), "expected all units to be released")
+	})
+	t.Run("operations in iter callback do not deadlock", func(t *testing.T) {
+		bkt := NewConcurrencyLimitedBucket(NewInMemBucket(), semaphore.NewWeighted(1))
+		testutil.Ok(t, bkt.Upload(ctx, "dir/a", strings.NewReader("a")))
+		testutil.Ok(t, bkt.Upload(ctx, "dir/b", strings.NewReader("b")))
+
+		var contents []string
+		testutil.Ok(t, bkt.Iter(ctx, "dir", func(name string) error {
+			r, err := bkt.Get(ctx, name)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+
+			b, err := ioutil.ReadAll(r)
+			contents = append(contents, string(b))
+			return err
+		}))
+		testutil.Equals(t, []string{"a", "b"}, contents)
+	})
+	t.Run("iter streams names and releases its unit on callback error", func(t *testing.T) {
+		sem := semaphore.NewWeighted(1)
+		bkt := NewConcurrencyLimitedBucket(NewInMemBucket(), sem)
+		testutil.Ok(t, bkt.Upload(ctx, "dir/a", strings.NewReader("a")))
+		testutil.Ok(t, bkt.Upload(ctx, "dir/b", strings.NewReader("b")))
+
+		var names []string
+		err := bkt.Iter(ctx, "dir", func(name string) error {
+			names = append(names, name)
+			return errors.New("stop")
+		})
+		testutil.NotOk(t, err)
+		testutil.Equals(t, []string{"dir/a"}, names)
+		testutil.Assert(t, sem.TryAcquire(1), "expected the unit to be released")
+	})
+	t.Run("waiting for a unit respects context", func(t *testing.T) {
+		sem := semaphore.NewWeighted(1)
+		bkt := NewConcurrencyLimitedBucket(NewInMemBucket(), sem)
+		testutil.Ok(t, bkt.Upload(ctx, "obj", strings.NewReader("obj")))
+
+		r, err := bkt.Get(ctx, "obj")
+		testutil.Ok(t, err)
+
+		cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		_, err = bkt.Exists(cctx, "obj")
+		testutil.Equals(t, context.DeadlineExceeded, err)
+
+		// Closing twice releases the unit only once.
+		testutil.Ok(t, r.Close())
+		testutil.Ok(t, r.Close())
+		ok, err := bkt.Exists(ctx, "obj")
+		testutil.Ok(t, err)
+		testutil.Assert(t, ok, "expected obj to exist")
+		testutil.Assert(t, sem.TryAcquire(1), "expected the unit to be released")
+		testutil.Assert(t, !sem.TryAcquire(1), "expected a single unit")
+	})
+	t.Run("failed get releases its unit", func(t *testing.T) {
+		sem := semaphore.NewWeighted(1)
+		bkt := NewConcurrencyLimitedBucket(NewInMemBucket(), sem)
+
+		_, err := bkt.Get(ctx, "missing")
+		testutil.Assert(t, bkt.IsObjNotFoundErr(err), "expected not found error, got %v", err)
+		testutil.Assert(t, sem.TryAcquire(1), "expected the unit to be released")
+	})
+}
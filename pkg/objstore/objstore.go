@@ -10,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -17,6 +18,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/thanos-io/thanos/pkg/runutil"
 )
@@ -86,6 +88,59 @@ type BucketReader interface {
 	Attributes(ctx context.Context, name string) (ObjectAttributes, error)
 }
 
+// BatchExistsBucketReader is an optional extension of BucketReader for backends that are able to check existence
+// of many objects more efficiently than by calling Exists for each of them.
+type BatchExistsBucketReader interface {
+	// BatchExists checks if the given objects exist in the bucket. The returned map contains an entry for each name.
+	BatchExists(ctx context.Context, names []string) (map[string]bool, error)
+}
+
+// batchExistsFallbackConcurrency is the maximum number of concurrent Exists calls issued by BatchExists for buckets
+// not implementing BatchExistsBucketReader.
+const batchExistsFallbackConcurrency = 16
+
+// BatchExists checks if the given objects exist in the bucket. It uses the bucket's BatchExists if implemented,
+// otherwise it falls back to calling Exists for each name concurrently.
+func BatchExists(ctx context.Context, bkt BucketReader, names []string) (map[string]bool, error) {
+	if b, ok := bkt.(BatchExistsBucketReader); ok {
+		return b.BatchExists(ctx, names)
+	}
+
+	var (
+		mtx sync.Mutex
+		res = make(map[string]bool, len(names))
+		sem = make(chan struct{}, batchExistsFallbackConcurrency)
+	)
+	g, gctx := errgroup.WithContext(ctx)
+	for _, name := range names {
+		name := name
+		select {
+		case sem <- struct{}{}:
+		case <-gctx.Done():
+			if err := g.Wait(); err != nil {
+				return nil, err
+			}
+			return nil, ctx.Err()
+		}
+		g.Go(func() error {
+			defer func() { <-sem }()
+
+			ok, err := bkt.Exists(gctx, name)
+			if err != nil {
+				return errors.Wrapf(err, "exists %s", name)
+			}
+			mtx.Lock()
+			res[name] = ok
+			mtx.Unlock()
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
 // InstrumentedBucket is a BucketReader with optional instrumentation control.
 type InstrumentedBucketReader interface {
 	BucketReader
@@ -446,6 +501,23 @@ func (b *metricBucket) Exists(ctx context.Context, name string) (bool, error) {
 	return ok, nil
 }
 
+// BatchExists checks existence of all given objects. Each object is accounted as a separate exists operation.
+func (b *metricBucket) BatchExists(ctx context.Context, names []string) (map[string]bool, error) {
+	const op = OpExists
+	b.ops.WithLabelValues(op).Add(float64(len(names)))
+
+	start := time.Now()
+	res, err := BatchExists(ctx, b.bkt, names)
+	if err != nil {
+		if !b.isOpFailureExpected(err) && ctx.Err() != context.Canceled {
+			b.opsFailures.WithLabelValues(op).Inc()
+		}
+		return nil, err
+	}
+	b.opsDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	return res, nil
+}
+
 func (b *metricBucket) Upload(ctx context.Context, name string, r io.Reader) error {
 	const op = OpUpload
 	b.ops.WithLabelValues(op).Inc()
@@ -5,7 +5,9 @@ package objstore
 
 import (
 	"bytes"
+	"context"
 	"io"
+	"strings"
 	"testing"
 
 	promtest "github.com/prometheus/client_golang/prometheus/testutil"
@@ -86,3 +88,42 @@ func TestTracingReader(t *testing.T) {
 	testutil.Ok(t, err)
 	testutil.Equals(t, int64(11), size)
 }
+
+// existsOnlyBucket hides BatchExists implementation of the wrapped bucket.
+type existsOnlyBucket struct {
+	Bucket
+}
+
+func TestBatchExists(t *testing.T) {
+	ctx := context.Background()
+
+	inmem := NewInMemBucket()
+	testutil.Ok(t, inmem.Upload(ctx, "dir/obj1", strings.NewReader("@test-data1@")))
+	testutil.Ok(t, inmem.Upload(ctx, "dir/obj2", strings.NewReader("@test-data2@")))
+	testutil.Ok(t, inmem.Upload(ctx, "obj3", strings.NewReader("@test-data3@")))
+
+	names := []string{"dir/obj1", "dir/obj2", "obj3", "dir/obj4", "obj5", "dir"}
+	expected := map[string]bool{}
+	for _, n := range names {
+		ok, err := inmem.Exists(ctx, n)
+		testutil.Ok(t, err)
+		expected[n] = ok
+	}
+	testutil.Equals(t, map[string]bool{"dir/obj1": true, "dir/obj2": true, "obj3": true, "dir/obj4": false, "obj5": false, "dir": false}, expected)
+
+	for _, tcase := range []struct {
+		name string
+		bkt  BucketReader
+	}{
+		{name: "inmem", bkt: inmem},
+		{name: "fallback", bkt: existsOnlyBucket{Bucket: inmem}},
+		{name: "metrics", bkt: BucketWithMetrics("abc", inmem, nil)},
+		{name: "tracing", bkt: NewTracingBucket(existsOnlyBucket{Bucket: inmem})},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			res, err := BatchExists(ctx, tcase.bkt, names)
+			testutil.Ok(t, err)
+			testutil.Equals(t, expected, res)
+		})
+	}
+}
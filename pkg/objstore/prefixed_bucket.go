@@ -0,0 +1,94 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"strings"
+)
+
+// PrefixedBucket stores all objects under the given prefix of the wrapped bucket, so that
+// many deployments can share a single bucket without seeing each other's objects.
+type PrefixedBucket struct {
+	bkt    Bucket
+	prefix string
+}
+
+// NewPrefixedBucket returns a Bucket prepending prefix to all object names passed to bkt.
+// Names passed to Iter callbacks are returned without the prefix.
+func NewPrefixedBucket(bkt Bucket, prefix string) Bucket {
+	prefix = strings.Trim(prefix, DirDelim)
+	if prefix == "" {
+		return bkt
+	}
+	return &PrefixedBucket{bkt: bkt, prefix: prefix}
+}
+
+func (p *PrefixedBucket) withPrefix(name string) string {
+	return p.prefix + DirDelim + name
+}
+
+func (p *PrefixedBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...IterOption) error {
+	pdir := p.prefix + DirDelim
+	if dir != "" {
+		pdir = p.withPrefix(dir)
+	}
+	return p.bkt.Iter(ctx, pdir, func(name string) error {
+		return f(strings.TrimPrefix(name, p.prefix+DirDelim))
+	}, options...)
+}
+
+func (p *PrefixedBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return p.bkt.Get(ctx, p.withPrefix(name))
+}
+
+func (p *PrefixedBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	return p.bkt.GetRange(ctx, p.withPrefix(name), off, length)
+}
+
+func (p *PrefixedBucket) Exists(ctx context.Context, name string) (bool, error) {
+	return p.bkt.Exists(ctx, p.withPrefix(name))
+}
+
+func (p *PrefixedBucket) BatchExists(ctx context.Context, names []string) (map[string]bool, error) {
+	pnames := make([]string, 0, len(names))
+	for _, n := range names {
+		pnames = append(pnames, p.withPrefix(n))
+	}
+	pres, err := BatchExists(ctx, p.bkt, pnames)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]bool, len(names))
+	for _, n := range names {
+		res[n] = pres[p.withPrefix(n)]
+	}
+	return res, nil
+}
+
+func (p *PrefixedBucket) IsObjNotFoundErr(err error) bool {
+	return p.bkt.IsObjNotFoundErr(err)
+}
+
+func (p *PrefixedBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	return p.bkt.Attributes(ctx, p.withPrefix(name))
+}
+
+func (p *PrefixedBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	return p.bkt.Upload(ctx, p.withPrefix(name), r)
+}
+
+func (p *PrefixedBucket) Delete(ctx context.Context, name string) error {
+	return p.bkt.Delete(ctx, p.withPrefix(name))
+}
+
+func (p *PrefixedBucket) Close() error {
+	return p.bkt.Close()
+}
+
+func (p *PrefixedBucket) Name() string {
+	return p.bkt.Name()
+}
@@ -0,0 +1,77 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestPrefixedBucket(t *testing.T) {
+	ctx := context.Background()
+	inmem := NewInMemBucket()
+	testutil.Ok(t, inmem.Upload(ctx, "other/obj", strings.NewReader("other")))
+
+	bkt := NewPrefixedBucket(inmem, "/tenant-a/")
+	testutil.Ok(t, bkt.Upload(ctx, "dir/obj1", strings.NewReader("content1")))
+	testutil.Ok(t, bkt.Upload(ctx, "dir/sub/obj2", strings.NewReader("content2")))
+	testutil.Ok(t, bkt.Upload(ctx, "obj3", strings.NewReader("content3")))
+
+	var stored []string
+	for n := range inmem.Objects() {
+		stored = append(stored, n)
+	}
+	sort.Strings(stored)
+	testutil.Equals(t, []string{"other/obj", "tenant-a/dir/obj1", "tenant-a/dir/sub/obj2", "tenant-a/obj3"}, stored)
+
+	iter := func(dir string, options ...IterOption) []string {
+		var names []string
+		testutil.Ok(t, bkt.Iter(ctx, dir, func(name string) error {
+			names = append(names, name)
+			return nil
+		}, options...))
+		return names
+	}
+	testutil.Equals(t, []string{"obj3", "dir/"}, iter(""))
+	testutil.Equals(t, []string{"dir/obj1", "dir/sub/"}, iter("dir"))
+	testutil.Equals(t, []string{"dir/obj1", "dir/sub/obj2"}, iter("dir/", WithRecursiveIter))
+
+	r, err := bkt.Get(ctx, "dir/obj1")
+	testutil.Ok(t, err)
+	content, err := ioutil.ReadAll(r)
+	testutil.Ok(t, err)
+	testutil.Ok(t, r.Close())
+	testutil.Equals(t, "content1", string(content))
+
+	r, err = bkt.GetRange(ctx, "obj3", 1, 3)
+	testutil.Ok(t, err)
+	content, err = ioutil.ReadAll(r)
+	testutil.Ok(t, err)
+	testutil.Ok(t, r.Close())
+	testutil.Equals(t, "ont", string(content))
+
+	_, err = bkt.Get(ctx, "other/obj")
+	testutil.Assert(t, bkt.IsObjNotFoundErr(err), "objects outside of the prefix should not be visible")
+
+	attrs, err := bkt.Attributes(ctx, "obj3")
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(8), attrs.Size)
+
+	exists, err := BatchExists(ctx, bkt, []string{"obj3", "other/obj"})
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]bool{"obj3": true, "other/obj": false}, exists)
+
+	testutil.Ok(t, bkt.Delete(ctx, "obj3"))
+	ok, err := bkt.Exists(ctx, "obj3")
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "deleted object should not exist")
+	ok, err = inmem.Exists(ctx, "other/obj")
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "objects outside of the prefix should be untouched")
+}
@@ -5,6 +5,7 @@
 package s3
 
 import (
+	"compress/gzip"
 	"context"
 	"crypto/tls"
 	"fmt"
@@ -12,10 +13,13 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"os"
+	"path"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -25,10 +29,13 @@ import (
 	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/minio/minio-go/v7/pkg/encrypt"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/version"
 	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/runutil"
+	"golang.org/x/sync/errgroup"
 	"gopkg.in/yaml.v2"
 )
 
@@ -53,6 +60,12 @@ const (
 	// NOTE: we're using a context value only because it's a very specific S3 option. If SSE will
 	// be available to wider set of backends we should probably add a variadic option to Get() and Upload().
 	sseConfigKey = ctxKey(0)
+
+	// defaultSTSEndpoint is the STS endpoint used to assume roles if none is configured.
+	defaultSTSEndpoint = "https://sts.amazonaws.com"
+
+	// batchExistsConcurrency is the maximum number of concurrent stat requests issued by BatchExists.
+	batchExistsConcurrency = 16
 )
 
 var DefaultConfig = Config{
@@ -86,6 +99,20 @@ type Config struct {
 	// NOTE we need to make sure this number does not produce more parts than 10 000.
 	PartSize  uint64    `yaml:"part_size"`
 	SSEConfig SSEConfig `yaml:"sse_config"`
+	// AssumeRoleConfig configures assuming an IAM role, e.g. for cross-account bucket access.
+	AssumeRoleConfig AssumeRoleConfig `yaml:"assume_role_config"`
+	// DecompressObjects are glob patterns of object names, which are decoded when read if they are served with gzip content encoding.
+	// NOTE: Matching objects are always read as a whole, also for range reads, as ranges apply to the decoded content.
+	DecompressObjects []string `yaml:"decompress_objects"`
+}
+
+// AssumeRoleConfig deals with the configuration of STS AssumeRole. The configured access_key and secret_key
+// are used to request temporary credentials for the given role, which are then used to access the bucket.
+type AssumeRoleConfig struct {
+	RoleARN     string `yaml:"role_arn"`
+	SessionName string `yaml:"session_name"`
+	// STSEndpoint defaults to the global AWS STS endpoint if empty.
+	STSEndpoint string `yaml:"sts_endpoint"`
 }
 
 // SSEConfig deals with the configuration of SSE for Minio. The following options are valid:
@@ -150,6 +177,68 @@ func DefaultTransport(config Config) *http.Transport {
 	}
 }
 
+// connMetrics exposes the connection usage of the HTTP transport, to help sizing its idle connection pool.
+type connMetrics struct {
+	connections     *prometheus.CounterVec
+	openConnections prometheus.Gauge
+}
+
+func newConnMetrics(reg prometheus.Registerer, bucket string) *connMetrics {
+	return &connMetrics{
+		connections: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name:        "thanos_objstore_s3_connections_total",
+			Help:        "Total number of connections obtained for requests against the bucket, by whether they were reused from the idle pool.",
+			ConstLabels: prometheus.Labels{"bucket": bucket},
+		}, []string{"reused"}),
+		openConnections: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name:        "thanos_objstore_s3_open_connections",
+			Help:        "Number of currently open connections to the bucket, both in use and idle. Only tracked for the default transport.",
+			ConstLabels: prometheus.Labels{"bucket": bucket},
+		}),
+	}
+}
+
+// trackRoundTripper returns a RoundTripper recording whether each request got a new or a reused connection.
+func (m *connMetrics) trackRoundTripper(rt http.RoundTripper) http.RoundTripper {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			m.connections.WithLabelValues(strconv.FormatBool(info.Reused)).Inc()
+		},
+	}
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return rt.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	})
+}
+
+// trackDialContext returns a dial function tracking the number of open connections.
+func (m *connMetrics) trackDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		m.openConnections.Inc()
+		return &trackedConn{Conn: conn, onClose: m.openConnections.Dec}, nil
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// trackedConn calls onClose once the connection is closed.
+type trackedConn struct {
+	net.Conn
+
+	once    sync.Once
+	onClose func()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.onClose)
+	return c.Conn.Close()
+}
+
 // Bucket implements the store.Bucket interface against s3-compatible APIs.
 type Bucket struct {
 	logger          log.Logger
@@ -159,6 +248,8 @@ type Bucket struct {
 	putUserMetadata map[string]string
 	partSize        uint64
 	listObjectsV1   bool
+
+	decompressObjects []string
 }
 
 // parseConfig unmarshals a buffer into a Config with default HTTPConfig values.
@@ -172,13 +263,13 @@ func parseConfig(conf []byte) (Config, error) {
 }
 
 // NewBucket returns a new Bucket using the provided s3 config values.
-func NewBucket(logger log.Logger, conf []byte, component string) (*Bucket, error) {
+func NewBucket(logger log.Logger, conf []byte, reg prometheus.Registerer, component string) (*Bucket, error) {
 	config, err := parseConfig(conf)
 	if err != nil {
 		return nil, err
 	}
 
-	return NewBucketWithConfig(logger, config, component)
+	return NewBucketWithConfig(logger, config, reg, component)
 }
 
 type overrideSignerType struct {
@@ -197,8 +288,8 @@ func (s *overrideSignerType) Retrieve() (credentials.Value, error) {
 	return v, nil
 }
 
-// NewBucketWithConfig returns a new Bucket using the provided s3 config values.
-func NewBucketWithConfig(logger log.Logger, config Config, component string) (*Bucket, error) {
+// credentialsChain returns the credential providers to try, in order, for the given config.
+func credentialsChain(config Config) []credentials.Provider {
 	var chain []credentials.Provider
 
 	// TODO(bwplotka): Don't do flags as they won't scale, use actual params like v2, v4 instead
@@ -209,10 +300,25 @@ func NewBucketWithConfig(logger log.Logger, config Config, component string) (*B
 		}
 	}
 
-	if err := validate(config); err != nil {
-		return nil, err
-	}
-	if config.AccessKey != "" {
+	if config.AssumeRoleConfig.RoleARN != "" {
+		endpoint := config.AssumeRoleConfig.STSEndpoint
+		if endpoint == "" {
+			endpoint = defaultSTSEndpoint
+		}
+		chain = []credentials.Provider{wrapCredentialsProvider(&credentials.STSAssumeRole{
+			Client: &http.Client{
+				Transport: http.DefaultTransport,
+			},
+			STSEndpoint: endpoint,
+			Options: credentials.STSAssumeRoleOptions{
+				AccessKey:       config.AccessKey,
+				SecretKey:       config.SecretKey,
+				Location:        config.Region,
+				RoleARN:         config.AssumeRoleConfig.RoleARN,
+				RoleSessionName: config.AssumeRoleConfig.SessionName,
+			},
+		})}
+	} else if config.AccessKey != "" {
 		chain = []credentials.Provider{wrapCredentialsProvider(&credentials.Static{
 			Value: credentials.Value{
 				AccessKeyID:     config.AccessKey,
@@ -231,6 +337,17 @@ func NewBucketWithConfig(logger log.Logger, config Config, component string) (*B
 			}),
 		}
 	}
+	return chain
+}
+
+// NewBucketWithConfig returns a new Bucket using the provided s3 config values.
+func NewBucketWithConfig(logger log.Logger, config Config, reg prometheus.Registerer, component string) (*Bucket, error) {
+	if err := validate(config); err != nil {
+		return nil, err
+	}
+	chain := credentialsChain(config)
+
+	m := newConnMetrics(reg, config.Bucket)
 
 	// Check if a roundtripper has been set in the config
 	// otherwise build the default transport.
@@ -238,8 +355,11 @@ func NewBucketWithConfig(logger log.Logger, config Config, component string) (*B
 	if config.HTTPConfig.Transport != nil {
 		rt = config.HTTPConfig.Transport
 	} else {
-		rt = DefaultTransport(config)
+		t := DefaultTransport(config)
+		t.DialContext = m.trackDialContext(t.DialContext)
+		rt = t
 	}
+	rt = m.trackRoundTripper(rt)
 
 	client, err := minio.New(config.Endpoint, &minio.Options{
 		Creds:     credentials.NewChainCredentials(chain),
@@ -298,6 +418,8 @@ func NewBucketWithConfig(logger log.Logger, config Config, component string) (*B
 		putUserMetadata: config.PutUserMetadata,
 		partSize:        config.PartSize,
 		listObjectsV1:   config.ListObjectsVersion == "v1",
+
+		decompressObjects: config.DecompressObjects,
 	}
 	return bkt, nil
 }
@@ -321,6 +443,15 @@ func validate(conf Config) error {
 		return errors.New("no s3 secret_key specified while access_key is present in config file; either both should be present in config or envvars/IAM should be used.")
 	}
 
+	if conf.AssumeRoleConfig.RoleARN != "" {
+		if conf.AssumeRoleConfig.SessionName == "" {
+			return errors.New("session_name must be set if assume_role_config.role_arn is set")
+		}
+		if conf.AccessKey == "" {
+			return errors.New("access_key and secret_key must be set to assume the role configured in assume_role_config")
+		}
+	}
+
 	if conf.SSEConfig.Type == SSEC && conf.SSEConfig.EncryptionKey == "" {
 		return errors.New("encryption_key must be set if sse_config.type is set to 'SSE-C'")
 	}
@@ -329,6 +460,12 @@ func validate(conf Config) error {
 		return errors.New("kms_key_id must be set if sse_config.type is set to 'SSE-KMS'")
 	}
 
+	for _, pattern := range conf.DecompressObjects {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "invalid decompress_objects pattern %q", pattern)
+		}
+	}
+
 	return nil
 }
 
@@ -379,6 +516,58 @@ func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error, opt
 }
 
 func (b *Bucket) getRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if !b.shouldDecompress(name) {
+		obj, err := b.getObject(ctx, name, off, length)
+		if err != nil {
+			return nil, err
+		}
+		return obj, nil
+	}
+
+	// The range applies to the decoded content, so the whole object is read.
+	obj, err := b.getObject(ctx, name, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	info, err := obj.Stat()
+	if err != nil {
+		runutil.CloseWithLogOnErr(b.logger, obj, "s3 get range obj close")
+		return nil, errors.Wrap(err, "stat s3 object")
+	}
+
+	var r io.Reader = obj
+	if strings.EqualFold(info.Metadata.Get("Content-Encoding"), "gzip") {
+		if r, err = gzip.NewReader(obj); err != nil {
+			runutil.CloseWithLogOnErr(b.logger, obj, "s3 get range obj close")
+			return nil, errors.Wrap(err, "create gzip reader")
+		}
+	}
+	if off > 0 {
+		if _, err := io.CopyN(ioutil.Discard, r, off); err != nil {
+			runutil.CloseWithLogOnErr(b.logger, obj, "s3 get range obj close")
+			return nil, errors.Wrap(err, "skip to range offset")
+		}
+	}
+	if length != -1 {
+		r = io.LimitReader(r, length)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{Reader: r, Closer: obj}, nil
+}
+
+// shouldDecompress returns true if the object with the given name matches any of the decompress_objects patterns.
+func (b *Bucket) shouldDecompress(name string) bool {
+	for _, pattern := range b.decompressObjects {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Bucket) getObject(ctx context.Context, name string, off, length int64) (*minio.Object, error) {
 	sse, err := b.getServerSideEncryption(ctx)
 	if err != nil {
 		return nil, err
@@ -434,6 +623,41 @@ func (b *Bucket) Exists(ctx context.Context, name string) (bool, error) {
 	return true, nil
 }
 
+// BatchExists checks if the given objects exist in the bucket using concurrent stat requests.
+func (b *Bucket) BatchExists(ctx context.Context, names []string) (map[string]bool, error) {
+	var (
+		mtx sync.Mutex
+		res = make(map[string]bool, len(names))
+		// Limit the number of concurrent requests, so big batches won't exhaust connections.
+		sem = make(chan struct{}, batchExistsConcurrency)
+	)
+	g, gctx := errgroup.WithContext(ctx)
+	for _, name := range names {
+		name := name
+		g.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+			case <-gctx.Done():
+				return gctx.Err()
+			}
+			defer func() { <-sem }()
+
+			ok, err := b.Exists(gctx, name)
+			if err != nil {
+				return errors.Wrapf(err, "exists %s", name)
+			}
+			mtx.Lock()
+			res[name] = ok
+			mtx.Unlock()
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
 // Upload the contents of the reader as an object into the bucket.
 func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader) error {
 	sse, err := b.getServerSideEncryption(ctx)
@@ -547,7 +771,7 @@ func NewTestBucketFromConfig(t testing.TB, location string, c Config, reuseBucke
 	if err != nil {
 		return nil, nil, err
 	}
-	b, err := NewBucket(log.NewNopLogger(), bc, "thanos-e2e-test")
+	b, err := NewBucket(log.NewNopLogger(), bc, nil, "thanos-e2e-test")
 	if err != nil {
 		return nil, nil, err
 	}
@@ -37,7 +37,7 @@ func BenchmarkUpload(b *testing.B) {
 		SecretKey: e2edb.MinioSecretKey,
 		Endpoint:  m.HTTPEndpoint(),
 		Insecure:  true,
-	}, "test-feed")
+	}, nil, "test-feed")
 	testutil.Ok(b, err)
 
 	buf := bytes.Buffer{}
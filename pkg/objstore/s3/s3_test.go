@@ -4,16 +4,23 @@
 package s3
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 
 	"github.com/thanos-io/thanos/pkg/testutil"
 )
@@ -265,11 +272,74 @@ list_objects_version: "abcd"`)
 	}
 }
 
+func TestParseConfig_AssumeRoleConfig(t *testing.T) {
+	input := []byte(`bucket: "bucket-name"
+endpoint: "s3-endpoint"
+access_key: "access_key"
+secret_key: "secret_key"`)
+
+	cfg, err := parseConfig(input)
+	testutil.Ok(t, err)
+	testutil.Ok(t, validate(cfg))
+
+	chain := credentialsChain(cfg)
+	testutil.Equals(t, 1, len(chain))
+	_, ok := chain[0].(*credentials.Static)
+	testutil.Assert(t, ok, "static credentials expected without role, got %T", chain[0])
+
+	input2 := []byte(`bucket: "bucket-name"
+endpoint: "s3-endpoint"
+region: "eu-west-1"
+access_key: "access_key"
+secret_key: "secret_key"
+assume_role_config:
+  role_arn: "arn:aws:iam::123456789012:role/thanos"
+  session_name: "thanos-store"`)
+
+	cfg2, err := parseConfig(input2)
+	testutil.Ok(t, err)
+	testutil.Ok(t, validate(cfg2))
+
+	chain = credentialsChain(cfg2)
+	testutil.Equals(t, 1, len(chain))
+	sts, ok := chain[0].(*credentials.STSAssumeRole)
+	testutil.Assert(t, ok, "STS assume role credentials expected, got %T", chain[0])
+	testutil.Equals(t, defaultSTSEndpoint, sts.STSEndpoint)
+	testutil.Equals(t, credentials.STSAssumeRoleOptions{
+		AccessKey:       "access_key",
+		SecretKey:       "secret_key",
+		Location:        "eu-west-1",
+		RoleARN:         "arn:aws:iam::123456789012:role/thanos",
+		RoleSessionName: "thanos-store",
+	}, sts.Options)
+
+	input3 := []byte(`bucket: "bucket-name"
+endpoint: "s3-endpoint"
+access_key: "access_key"
+secret_key: "secret_key"
+assume_role_config:
+  role_arn: "arn:aws:iam::123456789012:role/thanos"`)
+
+	cfg3, err := parseConfig(input3)
+	testutil.Ok(t, err)
+	testutil.NotOk(t, validate(cfg3))
+
+	input4 := []byte(`bucket: "bucket-name"
+endpoint: "s3-endpoint"
+assume_role_config:
+  role_arn: "arn:aws:iam::123456789012:role/thanos"
+  session_name: "thanos-store"`)
+
+	cfg4, err := parseConfig(input4)
+	testutil.Ok(t, err)
+	testutil.NotOk(t, validate(cfg4))
+}
+
 func TestBucket_getServerSideEncryption(t *testing.T) {
 	// Default config should return no SSE config.
 	cfg := DefaultConfig
 	cfg.Endpoint = "localhost:80"
-	bkt, err := NewBucketWithConfig(log.NewNopLogger(), cfg, "test")
+	bkt, err := NewBucketWithConfig(log.NewNopLogger(), cfg, nil, "test")
 	testutil.Ok(t, err)
 
 	sse, err := bkt.getServerSideEncryption(context.Background())
@@ -280,7 +350,7 @@ func TestBucket_getServerSideEncryption(t *testing.T) {
 	cfg = DefaultConfig
 	cfg.Endpoint = "localhost:80"
 	cfg.SSEConfig = SSEConfig{Type: SSES3}
-	bkt, err = NewBucketWithConfig(log.NewNopLogger(), cfg, "test")
+	bkt, err = NewBucketWithConfig(log.NewNopLogger(), cfg, nil, "test")
 	testutil.Ok(t, err)
 
 	sse, err = bkt.getServerSideEncryption(context.Background())
@@ -294,7 +364,7 @@ func TestBucket_getServerSideEncryption(t *testing.T) {
 	override, err := encrypt.NewSSEKMS("test", nil)
 	testutil.Ok(t, err)
 
-	bkt, err = NewBucketWithConfig(log.NewNopLogger(), cfg, "test")
+	bkt, err = NewBucketWithConfig(log.NewNopLogger(), cfg, nil, "test")
 	testutil.Ok(t, err)
 
 	sse, err = bkt.getServerSideEncryption(context.WithValue(context.Background(), sseConfigKey, override))
@@ -321,7 +391,7 @@ func TestBucket_Get_ShouldReturnErrorIfServerTruncateResponse(t *testing.T) {
 	cfg.AccessKey = "test"
 	cfg.SecretKey = "test"
 
-	bkt, err := NewBucketWithConfig(log.NewNopLogger(), cfg, "test")
+	bkt, err := NewBucketWithConfig(log.NewNopLogger(), cfg, nil, "test")
 	testutil.Ok(t, err)
 
 	reader, err := bkt.Get(context.Background(), "test")
@@ -331,3 +401,101 @@ func TestBucket_Get_ShouldReturnErrorIfServerTruncateResponse(t *testing.T) {
 	_, err = ioutil.ReadAll(reader)
 	testutil.Equals(t, io.ErrUnexpectedEOF, err)
 }
+
+func TestBucket_Get_DecompressObjects(t *testing.T) {
+	content := []byte(strings.Repeat("hello world ", 10))
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	_, err := gw.Write(content)
+	testutil.Ok(t, err)
+	testutil.Ok(t, gw.Close())
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(compressed.Len()))
+		_, err := w.Write(compressed.Bytes())
+		testutil.Ok(t, err)
+	}))
+	defer srv.Close()
+
+	newBucket := func(t *testing.T, patterns ...string) *Bucket {
+		cfg := DefaultConfig
+		cfg.Bucket = "test-bucket"
+		cfg.Endpoint = srv.Listener.Addr().String()
+		cfg.Insecure = true
+		cfg.Region = "test"
+		cfg.AccessKey = "test"
+		cfg.SecretKey = "test"
+		cfg.DecompressObjects = patterns
+
+		bkt, err := NewBucketWithConfig(log.NewNopLogger(), cfg, nil, "test")
+		testutil.Ok(t, err)
+		return bkt
+	}
+	read := func(t *testing.T, r io.ReadCloser, err error) []byte {
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, r.Close()) }()
+		b, err := ioutil.ReadAll(r)
+		testutil.Ok(t, err)
+		return b
+	}
+
+	t.Run("pattern matches", func(t *testing.T) {
+		bkt := newBucket(t, "*/meta.json")
+
+		r, err := bkt.Get(context.Background(), "01F/meta.json")
+		testutil.Equals(t, content, read(t, r, err))
+
+		r, err = bkt.GetRange(context.Background(), "01F/meta.json", 6, 5)
+		testutil.Equals(t, []byte("world"), read(t, r, err))
+	})
+	t.Run("pattern does not match", func(t *testing.T) {
+		bkt := newBucket(t, "*/meta.json")
+
+		r, err := bkt.Get(context.Background(), "01F/index")
+		testutil.Equals(t, compressed.Bytes(), read(t, r, err))
+	})
+	t.Run("invalid pattern", func(t *testing.T) {
+		cfg := DefaultConfig
+		cfg.Endpoint = srv.Listener.Addr().String()
+		cfg.DecompressObjects = []string{"["}
+		testutil.NotOk(t, validate(cfg))
+	})
+}
+
+func TestBucket_ConnectionMetrics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	cfg := DefaultConfig
+	cfg.Bucket = "test-bucket"
+	cfg.Endpoint = srv.Listener.Addr().String()
+	cfg.Insecure = true
+	cfg.Region = "test"
+	cfg.AccessKey = "test"
+	cfg.SecretKey = "test"
+
+	reg := prometheus.NewRegistry()
+	bkt, err := NewBucketWithConfig(log.NewNopLogger(), cfg, reg, "test")
+	testutil.Ok(t, err)
+
+	for i := 0; i < 2; i++ {
+		ok, err := bkt.Exists(context.Background(), "obj")
+		testutil.Ok(t, err)
+		testutil.Assert(t, !ok, "object should not exist")
+	}
+
+	// Second request reuses the idle connection of the first one.
+	testutil.Ok(t, promtest.GatherAndCompare(reg, strings.NewReader(`
+		# HELP thanos_objstore_s3_connections_total Total number of connections obtained for requests against the bucket, by whether they were reused from the idle pool.
+		# TYPE thanos_objstore_s3_connections_total counter
+		thanos_objstore_s3_connections_total{bucket="test-bucket",reused="false"} 1
+		thanos_objstore_s3_connections_total{bucket="test-bucket",reused="true"} 1
+		# HELP thanos_objstore_s3_open_connections Number of currently open connections to the bucket, both in use and idle. Only tracked for the default transport.
+		# TYPE thanos_objstore_s3_open_connections gauge
+		thanos_objstore_s3_open_connections{bucket="test-bucket"} 1
+		`), "thanos_objstore_s3_connections_total", "thanos_objstore_s3_open_connections"))
+}
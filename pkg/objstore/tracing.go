@@ -65,6 +65,14 @@ func (t TracingBucket) Exists(ctx context.Context, name string) (exists bool, er
 	return
 }
 
+func (t TracingBucket) BatchExists(ctx context.Context, names []string) (res map[string]bool, err error) {
+	tracing.DoWithSpan(ctx, "bucket_batch_exists", func(spanCtx context.Context, span opentracing.Span) {
+		span.LogKV("names", len(names))
+		res, err = BatchExists(spanCtx, t.bkt, names)
+	})
+	return
+}
+
 func (t TracingBucket) Attributes(ctx context.Context, name string) (attrs ObjectAttributes, err error) {
 	tracing.DoWithSpan(ctx, "bucket_attributes", func(spanCtx context.Context, span opentracing.Span) {
 		span.LogKV("name", name)
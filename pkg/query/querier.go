@@ -16,6 +16,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	promgate "github.com/prometheus/prometheus/pkg/gate"
 	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/storage"
 
 	"github.com/thanos-io/thanos/pkg/dedup"
@@ -394,3 +395,32 @@ func (q *querier) Close() error {
 	q.cancel()
 	return nil
 }
+
+// ErrUnreliableAbsent is returned for queries using absent functions that were evaluated on a partial response.
+var ErrUnreliableAbsent = errors.New("absent function evaluated on partial response")
+
+// CheckAbsentOnPartialResponse returns ErrUnreliableAbsent if the given query uses absent() or absent_over_time()
+// and its evaluation returned warnings. With partial response enabled, a failed store may hold the series such
+// function looks for, so their result cannot be distinguished from the series being actually absent.
+func CheckAbsentOnPartialResponse(q string, warns []string) error {
+	if len(warns) == 0 {
+		return nil
+	}
+	expr, err := parser.ParseExpr(q)
+	if err != nil {
+		return errors.Wrap(err, "parse query")
+	}
+
+	var fn string
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if call, ok := node.(*parser.Call); ok && (call.Func.Name == "absent" || call.Func.Name == "absent_over_time") {
+			fn = call.Func.Name
+			return errors.New("found")
+		}
+		return nil
+	})
+	if fn == "" {
+		return nil
+	}
+	return errors.Wrapf(ErrUnreliableAbsent, "%s() in query %q with warnings: %s", fn, q, strings.Join(warns, ", "))
+}
@@ -1069,3 +1069,62 @@ func storeSeriesResponse(t testing.TB, lset labels.Labels, smplChunks ...[]sampl
 	}
 	return storepb.NewSeriesResponse(&s)
 }
+
+func TestCheckAbsentOnPartialResponse(t *testing.T) {
+	// The store holding the series fails, which with partial response enabled only results in a warning.
+	storeAPI := &testStoreServer{resps: []*storepb.SeriesResponse{
+		storepb.NewWarnSeriesResponse(errors.New("store unavailable")),
+	}}
+	e := promql.NewEngine(promql.EngineOpts{
+		Logger:     log.NewNopLogger(),
+		Timeout:    time.Minute,
+		MaxSamples: math.MaxInt64,
+	})
+
+	for _, tcase := range []struct {
+		query       string
+		expectedErr bool
+	}{
+		{query: `absent(up{job="foo"})`, expectedErr: true},
+		{query: `absent_over_time(up{job="foo"}[5m])`, expectedErr: true},
+		{query: `sum(absent(up{job="foo"})) > 0`, expectedErr: true},
+		{query: `up{job="foo"} == 0`},
+	} {
+		t.Run(tcase.query, func(t *testing.T) {
+			mq := &mockedQueryable{
+				Creator: func(mint, maxt int64) storage.Querier {
+					return newQuerier(context.Background(), nil, mint, maxt, nil, nil, storeAPI, false, 0, true, false, gate.New(2), time.Minute)
+				},
+			}
+			t.Cleanup(func() {
+				testutil.Ok(t, mq.Close())
+			})
+
+			q, err := e.NewInstantQuery(mq, tcase.query, timestamp.Time(3600000))
+			testutil.Ok(t, err)
+			t.Cleanup(q.Close)
+			res := q.Exec(context.Background())
+			testutil.Ok(t, res.Err)
+
+			var warns []string
+			for _, w := range res.Warnings {
+				warns = append(warns, w.Error())
+			}
+			testutil.Assert(t, len(warns) > 0, "expected warnings from failed store")
+
+			err = CheckAbsentOnPartialResponse(tcase.query, warns)
+			if !tcase.expectedErr {
+				testutil.Ok(t, err)
+				return
+			}
+			// Without the check, absent() would fire for a series that is only missing due to the failed store.
+			vec, err2 := res.Vector()
+			testutil.Ok(t, err2)
+			testutil.Equals(t, 1, len(vec))
+			testutil.NotOk(t, err)
+			testutil.Equals(t, ErrUnreliableAbsent, errors.Cause(err))
+
+			testutil.Ok(t, CheckAbsentOnPartialResponse(tcase.query, nil))
+		})
+	}
+}
@@ -644,6 +644,19 @@ func (s *StoreSet) GetStoreStatus() []StoreStatus {
 	return statuses
 }
 
+// StoreStatusesInTimeRange returns the statuses of stores whose advertised time range intersects [mint, maxt],
+// i.e. those stores that may have data for a query over that range.
+func StoreStatusesInTimeRange(statuses []StoreStatus, mint, maxt int64) []StoreStatus {
+	var res []StoreStatus
+	for _, st := range statuses {
+		if mint > st.MaxTime || maxt < st.MinTime {
+			continue
+		}
+		res = append(res, st)
+	}
+	return res
+}
+
 // Get returns a list of all active stores.
 func (s *StoreSet) Get() []store.Client {
 	s.storesMtx.RLock()
@@ -664,12 +677,23 @@ func (s *StoreSet) GetRulesClients() []rulespb.RulesClient {
 	rules := make([]rulespb.RulesClient, 0, len(s.stores))
 	for _, st := range s.stores {
 		if st.HasRulesAPI() {
-			rules = append(rules, st.rule)
+			rules = append(rules, &namedRulesClient{RulesClient: st.rule, addr: st.addr})
 		}
 	}
 	return rules
 }
 
+// namedRulesClient is a rulespb.RulesClient that identifies itself by the address
+// of its store, so partial response warnings name the ruler that failed.
+type namedRulesClient struct {
+	rulespb.RulesClient
+	addr string
+}
+
+func (c *namedRulesClient) String() string {
+	return c.addr
+}
+
 // GetTargetsClients returns a list of all active targets clients.
 func (s *StoreSet) GetTargetsClients() []targetspb.TargetsClient {
 	s.storesMtx.RLock()
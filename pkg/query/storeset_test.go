@@ -1093,3 +1093,33 @@ func TestUpdateStoreStateForgetsPreviousErrors(t *testing.T) {
 	testutil.Ok(t, err)
 	testutil.Equals(t, `null`, string(b))
 }
+
+func TestStoreStatusesInTimeRange(t *testing.T) {
+	statuses := []StoreStatus{
+		{Name: "old", MinTime: 0, MaxTime: 1000},
+		{Name: "mid", MinTime: 1000, MaxTime: 2000},
+		{Name: "recent", MinTime: 3000, MaxTime: math.MaxInt64},
+	}
+	names := func(sts []StoreStatus) (res []string) {
+		for _, st := range sts {
+			res = append(res, st.Name)
+		}
+		return res
+	}
+
+	for _, tcase := range []struct {
+		mint, maxt int64
+		expected   []string
+	}{
+		{mint: 0, maxt: 500, expected: []string{"old"}},
+		{mint: 1000, maxt: 1000, expected: []string{"old", "mid"}},
+		{mint: 1500, maxt: 3500, expected: []string{"mid", "recent"}},
+		{mint: 2100, maxt: 2900, expected: nil},
+		{mint: 5000, maxt: 6000, expected: []string{"recent"}},
+		{mint: math.MinInt64, maxt: math.MaxInt64, expected: []string{"old", "mid", "recent"}},
+	} {
+		t.Run("", func(t *testing.T) {
+			testutil.Equals(t, tcase.expected, names(StoreStatusesInTimeRange(statuses, tcase.mint, tcase.maxt)))
+		})
+	}
+}
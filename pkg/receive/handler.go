@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
 	stdlog "log"
@@ -14,9 +15,11 @@ import (
 	"net/http"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/NYTimes/gziphandler"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/gogo/protobuf/proto"
@@ -28,6 +31,8 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/route"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/tsdb"
 	"google.golang.org/grpc"
@@ -38,6 +43,7 @@ import (
 	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
 	"github.com/thanos-io/thanos/pkg/runutil"
 	"github.com/thanos-io/thanos/pkg/server/http/middleware"
+	"github.com/thanos-io/thanos/pkg/store/labelpb"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
 	"github.com/thanos-io/thanos/pkg/store/storepb/prompb"
 	"github.com/thanos-io/thanos/pkg/tracing"
@@ -61,9 +67,10 @@ var (
 	// errConflict is returned whenever an operation fails due to any conflict-type error.
 	errConflict = errors.New("conflict")
 
-	errBadReplica  = errors.New("request replica exceeds receiver replication factor")
-	errNotReady    = errors.New("target not ready")
-	errUnavailable = errors.New("target not available")
+	errBadReplica    = errors.New("request replica exceeds receiver replication factor")
+	errNotReady      = errors.New("target not ready")
+	errUnavailable   = errors.New("target not available")
+	errInvalidSeries = errors.New("invalid series")
 )
 
 // Options for the web Handler.
@@ -81,6 +88,18 @@ type Options struct {
 	TLSConfig         *tls.Config
 	DialOpts          []grpc.DialOption
 	ForwardTimeout    time.Duration
+	// MaxFutureTolerance is how far in the future sample timestamps can be. Samples beyond it are rejected.
+	// Zero disables the check.
+	MaxFutureTolerance time.Duration
+	// MaxLabelsPerSeries, MaxLabelNameLength and MaxLabelValueLength limit the labels of ingested series.
+	// Series violating any of them are rejected. Zero disables the respective limit.
+	MaxLabelsPerSeries  int
+	MaxLabelNameLength  int
+	MaxLabelValueLength int
+	// TenantSeriesLabel is the label of incoming series the tenant is determined from when the tenant header is absent.
+	// The label is then removed from the series before they are written. With the tenant header present, series are
+	// written as is, as removing the label could merge series of different label values. Empty disables the fallback.
+	TenantSeriesLabel string
 }
 
 // Handler serves a Prometheus remote write receiving HTTP endpoint.
@@ -101,6 +120,9 @@ type Handler struct {
 	forwardRequests   *prometheus.CounterVec
 	replications      *prometheus.CounterVec
 	replicationFactor prometheus.Gauge
+	replicaWrites     *prometheus.HistogramVec
+	futureSamples     prometheus.Counter
+	rejectedSeries    *prometheus.CounterVec
 }
 
 func NewHandler(logger log.Logger, o *Options) *Handler {
@@ -139,6 +161,25 @@ func NewHandler(logger log.Logger, o *Options) *Handler {
 				Help: "The number of times to replicate incoming write requests.",
 			},
 		),
+		replicaWrites: promauto.With(o.Registry).NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "thanos_receive_replica_write_duration_seconds",
+				Help:    "Time it took a replica to acknowledge a replicated write request, by target endpoint.",
+				Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+			}, []string{"endpoint"},
+		),
+		futureSamples: promauto.With(o.Registry).NewCounter(
+			prometheus.CounterOpts{
+				Name: "thanos_receive_future_samples_rejected_total",
+				Help: "The number of samples rejected because their timestamp was too far in the future.",
+			},
+		),
+		rejectedSeries: promauto.With(o.Registry).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "thanos_receive_series_rejected_total",
+				Help: "The number of series rejected because their labels exceeded the configured limits.",
+			}, []string{"reason"},
+		),
 	}
 
 	h.forwardRequests.WithLabelValues(labelSuccess)
@@ -168,7 +209,9 @@ func NewHandler(logger log.Logger, o *Options) *Handler {
 		return next
 	}
 
-	h.router.Post("/api/v1/receive", instrf("receive", readyf(middleware.RequestID(http.HandlerFunc(h.receiveHTTP)))))
+	// Responses are compressed only if the client accepts gzip and they are bigger than gziphandler.DefaultMinSize.
+	h.router.Post("/api/v1/receive", instrf("receive", readyf(middleware.RequestID(gziphandler.GzipHandler(http.HandlerFunc(h.receiveHTTP))))))
+	h.router.Get("/api/v1/receive/endpoints", instrf("endpoints", readyf(h.endpointsHTTP)))
 
 	return h
 }
@@ -285,10 +328,86 @@ func (h *Handler) handleRequest(ctx context.Context, rep uint64, tenant string,
 		r.n--
 	}
 
+	var errs errutil.MultiError
+	errs.Add(h.dropInvalidSeries(wreq))
+
+	if h.options.MaxFutureTolerance > 0 {
+		if n := dropFutureSamples(wreq, timestamp.FromTime(time.Now().Add(h.options.MaxFutureTolerance))); n > 0 {
+			h.futureSamples.Add(float64(n))
+			level.Debug(h.logger).Log("msg", "rejected samples too far in the future", "tenant", tenant, "num", n)
+			errs.Add(errors.Wrapf(storage.ErrOutOfBounds, "rejected %d samples with timestamps more than %v in the future", n, h.options.MaxFutureTolerance))
+		}
+	}
+
 	// Forward any time series as necessary. All time series
 	// destined for the local node will be written to the receiver.
 	// Time series will be replicated as necessary.
-	return h.forward(ctx, tenant, r, wreq)
+	if err := h.forward(ctx, tenant, r, wreq); err != nil {
+		return err
+	}
+	return errs.Err()
+}
+
+// dropInvalidSeries removes series exceeding the configured label limits from the request.
+// It returns an error describing the first violation if any series was removed.
+func (h *Handler) dropInvalidSeries(wreq *prompb.WriteRequest) error {
+	var (
+		dropped   int
+		violation string
+		series    = wreq.Timeseries[:0]
+	)
+	for _, ts := range wreq.Timeseries {
+		reason, desc := h.labelLimitViolation(ts.Labels)
+		if reason == "" {
+			series = append(series, ts)
+			continue
+		}
+		h.rejectedSeries.WithLabelValues(reason).Inc()
+		if dropped == 0 {
+			violation = desc
+		}
+		dropped++
+	}
+	wreq.Timeseries = series
+
+	if dropped == 0 {
+		return nil
+	}
+	return errors.Wrapf(errInvalidSeries, "rejected %d series exceeding label limits, first: %s", dropped, violation)
+}
+
+// labelLimitViolation returns the reason and description of the first label limit the series violates,
+// or empty strings if it satisfies all of them.
+func (h *Handler) labelLimitViolation(lset []labelpb.ZLabel) (reason, desc string) {
+	if limit := h.options.MaxLabelsPerSeries; limit > 0 && len(lset) > limit {
+		return "label_count", fmt.Sprintf("series %s has %d labels, limit is %d", labelpb.ZLabelsToPromLabels(lset), len(lset), limit)
+	}
+	for _, l := range lset {
+		if limit := h.options.MaxLabelNameLength; limit > 0 && len(l.Name) > limit {
+			return "label_name_length", fmt.Sprintf("series %s has label name %q longer than %d characters", labelpb.ZLabelsToPromLabels(lset), l.Name, limit)
+		}
+		if limit := h.options.MaxLabelValueLength; limit > 0 && len(l.Value) > limit {
+			return "label_value_length", fmt.Sprintf("series %s has value of label %q longer than %d characters", labelpb.ZLabelsToPromLabels(lset), l.Name, limit)
+		}
+	}
+	return "", ""
+}
+
+// dropFutureSamples removes samples with timestamps after maxt from the request and returns their number.
+func dropFutureSamples(wreq *prompb.WriteRequest, maxt int64) int {
+	var dropped int
+	for i := range wreq.Timeseries {
+		samples := wreq.Timeseries[i].Samples[:0]
+		for _, s := range wreq.Timeseries[i].Samples {
+			if s.Timestamp > maxt {
+				dropped++
+				continue
+			}
+			samples = append(samples, s)
+		}
+		wreq.Timeseries[i].Samples = samples
+	}
+	return dropped
 }
 
 func (h *Handler) receiveHTTP(w http.ResponseWriter, r *http.Request) {
@@ -335,9 +454,6 @@ func (h *Handler) receiveHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	tenant := r.Header.Get(h.options.TenantHeader)
-	if tenant == "" {
-		tenant = h.options.DefaultTenantID
-	}
 
 	// TODO(yeya24): handle remote write metadata.
 	// exit early if the request contained no data
@@ -346,7 +462,30 @@ func (h *Handler) receiveHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.handleRequest(ctx, rep, tenant, &wreq)
+	// The tenant header takes precedence over the tenant series label, which takes precedence over the default tenant.
+	// The tenant series label is only removed from the series if it determined their tenant: with the header, series
+	// differing only by that label would otherwise be merged.
+	var tenantReqs map[string]*prompb.WriteRequest
+	switch {
+	case tenant != "":
+		tenantReqs = map[string]*prompb.WriteRequest{tenant: &wreq}
+	case h.options.TenantSeriesLabel != "":
+		tenantReqs = splitByTenantLabel(&wreq, h.options.TenantSeriesLabel, h.options.DefaultTenantID)
+	default:
+		tenantReqs = map[string]*prompb.WriteRequest{h.options.DefaultTenantID: &wreq}
+	}
+
+	if len(tenantReqs) == 1 {
+		for tenant, treq := range tenantReqs {
+			err = h.handleRequest(ctx, rep, tenant, treq)
+		}
+	} else {
+		var errs errutil.MultiError
+		for tenant, treq := range tenantReqs {
+			errs.Add(h.handleRequest(ctx, rep, tenant, treq))
+		}
+		err = errs.Err()
+	}
 	if err != nil {
 		level.Debug(h.logger).Log("msg", "failed to handle request", "err", err)
 	}
@@ -360,7 +499,7 @@ func (h *Handler) receiveHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 	case errConflict:
 		http.Error(w, err.Error(), http.StatusConflict)
-	case errBadReplica:
+	case errBadReplica, errInvalidSeries:
 		http.Error(w, err.Error(), http.StatusBadRequest)
 	default:
 		level.Error(h.logger).Log("err", err, "msg", "internal server error")
@@ -368,6 +507,32 @@ func (h *Handler) receiveHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// splitByTenantLabel splits the write request by the value of the given label, which is removed from the series.
+// Series without the label are assigned to the default tenant.
+func splitByTenantLabel(wreq *prompb.WriteRequest, labelName, defaultTenant string) map[string]*prompb.WriteRequest {
+	tenantReqs := map[string]*prompb.WriteRequest{}
+	for _, ts := range wreq.Timeseries {
+		tenant := defaultTenant
+		for i, l := range ts.Labels {
+			if l.Name != labelName {
+				continue
+			}
+			if l.Value != "" {
+				tenant = l.Value
+			}
+			ts.Labels = append(ts.Labels[:i:i], ts.Labels[i+1:]...)
+			break
+		}
+		treq, ok := tenantReqs[tenant]
+		if !ok {
+			treq = &prompb.WriteRequest{}
+			tenantReqs[tenant] = treq
+		}
+		treq.Timeseries = append(treq.Timeseries, ts)
+	}
+	return tenantReqs
+}
+
 // forward accepts a write request, batches its time series by
 // corresponding endpoint, and forwards them in parallel to the
 // correct endpoint. Requests destined for the local node are written
@@ -482,9 +647,13 @@ func (h *Handler) fanoutForward(pctx context.Context, tenant string, replicas ma
 				defer wg.Done()
 
 				var err error
+				begin := time.Now()
 				tracing.DoInSpan(fctx, "receive_tsdb_write", func(_ context.Context) {
 					err = h.writer.Write(fctx, tenant, wreqs[endpoint])
 				})
+				if replicas[endpoint].replicated {
+					h.replicaWrites.WithLabelValues(endpoint).Observe(time.Since(begin).Seconds())
+				}
 				if err != nil {
 					// When a MultiError is added to another MultiError, the error slices are concatenated, not nested.
 					// To avoid breaking the counting logic, we need to flatten the error.
@@ -533,6 +702,7 @@ func (h *Handler) fanoutForward(pctx context.Context, tenant string, replicas ma
 			h.mtx.RUnlock()
 
 			// Create a span to track the request made to another receive node.
+			begin := time.Now()
 			tracing.DoInSpan(fctx, "receive_forward", func(ctx context.Context) {
 				// Actually make the request against the endpoint we determined should handle these time series.
 				_, err = cl.RemoteWrite(ctx, &storepb.WriteRequest{
@@ -542,6 +712,9 @@ func (h *Handler) fanoutForward(pctx context.Context, tenant string, replicas ma
 					Replica: int64(replicas[endpoint].n + 1),
 				})
 			})
+			if replicas[endpoint].replicated {
+				h.replicaWrites.WithLabelValues(endpoint).Observe(time.Since(begin).Seconds())
+			}
 			if err != nil {
 				// Check if peer connection is unavailable, don't attempt to send requests constantly.
 				if st, ok := status.FromError(err); ok {
@@ -617,7 +790,6 @@ func (h *Handler) fanoutForward(pctx context.Context, tenant string, replicas ma
 func (h *Handler) replicate(ctx context.Context, tenant string, wreq *prompb.WriteRequest) error {
 	wreqs := make(map[string]*prompb.WriteRequest)
 	replicas := make(map[string]replica)
-	var i uint64
 
 	// It is possible that hashring is ready in testReady() but unready now,
 	// so need to lock here.
@@ -627,16 +799,15 @@ func (h *Handler) replicate(ctx context.Context, tenant string, wreq *prompb.Wri
 		return errors.New("hashring is not ready")
 	}
 
-	for i = 0; i < h.options.ReplicationFactor; i++ {
-		endpoint, err := h.hashring.GetN(tenant, &wreq.Timeseries[0], i)
-		if err != nil {
-			h.mtx.RUnlock()
-			return err
-		}
+	endpoints, err := replicaEndpoints(h.hashring, tenant, &wreq.Timeseries[0], h.options.ReplicationFactor)
+	h.mtx.RUnlock()
+	if err != nil {
+		return err
+	}
+	for i, endpoint := range endpoints {
 		wreqs[endpoint] = wreq
-		replicas[endpoint] = replica{i, true}
+		replicas[endpoint] = replica{uint64(i), true}
 	}
-	h.mtx.RUnlock()
 
 	quorum := h.writeQuorum()
 	// fanoutForward only returns an error if successThreshold (quorum) is not reached.
@@ -646,6 +817,58 @@ func (h *Handler) replicate(ctx context.Context, tenant string, wreq *prompb.Wri
 	return nil
 }
 
+// replicaEndpoints returns the endpoints the given time series of the tenant is written to, one per replica.
+func replicaEndpoints(hashring Hashring, tenant string, ts *prompb.TimeSeries, replicationFactor uint64) ([]string, error) {
+	if replicationFactor == 0 {
+		replicationFactor = 1
+	}
+	endpoints := make([]string, 0, replicationFactor)
+	for i := uint64(0); i < replicationFactor; i++ {
+		endpoint, err := hashring.GetN(tenant, ts, i)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+// endpointsHTTP returns the endpoints a series of a tenant is written to.
+// The series is passed as a metric selector in the "series" parameter, e.g. `up{job="foo"}`.
+func (h *Handler) endpointsHTTP(w http.ResponseWriter, r *http.Request) {
+	tenant := r.FormValue("tenant")
+	if tenant == "" {
+		tenant = h.options.DefaultTenantID
+	}
+
+	lset, err := parser.ParseMetric(r.FormValue("series"))
+	if err != nil {
+		http.Error(w, errors.Wrap(err, "parse series").Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.mtx.RLock()
+	if h.hashring == nil {
+		h.mtx.RUnlock()
+		http.Error(w, "hashring is not ready", http.StatusServiceUnavailable)
+		return
+	}
+	endpoints, err := replicaEndpoints(h.hashring, tenant, &prompb.TimeSeries{Labels: labelpb.ZLabelsFromPromLabels(lset)}, h.options.ReplicationFactor)
+	h.mtx.RUnlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		Tenant    string   `json:"tenant"`
+		Endpoints []string `json:"endpoints"`
+	}{Tenant: tenant, Endpoints: endpoints}); err != nil {
+		level.Warn(h.logger).Log("msg", "failed to write endpoints response", "err", err)
+	}
+}
+
 // RemoteWrite implements the gRPC remote write handler for storepb.WriteableStore.
 func (h *Handler) RemoteWrite(ctx context.Context, r *storepb.WriteRequest) (*storepb.WriteResponse, error) {
 	span, ctx := tracing.StartSpan(ctx, "receive_grpc")
@@ -664,7 +887,7 @@ func (h *Handler) RemoteWrite(ctx context.Context, r *storepb.WriteRequest) (*st
 		return nil, status.Error(codes.Unavailable, err.Error())
 	case errConflict:
 		return nil, status.Error(codes.AlreadyExists, err.Error())
-	case errBadReplica:
+	case errBadReplica, errInvalidSeries:
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	default:
 		return nil, status.Error(codes.Internal, err.Error())
@@ -683,6 +906,17 @@ func isConflict(err error) bool {
 		status.Code(err) == codes.AlreadyExists
 }
 
+// isInvalidSeries returns whether or not the given error represents a rejected series error.
+// Series rejected by peers are reported with the InvalidArgument code, which peers also use for other errors
+// such as errBadReplica, so the message has to match as well.
+func isInvalidSeries(err error) bool {
+	if err == errInvalidSeries {
+		return true
+	}
+	st, ok := status.FromError(err)
+	return ok && st.Code() == codes.InvalidArgument && strings.Contains(st.Message(), errInvalidSeries.Error())
+}
+
 // isNotReady returns whether or not the given error represents a not ready error.
 func isNotReady(err error) bool {
 	return err == errNotReady ||
@@ -738,6 +972,7 @@ func determineWriteErrorCause(err error, threshold int) error {
 		{err: errConflict, cause: isConflict},
 		{err: errNotReady, cause: isNotReady},
 		{err: errUnavailable, cause: isUnavailable},
+		{err: errInvalidSeries, cause: isInvalidSeries},
 	}
 	for _, exp := range expErrs {
 		exp.count = 0
@@ -5,17 +5,21 @@ package receive
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
@@ -26,8 +30,11 @@ import (
 	"github.com/golang/snappy"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/prometheus/pkg/exemplar"
 	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/tsdb"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
@@ -151,6 +158,26 @@ func TestDetermineWriteErrorCause(t *testing.T) {
 			threshold: 2,
 			exp:       errConflict,
 		},
+		{
+			name: "matching multierror with series rejected locally and by peers",
+			err: errutil.NonNilMultiError([]error{
+				errors.Wrap(errInvalidSeries, "rejected 1 series"),
+				status.Error(codes.InvalidArgument, errors.Wrap(errInvalidSeries, "rejected 2 series").Error()),
+				errors.New("foo"),
+			}),
+			threshold: 2,
+			exp:       errInvalidSeries,
+		},
+		{
+			name: "multierror with other invalid argument errors from peers",
+			err: errutil.NonNilMultiError([]error{
+				status.Error(codes.InvalidArgument, errBadReplica.Error()),
+				status.Error(codes.InvalidArgument, errBadReplica.Error()),
+				errors.New("foo"),
+			}),
+			threshold: 2,
+			exp:       errors.New("3 errors: rpc error: code = InvalidArgument desc = request replica exceeds receiver replication factor; rpc error: code = InvalidArgument desc = request replica exceeds receiver replication factor; foo"),
+		},
 		{
 			name: "nested matching multierror",
 			err: errors.Wrap(errors.Wrap(errutil.NonNilMultiError([]error{
@@ -1300,3 +1327,321 @@ func Heap(dir string) (err error) {
 	defer runutil.CloseWithErrCapture(&err, f, "close")
 	return pprof.WriteHeapProfile(f)
 }
+
+func TestReceiveHTTP_GzipResponse(t *testing.T) {
+	// Large enough error message to be compressed.
+	appenderErr := errors.New(strings.Repeat("failed to get appender ", 200))
+	appendables := []*fakeAppendable{{
+		appender:    newFakeAppender(nil, nil, nil),
+		appenderErr: func() error { return appenderErr },
+	}}
+	handlers, _ := newTestHandlerHashring(appendables, 1)
+	h := handlers[0]
+
+	wreq := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels:  []labelpb.ZLabel{{Name: "foo", Value: "bar"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 1}},
+			},
+		},
+	}
+	buf, err := proto.Marshal(wreq)
+	testutil.Ok(t, err)
+
+	for _, acceptGzip := range []bool{false, true} {
+		t.Run(fmt.Sprintf("accept-gzip=%v", acceptGzip), func(t *testing.T) {
+			req, err := http.NewRequest("POST", "/api/v1/receive", bytes.NewBuffer(snappy.Encode(nil, buf)))
+			testutil.Ok(t, err)
+			req.Header.Add(h.options.TenantHeader, DefaultTenant)
+			if acceptGzip {
+				req.Header.Add("Accept-Encoding", "gzip")
+			}
+
+			rec := httptest.NewRecorder()
+			h.router.ServeHTTP(rec, req)
+			testutil.Equals(t, http.StatusInternalServerError, rec.Code)
+
+			body := rec.Body.Bytes()
+			if acceptGzip {
+				testutil.Equals(t, "gzip", rec.Header().Get("Content-Encoding"))
+				r, err := gzip.NewReader(bytes.NewReader(body))
+				testutil.Ok(t, err)
+				body, err = ioutil.ReadAll(r)
+				testutil.Ok(t, err)
+			} else {
+				testutil.Equals(t, "", rec.Header().Get("Content-Encoding"))
+			}
+			testutil.Assert(t, strings.Contains(string(body), appenderErr.Error()), "unexpected response body %q", string(body))
+		})
+	}
+}
+
+func TestReceiveEndpointsHTTP(t *testing.T) {
+	appendables := []*fakeAppendable{
+		{appender: newFakeAppender(nil, nil, nil)},
+		{appender: newFakeAppender(nil, nil, nil)},
+		{appender: newFakeAppender(nil, nil, nil)},
+	}
+	handlers, _ := newTestHandlerHashring(appendables, 2)
+	tenant := "foo"
+
+	for _, series := range []string{`up{job="a"}`, `up{job="b",instance="c"}`, `{__name__="bar",a="1"}`} {
+		t.Run(series, func(t *testing.T) {
+			lset, err := parser.ParseMetric(series)
+			testutil.Ok(t, err)
+
+			wreq := &prompb.WriteRequest{
+				Timeseries: []prompb.TimeSeries{{
+					Labels:  labelpb.ZLabelsFromPromLabels(lset.Copy()),
+					Samples: []prompb.Sample{{Value: 1, Timestamp: 1}},
+				}},
+			}
+			rec, err := makeRequest(handlers[0], tenant, wreq)
+			testutil.Ok(t, err)
+			testutil.Equals(t, http.StatusOK, rec.Code)
+
+			// Endpoints the write path actually wrote to.
+			var written []string
+			for i, a := range appendables {
+				if len(a.appender.(*fakeAppender).Get(lset)) > 0 {
+					written = append(written, handlers[i].options.Endpoint)
+				}
+			}
+			testutil.Equals(t, 2, len(written))
+
+			req, err := http.NewRequest("GET", "/api/v1/receive/endpoints?"+url.Values{"tenant": {tenant}, "series": {series}}.Encode(), nil)
+			testutil.Ok(t, err)
+			rec = httptest.NewRecorder()
+			handlers[1].router.ServeHTTP(rec, req)
+			testutil.Equals(t, http.StatusOK, rec.Code)
+
+			var resp struct {
+				Tenant    string   `json:"tenant"`
+				Endpoints []string `json:"endpoints"`
+			}
+			testutil.Ok(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			testutil.Equals(t, tenant, resp.Tenant)
+
+			sort.Strings(written)
+			sort.Strings(resp.Endpoints)
+			testutil.Equals(t, written, resp.Endpoints)
+		})
+	}
+
+	// Invalid series are rejected.
+	req, err := http.NewRequest("GET", "/api/v1/receive/endpoints?series=%7B", nil)
+	testutil.Ok(t, err)
+	rec := httptest.NewRecorder()
+	handlers[0].router.ServeHTTP(rec, req)
+	testutil.Equals(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestReceiveReplicaWriteDuration(t *testing.T) {
+	slowAppendErr := func() error {
+		time.Sleep(200 * time.Millisecond)
+		return nil
+	}
+	appendables := []*fakeAppendable{
+		{appender: newFakeAppender(nil, nil, nil)},
+		{appender: newFakeAppender(nil, nil, nil)},
+		{appender: newFakeAppender(slowAppendErr, nil, nil)},
+	}
+	handlers, _ := newTestHandlerHashring(appendables, 3)
+
+	wreq := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{{
+			Labels:  []labelpb.ZLabel{{Name: "foo", Value: "bar"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1}},
+		}},
+	}
+	rec, err := makeRequest(handlers[0], "tenant", wreq)
+	testutil.Ok(t, err)
+	testutil.Equals(t, http.StatusOK, rec.Code)
+
+	observed := func(endpoint string) (uint64, float64) {
+		m := &dto.Metric{}
+		testutil.Ok(t, handlers[0].replicaWrites.WithLabelValues(endpoint).(prometheus.Metric).Write(m))
+		return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+	}
+
+	// Quorum is reached without the slow replica, so wait for its acknowledgement.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	testutil.Ok(t, runutil.Retry(10*time.Millisecond, ctx.Done(), func() error {
+		for _, h := range handlers {
+			if cnt, _ := observed(h.options.Endpoint); cnt != 1 {
+				return errors.Errorf("expected 1 observation for %s, got %d", h.options.Endpoint, cnt)
+			}
+		}
+		return nil
+	}))
+
+	_, slow := observed(handlers[2].options.Endpoint)
+	for _, h := range handlers[:2] {
+		_, fast := observed(h.options.Endpoint)
+		testutil.Assert(t, slow > fast, "expected slow replica latency %v to be higher than %v", slow, fast)
+	}
+}
+
+func TestReceiveMaxFutureTolerance(t *testing.T) {
+	appendables := []*fakeAppendable{{appender: newFakeAppender(nil, nil, nil)}}
+	handlers, _ := newTestHandlerHashring(appendables, 1)
+	h := handlers[0]
+	h.options.MaxFutureTolerance = time.Hour
+
+	var (
+		now    = time.Now()
+		near   = prompb.Sample{Value: 1, Timestamp: now.Add(time.Minute).UnixNano() / int64(time.Millisecond)}
+		future = prompb.Sample{Value: 2, Timestamp: now.Add(30*24*time.Hour).UnixNano() / int64(time.Millisecond)}
+		lset   = labels.FromStrings("foo", "bar")
+	)
+
+	// Near-now samples are accepted.
+	rec, err := makeRequest(h, "tenant", &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{{Labels: labelpb.ZLabelsFromPromLabels(lset.Copy()), Samples: []prompb.Sample{near}}},
+	})
+	testutil.Ok(t, err)
+	testutil.Equals(t, http.StatusOK, rec.Code)
+	testutil.Equals(t, 0.0, promtest.ToFloat64(h.futureSamples))
+
+	// Far-future samples are rejected, the rest of the request is still ingested.
+	rec, err = makeRequest(h, "tenant", &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{{Labels: labelpb.ZLabelsFromPromLabels(lset.Copy()), Samples: []prompb.Sample{future, {Value: 3, Timestamp: near.Timestamp + 1}}}},
+	})
+	testutil.Ok(t, err)
+	testutil.Equals(t, http.StatusConflict, rec.Code)
+	testutil.Assert(t, strings.Contains(rec.Body.String(), "rejected 1 samples with timestamps more than 1h0m0s in the future"), "unexpected response %q", rec.Body.String())
+	testutil.Equals(t, 1.0, promtest.ToFloat64(h.futureSamples))
+	testutil.Equals(t, []prompb.Sample{near, {Value: 3, Timestamp: near.Timestamp + 1}}, appendables[0].appender.(*fakeAppender).Get(lset))
+}
+
+func TestReceiveLabelLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		lset           labels.Labels
+		expectedCode   int
+		expectedReason string
+		expectedErr    string
+	}{
+		{
+			name:         "within limits",
+			lset:         labels.FromStrings("__name__", "up", "job", "foo"),
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:           "too many labels",
+			lset:           labels.FromStrings("__name__", "up", "a", "1", "b", "2", "c", "3"),
+			expectedCode:   http.StatusBadRequest,
+			expectedReason: "label_count",
+			expectedErr:    "has 4 labels, limit is 3",
+		},
+		{
+			name:           "label name too long",
+			lset:           labels.FromStrings("__name__", "up", strings.Repeat("a", 21), "1"),
+			expectedCode:   http.StatusBadRequest,
+			expectedReason: "label_name_length",
+			expectedErr:    "longer than 20 characters",
+		},
+		{
+			name:           "label value too long",
+			lset:           labels.FromStrings("__name__", "up", "job", strings.Repeat("v", 101)),
+			expectedCode:   http.StatusBadRequest,
+			expectedReason: "label_value_length",
+			expectedErr:    `has value of label "job" longer than 100 characters`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			appendables := []*fakeAppendable{{appender: newFakeAppender(nil, nil, nil)}}
+			handlers, _ := newTestHandlerHashring(appendables, 1)
+			h := handlers[0]
+			h.options.MaxLabelsPerSeries = 3
+			h.options.MaxLabelNameLength = 20
+			h.options.MaxLabelValueLength = 100
+
+			valid := labels.FromStrings("__name__", "valid")
+			rec, err := makeRequest(h, "tenant", &prompb.WriteRequest{
+				Timeseries: []prompb.TimeSeries{
+					{Labels: labelpb.ZLabelsFromPromLabels(tc.lset.Copy()), Samples: []prompb.Sample{{Value: 1, Timestamp: 1}}},
+					{Labels: labelpb.ZLabelsFromPromLabels(valid.Copy()), Samples: []prompb.Sample{{Value: 1, Timestamp: 1}}},
+				},
+			})
+			testutil.Ok(t, err)
+			testutil.Equals(t, tc.expectedCode, rec.Code)
+
+			// Valid series are always ingested.
+			testutil.Equals(t, 1, len(appendables[0].appender.(*fakeAppender).Get(valid)))
+			if tc.expectedReason == "" {
+				testutil.Equals(t, 1, len(appendables[0].appender.(*fakeAppender).Get(tc.lset)))
+				return
+			}
+			testutil.Equals(t, 0, len(appendables[0].appender.(*fakeAppender).Get(tc.lset)))
+			testutil.Assert(t, strings.Contains(rec.Body.String(), tc.expectedErr), "unexpected response %q", rec.Body.String())
+			testutil.Equals(t, 1.0, promtest.ToFloat64(h.rejectedSeries.WithLabelValues(tc.expectedReason)))
+		})
+	}
+}
+
+type perTenantAppendable map[string]*fakeAppendable
+
+func (p perTenantAppendable) TenantAppendable(tenant string) (Appendable, error) {
+	if _, ok := p[tenant]; !ok {
+		p[tenant] = &fakeAppendable{appender: newFakeAppender(nil, nil, nil)}
+	}
+	return p[tenant], nil
+}
+
+func TestReceiveTenantSeriesLabel(t *testing.T) {
+	handlers, _ := newTestHandlerHashring([]*fakeAppendable{{appender: newFakeAppender(nil, nil, nil)}}, 1)
+	h := handlers[0]
+	h.options.DefaultTenantID = DefaultTenant
+	h.options.TenantSeriesLabel = "__tenant__"
+
+	wreq := func() *prompb.WriteRequest {
+		return &prompb.WriteRequest{
+			Timeseries: []prompb.TimeSeries{
+				{Labels: labelpb.ZLabelsFromPromLabels(labels.FromStrings("__name__", "up", "__tenant__", "team-a")), Samples: []prompb.Sample{{Value: 1, Timestamp: 1}}},
+				{Labels: labelpb.ZLabelsFromPromLabels(labels.FromStrings("__name__", "up", "__tenant__", "team-b")), Samples: []prompb.Sample{{Value: 2, Timestamp: 1}}},
+				{Labels: labelpb.ZLabelsFromPromLabels(labels.FromStrings("__name__", "up")), Samples: []prompb.Sample{{Value: 3, Timestamp: 1}}},
+			},
+		}
+	}
+	up := labels.FromStrings("__name__", "up")
+	samples := func(tenants perTenantAppendable, tenant string) []prompb.Sample {
+		a, ok := tenants[tenant]
+		if !ok {
+			return nil
+		}
+		return a.appender.(*fakeAppender).Get(up)
+	}
+
+	t.Run("label used when header is missing", func(t *testing.T) {
+		tenants := perTenantAppendable{}
+		h.writer = NewWriter(log.NewNopLogger(), tenants)
+
+		rec, err := makeRequest(h, "", wreq())
+		testutil.Ok(t, err)
+		testutil.Equals(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		testutil.Equals(t, 3, len(tenants))
+		testutil.Equals(t, []prompb.Sample{{Value: 1, Timestamp: 1}}, samples(tenants, "team-a"))
+		testutil.Equals(t, []prompb.Sample{{Value: 2, Timestamp: 1}}, samples(tenants, "team-b"))
+		testutil.Equals(t, []prompb.Sample{{Value: 3, Timestamp: 1}}, samples(tenants, DefaultTenant))
+		// The label is removed once it determined the tenant.
+		testutil.Equals(t, 0, len(tenants["team-a"].appender.(*fakeAppender).Get(labels.FromStrings("__name__", "up", "__tenant__", "team-a"))))
+	})
+	t.Run("header takes precedence over label", func(t *testing.T) {
+		tenants := perTenantAppendable{}
+		h.writer = NewWriter(log.NewNopLogger(), tenants)
+
+		rec, err := makeRequest(h, "team-c", wreq())
+		testutil.Ok(t, err)
+		testutil.Equals(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		testutil.Equals(t, 1, len(tenants))
+		// The label is kept, so that series of different label values are not merged.
+		testutil.Equals(t, 1, len(samples(tenants, "team-c")))
+		testutil.Equals(t, 1, len(tenants["team-c"].appender.(*fakeAppender).Get(labels.FromStrings("__name__", "up", "__tenant__", "team-a"))))
+		testutil.Equals(t, 1, len(tenants["team-c"].appender.(*fakeAppender).Get(labels.FromStrings("__name__", "up", "__tenant__", "team-b"))))
+	})
+}
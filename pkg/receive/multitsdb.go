@@ -6,18 +6,22 @@ package receive
 import (
 	"context"
 	"io/ioutil"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/fileutil"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/component"
 	"github.com/thanos-io/thanos/pkg/errutil"
@@ -181,6 +185,85 @@ func (t *MultiTSDB) Flush() error {
 	return merr.Err()
 }
 
+// FlushClosed is like Flush, but only compacts the part of each head that no longer accepts appends, i.e. samples
+// older than half of the minimum block duration before the head's newest sample. Unlike Flush, it is safe to call
+// while samples are being appended: appends are only accepted for the remaining range, so none of them is lost
+// or newly rejected as out of bounds.
+func (t *MultiTSDB) FlushClosed() error {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	errmtx := &sync.Mutex{}
+	merr := errutil.MultiError{}
+	wg := &sync.WaitGroup{}
+	for id, tenant := range t.tenants {
+		db := tenant.readyStorage().Get()
+		if db == nil {
+			level.Error(t.logger).Log("msg", "flushing TSDB failed; not ready", "tenant", id)
+			continue
+		}
+		head := db.Head()
+		maxt := head.MaxTime() - t.tsdbOpts.MinBlockDuration/2
+		if head.MinTime() >= maxt {
+			continue
+		}
+		level.Info(t.logger).Log("msg", "flushing closed range of TSDB head", "tenant", id, "maxt", maxt)
+		wg.Add(1)
+		go func() {
+			if err := db.CompactHead(tsdb.NewRangeHead(head, head.MinTime(), maxt-1)); err != nil {
+				errmtx.Lock()
+				merr.Add(err)
+				errmtx.Unlock()
+			}
+			wg.Done()
+		}()
+	}
+
+	wg.Wait()
+	return merr.Err()
+}
+
+// WALStats summarizes the write-ahead logs of all ready tenants.
+type WALStats struct {
+	// SizeBytes is the total size of the WAL directories.
+	SizeBytes int64
+	// OldestSampleTime is the minimum timestamp of samples held in the heads in milliseconds,
+	// math.MaxInt64 if all heads are empty.
+	OldestSampleTime int64
+}
+
+// Exceeds returns true if the WAL is bigger than maxSizeBytes or holds samples older than maxAge.
+// Zero thresholds are disabled.
+func (s WALStats) Exceeds(maxSizeBytes int64, maxAge time.Duration, now time.Time) bool {
+	if maxSizeBytes > 0 && s.SizeBytes > maxSizeBytes {
+		return true
+	}
+	return maxAge > 0 && s.OldestSampleTime != math.MaxInt64 && now.Sub(timestamp.Time(s.OldestSampleTime)) > maxAge
+}
+
+// WALStats returns statistics of the write-ahead logs of all ready tenants.
+func (t *MultiTSDB) WALStats() (WALStats, error) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	stats := WALStats{OldestSampleTime: math.MaxInt64}
+	for id, tenant := range t.tenants {
+		db := tenant.readyStorage().Get()
+		if db == nil {
+			continue
+		}
+		size, err := fileutil.DirSize(filepath.Join(db.Dir(), "wal"))
+		if err != nil && !os.IsNotExist(err) {
+			return WALStats{}, errors.Wrapf(err, "get WAL size of tenant %s", id)
+		}
+		stats.SizeBytes += size
+		if mint := db.Head().MinTime(); mint < stats.OldestSampleTime {
+			stats.OldestSampleTime = mint
+		}
+	}
+	return stats, nil
+}
+
 func (t *MultiTSDB) Close() error {
 	t.mtx.Lock()
 	defer t.mtx.Unlock()
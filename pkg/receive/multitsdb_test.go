@@ -6,6 +6,7 @@ package receive
 import (
 	"context"
 	"io/ioutil"
+	"math"
 	"os"
 	"testing"
 	"time"
@@ -21,6 +22,7 @@ import (
 
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/exemplars/exemplarspb"
+	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/runutil"
 	"github.com/thanos-io/thanos/pkg/store/labelpb"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
@@ -451,3 +453,165 @@ func BenchmarkMultiTSDB(b *testing.B) {
 		_, _ = a.Append(0, l, int64(i), float64(i))
 	}
 }
+
+func TestMultiTSDBWALStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multitsdb-wal-stats")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt := objstore.NewInMemBucket()
+	m := NewMultiTSDB(dir, log.NewNopLogger(), prometheus.NewRegistry(), &tsdb.Options{
+		MinBlockDuration:  (2 * time.Hour).Milliseconds(),
+		MaxBlockDuration:  (2 * time.Hour).Milliseconds(),
+		RetentionDuration: (6 * time.Hour).Milliseconds(),
+		NoLockfile:        true,
+	}, labels.FromStrings("replica", "test"),
+		"tenant_id",
+		bkt,
+		false,
+		metadata.NoneFunc,
+	)
+	defer func() { testutil.Ok(t, m.Close()) }()
+
+	testutil.Ok(t, m.Flush())
+	testutil.Ok(t, m.Open())
+
+	stats, err := m.WALStats()
+	testutil.Ok(t, err)
+	testutil.Equals(t, WALStats{OldestSampleTime: math.MaxInt64}, stats)
+	testutil.Assert(t, !stats.Exceeds(1, time.Second, time.Now()), "no tenant, no WAL")
+
+	app, err := m.TenantAppendable("foo")
+	testutil.Ok(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var a storage.Appender
+	testutil.Ok(t, runutil.Retry(1*time.Second, ctx.Done(), func() error {
+		a, err = app.Appender(context.Background())
+		return err
+	}))
+
+	now := time.Now()
+	lset := labels.FromStrings("a", "1")
+	for i := 3; i > 0; i-- {
+		_, err = a.Append(0, lset, now.Add(-time.Duration(i)*time.Hour).UnixNano()/int64(time.Millisecond), float64(i))
+		testutil.Ok(t, err)
+	}
+	testutil.Ok(t, a.Commit())
+
+	stats, err = m.WALStats()
+	testutil.Ok(t, err)
+	testutil.Assert(t, stats.SizeBytes > 0, "expected non-empty WAL")
+	testutil.Equals(t, now.Add(-3*time.Hour).UnixNano()/int64(time.Millisecond), stats.OldestSampleTime)
+
+	testutil.Assert(t, !stats.Exceeds(0, 0, now), "disabled thresholds should never be exceeded")
+	testutil.Assert(t, !stats.Exceeds(stats.SizeBytes, 4*time.Hour, now), "thresholds should not be exceeded")
+	testutil.Assert(t, stats.Exceeds(stats.SizeBytes-1, 0, now), "size threshold should be exceeded")
+	testutil.Assert(t, stats.Exceeds(0, 2*time.Hour, now), "age threshold should be exceeded")
+
+	// Exceeded thresholds trigger flush and upload of the closed part of the head, i.e. samples older than an hour
+	// before the newest one.
+	testutil.Ok(t, m.FlushClosed())
+	uploaded, err := m.Sync(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, uploaded)
+
+	stats, err = m.WALStats()
+	testutil.Ok(t, err)
+	testutil.Assert(t, !stats.Exceeds(0, 150*time.Minute, now), "age threshold should not be exceeded after flush")
+}
+
+func TestMultiTSDBFlushClosed_ConcurrentAppends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multitsdb-flush-closed")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	m := NewMultiTSDB(dir, log.NewNopLogger(), prometheus.NewRegistry(), &tsdb.Options{
+		MinBlockDuration:  (2 * time.Hour).Milliseconds(),
+		MaxBlockDuration:  (2 * time.Hour).Milliseconds(),
+		RetentionDuration: (24 * time.Hour).Milliseconds(),
+		NoLockfile:        true,
+	}, labels.FromStrings("replica", "test"),
+		"tenant_id",
+		objstore.NewInMemBucket(),
+		false,
+		metadata.NoneFunc,
+	)
+	defer func() { testutil.Ok(t, m.Close()) }()
+
+	app, err := m.TenantAppendable("foo")
+	testutil.Ok(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	lset := labels.FromStrings("a", "1")
+	appendSample := func(i int) error {
+		a, err := app.Appender(ctx)
+		if err != nil {
+			return err
+		}
+		if _, err := a.Append(0, lset, int64(i)*time.Minute.Milliseconds(), float64(i)); err != nil {
+			return err
+		}
+		return a.Commit()
+	}
+	testutil.Ok(t, runutil.Retry(100*time.Millisecond, ctx.Done(), func() error { return appendSample(0) }))
+
+	// Three hours of samples in the head before flushing starts, three more appended while flushing.
+	const numSamples = 6 * 60
+	for i := 1; i < numSamples/2; i++ {
+		testutil.Ok(t, appendSample(i))
+	}
+
+	var g errgroup.Group
+	done := make(chan struct{})
+	g.Go(func() error {
+		defer close(done)
+		for i := numSamples / 2; i < numSamples; i++ {
+			if err := appendSample(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	g.Go(func() error {
+		for {
+			if err := m.FlushClosed(); err != nil {
+				return err
+			}
+			select {
+			case <-done:
+				return nil
+			default:
+			}
+		}
+	})
+	testutil.Ok(t, g.Wait())
+
+	db := m.tenants["foo"].readyStorage().Get()
+	testutil.Assert(t, len(db.Blocks()) > 0, "expected flushed blocks")
+
+	q, err := db.Querier(ctx, math.MinInt64, math.MaxInt64)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, q.Close()) }()
+
+	ss := q.Select(false, nil, labels.MustNewMatcher(labels.MatchEqual, "a", "1"))
+	var ts []int64
+	for ss.Next() {
+		it := ss.At().Iterator()
+		for it.Next() {
+			st, _ := it.At()
+			ts = append(ts, st)
+		}
+		testutil.Ok(t, it.Err())
+	}
+	testutil.Ok(t, ss.Err())
+
+	testutil.Equals(t, numSamples, len(ts))
+	for i, tm := range ts {
+		testutil.Equals(t, int64(i)*time.Minute.Milliseconds(), tm)
+	}
+}
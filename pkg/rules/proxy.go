@@ -5,7 +5,9 @@ package rules
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"sync"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -50,12 +52,14 @@ func (s *Proxy) Rules(req *rulespb.RulesRequest, srv rulespb.Rules_RulesServer)
 		err      error
 	)
 
+	// Warnings are forwarded from multiple goroutines, while gRPC streams do not allow concurrent Send calls.
+	syncSrv := &syncRulesServer{Rules_RulesServer: srv}
 	for _, rulesClient := range s.rules() {
 		rs := &rulesStream{
 			client:  rulesClient,
 			request: req,
 			channel: respChan,
-			server:  srv,
+			server:  syncSrv,
 		}
 		g.Go(func() error { return rs.receive(gctx) })
 	}
@@ -86,6 +90,23 @@ func (s *Proxy) Rules(req *rulespb.RulesRequest, srv rulespb.Rules_RulesServer)
 	return nil
 }
 
+// syncRulesServer is a rulespb.Rules_RulesServer safe for concurrent Send calls.
+type syncRulesServer struct {
+	rulespb.Rules_RulesServer
+
+	mtx sync.Mutex
+}
+
+func (s *syncRulesServer) Send(resp *rulespb.RulesResponse) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.Rules_RulesServer.Send(resp)
+}
+
+func (s *syncRulesServer) String() string {
+	return fmt.Sprintf("%v", s.Rules_RulesServer)
+}
+
 type rulesStream struct {
 	client  rulespb.RulesClient
 	request *rulespb.RulesRequest
@@ -8,12 +8,14 @@ import (
 	"io"
 	"os"
 	"reflect"
+	"sync"
 	"testing"
 
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
 	"github.com/thanos-io/thanos/pkg/rules/rulespb"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"github.com/thanos-io/thanos/pkg/testutil"
 	"google.golang.org/grpc"
 )
 
@@ -251,3 +253,82 @@ func TestProxy(t *testing.T) {
 		})
 	}
 }
+
+type addrRulesClient struct {
+	*testRulesClient
+	addr string
+}
+
+func (c *addrRulesClient) String() string {
+	return c.addr
+}
+
+type recordingRulesServer struct {
+	grpc.ServerStream
+
+	mtx       sync.Mutex
+	responses []*rulespb.RulesResponse
+}
+
+func (t *recordingRulesServer) Send(response *rulespb.RulesResponse) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.responses = append(t.responses, response)
+	return nil
+}
+
+func (t *recordingRulesServer) Context() context.Context {
+	return context.Background()
+}
+
+func TestProxy_PartialResponseAcrossRulers(t *testing.T) {
+	logger := log.NewLogfmtLogger(os.Stderr)
+
+	clients := []rulespb.RulesClient{
+		&addrRulesClient{
+			testRulesClient: &testRulesClient{
+				response: rulespb.NewRuleGroupRulesResponse(&rulespb.RuleGroup{Name: "foo"}),
+			},
+			addr: "ruler-1:10901",
+		},
+		&addrRulesClient{
+			testRulesClient: &testRulesClient{rulesErr: errors.New("connection refused")},
+			addr:            "ruler-2:10901",
+		},
+	}
+	p := NewProxy(logger, func() []rulespb.RulesClient { return clients })
+
+	t.Run("warn", func(t *testing.T) {
+		clients[0].(*addrRulesClient).sentResponse = false
+		srv := &recordingRulesServer{}
+		testutil.Ok(t, p.Rules(&rulespb.RulesRequest{
+			Type:                    rulespb.RulesRequest_ALL,
+			PartialResponseStrategy: storepb.PartialResponseStrategy_WARN,
+		}, srv))
+
+		var (
+			groups   []string
+			warnings []string
+		)
+		for _, r := range srv.responses {
+			if w := r.GetWarning(); w != "" {
+				warnings = append(warnings, w)
+				continue
+			}
+			groups = append(groups, r.GetGroup().Name)
+		}
+		testutil.Equals(t, []string{"foo"}, groups)
+		testutil.Equals(t, []string{"fetching rules from rules client ruler-2:10901: connection refused"}, warnings)
+	})
+	t.Run("abort", func(t *testing.T) {
+		clients[0].(*addrRulesClient).sentResponse = false
+		srv := &recordingRulesServer{}
+		err := p.Rules(&rulespb.RulesRequest{
+			Type:                    rulespb.RulesRequest_ALL,
+			PartialResponseStrategy: storepb.PartialResponseStrategy_ABORT,
+		}, srv)
+		testutil.NotOk(t, err)
+		testutil.Equals(t, "fetching rules from rules client ruler-2:10901: connection refused", err.Error())
+		testutil.Equals(t, 0, len(srv.responses))
+	})
+}
@@ -60,6 +60,7 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/jpillora/backoff"
 	"github.com/pkg/errors"
 
 	"github.com/thanos-io/thanos/pkg/errutil"
@@ -83,6 +84,35 @@ func Repeat(interval time.Duration, stopc <-chan struct{}, f func() error) error
 	}
 }
 
+// RepeatWithBackoff executes f every interval until stopc is closed. Once f fails, it's executed again after
+// the backoff instead, which grows with consecutive failures up to its max, but never beyond interval.
+// The backoff is reset once f succeeds. A nil backoff makes failed executions wait the full interval, like Repeat.
+// It executes f once right after being called.
+func RepeatWithBackoff(interval time.Duration, b *backoff.Backoff, stopc <-chan struct{}, f func() error) {
+	repeatWithBackoff(interval, b, stopc, f, time.After)
+}
+
+func repeatWithBackoff(interval time.Duration, b *backoff.Backoff, stopc <-chan struct{}, f func() error, after func(time.Duration) <-chan time.Time) {
+	for {
+		err := f()
+
+		d := interval
+		if b != nil {
+			if err == nil {
+				b.Reset()
+			} else if bd := b.Duration(); bd < d {
+				d = bd
+			}
+		}
+
+		select {
+		case <-stopc:
+			return
+		case <-after(d):
+		}
+	}
+}
+
 // Retry executes f every interval seconds until timeout or no error is returned from f.
 func Retry(interval time.Duration, stopc <-chan struct{}, f func() error) error {
 	return RetryWithLog(log.NewNopLogger(), interval, stopc, f)
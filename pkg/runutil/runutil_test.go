@@ -10,7 +10,9 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/jpillora/backoff"
 	"github.com/pkg/errors"
 	"github.com/thanos-io/thanos/pkg/testutil"
 )
@@ -174,3 +176,65 @@ func TestDeleteAll_ShouldReturnNoErrorIfDirectoryDoesNotExists(t *testing.T) {
 	// Calling DeleteAll() on a non-existent directory should return no error.
 	testutil.Ok(t, DeleteAll(dir))
 }
+
+func TestRepeatWithBackoff(t *testing.T) {
+	const interval = time.Minute
+
+	for _, tcase := range []struct {
+		name    string
+		backoff *backoff.Backoff
+		results []error
+
+		expectedDelays []time.Duration
+	}{
+		{
+			name:    "consecutive failures back off up to the cap, success resets the backoff",
+			backoff: &backoff.Backoff{Min: time.Second, Max: 4 * time.Second, Factor: 2},
+			results: []error{errors.New("1"), errors.New("2"), errors.New("3"), errors.New("4"), nil, errors.New("5")},
+			expectedDelays: []time.Duration{
+				time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second, interval, time.Second,
+			},
+		},
+		{
+			name:           "backoff never exceeds the interval",
+			backoff:        &backoff.Backoff{Min: 30 * time.Second, Max: time.Hour, Factor: 2},
+			results:        []error{errors.New("1"), errors.New("2"), errors.New("3")},
+			expectedDelays: []time.Duration{30 * time.Second, interval, interval},
+		},
+		{
+			name:           "no backoff",
+			results:        []error{errors.New("1"), nil},
+			expectedDelays: []time.Duration{interval, interval},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			var (
+				stopc  = make(chan struct{})
+				calls  int
+				delays []time.Duration
+			)
+			f := func() error {
+				err := tcase.results[calls]
+				calls++
+				if calls == len(tcase.results) {
+					close(stopc)
+				}
+				return err
+			}
+			after := func(d time.Duration) <-chan time.Time {
+				delays = append(delays, d)
+				if calls == len(tcase.results) {
+					// Never fires, so that the loop stops after the last call.
+					return nil
+				}
+				c := make(chan time.Time, 1)
+				c <- time.Time{}
+				return c
+			}
+
+			repeatWithBackoff(interval, tcase.backoff, stopc, f, after)
+			testutil.Equals(t, len(tcase.results), calls)
+			testutil.Equals(t, tcase.expectedDelays, delays)
+		})
+	}
+}
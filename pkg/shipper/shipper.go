@@ -14,6 +14,7 @@ import (
 	"path"
 	"path/filepath"
 	"sort"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -36,6 +37,7 @@ type metrics struct {
 	uploads           prometheus.Counter
 	uploadFailures    prometheus.Counter
 	uploadedCompacted prometheus.Gauge
+	oldestPendingAge  prometheus.Gauge
 }
 
 func newMetrics(reg prometheus.Registerer, uploadCompacted bool) *metrics {
@@ -57,6 +59,10 @@ func newMetrics(reg prometheus.Registerer, uploadCompacted bool) *metrics {
 		Name: "thanos_shipper_upload_failures_total",
 		Help: "Total number of block upload failures",
 	})
+	m.oldestPendingAge = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_shipper_oldest_pending_block_age_seconds",
+		Help: "Age of the oldest local block that should be, but is not yet uploaded, as of the last sync. 0 if all blocks are uploaded.",
+	})
 	uploadCompactedGaugeOpts := prometheus.GaugeOpts{
 		Name: "thanos_shipper_upload_compacted_done",
 		Help: "If 1 it means shipper uploaded all compacted blocks from the filesystem.",
@@ -258,6 +264,10 @@ func (s *Shipper) Sync(ctx context.Context) (uploaded int, err error) {
 	if err != nil {
 		return 0, err
 	}
+	// Blocks uploaded before or during this run are not pending, even if this run stops early because of an error.
+	defer func() {
+		s.metrics.oldestPendingAge.Set(s.oldestPendingAge(metas, hasUploaded, time.Now()).Seconds())
+	}()
 	for _, m := range metas {
 		// Do not sync a block if we already uploaded or ignored it. If it's no longer found in the bucket,
 		// it was generally removed by the compaction process.
@@ -286,6 +296,7 @@ func (s *Shipper) Sync(ctx context.Context) (uploaded int, err error) {
 		}
 		if ok {
 			meta.Uploaded = append(meta.Uploaded, m.ULID)
+			hasUploaded[m.ULID] = struct{}{}
 			continue
 		}
 
@@ -312,6 +323,7 @@ func (s *Shipper) Sync(ctx context.Context) (uploaded int, err error) {
 			continue
 		}
 		meta.Uploaded = append(meta.Uploaded, m.ULID)
+		hasUploaded[m.ULID] = struct{}{}
 		uploaded++
 		s.metrics.uploads.Inc()
 	}
@@ -331,6 +343,25 @@ func (s *Shipper) Sync(ctx context.Context) (uploaded int, err error) {
 	return uploaded, nil
 }
 
+// oldestPendingAge returns the age at now of the oldest block in metas which should be uploaded but is not in
+// hasUploaded, or 0 if there is no such block. The age of a block is based on the creation time encoded in its ULID.
+func (s *Shipper) oldestPendingAge(metas []*metadata.Meta, hasUploaded map[ulid.ULID]struct{}, now time.Time) time.Duration {
+	var oldest time.Duration
+	for _, m := range metas {
+		// Empty blocks and, unless enabled, compacted blocks are never uploaded.
+		if m.Stats.NumSamples == 0 || (m.Compaction.Level > 1 && !s.uploadCompacted) {
+			continue
+		}
+		if _, ok := hasUploaded[m.ULID]; ok {
+			continue
+		}
+		if age := now.Sub(ulid.Time(m.ULID.Time())); age > oldest {
+			oldest = age
+		}
+	}
+	return oldest
+}
+
 // sync uploads the block if not exists in remote storage.
 // TODO(khyatisoneji): Double check if block does not have deletion-mark.json for some reason, otherwise log it or return error.
 func (s *Shipper) upload(ctx context.Context, meta *metadata.Meta) error {
@@ -5,6 +5,7 @@ package shipper
 
 import (
 	"context"
+	"io"
 	"io/ioutil"
 	"math"
 	"math/rand"
@@ -13,9 +14,13 @@ import (
 	"path/filepath"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/tsdb"
 
@@ -212,3 +217,72 @@ func TestShipperAddsSegmentFiles(t *testing.T) {
 
 	testutil.Equals(t, []string{segmentFile}, meta.Thanos.SegmentFiles)
 }
+
+// uploadFailingBucket fails all uploads while fail is set.
+type uploadFailingBucket struct {
+	objstore.Bucket
+	fail bool
+}
+
+func (b *uploadFailingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if b.fail {
+		return errors.Errorf("upload of %s failed", name)
+	}
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func TestShipperOldestPendingBlockAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shipper-test")
+	testutil.Ok(t, err)
+	defer func() {
+		testutil.Ok(t, os.RemoveAll(dir))
+	}()
+
+	bkt := &uploadFailingBucket{Bucket: objstore.NewInMemBucket(), fail: true}
+	reg := prometheus.NewRegistry()
+	s := New(nil, reg, dir, bkt, func() labels.Labels { return labels.FromStrings("test", "test") }, metadata.TestSource, false, true, metadata.NoneFunc)
+
+	createBlock := func(created time.Time, minTime int64) ulid.ULID {
+		id := ulid.MustNew(ulid.Timestamp(created), nil)
+		blockDir := filepath.Join(dir, id.String())
+		testutil.Ok(t, os.MkdirAll(filepath.Join(blockDir, block.ChunksDirname), os.ModePerm))
+		testutil.Ok(t, metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{
+				ULID:    id,
+				MinTime: minTime,
+				MaxTime: minTime + 1000,
+				Version: 1,
+				Stats: tsdb.BlockStats{
+					NumSamples: 1000, // Not really, but shipper needs nonzero value.
+				},
+			},
+		}.WriteToDir(log.NewNopLogger(), blockDir))
+		testutil.Ok(t, ioutil.WriteFile(filepath.Join(blockDir, block.IndexFilename), []byte("index file"), 0666))
+		return id
+	}
+	createBlock(time.Now().Add(-2*time.Hour), 0)
+	createBlock(time.Now().Add(-time.Minute), 1000)
+
+	// Nothing can be uploaded, so the gauge reflects the age of the stale block.
+	_, err = s.Sync(context.Background())
+	testutil.NotOk(t, err)
+	age := promtest.ToFloat64(s.metrics.oldestPendingAge)
+	testutil.Assert(t, age >= (2*time.Hour).Seconds() && age < (2*time.Hour+time.Minute).Seconds(), "unexpected oldest pending block age %v", age)
+
+	// Once all blocks are uploaded, nothing is pending anymore.
+	bkt.fail = false
+	uploaded, err := s.Sync(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, uploaded)
+	testutil.Equals(t, 0.0, promtest.ToFloat64(s.metrics.oldestPendingAge))
+
+	// Blocks are synced by min time, so a failed upload stops the sync before blocks of later min time. Those that
+	// were uploaded already, even if they were created earlier, are not pending.
+	bkt.fail = true
+	s = New(nil, nil, dir, bkt, func() labels.Labels { return labels.FromStrings("test", "test") }, metadata.TestSource, false, false, metadata.NoneFunc)
+	createBlock(time.Now().Add(-10*time.Minute), -1000)
+	_, err = s.Sync(context.Background())
+	testutil.NotOk(t, err)
+	age = promtest.ToFloat64(s.metrics.oldestPendingAge)
+	testutil.Assert(t, age >= (10*time.Minute).Seconds() && age < (11*time.Minute).Seconds(), "unexpected oldest pending block age %v", age)
+}
@@ -32,6 +32,7 @@ import (
 	"github.com/prometheus/prometheus/tsdb/chunks"
 	"github.com/prometheus/prometheus/tsdb/encoding"
 	"github.com/prometheus/prometheus/tsdb/index"
+	"go.uber.org/atomic"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -98,8 +99,11 @@ type bucketStoreMetrics struct {
 	blocksLoaded          prometheus.Gauge
 	blockLoads            prometheus.Counter
 	blockLoadFailures     prometheus.Counter
+	indexCacheRebuilds    prometheus.Counter
 	blockDrops            prometheus.Counter
 	blockDropFailures     prometheus.Counter
+	blockSyncsSkipped     prometheus.Counter
+	blockSyncLag          prometheus.Gauge
 	seriesDataTouched     *prometheus.SummaryVec
 	seriesDataFetched     *prometheus.SummaryVec
 	seriesDataSizeTouched *prometheus.SummaryVec
@@ -110,6 +114,7 @@ type bucketStoreMetrics struct {
 	resultSeriesCount     prometheus.Summary
 	chunkSizeBytes        prometheus.Histogram
 	queriesDropped        *prometheus.CounterVec
+	queriesSampleLimitHit prometheus.Counter
 	seriesRefetches       prometheus.Counter
 
 	cachedPostingsCompressions           *prometheus.CounterVec
@@ -133,6 +138,10 @@ func newBucketStoreMetrics(reg prometheus.Registerer) *bucketStoreMetrics {
 		Name: "thanos_bucket_store_block_load_failures_total",
 		Help: "Total number of failed remote block loading attempts.",
 	})
+	m.indexCacheRebuilds = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_index_cache_rebuilds_total",
+		Help: "Total number of block index-headers that were rebuilt from the block index instead of being loaded from disk.",
+	})
 	m.blockDrops = promauto.With(reg).NewCounter(prometheus.CounterOpts{
 		Name: "thanos_bucket_store_block_drops_total",
 		Help: "Total number of local blocks that were dropped.",
@@ -141,6 +150,14 @@ func newBucketStoreMetrics(reg prometheus.Registerer) *bucketStoreMetrics {
 		Name: "thanos_bucket_store_block_drop_failures_total",
 		Help: "Total number of local blocks that failed to be dropped.",
 	})
+	m.blockSyncsSkipped = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_block_syncs_skipped_total",
+		Help: "Total number of block syncs skipped because the previous sync was still in progress.",
+	})
+	m.blockSyncLag = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_bucket_store_block_sync_lag_seconds",
+		Help: "Time between the last block sync and the creation of the newest block found in the bucket that the store failed to load, based on its ULID. Zero if all blocks are loaded.",
+	})
 	m.blocksLoaded = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
 		Name: "thanos_bucket_store_blocks_loaded",
 		Help: "Number of currently loaded blocks.",
@@ -195,6 +212,10 @@ func newBucketStoreMetrics(reg prometheus.Registerer) *bucketStoreMetrics {
 		Name: "thanos_bucket_store_queries_dropped_total",
 		Help: "Number of queries that were dropped due to the limit.",
 	}, []string{"reason"})
+	m.queriesSampleLimitHit = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_queries_sample_limit_hit_total",
+		Help: "Number of Series calls aborted because they exceeded the sample limit, enforced as a limit on fetched chunks.",
+	})
 	m.seriesRefetches = promauto.With(reg).NewCounter(prometheus.CounterOpts{
 		Name: "thanos_bucket_store_series_refetches_total",
 		Help: fmt.Sprintf("Total number of cases where %v bytes was not enough was to fetch series from index, resulting in refetch.", maxSeriesSize),
@@ -276,6 +297,8 @@ type BucketStore struct {
 	debugLogging bool
 	// Number of goroutines to use when syncing blocks from object storage.
 	blockSyncConcurrency int
+	// Set while SyncBlocks is running, so overlapping syncs are skipped instead of piling up.
+	syncing atomic.Bool
 
 	// Query gate which limits the maximum amount of concurrent queries.
 	queryGate gate.Gate
@@ -285,7 +308,9 @@ type BucketStore struct {
 	// seriesLimiterFactory creates a new limiter used to limit the number of touched series by each Series() call,
 	// or LabelName and LabelValues calls when used with matchers.
 	seriesLimiterFactory SeriesLimiterFactory
-	partitioner          Partitioner
+	// seriesChunksLimit is the maximum number of chunks of any single series fetched by each Series() call. 0 means no limit.
+	seriesChunksLimit uint64
+	partitioner       Partitioner
 
 	filterConfig             *FilterConfig
 	advLabelSets             []labelpb.ZLabelSet
@@ -355,6 +380,14 @@ func WithFilterConfig(filter *FilterConfig) BucketStoreOption {
 	}
 }
 
+// WithSeriesChunksLimit sets the maximum number of chunks of any single series fetched by a Series() call.
+// Series() calls exceeding it for any series in a block fail. 0 means no limit.
+func WithSeriesChunksLimit(limit uint64) BucketStoreOption {
+	return func(s *BucketStore) {
+		s.seriesChunksLimit = limit
+	}
+}
+
 // WithDebugLogging enables debug logging.
 func WithDebugLogging() BucketStoreOption {
 	return func(s *BucketStore) {
@@ -428,7 +461,15 @@ func (s *BucketStore) Close() (err error) {
 
 // SyncBlocks synchronizes the stores state with the Bucket bucket.
 // It will reuse disk space as persistent cache based on s.dir param.
+// If a previous sync is still in progress, the call is skipped and returns nil.
 func (s *BucketStore) SyncBlocks(ctx context.Context) error {
+	if !s.syncing.CAS(false, true) {
+		level.Warn(s.logger).Log("msg", "skipping block sync, previous sync still in progress")
+		s.metrics.blockSyncsSkipped.Inc()
+		return nil
+	}
+	defer s.syncing.Store(false)
+
 	metas, _, metaFetchErr := s.fetcher.Fetch(ctx)
 	// For partial view allow adding new blocks at least.
 	if metaFetchErr != nil && metas == nil {
@@ -483,6 +524,7 @@ func (s *BucketStore) SyncBlocks(ctx context.Context) error {
 	// Sync advertise labels.
 	var storeLabels labels.Labels
 	s.mtx.Lock()
+	s.metrics.blockSyncLag.Set(s.syncLag(metas, time.Now()).Seconds())
 	s.advLabelSets = make([]labelpb.ZLabelSet, 0, len(s.advLabelSets))
 	for _, bs := range s.blockSets {
 		storeLabels = storeLabels[:0]
@@ -495,6 +537,24 @@ func (s *BucketStore) SyncBlocks(ctx context.Context) error {
 	return nil
 }
 
+// syncLag returns the time between now and the creation of the newest of the given blocks that is not loaded,
+// based on its ULID. It returns zero if all of them are loaded. It expects the mutex to be held.
+func (s *BucketStore) syncLag(metas map[ulid.ULID]*metadata.Meta, now time.Time) time.Duration {
+	var newest ulid.ULID
+	for id := range metas {
+		if _, ok := s.blocks[id]; ok {
+			continue
+		}
+		if id.Time() > newest.Time() {
+			newest = id
+		}
+	}
+	if newest.Time() == 0 {
+		return 0
+	}
+	return now.Sub(ulid.Time(newest.Time()))
+}
+
 // InitialSync perform blocking sync with extra step at the end to delete locally saved blocks that are no longer
 // present in the bucket. The mismatch of these can only happen between restarts, so we can do that only once per startup.
 func (s *BucketStore) InitialSync(ctx context.Context) error {
@@ -555,6 +615,10 @@ func (s *BucketStore) addBlock(ctx context.Context, meta *metadata.Meta) (err er
 	lset := labels.FromMap(meta.Thanos.Labels)
 	h := lset.Hash()
 
+	// The index-header is rebuilt from the block index if it's not available on disk yet.
+	_, statErr := os.Stat(filepath.Join(dir, block.IndexHeaderFilename))
+	indexHeaderMissing := os.IsNotExist(statErr)
+
 	indexHeaderReader, err := s.indexReaderPool.NewBinaryReader(
 		ctx,
 		s.logger,
@@ -566,6 +630,9 @@ func (s *BucketStore) addBlock(ctx context.Context, meta *metadata.Meta) (err er
 	if err != nil {
 		return errors.Wrap(err, "create index header reader")
 	}
+	if indexHeaderMissing {
+		s.metrics.indexCacheRebuilds.Inc()
+	}
 	defer func() {
 		if err != nil {
 			runutil.CloseWithErrCapture(&err, indexHeaderReader, "index-header")
@@ -658,6 +725,39 @@ func (s *BucketStore) TimeRange() (mint, maxt int64) {
 	return mint, maxt
 }
 
+// LoadedBlock describes a block currently loaded by the bucket store.
+type LoadedBlock struct {
+	ULID       ulid.ULID         `json:"ulid"`
+	MinTime    int64             `json:"minTime"`
+	MaxTime    int64             `json:"maxTime"`
+	Resolution int64             `json:"resolution"`
+	Labels     map[string]string `json:"labels"`
+}
+
+// LoadedBlocks returns the blocks currently loaded by the store, sorted by min time and ULID.
+func (s *BucketStore) LoadedBlocks() []LoadedBlock {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	res := make([]LoadedBlock, 0, len(s.blocks))
+	for id, b := range s.blocks {
+		res = append(res, LoadedBlock{
+			ULID:       id,
+			MinTime:    b.meta.MinTime,
+			MaxTime:    b.meta.MaxTime,
+			Resolution: b.meta.Thanos.Downsample.Resolution,
+			Labels:     b.extLset.Map(),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].MinTime != res[j].MinTime {
+			return res[i].MinTime < res[j].MinTime
+		}
+		return res[i].ULID.Compare(res[j].ULID) < 0
+	})
+	return res
+}
+
 // Info implements the storepb.StoreServer interface.
 func (s *BucketStore) Info(context.Context, *storepb.InfoRequest) (*storepb.InfoResponse, error) {
 	mint, maxt := s.TimeRange()
@@ -750,6 +850,7 @@ func blockSeries(
 	matchers []*labels.Matcher, // Series matchers.
 	chunksLimiter ChunksLimiter, // Rate limiter for loading chunks.
 	seriesLimiter SeriesLimiter, // Rate limiter for loading series.
+	seriesChunksLimiter *seriesChunksLimiter, // Limiter of chunks of a single series.
 	skipChunks bool, // If true, chunks are not loaded.
 	minTime, maxTime int64, // Series must have data in this time range to be returned.
 	loadAggregates []storepb.Aggr, // List of aggregates to load when loading chunks.
@@ -795,6 +896,13 @@ func blockSeries(
 
 		s := seriesEntry{}
 		if !skipChunks {
+			if err := seriesChunksLimiter.Check(uint64(len(chks))); err != nil {
+				if lerr := indexr.LookupLabelsSymbols(symbolizedLset, &lset); lerr != nil {
+					return nil, nil, errors.Wrap(lerr, "Lookup labels symbols")
+				}
+				return nil, nil, errors.Wrapf(err, "exceeded chunks per series limit for series %s", lset)
+			}
+
 			// Schedule loading chunks.
 			s.refs = make([]uint64, 0, len(chks))
 			s.chks = make([]storepb.AggrChunk, 0, len(chks))
@@ -963,15 +1071,16 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 	req.MaxTime = s.limitMaxTime(req.MaxTime)
 
 	var (
-		ctx              = srv.Context()
-		stats            = &queryStats{}
-		res              []storepb.SeriesSet
-		mtx              sync.Mutex
-		g, gctx          = errgroup.WithContext(ctx)
-		resHints         = &hintspb.SeriesResponseHints{}
-		reqBlockMatchers []*labels.Matcher
-		chunksLimiter    = s.chunksLimiterFactory(s.metrics.queriesDropped.WithLabelValues("chunks"))
-		seriesLimiter    = s.seriesLimiterFactory(s.metrics.queriesDropped.WithLabelValues("series"))
+		ctx                 = srv.Context()
+		stats               = &queryStats{}
+		res                 []storepb.SeriesSet
+		mtx                 sync.Mutex
+		g, gctx             = errgroup.WithContext(ctx)
+		resHints            = &hintspb.SeriesResponseHints{}
+		reqBlockMatchers    []*labels.Matcher
+		chunksLimiter       = &exceededTrackingChunksLimiter{ChunksLimiter: s.chunksLimiterFactory(s.metrics.queriesDropped.WithLabelValues("chunks"))}
+		seriesLimiter       = s.seriesLimiterFactory(s.metrics.queriesDropped.WithLabelValues("series"))
+		seriesChunksLimiter = newSeriesChunksLimiter(s.seriesChunksLimit, s.metrics.queriesDropped.WithLabelValues("series_chunks"))
 	)
 
 	if req.Hints != nil {
@@ -1027,6 +1136,7 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 					blockMatchers,
 					chunksLimiter,
 					seriesLimiter,
+					seriesChunksLimiter,
 					req.SkipChunks,
 					req.MinTime, req.MaxTime,
 					req.Aggregates,
@@ -1081,6 +1191,9 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 			err = g.Wait()
 		})
 		if err != nil {
+			if chunksLimiter.exceeded.Load() {
+				s.metrics.queriesSampleLimitHit.Inc()
+			}
 			code := codes.Aborted
 			if s, ok := status.FromError(errors.Cause(err)); ok {
 				code = s.Code()
@@ -1146,6 +1259,20 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 	return err
 }
 
+// exceededTrackingChunksLimiter records whether the wrapped limiter rejected a reservation.
+type exceededTrackingChunksLimiter struct {
+	ChunksLimiter
+	exceeded atomic.Bool
+}
+
+func (l *exceededTrackingChunksLimiter) Reserve(num uint64) error {
+	err := l.ChunksLimiter.Reserve(num)
+	if err != nil {
+		l.exceeded.Store(true)
+	}
+	return err
+}
+
 func chunksSize(chks []storepb.AggrChunk) (size int) {
 	for _, chk := range chks {
 		size += chk.Size() // This gets the encoded proto size.
@@ -1219,7 +1346,7 @@ func (s *BucketStore) LabelNames(ctx context.Context, req *storepb.LabelNamesReq
 
 				result = strutil.MergeSlices(res, extRes)
 			} else {
-				seriesSet, _, err := blockSeries(b.extLset, indexr, nil, reqSeriesMatchers, nil, seriesLimiter, true, req.Start, req.End, nil)
+				seriesSet, _, err := blockSeries(b.extLset, indexr, nil, reqSeriesMatchers, nil, seriesLimiter, nil, true, req.Start, req.End, nil)
 				if err != nil {
 					return errors.Wrapf(err, "fetch series for block %s", b.meta.ULID)
 				}
@@ -1344,7 +1471,7 @@ func (s *BucketStore) LabelValues(ctx context.Context, req *storepb.LabelValuesR
 				}
 				result = res
 			} else {
-				seriesSet, _, err := blockSeries(b.extLset, indexr, nil, reqSeriesMatchers, nil, seriesLimiter, true, req.Start, req.End, nil)
+				seriesSet, _, err := blockSeries(b.extLset, indexr, nil, reqSeriesMatchers, nil, seriesLimiter, nil, true, req.Start, req.End, nil)
 				if err != nil {
 					return errors.Wrapf(err, "fetch series for block %s", b.meta.ULID)
 				}
@@ -17,6 +17,7 @@ import (
 	"github.com/gogo/status"
 	"github.com/oklog/ulid"
 	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/pkg/relabel"
 	"github.com/prometheus/prometheus/pkg/timestamp"
@@ -585,23 +586,26 @@ func TestBucketStore_Series_ChunksLimiter_e2e(t *testing.T) {
 	expectedChunks := uint64(2 * 6)
 
 	cases := map[string]struct {
-		maxChunksLimit uint64
-		maxSeriesLimit uint64
-		expectedErr    string
-		code           codes.Code
+		maxChunksLimit         uint64
+		maxSeriesLimit         uint64
+		expectedErr            string
+		code                   codes.Code
+		expectedSampleLimitHit float64
 	}{
 		"should succeed if the max chunks limit is not exceeded": {
 			maxChunksLimit: expectedChunks,
 		},
 		"should fail if the max chunks limit is exceeded - ResourceExhausted": {
-			maxChunksLimit: expectedChunks - 1,
-			expectedErr:    "exceeded chunks limit",
-			code:           codes.ResourceExhausted,
+			maxChunksLimit:         expectedChunks - 1,
+			expectedErr:            "exceeded chunks limit",
+			code:                   codes.ResourceExhausted,
+			expectedSampleLimitHit: 1,
 		},
 		"should fail if the max chunks limit is exceeded - 422": {
-			maxChunksLimit: expectedChunks - 1,
-			expectedErr:    "exceeded chunks limit",
-			code:           422,
+			maxChunksLimit:         expectedChunks - 1,
+			expectedErr:            "exceeded chunks limit",
+			code:                   422,
+			expectedSampleLimitHit: 1,
 		},
 		"should fail if the max series limit is exceeded - 422": {
 			maxChunksLimit: expectedChunks,
@@ -645,6 +649,7 @@ func TestBucketStore_Series_ChunksLimiter_e2e(t *testing.T) {
 				testutil.Equals(t, true, ok)
 				testutil.Equals(t, testData.code, status.Code())
 			}
+			testutil.Equals(t, testData.expectedSampleLimitHit, promtest.ToFloat64(s.store.metrics.queriesSampleLimitHit))
 		})
 	}
 }
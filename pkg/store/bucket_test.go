@@ -18,6 +18,7 @@ import (
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -599,6 +600,135 @@ func TestBucketStore_Info(t *testing.T) {
 	testutil.Equals(t, []labelpb.ZLabel(nil), resp.Labels)
 }
 
+// blockingFetcher is a block.MetadataFetcher whose Fetch blocks until release is closed.
+type blockingFetcher struct {
+	started chan struct{}
+	release chan struct{}
+	calls   atomic.Int64
+}
+
+func (f *blockingFetcher) Fetch(context.Context) (map[ulid.ULID]*metadata.Meta, map[ulid.ULID]error, error) {
+	if f.calls.Inc() == 1 {
+		close(f.started)
+	}
+	<-f.release
+	return map[ulid.ULID]*metadata.Meta{}, nil, nil
+}
+
+func (f *blockingFetcher) UpdateOnChange(func([]metadata.Meta, error)) {}
+
+func TestBucketStore_SyncBlocks_SkipsOverlappingSyncs(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+
+	dir, err := ioutil.TempDir("", "bucketstore-test")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	fetcher := &blockingFetcher{started: make(chan struct{}), release: make(chan struct{})}
+	bucketStore, err := NewBucketStore(
+		nil,
+		fetcher,
+		dir,
+		NewChunksLimiterFactory(0),
+		NewSeriesLimiterFactory(0),
+		NewGapBasedPartitioner(PartitionerMaxGapSize),
+		20,
+		true,
+		DefaultPostingOffsetInMemorySampling,
+		false,
+		false,
+		0,
+		WithFilterConfig(allowAllFilterConf),
+	)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, bucketStore.Close()) }()
+
+	ctx := context.Background()
+	errc := make(chan error, 1)
+	go func() { errc <- bucketStore.SyncBlocks(ctx) }()
+	<-fetcher.started
+
+	// Syncs triggered while the first one is still running are skipped.
+	testutil.Ok(t, bucketStore.SyncBlocks(ctx))
+	testutil.Ok(t, bucketStore.SyncBlocks(ctx))
+	testutil.Equals(t, int64(1), fetcher.calls.Load())
+	testutil.Equals(t, float64(2), promtest.ToFloat64(bucketStore.metrics.blockSyncsSkipped))
+
+	close(fetcher.release)
+	testutil.Ok(t, <-errc)
+
+	// Once the running sync finished, the next one goes through.
+	testutil.Ok(t, bucketStore.SyncBlocks(ctx))
+	testutil.Equals(t, int64(2), fetcher.calls.Load())
+	testutil.Equals(t, float64(2), promtest.ToFloat64(bucketStore.metrics.blockSyncsSkipped))
+}
+
+func TestBucketStore_SyncBlocks_SyncLag(t *testing.T) {
+	ctx := context.Background()
+	logger := log.NewNopLogger()
+
+	dir, err := ioutil.TempDir("", "bucketstore-sync-lag")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt := objstore.WithNoopInstr(objstore.NewInMemBucket())
+	series := []labels.Labels{labels.FromStrings("a", "1")}
+	extLset := labels.Labels{{Name: "ext1", Value: "1"}}
+
+	id1, err := e2eutil.CreateBlockWithBlockDelay(ctx, dir, series, 10, 0, 1000, 2*time.Hour, extLset, 0, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(dir, id1.String()), metadata.NoneFunc))
+
+	fetcher, err := block.NewMetaFetcher(logger, 10, bkt, dir, nil, nil, nil)
+	testutil.Ok(t, err)
+
+	bucketStore, err := NewBucketStore(
+		bkt,
+		fetcher,
+		filepath.Join(dir, "store"),
+		NewChunksLimiterFactory(0),
+		NewSeriesLimiterFactory(0),
+		NewGapBasedPartitioner(PartitionerMaxGapSize),
+		20,
+		true,
+		DefaultPostingOffsetInMemorySampling,
+		false,
+		false,
+		0,
+		WithLogger(logger),
+		WithFilterConfig(allowAllFilterConf),
+	)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, bucketStore.Close()) }()
+
+	assertLag := func(expected time.Duration) {
+		t.Helper()
+
+		lag := time.Duration(promtest.ToFloat64(bucketStore.metrics.blockSyncLag) * float64(time.Second))
+		testutil.Assert(t, lag >= expected && lag < expected+time.Minute, "expected sync lag of about %v, got %v", expected, lag)
+	}
+
+	testutil.Ok(t, bucketStore.SyncBlocks(ctx))
+	testutil.Equals(t, 1, len(bucketStore.LoadedBlocks()))
+	assertLag(0)
+
+	// A newer block in the bucket that cannot be loaded yet, as its index is missing, is reflected until a sync
+	// loads it, no matter how old the loaded blocks are.
+	id2, err := e2eutil.CreateBlockWithBlockDelay(ctx, dir, series, 10, 1000, 2000, 10*time.Minute, extLset, 0, metadata.NoneFunc)
+	testutil.Ok(t, err)
+	testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(dir, id2.String()), metadata.NoneFunc))
+	testutil.Ok(t, bkt.Delete(ctx, path.Join(id2.String(), block.IndexFilename)))
+
+	testutil.Ok(t, bucketStore.SyncBlocks(ctx))
+	testutil.Equals(t, 1, len(bucketStore.LoadedBlocks()))
+	assertLag(10 * time.Minute)
+
+	testutil.Ok(t, objstore.UploadFile(ctx, logger, bkt, filepath.Join(dir, id2.String(), block.IndexFilename), path.Join(id2.String(), block.IndexFilename)))
+	testutil.Ok(t, bucketStore.SyncBlocks(ctx))
+	testutil.Equals(t, 2, len(bucketStore.LoadedBlocks()))
+	assertLag(0)
+}
+
 type recorder struct {
 	mtx sync.Mutex
 	objstore.Bucket
@@ -1662,6 +1792,98 @@ func TestSeries_ErrorUnmarshallingRequestHints(t *testing.T) {
 	testutil.Equals(t, true, regexp.MustCompile(".*unmarshal series request hints.*").MatchString(err.Error()))
 }
 
+func TestSeries_SeriesChunksLimit(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "test-series-chunks-limit")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	// Create a block with a series spanning many chunks and a series with a single chunk.
+	headOpts := tsdb.DefaultHeadOptions()
+	headOpts.ChunkDirRoot = filepath.Join(tmpDir, "block")
+	headOpts.ChunkRange = 10000000000
+
+	h, err := tsdb.NewHead(nil, nil, nil, headOpts)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, h.Close()) }()
+
+	for ts := int64(0); ts < 1000; ts++ {
+		// Appending a single sample at a time guarantees each chunk is always MaxSamplesPerChunk.
+		app := h.Appender(context.Background())
+		_, err := app.Append(0, labels.FromStrings("__name__", "many_chunks"), ts, float64(ts))
+		testutil.Ok(t, err)
+		if ts < 100 {
+			_, err = app.Append(0, labels.FromStrings("__name__", "single_chunk"), ts, float64(ts))
+			testutil.Ok(t, err)
+		}
+		testutil.Ok(t, app.Commit())
+	}
+
+	blk := createBlockFromHead(t, headOpts.ChunkDirRoot, h)
+
+	thanosMeta := metadata.Thanos{
+		Labels:     labels.Labels{{Name: "ext1", Value: "1"}}.Map(),
+		Downsample: metadata.ThanosDownsample{Resolution: 0},
+		Source:     metadata.TestSource,
+	}
+	_, err = metadata.InjectThanos(log.NewNopLogger(), filepath.Join(headOpts.ChunkDirRoot, blk.String()), thanosMeta, nil)
+	testutil.Ok(t, err)
+
+	bkt, err := filesystem.NewBucket(filepath.Join(tmpDir, "bucket"))
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, bkt.Close()) }()
+
+	instrBkt := objstore.WithNoopInstr(bkt)
+	logger := log.NewNopLogger()
+	testutil.Ok(t, block.Upload(context.Background(), logger, bkt, filepath.Join(headOpts.ChunkDirRoot, blk.String()), metadata.NoneFunc))
+
+	fetcher, err := block.NewMetaFetcher(logger, 10, instrBkt, tmpDir, nil, nil, nil)
+	testutil.Ok(t, err)
+
+	store, err := NewBucketStore(
+		instrBkt,
+		fetcher,
+		tmpDir,
+		NewChunksLimiterFactory(0),
+		NewSeriesLimiterFactory(0),
+		NewGapBasedPartitioner(PartitionerMaxGapSize),
+		10,
+		false,
+		DefaultPostingOffsetInMemorySampling,
+		true,
+		false,
+		0,
+		WithLogger(logger),
+		WithSeriesChunksLimit(5),
+	)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, store.Close()) }()
+	testutil.Ok(t, store.SyncBlocks(context.Background()))
+
+	series := func(name string, mint, maxt int64) (*storeSeriesServer, error) {
+		srv := newStoreSeriesServer(context.Background())
+		return srv, store.Series(&storepb.SeriesRequest{
+			MinTime:  mint,
+			MaxTime:  maxt,
+			Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "__name__", Value: name}},
+		}, srv)
+	}
+
+	srv, err := series("single_chunk", 0, 1000)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(srv.SeriesSet))
+
+	// Only chunks within the requested time range count towards the limit.
+	srv, err = series("many_chunks", 0, 100)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(srv.SeriesSet))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(store.metrics.queriesDropped.WithLabelValues("series_chunks")))
+
+	_, err = series("many_chunks", 0, 1000)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(err.Error(), "exceeded chunks per series limit"), "unexpected error: %v", err)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(store.metrics.queriesDropped.WithLabelValues("series_chunks")))
+}
+
 func TestSeries_BlockWithMultipleChunks(t *testing.T) {
 	tb := testutil.NewTB(t)
 
@@ -2197,7 +2419,7 @@ func prepareBucket(b *testing.B, resolutionLevel compact.ResolutionLevel) (*buck
 
 	if resolutionLevel > 0 {
 		// Downsample newly-created block.
-		blockID, err = downsample.Downsample(logger, blockMeta, head, tmpDir, int64(resolutionLevel))
+		blockID, _, err = downsample.Downsample(logger, blockMeta, head, tmpDir, int64(resolutionLevel))
 		testutil.Ok(b, err)
 		blockMeta, err = metadata.ReadFromDir(filepath.Join(tmpDir, blockID.String()))
 		testutil.Ok(b, err)
@@ -2266,7 +2488,7 @@ func benchmarkBlockSeriesWithConcurrency(b *testing.B, concurrency int, blockMet
 				indexReader := blk.indexReader(ctx)
 				chunkReader := blk.chunkReader(ctx)
 
-				seriesSet, _, err := blockSeries(nil, indexReader, chunkReader, matchers, chunksLimiter, seriesLimiter, req.SkipChunks, req.MinTime, req.MaxTime, req.Aggregates)
+				seriesSet, _, err := blockSeries(nil, indexReader, chunkReader, matchers, chunksLimiter, seriesLimiter, newSeriesChunksLimiter(0, nil), req.SkipChunks, req.MinTime, req.MaxTime, req.Aggregates)
 				testutil.Ok(b, err)
 
 				// Ensure at least 1 series has been returned (as expected).
@@ -2293,3 +2515,44 @@ func BenchmarkDownsampledBlockSeries(b *testing.B) {
 		}
 	}
 }
+
+func TestBucketStore_LoadedBlocks(t *testing.T) {
+	_, store, _, _, block1, block2, close := setupStoreForHintsTest(t)
+	defer close()
+
+	var expected []LoadedBlock
+	for _, id := range []ulid.ULID{block1, block2} {
+		meta, err := metadata.ReadFromDir(filepath.Join(store.dir, "bkt", id.String()))
+		testutil.Ok(t, err)
+		expected = append(expected, LoadedBlock{
+			ULID:       id,
+			MinTime:    meta.MinTime,
+			MaxTime:    meta.MaxTime,
+			Resolution: 0,
+			Labels:     map[string]string{"ext1": "1"},
+		})
+	}
+	testutil.Equals(t, expected, store.LoadedBlocks())
+
+	// Removed blocks are no longer reported.
+	testutil.Ok(t, store.removeBlock(block1))
+	testutil.Equals(t, expected[1:], store.LoadedBlocks())
+}
+
+func TestBucketStore_IndexCacheRebuilds(t *testing.T) {
+	_, store, _, _, block1, _, close := setupStoreForHintsTest(t)
+	defer close()
+
+	// Index-headers of both blocks were missing on first load.
+	testutil.Equals(t, 2.0, promtest.ToFloat64(store.metrics.indexCacheRebuilds))
+
+	// Syncing again doesn't touch already loaded blocks.
+	testutil.Ok(t, store.SyncBlocks(context.Background()))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(store.metrics.indexCacheRebuilds))
+
+	// Removing the block deletes its index-header, so it's rebuilt once the block is loaded again.
+	testutil.Ok(t, store.removeBlock(block1))
+	testutil.Ok(t, store.SyncBlocks(context.Background()))
+	testutil.Equals(t, 2, len(store.LoadedBlocks()))
+	testutil.Equals(t, 3.0, promtest.ToFloat64(store.metrics.indexCacheRebuilds))
+}
@@ -6,22 +6,28 @@ package storecache
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/golang/snappy"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/thanos-io/thanos/pkg/cache"
+	"github.com/thanos-io/thanos/pkg/extprom"
+	"github.com/thanos-io/thanos/pkg/gate"
 	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/runutil"
 )
@@ -43,6 +49,16 @@ type CachingBucket struct {
 	requestedGetRangeBytes *prometheus.CounterVec
 	fetchedGetRangeBytes   *prometheus.CounterVec
 	refetchedGetRangeBytes *prometheus.CounterVec
+	getRangeHitRatio       *prometheus.HistogramVec
+
+	// getRangeGate limits concurrent GetRange sub-requests issued on the underlying bucket.
+	getRangeGate gate.Gate
+
+	// randFloat returns the random fraction of the TTL jitter applied to an entry.
+	randFloat func() float64
+
+	// readAheads in progress. Shared by copies of the bucket.
+	readAheads *readAheads
 
 	operationConfigs  map[string][]*operationConfig
 	operationRequests *prometheus.CounterVec
@@ -55,11 +71,17 @@ func NewCachingBucket(b objstore.Bucket, cfg *CachingBucketConfig, logger log.Lo
 	if b == nil {
 		return nil, errors.New("bucket is nil")
 	}
+	if cfg.maxKeyLength > 0 && cfg.maxKeyLength < hashedCacheKeyLength {
+		return nil, errors.Errorf("max cache key length %d is shorter than length of hashed keys %d", cfg.maxKeyLength, hashedCacheKeyLength)
+	}
 
 	cb := &CachingBucket{
-		Bucket: b,
-		cfg:    cfg,
-		logger: logger,
+		Bucket:    b,
+		cfg:       cfg,
+		logger:    logger,
+		randFloat: rand.Float64,
+
+		readAheads: newReadAheads(),
 
 		operationConfigs: map[string][]*operationConfig{},
 
@@ -75,6 +97,11 @@ func NewCachingBucket(b objstore.Bucket, cfg *CachingBucketConfig, logger log.Lo
 			Name: "thanos_store_bucket_cache_getrange_refetched_bytes_total",
 			Help: "Total number of bytes re-fetched from storage because of GetRange operation, despite being in cache already.",
 		}, []string{"origin", "config"}),
+		getRangeHitRatio: promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "thanos_store_bucket_cache_getrange_hit_ratio",
+			Help:    "Ratio of bytes served from cache to bytes requested by single GetRange operation.",
+			Buckets: prometheus.LinearBuckets(0, 0.1, 11),
+		}, []string{"config"}),
 
 		operationRequests: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
 			Name: "thanos_store_bucket_cache_operation_requests_total",
@@ -86,6 +113,11 @@ func NewCachingBucket(b objstore.Bucket, cfg *CachingBucketConfig, logger log.Lo
 		}, []string{"operation", "config"}),
 	}
 
+	cb.getRangeGate = gate.NewNoop()
+	if cfg.maxConcurrentGetRangeRequests > 0 {
+		cb.getRangeGate = gate.New(extprom.WrapRegistererWithPrefix("thanos_store_bucket_cache_getrange_", reg), cfg.maxConcurrentGetRangeRequests)
+	}
+
 	for op, names := range cfg.allConfigNames() {
 		for _, n := range names {
 			cb.operationRequests.WithLabelValues(op, n)
@@ -96,6 +128,7 @@ func NewCachingBucket(b objstore.Bucket, cfg *CachingBucketConfig, logger log.Lo
 				cb.fetchedGetRangeBytes.WithLabelValues(originCache, n)
 				cb.fetchedGetRangeBytes.WithLabelValues(originBucket, n)
 				cb.refetchedGetRangeBytes.WithLabelValues(originCache, n)
+				cb.getRangeHitRatio.WithLabelValues(n)
 			}
 		}
 	}
@@ -107,6 +140,12 @@ func (cb *CachingBucket) Name() string {
 	return "caching: " + cb.Bucket.Name()
 }
 
+// Close aborts read-aheads in progress, waits for them to finish and closes the underlying bucket.
+func (cb *CachingBucket) Close() error {
+	cb.readAheads.stop()
+	return cb.Bucket.Close()
+}
+
 func (cb *CachingBucket) WithExpectedErrs(expectedFunc objstore.IsOpFailureExpectedFunc) objstore.Bucket {
 	if ib, ok := cb.Bucket.(objstore.InstrumentedBucket); ok {
 		// Make a copy, but replace bucket with instrumented one.
@@ -123,6 +162,105 @@ func (cb *CachingBucket) ReaderWithExpectedErrs(expectedFunc objstore.IsOpFailur
 	return cb.WithExpectedErrs(expectedFunc)
 }
 
+// Upload uploads the object and invalidates its cached entries.
+func (cb *CachingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if err := cb.Bucket.Upload(ctx, name, r); err != nil {
+		return err
+	}
+	cb.invalidate(ctx, name, true)
+	return nil
+}
+
+// Delete deletes the object and invalidates its cached entries.
+func (cb *CachingBucket) Delete(ctx context.Context, name string) error {
+	if err := cb.Bucket.Delete(ctx, name); err != nil {
+		return err
+	}
+	cb.invalidate(ctx, name, false)
+	return nil
+}
+
+// invalidate makes a best-effort attempt to invalidate cached entries of the modified object. Caches don't support
+// deletion, so the object is moved to a new generation instead, which is stored in all caches configured for it.
+// All entries of the object are cached under keys of its current generation, so that entries cached before the
+// modification are ignored by all caching buckets sharing these caches, e.g. other replicas. The generation is
+// cached until all entries cached before the modification expired, i.e. for the longest TTL of these entries.
+func (cb *CachingBucket) invalidate(ctx context.Context, name string, exists bool) {
+	_, getCfg := cb.cfg.findGetConfig(name)
+	_, getRangeCfg := cb.cfg.findGetRangeConfig(name)
+	_, attrsCfg := cb.cfg.findAttributesConfig(name)
+	_, existsCfg := cb.cfg.findExistConfig(name)
+
+	var (
+		caches []cache.Cache
+		maxTTL time.Duration
+	)
+	if getCfg != nil {
+		caches = append(caches, getCfg.cache)
+		maxTTL = maxDuration(maxTTL, maxDuration(getCfg.contentTTL, maxDuration(getCfg.existsTTL, getCfg.doesntExistTTL)))
+		for _, t := range getCfg.contentTTLTiers {
+			maxTTL = maxDuration(maxTTL, t.TTL)
+		}
+	}
+	if getRangeCfg != nil {
+		caches = append(caches, getRangeCfg.cache)
+		maxTTL = maxDuration(maxTTL, maxDuration(getRangeCfg.attributesTTL, getRangeCfg.subrangeTTL))
+	}
+	if attrsCfg != nil {
+		caches = append(caches, attrsCfg.cache)
+		maxTTL = maxDuration(maxTTL, attrsCfg.ttl)
+	}
+	if existsCfg != nil {
+		caches = append(caches, existsCfg.cache)
+		maxTTL = maxDuration(maxTTL, maxDuration(existsCfg.existsTTL, existsCfg.doesntExistTTL))
+	}
+	if maxTTL <= 0 {
+		return
+	}
+
+	now := time.Now()
+	gen := strconv.FormatInt(now.UnixNano(), 10)
+	genKey := cb.cacheKey(cachingKeyGeneration(name))
+	for _, c := range caches {
+		c.Store(ctx, map[string][]byte{genKey: []byte(gen)}, maxTTL)
+	}
+
+	existsKey := cb.cacheKey(withGeneration(cachingKeyExists(name), gen))
+	if getCfg != nil {
+		cb.storeExistsCacheEntry(ctx, existsKey, exists, now, getCfg.cache, getCfg.existsTTL, getCfg.doesntExistTTL)
+	}
+	if existsCfg != nil {
+		cb.storeExistsCacheEntry(ctx, existsKey, exists, now, existsCfg.cache, existsCfg.existsTTL, existsCfg.doesntExistTTL)
+	}
+}
+
+// generations returns the current generations of the given objects, as stored in the given cache by invalidate.
+// Objects which were not modified via a caching bucket sharing the cache, or whose generation expired, are left out,
+// as their entries are cached under keys without generation.
+func (cb *CachingBucket) generations(ctx context.Context, c cache.Cache, names ...string) map[string]string {
+	keys := make([]string, 0, len(names))
+	for _, name := range names {
+		keys = append(keys, cb.cacheKey(cachingKeyGeneration(name)))
+	}
+	hits := c.Fetch(ctx, keys)
+	if len(hits) == 0 {
+		return nil
+	}
+
+	gens := make(map[string]string, len(hits))
+	for i, name := range names {
+		if gen := hits[keys[i]]; gen != nil {
+			gens[name] = string(gen)
+		}
+	}
+	return gens
+}
+
+// generation returns the current generation of the object as stored in the given cache, see generations.
+func (cb *CachingBucket) generation(ctx context.Context, c cache.Cache, name string) string {
+	return cb.generations(ctx, c, name)[name]
+}
+
 func (cb *CachingBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
 	cfgName, cfg := cb.cfg.findIterConfig(dir)
 	if cfg == nil {
@@ -131,7 +269,7 @@ func (cb *CachingBucket) Iter(ctx context.Context, dir string, f func(string) er
 
 	cb.operationRequests.WithLabelValues(objstore.OpIter, cfgName).Inc()
 
-	key := cachingKeyIter(dir)
+	key := cb.cacheKey(cachingKeyIter(dir))
 	data := cfg.cache.Fetch(ctx, []string{key})
 	if data[key] != nil {
 		list, err := cfg.codec.Decode(data[key])
@@ -156,7 +294,7 @@ func (cb *CachingBucket) Iter(ctx context.Context, dir string, f func(string) er
 		return f(s)
 	}, options...)
 
-	remainingTTL := cfg.ttl - time.Since(iterTime)
+	remainingTTL := cb.jitterTTL(cfg.ttlForDir(dir)) - time.Since(iterTime)
 	if err == nil && remainingTTL > 0 {
 		data, encErr := cfg.codec.Encode(list)
 		if encErr == nil {
@@ -176,7 +314,7 @@ func (cb *CachingBucket) Exists(ctx context.Context, name string) (bool, error)
 
 	cb.operationRequests.WithLabelValues(objstore.OpExists, cfgName).Inc()
 
-	key := cachingKeyExists(name)
+	key := cb.cacheKey(withGeneration(cachingKeyExists(name), cb.generation(ctx, cfg.cache, name)))
 	hits := cfg.cache.Fetch(ctx, []string{key})
 
 	if ex := hits[key]; ex != nil {
@@ -191,18 +329,85 @@ func (cb *CachingBucket) Exists(ctx context.Context, name string) (bool, error)
 	existsTime := time.Now()
 	ok, err := cb.Bucket.Exists(ctx, name)
 	if err == nil {
-		storeExistsCacheEntry(ctx, key, ok, existsTime, cfg.cache, cfg.existsTTL, cfg.doesntExistTTL)
+		cb.storeExistsCacheEntry(ctx, key, ok, existsTime, cfg.cache, cfg.existsTTL, cfg.doesntExistTTL)
 	}
 
 	return ok, err
 }
 
-func storeExistsCacheEntry(ctx context.Context, cachingKey string, exists bool, ts time.Time, cache cache.Cache, existsTTL, doesntExistTTL time.Duration) {
+// BatchExists checks existence of all given objects. Objects matching exists configuration are looked up in the cache
+// first, and only cache misses are checked against the underlying bucket in a single batch.
+func (cb *CachingBucket) BatchExists(ctx context.Context, names []string) (map[string]bool, error) {
+	var (
+		res        = make(map[string]bool, len(names))
+		misses     []string
+		namesByCfg = map[string][]string{}
+		cfgs       = map[string]*existsConfig{}
+	)
+	for _, name := range names {
+		cfgName, cfg := cb.cfg.findExistConfig(name)
+		if cfg == nil {
+			misses = append(misses, name)
+			continue
+		}
+		namesByCfg[cfgName] = append(namesByCfg[cfgName], name)
+		cfgs[cfgName] = cfg
+	}
+
+	// Names which are not cached, mapped to the config and key used to cache them once fetched.
+	missesCfgs := map[string]*existsConfig{}
+	missesKeys := map[string]string{}
+	for cfgName, cfgNames := range namesByCfg {
+		cfg := cfgs[cfgName]
+		cb.operationRequests.WithLabelValues(objstore.OpExists, cfgName).Add(float64(len(cfgNames)))
+
+		gens := cb.generations(ctx, cfg.cache, cfgNames...)
+		keys := make([]string, 0, len(cfgNames))
+		for _, name := range cfgNames {
+			keys = append(keys, cb.cacheKey(withGeneration(cachingKeyExists(name), gens[name])))
+		}
+		hits := cfg.cache.Fetch(ctx, keys)
+
+		for i, name := range cfgNames {
+			if ex := hits[keys[i]]; ex != nil {
+				exists, err := strconv.ParseBool(string(ex))
+				if err == nil {
+					cb.operationHits.WithLabelValues(objstore.OpExists, cfgName).Inc()
+					res[name] = exists
+					continue
+				}
+				level.Warn(cb.logger).Log("msg", "unexpected cached 'exists' value", "key", keys[i], "val", string(ex))
+			}
+			misses = append(misses, name)
+			missesCfgs[name] = cfg
+			missesKeys[name] = keys[i]
+		}
+	}
+
+	if len(misses) == 0 {
+		return res, nil
+	}
+
+	existsTime := time.Now()
+	fetched, err := objstore.BatchExists(ctx, cb.Bucket, misses)
+	if err != nil {
+		return nil, err
+	}
+	for name, ok := range fetched {
+		res[name] = ok
+		if cfg := missesCfgs[name]; cfg != nil {
+			cb.storeExistsCacheEntry(ctx, missesKeys[name], ok, existsTime, cfg.cache, cfg.existsTTL, cfg.doesntExistTTL)
+		}
+	}
+	return res, nil
+}
+
+func (cb *CachingBucket) storeExistsCacheEntry(ctx context.Context, cachingKey string, exists bool, ts time.Time, cache cache.Cache, existsTTL, doesntExistTTL time.Duration) {
 	var ttl time.Duration
 	if exists {
-		ttl = existsTTL - time.Since(ts)
+		ttl = cb.jitterTTL(existsTTL) - time.Since(ts)
 	} else {
-		ttl = doesntExistTTL - time.Since(ts)
+		ttl = cb.jitterTTL(doesntExistTTL) - time.Since(ts)
 	}
 
 	if ttl > 0 {
@@ -210,6 +415,14 @@ func storeExistsCacheEntry(ctx context.Context, cachingKey string, exists bool,
 	}
 }
 
+// jitterTTL returns the given TTL shortened by a random fraction of up to the configured TTL jitter.
+func (cb *CachingBucket) jitterTTL(ttl time.Duration) time.Duration {
+	if cb.cfg.ttlJitter <= 0 {
+		return ttl
+	}
+	return ttl - time.Duration(cb.cfg.ttlJitter*cb.randFloat()*float64(ttl))
+}
+
 func (cb *CachingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
 	cfgName, cfg := cb.cfg.findGetConfig(name)
 	if cfg == nil {
@@ -218,13 +431,18 @@ func (cb *CachingBucket) Get(ctx context.Context, name string) (io.ReadCloser, e
 
 	cb.operationRequests.WithLabelValues(objstore.OpGet, cfgName).Inc()
 
-	contentKey := cachingKeyContent(name)
-	existsKey := cachingKeyExists(name)
+	gen := cb.generation(ctx, cfg.cache, name)
+	contentKey := cb.cacheKey(withGeneration(cachingKeyContent(name), gen))
+	existsKey := cb.cacheKey(withGeneration(cachingKeyExists(name), gen))
 
 	hits := cfg.cache.Fetch(ctx, []string{contentKey, existsKey})
 	if hits[contentKey] != nil {
-		cb.operationHits.WithLabelValues(objstore.OpGet, cfgName).Inc()
-		return objstore.NopCloserWithSize(bytes.NewBuffer(hits[contentKey])), nil
+		content, err := decodeCachedContent(hits[contentKey])
+		if err == nil {
+			cb.operationHits.WithLabelValues(objstore.OpGet, cfgName).Inc()
+			return objstore.NopCloserWithSize(bytes.NewBuffer(content)), nil
+		}
+		level.Warn(cb.logger).Log("msg", "failed to decode cached Get content", "key", contentKey, "err", err)
 	}
 
 	// If we know that file doesn't exist, we can return that. Useful for deletion marks.
@@ -240,22 +458,24 @@ func (cb *CachingBucket) Get(ctx context.Context, name string) (io.ReadCloser, e
 	if err != nil {
 		if cb.Bucket.IsObjNotFoundErr(err) {
 			// Cache that object doesn't exist.
-			storeExistsCacheEntry(ctx, existsKey, false, getTime, cfg.cache, cfg.existsTTL, cfg.doesntExistTTL)
+			cb.storeExistsCacheEntry(ctx, existsKey, false, getTime, cfg.cache, cfg.existsTTL, cfg.doesntExistTTL)
 		}
 
 		return nil, err
 	}
 
-	storeExistsCacheEntry(ctx, existsKey, true, getTime, cfg.cache, cfg.existsTTL, cfg.doesntExistTTL)
+	cb.storeExistsCacheEntry(ctx, existsKey, true, getTime, cfg.cache, cfg.existsTTL, cfg.doesntExistTTL)
 	return &getReader{
 		c:         cfg.cache,
 		ctx:       ctx,
 		r:         reader,
 		buf:       new(bytes.Buffer),
 		startTime: getTime,
-		ttl:       cfg.contentTTL,
+		ttl:       cfg.contentTTLForSize,
+		jitter:    cb.jitterTTL,
 		cacheKey:  contentKey,
-		maxSize:   cfg.maxCacheableSize,
+		maxSize:   cfg.maxCacheableContentSize(),
+		compress:  cfg.compressContent,
 	}, nil
 }
 
@@ -282,11 +502,11 @@ func (cb *CachingBucket) Attributes(ctx context.Context, name string) (objstore.
 		return cb.Bucket.Attributes(ctx, name)
 	}
 
-	return cb.cachedAttributes(ctx, name, cfgName, cfg.cache, cfg.ttl)
+	return cb.cachedAttributes(ctx, name, cb.generation(ctx, cfg.cache, name), cfgName, cfg.cache, cfg.ttl)
 }
 
-func (cb *CachingBucket) cachedAttributes(ctx context.Context, name, cfgName string, cache cache.Cache, ttl time.Duration) (objstore.ObjectAttributes, error) {
-	key := cachingKeyAttributes(name)
+func (cb *CachingBucket) cachedAttributes(ctx context.Context, name, gen, cfgName string, cache cache.Cache, ttl time.Duration) (objstore.ObjectAttributes, error) {
+	key := cb.cacheKey(withGeneration(cachingKeyAttributes(name), gen))
 
 	cb.operationRequests.WithLabelValues(objstore.OpAttributes, cfgName).Inc()
 
@@ -308,7 +528,7 @@ func (cb *CachingBucket) cachedAttributes(ctx context.Context, name, cfgName str
 	}
 
 	if raw, err := json.Marshal(attrs); err == nil {
-		cache.Store(ctx, map[string][]byte{key: raw}, ttl)
+		cache.Store(ctx, map[string][]byte{key: raw}, cb.jitterTTL(ttl))
 	} else {
 		level.Warn(cb.logger).Log("msg", "failed to encode cached Attributes result", "key", key, "err", err)
 	}
@@ -320,7 +540,8 @@ func (cb *CachingBucket) cachedGetRange(ctx context.Context, name string, offset
 	cb.operationRequests.WithLabelValues(objstore.OpGetRange, cfgName).Inc()
 	cb.requestedGetRangeBytes.WithLabelValues(cfgName).Add(float64(length))
 
-	attrs, err := cb.cachedAttributes(ctx, name, cfgName, cfg.cache, cfg.attributesTTL)
+	gen := cb.generation(ctx, cfg.cache, name)
+	attrs, err := cb.cachedAttributes(ctx, name, gen, cfgName, cfg.cache, cfg.attributesTTL)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to get object attributes: %s", name)
 	}
@@ -358,7 +579,7 @@ func (cb *CachingBucket) cachedGetRange(ctx context.Context, name string, offset
 		}
 		totalRequestedBytes += (end - off)
 
-		k := cachingKeyObjectSubrange(name, off, end)
+		k := cb.cacheKey(withGeneration(cachingKeyObjectSubrange(name, off, end), gen))
 		keys = append(keys, k)
 		offsetKeys[off] = k
 	}
@@ -371,6 +592,9 @@ func (cb *CachingBucket) cachedGetRange(ctx context.Context, name string, offset
 	}
 	cb.fetchedGetRangeBytes.WithLabelValues(originCache, cfgName).Add(float64(totalCachedBytes))
 	cb.operationHits.WithLabelValues(objstore.OpGetRange, cfgName).Add(float64(len(hits)) / float64(len(keys)))
+	if totalRequestedBytes > 0 {
+		cb.getRangeHitRatio.WithLabelValues(cfgName).Observe(float64(totalCachedBytes) / float64(totalRequestedBytes))
+	}
 
 	if len(hits) < len(keys) {
 		if hits == nil {
@@ -383,9 +607,113 @@ func (cb *CachingBucket) cachedGetRange(ctx context.Context, name string, offset
 		}
 	}
 
+	if cfg.readAheadSubranges > 0 && endRange < attrs.Size {
+		cb.readAheads.start(fmt.Sprintf("%s:%d", name, endRange), func(ctx context.Context) {
+			cb.readAhead(ctx, name, gen, endRange, attrs.Size, cfgName, cfg)
+		})
+	}
+
 	return ioutil.NopCloser(newSubrangesReader(cfg.subrangeSize, offsetKeys, hits, offset, length)), nil
 }
 
+// readAhead fetches up to the configured number of subranges starting at startRange, which are not cached yet, and stores them to the cache.
+// It is run in the background, detached from the context of the request that triggered it, until the bucket is closed.
+func (cb *CachingBucket) readAhead(ctx context.Context, name, gen string, startRange, size int64, cfgName string, cfg *getRangeConfig) {
+	endRange := startRange + int64(cfg.readAheadSubranges)*cfg.subrangeSize
+	if endRange > size {
+		endRange = ((size + cfg.subrangeSize - 1) / cfg.subrangeSize) * cfg.subrangeSize
+	}
+
+	lastSubrangeOffset := endRange - cfg.subrangeSize
+	lastSubrangeLength := int(cfg.subrangeSize)
+	if endRange > size {
+		lastSubrangeOffset = (size / cfg.subrangeSize) * cfg.subrangeSize
+		lastSubrangeLength = int(size - lastSubrangeOffset)
+	}
+
+	offsetKeys := map[int64]string{}
+	keys := make([]string, 0, cfg.readAheadSubranges)
+	for off := startRange; off < endRange; off += cfg.subrangeSize {
+		end := off + cfg.subrangeSize
+		if end > size {
+			end = size
+		}
+
+		k := cb.cacheKey(withGeneration(cachingKeyObjectSubrange(name, off, end), gen))
+		keys = append(keys, k)
+		offsetKeys[off] = k
+	}
+
+	hits := cfg.cache.Fetch(ctx, keys)
+	if len(hits) == len(keys) {
+		return
+	}
+	if hits == nil {
+		hits = map[string][]byte{}
+	}
+
+	if err := cb.fetchMissingSubranges(ctx, name, startRange, endRange, offsetKeys, hits, lastSubrangeOffset, lastSubrangeLength, cfgName, cfg); err != nil {
+		level.Warn(cb.logger).Log("msg", "failed to read ahead subranges", "name", name, "start", startRange, "end", endRange, "err", err)
+	}
+}
+
+// readAheads runs read-aheads in the background, for as long as the caching bucket is not closed. A read-ahead
+// is not started while another one with the same key is in progress, e.g. when readers of the same object
+// request the same range concurrently.
+type readAheads struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mtx      sync.Mutex
+	inflight map[string]struct{}
+}
+
+func newReadAheads() *readAheads {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &readAheads{ctx: ctx, cancel: cancel, inflight: map[string]struct{}{}}
+}
+
+// start runs f in the background, unless a read-ahead with the same key is in progress or read-aheads were stopped.
+func (r *readAheads) start(key string, f func(ctx context.Context)) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.ctx.Err() != nil {
+		return
+	}
+	if _, ok := r.inflight[key]; ok {
+		return
+	}
+	r.inflight[key] = struct{}{}
+	r.wg.Add(1)
+
+	go func() {
+		defer r.wg.Done()
+		defer func() {
+			r.mtx.Lock()
+			delete(r.inflight, key)
+			r.mtx.Unlock()
+		}()
+
+		f(r.ctx)
+	}()
+}
+
+// wait waits for read-aheads in progress to finish.
+func (r *readAheads) wait() {
+	r.wg.Wait()
+}
+
+// stop aborts read-aheads in progress and waits for them to finish. No new read-aheads are started afterwards.
+func (r *readAheads) stop() {
+	r.mtx.Lock()
+	r.cancel()
+	r.mtx.Unlock()
+
+	r.wait()
+}
+
 type rng struct {
 	start, end int64
 }
@@ -415,6 +743,11 @@ func (cb *CachingBucket) fetchMissingSubranges(ctx context.Context, name string,
 	for _, m := range missing {
 		m := m
 		g.Go(func() error {
+			if err := cb.getRangeGate.Start(gctx); err != nil {
+				return errors.Wrapf(err, "waiting for turn to fetch range [%d, %d]", m.start, m.end)
+			}
+			defer cb.getRangeGate.Done()
+
 			r, err := cb.Bucket.GetRange(gctx, name, m.start, m.end-m.start)
 			if err != nil {
 				return errors.Wrapf(err, "fetching range [%d, %d]", m.start, m.end)
@@ -451,7 +784,7 @@ func (cb *CachingBucket) fetchMissingSubranges(ctx context.Context, name string,
 
 				if storeToCache {
 					cb.fetchedGetRangeBytes.WithLabelValues(originBucket, cfgName).Add(float64(len(subrangeData)))
-					cfg.cache.Store(gctx, map[string][]byte{key: subrangeData}, cfg.subrangeTTL)
+					cfg.cache.Store(gctx, map[string][]byte{key: subrangeData}, cb.jitterTTL(cfg.subrangeTTL))
 				} else {
 					cb.refetchedGetRangeBytes.WithLabelValues(originCache, cfgName).Add(float64(len(subrangeData)))
 				}
@@ -482,6 +815,26 @@ func mergeRanges(input []rng, limit int64) []rng {
 	return input[:last+1]
 }
 
+// hashedCacheKeyPrefix is the prefix of cache keys, which were replaced by their hash.
+const hashedCacheKeyPrefix = "hash:"
+
+// hashedCacheKeyLength is the length of cache keys, which were replaced by their hash.
+var hashedCacheKeyLength = len(hashCacheKey(""))
+
+// cacheKey returns the given key, or its hash if the key is longer than the configured max length of cache keys.
+// Short keys are kept as they are, so that they remain human-readable.
+func (cb *CachingBucket) cacheKey(key string) string {
+	if cb.cfg.maxKeyLength <= 0 || len(key) <= cb.cfg.maxKeyLength {
+		return key
+	}
+	return hashCacheKey(key)
+}
+
+func hashCacheKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hashedCacheKeyPrefix + base64.RawURLEncoding.EncodeToString(h[:])
+}
+
 func cachingKeyAttributes(name string) string {
 	return fmt.Sprintf("attrs:%s", name)
 }
@@ -502,6 +855,27 @@ func cachingKeyContent(name string) string {
 	return fmt.Sprintf("content:%s", name)
 }
 
+func cachingKeyGeneration(name string) string {
+	return fmt.Sprintf("objgen:%s", name)
+}
+
+// withGeneration returns the caching key of the given generation of an object. Objects without generation use the key
+// as is. The numeric generation is prefixed, as none of the other keys starts with "gen", they can't collide with keys
+// of modified objects, whatever the object names are.
+func withGeneration(key, gen string) string {
+	if gen == "" {
+		return key
+	}
+	return fmt.Sprintf("gen%s:%s", gen, key)
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 // Reader implementation that uses in-memory subranges.
 type subrangesReader struct {
 	subrangeSize int64
@@ -574,9 +948,11 @@ type getReader struct {
 	r         io.ReadCloser
 	buf       *bytes.Buffer
 	startTime time.Time
-	ttl       time.Duration
+	ttl       func(size int) (time.Duration, bool)
+	jitter    func(ttl time.Duration) time.Duration
 	cacheKey  string
 	maxSize   int
+	compress  bool
 }
 
 func (g *getReader) Close() error {
@@ -597,9 +973,10 @@ func (g *getReader) Read(p []byte) (n int, err error) {
 	}
 
 	if err == io.EOF && g.buf != nil {
-		remainingTTL := g.ttl - time.Since(g.startTime)
-		if remainingTTL > 0 {
-			g.c.Store(g.ctx, map[string][]byte{g.cacheKey: g.buf.Bytes()}, remainingTTL)
+		if ttl, ok := g.ttl(g.buf.Len()); ok {
+			if remainingTTL := g.jitter(ttl) - time.Since(g.startTime); remainingTTL > 0 {
+				g.c.Store(g.ctx, map[string][]byte{g.cacheKey: encodeCachedContent(g.buf.Bytes(), g.compress)}, remainingTTL)
+			}
 		}
 		// Clear reference, to avoid doing another Store on next read.
 		g.buf = nil
@@ -608,6 +985,48 @@ func (g *getReader) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
+// cachedContentMagic prefixes content cached by Get, followed by a single byte with the version of its encoding.
+// Content without it was cached as raw object bytes, which is still how uncompressed content is cached,
+// so that entries can be read by older versions too.
+const cachedContentMagic = "\xffthanos-content"
+
+const (
+	cachedContentRaw    byte = 0
+	cachedContentSnappy byte = 1
+)
+
+// encodeCachedContent returns the cache entry of the given object content.
+func encodeCachedContent(content []byte, compress bool) []byte {
+	if compress {
+		return append(append([]byte(cachedContentMagic), cachedContentSnappy), snappy.Encode(nil, content)...)
+	}
+	if bytes.HasPrefix(content, []byte(cachedContentMagic)) {
+		// Raw content would be mistaken for an encoded entry.
+		return append(append([]byte(cachedContentMagic), cachedContentRaw), content...)
+	}
+	return content
+}
+
+// decodeCachedContent returns the object content of the given cache entry.
+func decodeCachedContent(entry []byte) ([]byte, error) {
+	if !bytes.HasPrefix(entry, []byte(cachedContentMagic)) {
+		return entry, nil
+	}
+	entry = entry[len(cachedContentMagic):]
+	if len(entry) == 0 {
+		return nil, errors.New("missing content encoding version")
+	}
+	switch entry[0] {
+	case cachedContentRaw:
+		return entry[1:], nil
+	case cachedContentSnappy:
+		content, err := snappy.Decode(nil, entry[1:])
+		return content, errors.Wrap(err, "decompress content")
+	default:
+		return nil, errors.Errorf("unknown content encoding version %d", entry[0])
+	}
+}
+
 // JSONIterCodec encodes iter results into JSON. Suitable for root dir.
 type JSONIterCodec struct{}
 
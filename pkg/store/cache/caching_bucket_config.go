@@ -4,8 +4,12 @@
 package storecache
 
 import (
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/pkg/errors"
+
 	"github.com/thanos-io/thanos/pkg/cache"
 	"github.com/thanos-io/thanos/pkg/objstore"
 )
@@ -18,13 +22,18 @@ type IterCodec interface {
 
 // CachingBucketConfig contains low-level configuration for individual bucket operations.
 // This is not exposed to the user, but it is expected that code sets up individual
-// operations based on user-provided configuration.
+// operations based on user-provided configuration. Every operation config carries its own cache,
+// so different operations (e.g. Exists of metadata files and GetRange of chunks) can be backed by different caches.
 type CachingBucketConfig struct {
 	get        map[string]*getConfig
 	iter       map[string]*iterConfig
 	exists     map[string]*existsConfig
 	getRange   map[string]*getRangeConfig
 	attributes map[string]*attributesConfig
+
+	maxConcurrentGetRangeRequests int
+	ttlJitter                     float64
+	maxKeyLength                  int
 }
 
 func NewCachingBucketConfig() *CachingBucketConfig {
@@ -46,8 +55,24 @@ type operationConfig struct {
 // Operation-specific configs.
 type iterConfig struct {
 	operationConfig
-	ttl   time.Duration
-	codec IterCodec
+	ttl         time.Duration
+	ttlsByDepth []time.Duration
+	codec       IterCodec
+}
+
+// ttlForDir returns the TTL of the cached listing of the given directory.
+func (cfg *iterConfig) ttlForDir(dir string) time.Duration {
+	if len(cfg.ttlsByDepth) == 0 {
+		return cfg.ttl
+	}
+	depth := 0
+	if dir = strings.Trim(dir, objstore.DirDelim); dir != "" {
+		depth = strings.Count(dir, objstore.DirDelim) + 1
+	}
+	if depth >= len(cfg.ttlsByDepth) {
+		return cfg.ttlsByDepth[len(cfg.ttlsByDepth)-1]
+	}
+	return cfg.ttlsByDepth[depth]
 }
 
 type existsConfig struct {
@@ -59,7 +84,39 @@ type existsConfig struct {
 type getConfig struct {
 	existsConfig
 	contentTTL       time.Duration
+	contentTTLTiers  []ContentTTLTier
 	maxCacheableSize int
+	compressContent  bool
+}
+
+// ContentTTLTier is the TTL of cached content of objects up to MaxSize bytes big.
+type ContentTTLTier struct {
+	MaxSize int
+	TTL     time.Duration
+}
+
+// contentTTLForSize returns the TTL of cached content of an object of the given size, or false if it shouldn't be cached.
+func (cfg *getConfig) contentTTLForSize(size int) (time.Duration, bool) {
+	if size > cfg.maxCacheableSize {
+		return 0, false
+	}
+	if len(cfg.contentTTLTiers) == 0 {
+		return cfg.contentTTL, true
+	}
+	for _, t := range cfg.contentTTLTiers {
+		if size <= t.MaxSize {
+			return t.TTL, true
+		}
+	}
+	return 0, false
+}
+
+// maxCacheableContentSize returns the size of the biggest object whose content is cached.
+func (cfg *getConfig) maxCacheableContentSize() int {
+	if n := len(cfg.contentTTLTiers); n > 0 && cfg.contentTTLTiers[n-1].MaxSize < cfg.maxCacheableSize {
+		return cfg.contentTTLTiers[n-1].MaxSize
+	}
+	return cfg.maxCacheableSize
 }
 
 type getRangeConfig struct {
@@ -68,6 +125,9 @@ type getRangeConfig struct {
 	maxSubRequests int
 	attributesTTL  time.Duration
 	subrangeTTL    time.Duration
+
+	// readAheadSubranges is the number of subranges past the requested range, which are fetched and cached in the background.
+	readAheadSubranges int
 }
 
 type attributesConfig struct {
@@ -98,6 +158,18 @@ func (cfg *CachingBucketConfig) CacheIter(configName string, cache cache.Cache,
 	}
 }
 
+// IterTTLByDepth configures TTLs of listings cached by the "Iter" operation config with the given name by the depth of
+// the listed directory, which has to be configured by CacheIter first. The i-th TTL is used for directories with i path
+// elements, i.e. the first one for the bucket root, and the last one for all deeper directories too. This allows caching
+// listings of frequently changing directories, like the root with new blocks, shortly, and of immutable ones long.
+func (cfg *CachingBucketConfig) IterTTLByDepth(configName string, ttls ...time.Duration) {
+	iterCfg, ok := cfg.iter[configName]
+	if !ok {
+		panic("iter config " + configName)
+	}
+	iterCfg.ttlsByDepth = append([]time.Duration(nil), ttls...)
+}
+
 // CacheGet configures caching of "Get" operation for matching files. Content of the object is cached, as well as whether object exists or not.
 func (cfg *CachingBucketConfig) CacheGet(configName string, cache cache.Cache, matcher func(string) bool, maxCacheableSize int, contentTTL, existsTTL, doesntExistTTL time.Duration) {
 	cfg.get[configName] = &getConfig{
@@ -111,6 +183,31 @@ func (cfg *CachingBucketConfig) CacheGet(configName string, cache cache.Cache, m
 	}
 }
 
+// TierGetContentTTL configures size-based TTLs of content cached by the "Get" operation config with the given name,
+// which has to be configured by CacheGet first. Content of an object is cached with the TTL of the smallest tier the
+// object fits into, instead of the content TTL of the config. Objects bigger than all tiers are not cached.
+func (cfg *CachingBucketConfig) TierGetContentTTL(configName string, tiers ...ContentTTLTier) {
+	getCfg, ok := cfg.get[configName]
+	if !ok {
+		panic("get config " + configName)
+	}
+
+	getCfg.contentTTLTiers = append([]ContentTTLTier(nil), tiers...)
+	sort.Slice(getCfg.contentTTLTiers, func(i, j int) bool {
+		return getCfg.contentTTLTiers[i].MaxSize < getCfg.contentTTLTiers[j].MaxSize
+	})
+}
+
+// CompressGetContent enables snappy compression of content cached by the "Get" operation config with the given name,
+// which has to be configured by CacheGet first. Content cached uncompressed, e.g. before compression was enabled, is still read.
+func (cfg *CachingBucketConfig) CompressGetContent(configName string) {
+	getCfg, ok := cfg.get[configName]
+	if !ok {
+		panic("get config " + configName)
+	}
+	getCfg.compressContent = true
+}
+
 // CacheExists configures caching of "Exists" operation for matching files. Negative values are cached as well.
 func (cfg *CachingBucketConfig) CacheExists(configName string, cache cache.Cache, matcher func(string) bool, existsTTL, doesntExistTTL time.Duration) {
 	cfg.exists[configName] = &existsConfig{
@@ -135,6 +232,40 @@ func (cfg *CachingBucketConfig) CacheGetRange(configName string, cache cache.Cac
 	}
 }
 
+// ReadAheadGetRange configures given GetRange config to fetch and cache up to the given number of subranges following
+// each requested range in the background, so that subsequent sequential reads are served from the cache.
+// Read-ahead requests respect the max number of sub-requests of the config and the limit of concurrent GetRange requests.
+func (cfg *CachingBucketConfig) ReadAheadGetRange(configName string, subranges int) {
+	getRangeCfg, ok := cfg.getRange[configName]
+	if !ok {
+		panic("get range config " + configName)
+	}
+	getRangeCfg.readAheadSubranges = subranges
+}
+
+// LimitConcurrentGetRangeRequests limits the number of GetRange sub-requests issued on the underlying bucket
+// concurrently, across all cached GetRange calls. Values <= 0 mean there is no limit.
+func (cfg *CachingBucketConfig) LimitConcurrentGetRangeRequests(maxConcurrent int) {
+	cfg.maxConcurrentGetRangeRequests = maxConcurrent
+}
+
+// JitterTTLs shortens the TTL of each cached entry by a random fraction of up to the given fraction of the TTL, so that
+// entries cached at the same time, e.g. after a restart, do not expire at the same time. The fraction is capped at 1,
+// values <= 0 disable the jitter.
+func (cfg *CachingBucketConfig) JitterTTLs(fraction float64) {
+	if fraction > 1 {
+		fraction = 1
+	}
+	cfg.ttlJitter = fraction
+}
+
+// HashLongKeys configures caching bucket to replace cache keys longer than maxLength, e.g. keys of objects with long names,
+// by their hash. This is useful for caches limiting the length of keys, like memcached. Zero disables hashing.
+// maxLength must not be shorter than hashed keys themselves.
+func (cfg *CachingBucketConfig) HashLongKeys(maxLength int) {
+	cfg.maxKeyLength = maxLength
+}
+
 // CacheAttributes configures caching of "Attributes" operation for matching files.
 func (cfg *CachingBucketConfig) CacheAttributes(configName string, cache cache.Cache, matcher func(name string) bool, ttl time.Duration) {
 	cfg.attributes[configName] = &attributesConfig{
@@ -143,6 +274,95 @@ func (cfg *CachingBucketConfig) CacheAttributes(configName string, cache cache.C
 	}
 }
 
+// Merge returns a new config combining the operations configured in cfg and other. Configs of the same
+// operation and name in other take precedence over those in cfg, as does a positive limit of concurrent
+// GetRange requests. An error is returned if the merged config is invalid.
+func (cfg *CachingBucketConfig) Merge(other *CachingBucketConfig) (*CachingBucketConfig, error) {
+	merged := NewCachingBucketConfig()
+	for _, c := range []*CachingBucketConfig{cfg, other} {
+		for n, op := range c.get {
+			merged.get[n] = op
+		}
+		for n, op := range c.iter {
+			merged.iter[n] = op
+		}
+		for n, op := range c.exists {
+			merged.exists[n] = op
+		}
+		for n, op := range c.getRange {
+			merged.getRange[n] = op
+		}
+		for n, op := range c.attributes {
+			merged.attributes[n] = op
+		}
+		if c.maxConcurrentGetRangeRequests > 0 {
+			merged.maxConcurrentGetRangeRequests = c.maxConcurrentGetRangeRequests
+		}
+		if c.ttlJitter > 0 {
+			merged.ttlJitter = c.ttlJitter
+		}
+		if c.maxKeyLength > 0 {
+			merged.maxKeyLength = c.maxKeyLength
+		}
+	}
+
+	if err := merged.validate(); err != nil {
+		return nil, errors.Wrap(err, "validate merged caching bucket config")
+	}
+	return merged, nil
+}
+
+// validate checks that GetRange subrange sizes are positive and that operations sharing a config name use
+// the same cache, since they are reported under the same name and share cached entries (e.g. "Get" caches
+// whether object exists for "Exists").
+func (cfg *CachingBucketConfig) validate() error {
+	caches := map[string]cache.Cache{}
+	check := func(op, name string, c cache.Cache) error {
+		if name == "" {
+			return errors.Errorf("empty config name for operation %s", op)
+		}
+		if prev, ok := caches[name]; ok && prev != c {
+			return errors.Errorf("config %q uses different caches across operations, found conflict for operation %s", name, op)
+		}
+		caches[name] = c
+		return nil
+	}
+
+	ops := cfg.allConfigNames()
+	opNames := make([]string, 0, len(ops))
+	for op := range ops {
+		opNames = append(opNames, op)
+	}
+	sort.Strings(opNames)
+
+	for _, op := range opNames {
+		names := ops[op]
+		sort.Strings(names)
+		for _, n := range names {
+			var c cache.Cache
+			switch op {
+			case objstore.OpGet:
+				c = cfg.get[n].cache
+			case objstore.OpIter:
+				c = cfg.iter[n].cache
+			case objstore.OpExists:
+				c = cfg.exists[n].cache
+			case objstore.OpGetRange:
+				if cfg.getRange[n].subrangeSize <= 0 {
+					return errors.Errorf("config %q for operation %s has non-positive subrange size %d", n, op, cfg.getRange[n].subrangeSize)
+				}
+				c = cfg.getRange[n].cache
+			case objstore.OpAttributes:
+				c = cfg.attributes[n].cache
+			}
+			if err := check(op, n, c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (cfg *CachingBucketConfig) allConfigNames() map[string][]string {
 	result := map[string][]string{}
 	for n := range cfg.get {
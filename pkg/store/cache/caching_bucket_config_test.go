@@ -0,0 +1,82 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package storecache
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestCachingBucketConfig_Merge(t *testing.T) {
+	matchAll := func(string) bool { return true }
+	c1, c2 := newMockCache(), newMockCache()
+
+	t.Run("later config takes precedence", func(t *testing.T) {
+		defaults := NewCachingBucketConfig()
+		defaults.CacheGetRange("chunks", c1, matchAll, 16000, time.Hour, time.Hour, 3)
+		defaults.CacheExists("meta.jsons", c1, matchAll, time.Minute, time.Minute)
+		defaults.CacheGet("meta.jsons", c1, matchAll, 1024, time.Minute, time.Minute, time.Minute)
+		defaults.LimitConcurrentGetRangeRequests(10)
+		defaults.JitterTTLs(0.1)
+		defaults.HashLongKeys(250)
+
+		overrides := NewCachingBucketConfig()
+		overrides.CacheGetRange("chunks", c1, matchAll, 32000, time.Hour, time.Hour, 5)
+		overrides.CacheIter("blocks-iter", c2, matchAll, time.Minute, JSONIterCodec{})
+
+		merged, err := defaults.Merge(overrides)
+		testutil.Ok(t, err)
+
+		testutil.Equals(t, map[string][]string{
+			objstore.OpGet:      {"meta.jsons"},
+			objstore.OpExists:   {"meta.jsons"},
+			objstore.OpGetRange: {"chunks"},
+			objstore.OpIter:     {"blocks-iter"},
+		}, merged.allConfigNames())
+		testutil.Equals(t, int64(32000), merged.getRange["chunks"].subrangeSize)
+		testutil.Equals(t, 5, merged.getRange["chunks"].maxSubRequests)
+		testutil.Equals(t, 1024, merged.get["meta.jsons"].maxCacheableSize)
+		// Unset limits and jitter don't override.
+		testutil.Equals(t, 10, merged.maxConcurrentGetRangeRequests)
+		testutil.Equals(t, 0.1, merged.ttlJitter)
+		testutil.Equals(t, 250, merged.maxKeyLength)
+
+		// Inputs are left untouched.
+		testutil.Equals(t, int64(16000), defaults.getRange["chunks"].subrangeSize)
+		testutil.Equals(t, 0, len(defaults.iter))
+
+		overrides.LimitConcurrentGetRangeRequests(20)
+		merged, err = defaults.Merge(overrides)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 20, merged.maxConcurrentGetRangeRequests)
+	})
+	t.Run("conflicting caches for the same name", func(t *testing.T) {
+		defaults := NewCachingBucketConfig()
+		defaults.CacheExists("meta.jsons", c1, matchAll, time.Minute, time.Minute)
+
+		overrides := NewCachingBucketConfig()
+		overrides.CacheGet("meta.jsons", c2, matchAll, 1024, time.Minute, time.Minute, time.Minute)
+
+		_, err := defaults.Merge(overrides)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.Contains(err.Error(), `config "meta.jsons" uses different caches across operations`), err.Error())
+
+		// Overriding the conflicting operation as well resolves the conflict.
+		overrides.CacheExists("meta.jsons", c2, matchAll, time.Minute, time.Minute)
+		_, err = defaults.Merge(overrides)
+		testutil.Ok(t, err)
+	})
+	t.Run("invalid subrange size", func(t *testing.T) {
+		overrides := NewCachingBucketConfig()
+		overrides.CacheGetRange("chunks", c1, matchAll, 0, time.Hour, time.Hour, 3)
+
+		_, err := NewCachingBucketConfig().Merge(overrides)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.Contains(err.Error(), "non-positive subrange size"), err.Error())
+	})
+}
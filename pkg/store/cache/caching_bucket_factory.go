@@ -40,10 +40,22 @@ type CachingWithBackendConfig struct {
 	// Maximum number of GetRange requests issued by this bucket for single GetRange call. Zero or negative value = unlimited.
 	MaxChunksGetRangeRequests int `yaml:"max_chunks_get_range_requests"`
 
+	// Maximum number of GetRange requests issued by this bucket concurrently, across all GetRange calls. Zero or negative value = unlimited.
+	MaxConcurrentGetRangeRequests int `yaml:"max_concurrent_get_range_requests"`
+
+	// Number of subranges following each requested range of chunks, which are fetched and cached in the background. Zero disables read-ahead.
+	ChunkSubrangeReadAhead int `yaml:"chunk_subrange_read_ahead"`
+
+	// Maximum length of cache keys. Longer keys, e.g. of objects with long names, are replaced by their hash. Zero disables hashing.
+	MaxCacheKeyLength int `yaml:"max_cache_key_length"`
+
 	// TTLs for various cache items.
 	ChunkObjectAttrsTTL time.Duration `yaml:"chunk_object_attrs_ttl"`
 	ChunkSubrangeTTL    time.Duration `yaml:"chunk_subrange_ttl"`
 
+	// Fraction of up to which TTLs of cached entries are randomly shortened, to spread their expiry.
+	TTLJitter float64 `yaml:"ttl_jitter"`
+
 	// How long to cache result of Iter call in root directory.
 	BlocksIterTTL time.Duration `yaml:"blocks_iter_ttl"`
 
@@ -52,6 +64,7 @@ type CachingWithBackendConfig struct {
 	MetafileDoesntExistTTL time.Duration `yaml:"metafile_doesnt_exist_ttl"`
 	MetafileContentTTL     time.Duration `yaml:"metafile_content_ttl"`
 	MetafileMaxSize        model.Bytes   `yaml:"metafile_max_size"`
+	MetafileCompress       bool          `yaml:"metafile_compress"`
 }
 
 func (cfg *CachingWithBackendConfig) Defaults() {
@@ -107,8 +120,17 @@ func NewCachingBucketFromYaml(yamlContent []byte, bucket objstore.Bucket, logger
 
 	// Configure cache.
 	cfg.CacheGetRange("chunks", c, isTSDBChunkFile, config.ChunkSubrangeSize, config.ChunkObjectAttrsTTL, config.ChunkSubrangeTTL, config.MaxChunksGetRangeRequests)
+	if config.ChunkSubrangeReadAhead > 0 {
+		cfg.ReadAheadGetRange("chunks", config.ChunkSubrangeReadAhead)
+	}
+	cfg.LimitConcurrentGetRangeRequests(config.MaxConcurrentGetRangeRequests)
+	cfg.JitterTTLs(config.TTLJitter)
+	cfg.HashLongKeys(config.MaxCacheKeyLength)
 	cfg.CacheExists("meta.jsons", c, isMetaFile, config.MetafileExistsTTL, config.MetafileDoesntExistTTL)
 	cfg.CacheGet("meta.jsons", c, isMetaFile, int(config.MetafileMaxSize), config.MetafileContentTTL, config.MetafileExistsTTL, config.MetafileDoesntExistTTL)
+	if config.MetafileCompress {
+		cfg.CompressGetContent("meta.jsons")
+	}
 
 	// Cache Iter requests for root.
 	cfg.CacheIter("blocks-iter", c, isBlocksRootDir, config.BlocksIterTTL, JSONIterCodec{})
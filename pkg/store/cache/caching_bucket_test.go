@@ -10,14 +10,19 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"sort"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 
 	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/runutil"
@@ -299,6 +304,114 @@ func (m *mockCache) flush() {
 	m.cache = map[string]cacheItem{}
 }
 
+// ttlRecordingCache records the TTL of each stored entry.
+type ttlRecordingCache struct {
+	*mockCache
+
+	ttlsMtx sync.Mutex
+	ttls    map[string]time.Duration
+}
+
+func newTTLRecordingCache() *ttlRecordingCache {
+	return &ttlRecordingCache{mockCache: newMockCache(), ttls: map[string]time.Duration{}}
+}
+
+func (c *ttlRecordingCache) Store(ctx context.Context, data map[string][]byte, ttl time.Duration) {
+	c.ttlsMtx.Lock()
+	for k := range data {
+		c.ttls[k] = ttl
+	}
+	c.ttlsMtx.Unlock()
+	c.mockCache.Store(ctx, data, ttl)
+}
+
+func TestCachingBucketTTLJitter(t *testing.T) {
+	inmem := objstore.NewInMemBucket()
+	for _, name := range []string{"dir/exists", "dir/get", "dir/attrs", "dir/range"} {
+		testutil.Ok(t, inmem.Upload(context.Background(), name, strings.NewReader("hello world")))
+	}
+
+	const (
+		existsTTL  = 10 * time.Minute
+		contentTTL = 20 * time.Minute
+		attrsTTL   = 30 * time.Minute
+		rangeTTL   = 40 * time.Minute
+		iterTTL    = 50 * time.Minute
+	)
+	isName := func(names ...string) func(string) bool {
+		return func(name string) bool {
+			for _, n := range names {
+				if n == name {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	for _, tcase := range []struct {
+		name      string
+		jitter    float64
+		randFloat func() float64
+		// exact is true if TTLs not shortened by the time passed are known upfront.
+		exact bool
+	}{
+		{name: "random jitter", jitter: 0.5, randFloat: rand.Float64},
+		{name: "max jitter", jitter: 0.5, randFloat: func() float64 { return 1 }, exact: true},
+		{name: "no jitter", jitter: 0, randFloat: func() float64 { return 1 }, exact: true},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			c := newTTLRecordingCache()
+			cfg := NewCachingBucketConfig()
+			cfg.CacheExists("exists", c, isName("dir/exists", "dir/missing"), existsTTL, existsTTL)
+			cfg.CacheGet("get", c, isName("dir/get"), 1024, contentTTL, existsTTL, existsTTL)
+			cfg.CacheAttributes("attrs", c, isName("dir/attrs"), attrsTTL)
+			cfg.CacheGetRange("range", c, isName("dir/range"), 4, attrsTTL, rangeTTL, 0)
+			cfg.CacheIter("iter", c, isName("dir"), iterTTL, JSONIterCodec{})
+			cfg.JitterTTLs(tcase.jitter)
+
+			cb, err := NewCachingBucket(inmem, cfg, nil, nil)
+			testutil.Ok(t, err)
+			cb.randFloat = tcase.randFloat
+
+			ctx := context.Background()
+			verifyExists(t, cb, "dir/exists", true, false, "exists")
+			verifyExists(t, cb, "dir/missing", false, false, "exists")
+			verifyGet(t, cb, "dir/get", []byte("hello world"), false, "get")
+			_, err = cb.Attributes(ctx, "dir/attrs")
+			testutil.Ok(t, err)
+			verifyGetRange(t, cb, "dir/range", 0, 8, 8)
+			testutil.Ok(t, cb.Iter(ctx, "dir", func(string) error { return nil }))
+
+			expected := map[string]time.Duration{
+				cachingKeyExists("dir/exists"):              existsTTL,
+				cachingKeyExists("dir/missing"):             existsTTL,
+				cachingKeyExists("dir/get"):                 existsTTL,
+				cachingKeyContent("dir/get"):                contentTTL,
+				cachingKeyAttributes("dir/attrs"):           attrsTTL,
+				cachingKeyAttributes("dir/range"):           attrsTTL,
+				cachingKeyObjectSubrange("dir/range", 0, 4): rangeTTL,
+				cachingKeyObjectSubrange("dir/range", 4, 8): rangeTTL,
+				cachingKeyIter("dir"):                       iterTTL,
+			}
+			testutil.Equals(t, len(expected), len(c.ttls))
+			for key, ttl := range expected {
+				got, ok := c.ttls[key]
+				testutil.Assert(t, ok, "expected %s to be cached", key)
+
+				// Some time passes between some of the operations and storing their results.
+				min := time.Duration((1-tcase.jitter)*float64(ttl)) - time.Minute
+				testutil.Assert(t, got <= ttl && got >= min, "TTL %v of %s outside of jittered window [%v, %v]", got, key, min, ttl)
+			}
+			if tcase.exact {
+				// TTLs of attributes and subranges are not shortened by the time passed.
+				testutil.Equals(t, time.Duration((1-tcase.jitter)*float64(attrsTTL)), c.ttls[cachingKeyAttributes("dir/attrs")])
+				testutil.Equals(t, time.Duration((1-tcase.jitter)*float64(rangeTTL)), c.ttls[cachingKeyObjectSubrange("dir/range", 0, 4)])
+			}
+		})
+	}
+}
+
 func TestMergeRanges(t *testing.T) {
 	for ix, tc := range []struct {
 		input    []rng
@@ -368,6 +481,333 @@ func (b *testBucket) GetRange(ctx context.Context, name string, off, length int6
 	return b.InMemBucket.GetRange(ctx, name, off, length)
 }
 
+type inFlightBucket struct {
+	*objstore.InMemBucket
+
+	mtx         sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (b *inFlightBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	b.mtx.Lock()
+	b.inFlight++
+	if b.inFlight > b.maxInFlight {
+		b.maxInFlight = b.inFlight
+	}
+	b.mtx.Unlock()
+
+	defer func() {
+		b.mtx.Lock()
+		b.inFlight--
+		b.mtx.Unlock()
+	}()
+
+	// Give other requests a chance to pile up.
+	time.Sleep(10 * time.Millisecond)
+	return b.InMemBucket.GetRange(ctx, name, off, length)
+}
+
+func TestConcurrentGetRangeRequestsLimit(t *testing.T) {
+	const (
+		subrangeSize  = int64(1000)
+		numRequests   = 20
+		maxConcurrent = 3
+	)
+
+	data := make([]byte, numRequests*subrangeSize)
+	for ix := 0; ix < len(data); ix++ {
+		data[ix] = byte(ix)
+	}
+	name := "/test/chunks/000001"
+
+	b := &inFlightBucket{InMemBucket: objstore.NewInMemBucket()}
+	testutil.Ok(t, b.Upload(context.Background(), name, bytes.NewReader(data)))
+
+	cfg := NewCachingBucketConfig()
+	cfg.CacheGetRange("chunks", newMockCache(), isTSDBChunkFile, subrangeSize, time.Hour, time.Hour, 0)
+	cfg.LimitConcurrentGetRangeRequests(maxConcurrent)
+
+	cb, err := NewCachingBucket(b, cfg, nil, nil)
+	testutil.Ok(t, err)
+
+	// Warm up object attributes, so that only subranges are fetched below.
+	verifyGetRange(t, cb, name, 0, 1, 1)
+
+	var wg sync.WaitGroup
+	for i := int64(1); i < numRequests; i++ {
+		wg.Add(1)
+		go func(off int64) {
+			defer wg.Done()
+			verifyGetRange(t, cb, name, off, subrangeSize, subrangeSize)
+		}(i * subrangeSize)
+	}
+	wg.Wait()
+
+	testutil.Assert(t, b.maxInFlight > 0 && b.maxInFlight <= maxConcurrent, "expected at most %d in-flight requests, got %d", maxConcurrent, b.maxInFlight)
+	testutil.Equals(t, float64(numRequests*subrangeSize), promtest.ToFloat64(cb.fetchedGetRangeBytes.WithLabelValues(originBucket, "chunks")))
+}
+
+type rangeRecordingBucket struct {
+	*objstore.InMemBucket
+
+	mtx    sync.Mutex
+	ranges []rng
+
+	// If set, ranges starting at or after blockFrom are only served once release is closed.
+	release   chan struct{}
+	blockFrom int64
+}
+
+func (b *rangeRecordingBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	b.mtx.Lock()
+	b.ranges = append(b.ranges, rng{start: off, end: off + length})
+	b.mtx.Unlock()
+
+	if b.release != nil && off >= b.blockFrom {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-b.release:
+		}
+	}
+	return b.InMemBucket.GetRange(ctx, name, off, length)
+}
+
+func TestGetRangeReadAhead(t *testing.T) {
+	const subrangeSize = int64(100)
+
+	data := make([]byte, 10*subrangeSize+50)
+	for ix := 0; ix < len(data); ix++ {
+		data[ix] = byte(ix)
+	}
+	name := "/test/chunks/000001"
+
+	waitForCached := func(t *testing.T, c *mockCache, keys ...string) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		testutil.Ok(t, runutil.Retry(10*time.Millisecond, ctx.Done(), func() error {
+			if hits := c.Fetch(context.Background(), keys); len(hits) != len(keys) {
+				return errors.Errorf("expected %d cached subranges, got %d", len(keys), len(hits))
+			}
+			return nil
+		}))
+	}
+
+	t.Run("subranges past the requested range are cached in the background", func(t *testing.T) {
+		b := &rangeRecordingBucket{InMemBucket: objstore.NewInMemBucket()}
+		testutil.Ok(t, b.Upload(context.Background(), name, bytes.NewReader(data)))
+
+		c := newMockCache()
+		// Cache a subrange in the middle of the read-ahead window, so that the missing ones are not adjacent.
+		c.Store(context.Background(), map[string][]byte{cachingKeyObjectSubrange(name, 200, 300): data[200:300]}, time.Hour)
+
+		cfg := NewCachingBucketConfig()
+		cfg.CacheGetRange("chunks", c, isTSDBChunkFile, subrangeSize, time.Hour, time.Hour, 1)
+		cfg.ReadAheadGetRange("chunks", 3)
+
+		cb, err := NewCachingBucket(b, cfg, log.NewNopLogger(), nil)
+		testutil.Ok(t, err)
+
+		verifyGetRange(t, cb, name, 10, 20, 20)
+		waitForCached(t, c,
+			cachingKeyObjectSubrange(name, 100, 200),
+			cachingKeyObjectSubrange(name, 300, 400),
+		)
+		testutil.Equals(t, 0, len(c.Fetch(context.Background(), []string{cachingKeyObjectSubrange(name, 400, 500)})))
+
+		// Requested subrange and a single merged read-ahead request, due to max sub-requests.
+		b.mtx.Lock()
+		testutil.Equals(t, []rng{{start: 0, end: 100}, {start: 100, end: 400}}, b.ranges)
+		b.mtx.Unlock()
+	})
+	t.Run("read-ahead stops at the end of the object", func(t *testing.T) {
+		b := &rangeRecordingBucket{InMemBucket: objstore.NewInMemBucket()}
+		testutil.Ok(t, b.Upload(context.Background(), name, bytes.NewReader(data)))
+
+		c := newMockCache()
+		cfg := NewCachingBucketConfig()
+		cfg.CacheGetRange("chunks", c, isTSDBChunkFile, subrangeSize, time.Hour, time.Hour, 0)
+		cfg.ReadAheadGetRange("chunks", 3)
+
+		cb, err := NewCachingBucket(b, cfg, log.NewNopLogger(), nil)
+		testutil.Ok(t, err)
+
+		verifyGetRange(t, cb, name, 910, 20, 20)
+		waitForCached(t, c, cachingKeyObjectSubrange(name, 1000, 1050))
+
+		b.mtx.Lock()
+		testutil.Equals(t, []rng{{start: 900, end: 1000}, {start: 1000, end: 1100}}, b.ranges)
+		b.mtx.Unlock()
+
+		// Nothing to read ahead past the last subrange.
+		verifyGetRange(t, cb, name, 1010, 100, 40)
+		cb.readAheads.wait()
+		b.mtx.Lock()
+		testutil.Equals(t, 2, len(b.ranges))
+		b.mtx.Unlock()
+	})
+	t.Run("read-ahead of a range in progress is not started again", func(t *testing.T) {
+		b := &rangeRecordingBucket{InMemBucket: objstore.NewInMemBucket(), release: make(chan struct{}), blockFrom: subrangeSize}
+		testutil.Ok(t, b.Upload(context.Background(), name, bytes.NewReader(data)))
+
+		c := newMockCache()
+		cfg := NewCachingBucketConfig()
+		cfg.CacheGetRange("chunks", c, isTSDBChunkFile, subrangeSize, time.Hour, time.Hour, 1)
+		cfg.ReadAheadGetRange("chunks", 3)
+
+		cb, err := NewCachingBucket(b, cfg, log.NewNopLogger(), nil)
+		testutil.Ok(t, err)
+
+		verifyGetRange(t, cb, name, 10, 20, 20)
+		verifyGetRange(t, cb, name, 30, 20, 20)
+		close(b.release)
+		cb.readAheads.wait()
+
+		b.mtx.Lock()
+		testutil.Equals(t, []rng{{start: 0, end: 100}, {start: 100, end: 400}}, b.ranges)
+		b.mtx.Unlock()
+		waitForCached(t, c, cachingKeyObjectSubrange(name, 100, 200), cachingKeyObjectSubrange(name, 300, 400))
+	})
+	t.Run("closing the bucket aborts read-aheads", func(t *testing.T) {
+		b := &rangeRecordingBucket{InMemBucket: objstore.NewInMemBucket(), release: make(chan struct{}), blockFrom: subrangeSize}
+		testutil.Ok(t, b.Upload(context.Background(), name, bytes.NewReader(data)))
+
+		c := newMockCache()
+		cfg := NewCachingBucketConfig()
+		cfg.CacheGetRange("chunks", c, isTSDBChunkFile, subrangeSize, time.Hour, time.Hour, 1)
+		cfg.ReadAheadGetRange("chunks", 3)
+
+		cb, err := NewCachingBucket(b, cfg, log.NewNopLogger(), nil)
+		testutil.Ok(t, err)
+
+		verifyGetRange(t, cb, name, 10, 20, 20)
+		// Returns only once the blocked read-ahead was aborted.
+		testutil.Ok(t, cb.Close())
+		testutil.Equals(t, 0, len(c.Fetch(context.Background(), []string{cachingKeyObjectSubrange(name, 100, 200)})))
+
+		// No read-ahead is started once the bucket is closed.
+		b.blockFrom = int64(len(data))
+		verifyGetRange(t, cb, name, 510, 20, 20)
+		cb.readAheads.wait()
+		b.mtx.Lock()
+		testutil.Equals(t, []rng{{start: 0, end: 100}, {start: 100, end: 400}, {start: 500, end: 600}}, b.ranges)
+		b.mtx.Unlock()
+	})
+}
+
+func TestGetRangeHitRatio(t *testing.T) {
+	const subrangeSize = int64(10)
+
+	data := make([]byte, 10*subrangeSize)
+	for ix := 0; ix < len(data); ix++ {
+		data[ix] = byte(ix)
+	}
+	name := "/test/chunks/000001"
+
+	inmem := objstore.NewInMemBucket()
+	testutil.Ok(t, inmem.Upload(context.Background(), name, bytes.NewReader(data)))
+
+	cfg := NewCachingBucketConfig()
+	cfg.CacheGetRange("chunks", newMockCache(), isTSDBChunkFile, subrangeSize, time.Hour, time.Hour, 0)
+
+	cb, err := NewCachingBucket(inmem, cfg, nil, nil)
+	testutil.Ok(t, err)
+
+	observed := func() (uint64, float64) {
+		m := &dto.Metric{}
+		testutil.Ok(t, cb.getRangeHitRatio.WithLabelValues("chunks").(prometheus.Metric).Write(m))
+		return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+	}
+
+	// Fully missed read.
+	verifyGetRange(t, cb, name, 0, 30, 30)
+	count, sum := observed()
+	testutil.Equals(t, uint64(1), count)
+	testutil.Equals(t, 0.0, sum)
+
+	// Fully cached read.
+	verifyGetRange(t, cb, name, 5, 20, 20)
+	count, sum = observed()
+	testutil.Equals(t, uint64(2), count)
+	testutil.Equals(t, 1.0, sum)
+
+	// Partially cached read, only subrange [20, 30) out of [20, 50) is cached.
+	verifyGetRange(t, cb, name, 25, 20, 20)
+	count, sum = observed()
+	testutil.Equals(t, uint64(3), count)
+	testutil.Assert(t, math.Abs(sum-(1+1.0/3)) < 1e-9, "expected hit ratio sum of 4/3, got %v", sum)
+
+	// Counter keeps counting the fraction of cached subranges.
+	testutil.Assert(t, math.Abs(promtest.ToFloat64(cb.operationHits.WithLabelValues(objstore.OpGetRange, "chunks"))-(1+1.0/3)) < 1e-9, "unexpected operation hits")
+}
+
+func TestHashLongCacheKeys(t *testing.T) {
+	const maxKeyLength = 250
+
+	shortName := "01EHBQRN4RF0HSRR1772KW0TN8/chunks/000001"
+	longName := strings.Repeat("very/deeply/nested/dir/", 20) + shortName
+
+	inmem := objstore.NewInMemBucket()
+	data := []byte("0123456789abcdef")
+	for _, name := range []string{shortName, longName} {
+		testutil.Ok(t, inmem.Upload(context.Background(), name, bytes.NewReader(data)))
+	}
+
+	c := newMockCache()
+	cfg := NewCachingBucketConfig()
+	cfg.CacheGetRange("chunks", c, isTSDBChunkFile, 4, time.Hour, time.Hour, 0)
+	cfg.CacheExists("exists", c, matchAll, time.Hour, time.Hour)
+	cfg.HashLongKeys(maxKeyLength)
+
+	cb, err := NewCachingBucket(inmem, cfg, nil, nil)
+	testutil.Ok(t, err)
+
+	readRange := func(name string) {
+		t.Helper()
+
+		r, err := cb.GetRange(context.Background(), name, 2, 8)
+		testutil.Ok(t, err)
+		read, err := ioutil.ReadAll(r)
+		testutil.Ok(t, err)
+		testutil.Equals(t, data[2:10], read)
+	}
+
+	for _, name := range []string{shortName, longName} {
+		readRange(name)
+
+		ok, err := cb.Exists(context.Background(), name)
+		testutil.Ok(t, err)
+		testutil.Assert(t, ok, "expected %s to exist", name)
+	}
+
+	c.mu.Lock()
+	for k := range c.cache {
+		testutil.Assert(t, len(k) <= maxKeyLength, "key of length %d exceeds the limit: %s", len(k), k)
+	}
+	// Short keys are kept human-readable.
+	_, ok := c.cache[cachingKeyObjectSubrange(shortName, 0, 4)]
+	testutil.Assert(t, ok, "expected short subrange key to be cached as is")
+	_, ok = c.cache[hashCacheKey(cachingKeyObjectSubrange(longName, 0, 4))]
+	testutil.Assert(t, ok, "expected long subrange key to be cached hashed")
+	c.mu.Unlock()
+
+	// Entries of long keys round-trip, even once the object is gone from the bucket.
+	testutil.Ok(t, inmem.Delete(context.Background(), longName))
+	hitsBefore := promtest.ToFloat64(cb.operationHits.WithLabelValues(objstore.OpGetRange, "chunks"))
+	readRange(longName)
+	testutil.Equals(t, hitsBefore+1, promtest.ToFloat64(cb.operationHits.WithLabelValues(objstore.OpGetRange, "chunks")))
+	verifyExists(t, cb, longName, true, true, "exists")
+
+	t.Run("max length shorter than hashed keys", func(t *testing.T) {
+		cfg := NewCachingBucketConfig()
+		cfg.HashLongKeys(hashedCacheKeyLength - 1)
+		_, err := NewCachingBucket(inmem, cfg, nil, nil)
+		testutil.NotOk(t, err)
+	})
+}
+
 func TestCachedIter(t *testing.T) {
 	inmem := objstore.NewInMemBucket()
 	testutil.Ok(t, inmem.Upload(context.Background(), "/file-1", strings.NewReader("hej")))
@@ -409,6 +849,36 @@ func TestCachedIter(t *testing.T) {
 	verifyIter(t, cb, allFiles, false, cfgName)
 }
 
+func TestCachedIterTTLByDepth(t *testing.T) {
+	inmem := objstore.NewInMemBucket()
+	for _, name := range []string{"01A/meta.json", "01A/chunks/000001", "01A/chunks/000002", "01B/meta.json"} {
+		testutil.Ok(t, inmem.Upload(context.Background(), name, strings.NewReader("hello world")))
+	}
+
+	c := newTTLRecordingCache()
+	cfg := NewCachingBucketConfig()
+	const cfgName = "dirs"
+	cfg.CacheIter(cfgName, c, func(string) bool { return true }, time.Minute, JSONIterCodec{})
+	cfg.IterTTLByDepth(cfgName, time.Minute, time.Hour, 24*time.Hour)
+
+	cb, err := NewCachingBucket(inmem, cfg, nil, nil)
+	testutil.Ok(t, err)
+
+	for _, dir := range []string{"", "01A", "01A/chunks/"} {
+		testutil.Ok(t, cb.Iter(context.Background(), dir, func(string) error { return nil }))
+	}
+
+	// Root listings change with every new block, while listings of block subdirectories don't.
+	for key, ttl := range map[string]time.Duration{
+		cachingKeyIter(""):            time.Minute,
+		cachingKeyIter("01A"):         time.Hour,
+		cachingKeyIter("01A/chunks/"): 24 * time.Hour,
+	} {
+		got := c.ttls[key]
+		testutil.Assert(t, got <= ttl && got > ttl-time.Minute/2, "expected TTL of about %v for %s, got %v", ttl, key, got)
+	}
+}
+
 func verifyIter(t *testing.T, cb *CachingBucket, expectedFiles []string, expectedCache bool, cfgName string) {
 	hitsBefore := int(promtest.ToFloat64(cb.operationHits.WithLabelValues(objstore.OpIter, cfgName)))
 
@@ -463,6 +933,53 @@ func TestExists(t *testing.T) {
 	verifyExists(t, cb, testFilename, false, false, cfgName)
 }
 
+func TestBatchExists(t *testing.T) {
+	inmem := objstore.NewInMemBucket()
+	testutil.Ok(t, inmem.Upload(context.Background(), "/block1/meta.json", strings.NewReader("hej")))
+	testutil.Ok(t, inmem.Upload(context.Background(), "/block2/meta.json", strings.NewReader("ahoj")))
+	testutil.Ok(t, inmem.Upload(context.Background(), "/block2/index", strings.NewReader("hello")))
+
+	// We reuse cache between tests (!)
+	cache := newMockCache()
+
+	cfg := NewCachingBucketConfig()
+	const cfgName = "test"
+	cfg.CacheExists(cfgName, cache, isMetaFile, 10*time.Minute, 2*time.Minute)
+
+	cb, err := NewCachingBucket(inmem, cfg, nil, nil)
+	testutil.Ok(t, err)
+
+	names := []string{"/block1/meta.json", "/block2/meta.json", "/block3/meta.json", "/block2/index", "/block3/index"}
+	expected := map[string]bool{}
+	for _, n := range names {
+		ok, err := inmem.Exists(context.Background(), n)
+		testutil.Ok(t, err)
+		expected[n] = ok
+	}
+
+	res, err := objstore.BatchExists(context.Background(), cb, names)
+	testutil.Ok(t, err)
+	testutil.Equals(t, expected, res)
+	testutil.Equals(t, 3.0, promtest.ToFloat64(cb.operationRequests.WithLabelValues(objstore.OpExists, cfgName)))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(cb.operationHits.WithLabelValues(objstore.OpExists, cfgName)))
+
+	// Cached results are used for meta files, even if bucket changes.
+	testutil.Ok(t, inmem.Upload(context.Background(), "/block3/meta.json", strings.NewReader("nazdar")))
+	testutil.Ok(t, inmem.Upload(context.Background(), "/block3/index", strings.NewReader("nazdar")))
+	expected["/block3/index"] = true
+
+	res, err = objstore.BatchExists(context.Background(), cb, names)
+	testutil.Ok(t, err)
+	testutil.Equals(t, expected, res)
+	testutil.Equals(t, 6.0, promtest.ToFloat64(cb.operationRequests.WithLabelValues(objstore.OpExists, cfgName)))
+	testutil.Equals(t, 3.0, promtest.ToFloat64(cb.operationHits.WithLabelValues(objstore.OpExists, cfgName)))
+
+	// Individual Exists agrees with batch results.
+	for _, n := range names {
+		verifyExists(t, cb, n, expected[n], isMetaFile(n), cfgName)
+	}
+}
+
 func TestExistsCachingDisabled(t *testing.T) {
 	inmem := objstore.NewInMemBucket()
 
@@ -531,6 +1048,190 @@ func TestGet(t *testing.T) {
 	verifyExists(t, cb, testFilename, true, true, cfgName)
 }
 
+func TestUploadAndDeleteInvalidateCache(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("exists", func(t *testing.T) {
+		cfg := NewCachingBucketConfig()
+		const cfgName = "test"
+		cfg.CacheExists(cfgName, newMockCache(), matchAll, 10*time.Minute, 2*time.Minute)
+
+		cb, err := NewCachingBucket(objstore.NewInMemBucket(), cfg, nil, nil)
+		testutil.Ok(t, err)
+
+		verifyExists(t, cb, testFilename, false, false, cfgName)
+
+		testutil.Ok(t, cb.Upload(ctx, testFilename, strings.NewReader("hej")))
+		verifyExists(t, cb, testFilename, true, true, cfgName)
+
+		testutil.Ok(t, cb.Delete(ctx, testFilename))
+		verifyExists(t, cb, testFilename, false, true, cfgName)
+	})
+	t.Run("exists with non-existence not cached", func(t *testing.T) {
+		c := newMockCache()
+		cfg := NewCachingBucketConfig()
+		const cfgName = "test"
+		cfg.CacheExists(cfgName, c, matchAll, 10*time.Minute, 0)
+
+		bkt := objstore.NewInMemBucket()
+		cb, err := NewCachingBucket(bkt, cfg, nil, nil)
+		testutil.Ok(t, err)
+		other, err := NewCachingBucket(bkt, cfg, nil, nil)
+		testutil.Ok(t, err)
+
+		testutil.Ok(t, cb.Upload(ctx, testFilename, strings.NewReader("hej")))
+		verifyExists(t, other, testFilename, true, true, cfgName)
+
+		// Stale existence is not served, although non-existence of the deleted object can't be cached.
+		testutil.Ok(t, cb.Delete(ctx, testFilename))
+		verifyExists(t, other, testFilename, false, false, cfgName)
+		verifyExists(t, cb, testFilename, false, false, cfgName)
+	})
+	t.Run("other buckets sharing the cache", func(t *testing.T) {
+		c := newMockCache()
+		cfg := NewCachingBucketConfig()
+		const cfgName = "metafile"
+		cfg.CacheGet(cfgName, c, matchAll, 1024, 10*time.Minute, 10*time.Minute, 2*time.Minute)
+
+		bkt := objstore.NewInMemBucket()
+		cb, err := NewCachingBucket(bkt, cfg, nil, nil)
+		testutil.Ok(t, err)
+		other, err := NewCachingBucket(bkt, cfg, nil, nil)
+		testutil.Ok(t, err)
+
+		testutil.Ok(t, bkt.Upload(ctx, testFilename, strings.NewReader("hello")))
+		verifyGet(t, other, testFilename, []byte("hello"), false, cfgName)
+		verifyGet(t, other, testFilename, []byte("hello"), true, cfgName)
+
+		// Content re-uploaded via another bucket is not served from stale cache entry.
+		testutil.Ok(t, cb.Upload(ctx, testFilename, strings.NewReader("hello world")))
+		verifyGet(t, other, testFilename, []byte("hello world"), false, cfgName)
+		verifyGet(t, cb, testFilename, []byte("hello world"), true, cfgName)
+
+		// Object deleted via another bucket is known not to exist.
+		testutil.Ok(t, cb.Delete(ctx, testFilename))
+		verifyGet(t, other, testFilename, nil, true, cfgName)
+	})
+	t.Run("get", func(t *testing.T) {
+		cfg := NewCachingBucketConfig()
+		const cfgName = "metafile"
+		cfg.CacheGet(cfgName, newMockCache(), matchAll, 1024, 10*time.Minute, 10*time.Minute, 2*time.Minute)
+
+		cb, err := NewCachingBucket(objstore.NewInMemBucket(), cfg, nil, nil)
+		testutil.Ok(t, err)
+
+		testutil.Ok(t, cb.Upload(ctx, testFilename, strings.NewReader("hello")))
+		verifyGet(t, cb, testFilename, []byte("hello"), false, cfgName)
+		verifyGet(t, cb, testFilename, []byte("hello"), true, cfgName)
+
+		// Re-uploaded content is not served from stale cache entry.
+		testutil.Ok(t, cb.Upload(ctx, testFilename, strings.NewReader("hello world")))
+		verifyGet(t, cb, testFilename, []byte("hello world"), false, cfgName)
+		verifyGet(t, cb, testFilename, []byte("hello world"), true, cfgName)
+
+		// Deleted object is known not to exist.
+		testutil.Ok(t, cb.Delete(ctx, testFilename))
+		verifyGet(t, cb, testFilename, nil, true, cfgName)
+	})
+	t.Run("get range and attributes", func(t *testing.T) {
+		cfg := NewCachingBucketConfig()
+		const cfgName = "chunks"
+		cfg.CacheGetRange(cfgName, newMockCache(), matchAll, 4, time.Hour, time.Hour, 0)
+		cfg.CacheAttributes(cfgName, newMockCache(), matchAll, time.Hour)
+
+		cb, err := NewCachingBucket(objstore.NewInMemBucket(), cfg, nil, nil)
+		testutil.Ok(t, err)
+
+		readRange := func(expected string) {
+			t.Helper()
+
+			r, err := cb.GetRange(ctx, testFilename, 0, 100)
+			testutil.Ok(t, err)
+			read, err := ioutil.ReadAll(r)
+			testutil.Ok(t, err)
+			testutil.Ok(t, r.Close())
+			testutil.Equals(t, expected, string(read))
+		}
+
+		testutil.Ok(t, cb.Upload(ctx, testFilename, strings.NewReader("aaaaaa")))
+		readRange("aaaaaa")
+		verifyObjectAttrs(t, cb, testFilename, 6, false, cfgName)
+		verifyObjectAttrs(t, cb, testFilename, 6, true, cfgName)
+
+		// Both stale subranges and attributes are ignored once the object is re-uploaded.
+		testutil.Ok(t, cb.Upload(ctx, testFilename, strings.NewReader("bbbbbbbbbb")))
+		readRange("bbbbbbbbbb")
+		verifyObjectAttrs(t, cb, testFilename, 10, false, cfgName)
+		verifyObjectAttrs(t, cb, testFilename, 10, true, cfgName)
+	})
+}
+
+func TestWithGeneration(t *testing.T) {
+	testutil.Equals(t, cachingKeyContent("a"), withGeneration(cachingKeyContent("a"), ""))
+
+	// Keys of modified objects don't collide with keys of objects named like them.
+	testutil.Assert(t, withGeneration(cachingKeyContent("a"), "1") != cachingKeyContent("a:gen1"), "generation key collides with object key")
+	testutil.Assert(t, withGeneration(cachingKeyContent("a"), "1") != cachingKeyGeneration("a"), "generation key collides with object generation key")
+}
+
+func TestGetCompressedContent(t *testing.T) {
+	inmem := objstore.NewInMemBucket()
+	cache := newMockCache()
+
+	cfg := NewCachingBucketConfig()
+	const cfgName = "metafile"
+	cfg.CacheGet(cfgName, cache, matchAll, 1024, 10*time.Minute, 10*time.Minute, 2*time.Minute)
+	cfg.CompressGetContent(cfgName)
+
+	cb, err := NewCachingBucket(inmem, cfg, log.NewNopLogger(), nil)
+	testutil.Ok(t, err)
+
+	t.Run("compressed", func(t *testing.T) {
+		data := []byte(strings.Repeat("hello world ", 50))
+		testutil.Ok(t, inmem.Upload(context.Background(), testFilename, bytes.NewBuffer(data)))
+
+		verifyGet(t, cb, testFilename, data, false, cfgName)
+		entry := cache.Fetch(context.Background(), []string{cachingKeyContent(testFilename)})[cachingKeyContent(testFilename)]
+		testutil.Assert(t, bytes.HasPrefix(entry, []byte(cachedContentMagic)), "expected encoded cache entry")
+		testutil.Assert(t, len(entry) < len(data), "expected compressed cache entry, got %d bytes for %d bytes of content", len(entry), len(data))
+		verifyGet(t, cb, testFilename, data, true, cfgName)
+	})
+	t.Run("legacy uncompressed", func(t *testing.T) {
+		const name = "/legacy_object"
+		data := []byte("legacy content")
+		// Entry cached by a version without compression, the object itself is not in the bucket.
+		cache.Store(context.Background(), map[string][]byte{cachingKeyContent(name): data}, time.Minute)
+
+		verifyGet(t, cb, name, data, true, cfgName)
+	})
+	t.Run("corrupted", func(t *testing.T) {
+		data := []byte("fresh content")
+		testutil.Ok(t, inmem.Upload(context.Background(), testFilename, bytes.NewBuffer(data)))
+		cache.Store(context.Background(), map[string][]byte{cachingKeyContent(testFilename): append([]byte(cachedContentMagic), 42)}, time.Minute)
+
+		// Undecodable entries are ignored and replaced.
+		verifyGet(t, cb, testFilename, data, false, cfgName)
+		verifyGet(t, cb, testFilename, data, true, cfgName)
+	})
+}
+
+func TestCachedContentEncoding(t *testing.T) {
+	for _, content := range [][]byte{
+		nil,
+		[]byte("{}"),
+		[]byte(cachedContentMagic),
+		append([]byte(cachedContentMagic), cachedContentSnappy, 'x'),
+	} {
+		for _, compress := range []bool{false, true} {
+			decoded, err := decodeCachedContent(encodeCachedContent(content, compress))
+			testutil.Ok(t, err)
+			testutil.Equals(t, string(content), string(decoded))
+		}
+	}
+	// Uncompressed content is cached as is, unless it looks like an encoded entry.
+	testutil.Equals(t, []byte("{}"), encodeCachedContent([]byte("{}"), false))
+}
+
 func TestGetTooBigObject(t *testing.T) {
 	inmem := objstore.NewInMemBucket()
 
@@ -555,6 +1256,49 @@ func TestGetTooBigObject(t *testing.T) {
 	verifyExists(t, cb, testFilename, true, true, cfgName)
 }
 
+func TestGetContentTTLTiers(t *testing.T) {
+	inmem := objstore.NewInMemBucket()
+	cache := newMockCache()
+
+	cfg := NewCachingBucketConfig()
+	const cfgName = "metafile"
+	cfg.CacheGet(cfgName, cache, matchAll, 100, 10*time.Minute, 10*time.Minute, 2*time.Minute)
+	cfg.TierGetContentTTL(cfgName,
+		ContentTTLTier{MaxSize: 10, TTL: 5 * time.Minute},
+		ContentTTLTier{MaxSize: 5, TTL: time.Hour},
+	)
+
+	cb, err := NewCachingBucket(inmem, cfg, nil, nil)
+	testutil.Ok(t, err)
+
+	for _, tc := range []struct {
+		name        string
+		data        string
+		expectedTTL time.Duration // Zero if not cached.
+	}{
+		{name: "/small", data: "hej", expectedTTL: time.Hour},
+		{name: "/small-tier-limit", data: "hello", expectedTTL: time.Hour},
+		{name: "/medium", data: "hello!", expectedTTL: 5 * time.Minute},
+		{name: "/large", data: "hello world", expectedTTL: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.Ok(t, inmem.Upload(context.Background(), tc.name, strings.NewReader(tc.data)))
+			verifyGet(t, cb, tc.name, []byte(tc.data), false, cfgName)
+
+			cache.mu.Lock()
+			item, ok := cache.cache[cachingKeyContent(tc.name)]
+			cache.mu.Unlock()
+			if tc.expectedTTL == 0 {
+				testutil.Assert(t, !ok, "object should not be cached")
+				return
+			}
+			testutil.Assert(t, ok, "object should be cached")
+			ttl := time.Until(item.exp)
+			testutil.Assert(t, ttl <= tc.expectedTTL && ttl > tc.expectedTTL-time.Minute, "unexpected TTL %v, expected %v", ttl, tc.expectedTTL)
+		})
+	}
+}
+
 func TestGetPartialRead(t *testing.T) {
 	inmem := objstore.NewInMemBucket()
 
@@ -636,6 +1380,91 @@ func TestAttributes(t *testing.T) {
 	verifyObjectAttrs(t, cb, testFilename, len(data), true, cfgName)
 }
 
+type attributesCountingBucket struct {
+	*objstore.InMemBucket
+
+	attributesCalls int
+}
+
+func (b *attributesCountingBucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	b.attributesCalls++
+	return b.InMemBucket.Attributes(ctx, name)
+}
+
+func TestAttributesServedFromCache(t *testing.T) {
+	bkt := &attributesCountingBucket{InMemBucket: objstore.NewInMemBucket()}
+	data := []byte("hello world")
+	testutil.Ok(t, bkt.Upload(context.Background(), testFilename, bytes.NewBuffer(data)))
+	expected, err := bkt.InMemBucket.Attributes(context.Background(), testFilename)
+	testutil.Ok(t, err)
+
+	cfg := NewCachingBucketConfig()
+	const cfgName = "test"
+	cfg.CacheAttributes(cfgName, newMockCache(), matchAll, time.Minute)
+
+	cb, err := NewCachingBucket(bkt, cfg, nil, nil)
+	testutil.Ok(t, err)
+
+	for i := 0; i < 3; i++ {
+		attrs, err := cb.Attributes(context.Background(), testFilename)
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(len(data)), attrs.Size)
+		testutil.Assert(t, expected.LastModified.Equal(attrs.LastModified), "expected last modified %v, got %v", expected.LastModified, attrs.LastModified)
+	}
+	// Both size and last modified time are cached by the first bucket call.
+	testutil.Equals(t, 1, bkt.attributesCalls)
+	testutil.Equals(t, 2, int(promtest.ToFloat64(cb.operationHits.WithLabelValues(objstore.OpAttributes, cfgName))))
+}
+
+func TestPerOperationCaches(t *testing.T) {
+	inmem := objstore.NewInMemBucket()
+
+	const (
+		metaName  = "/block1/meta.json"
+		chunkName = "/block1/chunks/000001"
+	)
+	data := []byte("hello world")
+	testutil.Ok(t, inmem.Upload(context.Background(), metaName, bytes.NewBuffer(data)))
+	testutil.Ok(t, inmem.Upload(context.Background(), chunkName, bytes.NewBuffer(data)))
+
+	existsCache := newMockCache()
+	chunksCache := newMockCache()
+
+	cfg := NewCachingBucketConfig()
+	cfg.CacheExists("metas", existsCache, isMetaFile, 10*time.Minute, 2*time.Minute)
+	cfg.CacheGetRange("chunks", chunksCache, isTSDBChunkFile, 4, time.Minute, time.Minute, 0)
+
+	cb, err := NewCachingBucket(inmem, cfg, nil, nil)
+	testutil.Ok(t, err)
+
+	verifyExists(t, cb, metaName, true, false, "metas")
+	verifyExists(t, cb, metaName, true, true, "metas")
+	r, err := cb.GetRange(context.Background(), chunkName, 0, 5)
+	testutil.Ok(t, err)
+	read, err := ioutil.ReadAll(r)
+	testutil.Ok(t, err)
+	testutil.Equals(t, data[:5], read)
+
+	testutil.Equals(t, []string{cachingKeyExists(metaName)}, mockCacheKeys(existsCache))
+	testutil.Equals(t, []string{
+		cachingKeyAttributes(chunkName),
+		cachingKeyObjectSubrange(chunkName, 0, 4),
+		cachingKeyObjectSubrange(chunkName, 4, 8),
+	}, mockCacheKeys(chunksCache))
+}
+
+func mockCacheKeys(m *mockCache) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]string, 0, len(m.cache))
+	for k := range m.cache {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func verifyObjectAttrs(t *testing.T, cb *CachingBucket, file string, expectedLength int, cacheUsed bool, cfgName string) {
 	t.Helper()
 	hitsBefore := int(promtest.ToFloat64(cb.operationHits.WithLabelValues(objstore.OpAttributes, cfgName)))
@@ -227,6 +227,32 @@ func TestInMemoryIndexCache_MaxNumberOfItemsHit(t *testing.T) {
 	testutil.Equals(t, float64(0), promtest.ToFloat64(cache.hits.WithLabelValues(cacheTypeSeries)))
 }
 
+func TestInMemoryIndexCache_SkipsItemsBiggerThanMaxItemSize(t *testing.T) {
+	metrics := prometheus.NewRegistry()
+	cache, err := NewInMemoryIndexCacheWithConfig(log.NewNopLogger(), metrics, InMemoryIndexCacheConfig{
+		MaxItemSize: sliceHeaderSize + 5,
+		MaxSize:     10 * (sliceHeaderSize + 5),
+	})
+	testutil.Ok(t, err)
+
+	id := ulid.MustNew(0, nil)
+	ctx := context.Background()
+	small := labels.Label{Name: "test", Value: "small"}
+	big := labels.Label{Name: "test", Value: "big"}
+
+	cache.StorePostings(ctx, id, small, []byte{1, 2, 3, 4, 5})
+	cache.StorePostings(ctx, id, big, []byte{1, 2, 3, 4, 5, 6})
+
+	hits, missed := cache.FetchMultiPostings(ctx, id, []labels.Label{small, big})
+	testutil.Equals(t, map[labels.Label][]byte{small: {1, 2, 3, 4, 5}}, hits)
+	testutil.Equals(t, []labels.Label{big}, missed)
+
+	testutil.Equals(t, uint64(sliceHeaderSize+5), cache.curSize)
+	testutil.Equals(t, float64(1), promtest.ToFloat64(cache.overflow.WithLabelValues(cacheTypePostings)))
+	testutil.Equals(t, float64(1), promtest.ToFloat64(cache.added.WithLabelValues(cacheTypePostings)))
+	testutil.Equals(t, float64(0), promtest.ToFloat64(cache.evicted.WithLabelValues(cacheTypePostings)))
+}
+
 func TestInMemoryIndexCache_Eviction_WithMetrics(t *testing.T) {
 	metrics := prometheus.NewRegistry()
 	cache, err := NewInMemoryIndexCacheWithConfig(log.NewNopLogger(), metrics, InMemoryIndexCacheConfig{
@@ -61,6 +61,29 @@ func (l *Limiter) Reserve(num uint64) error {
 	return nil
 }
 
+// seriesChunksLimiter limits the number of chunks of any single series fetched by a Series() call.
+type seriesChunksLimiter struct {
+	limit uint64
+
+	// Counter metric which we will increase if limit is exceeded.
+	failedCounter prometheus.Counter
+	failedOnce    sync.Once
+}
+
+// newSeriesChunksLimiter returns a new limiter of chunks per series with a specified limit. 0 disables the limit.
+func newSeriesChunksLimiter(limit uint64, ctr prometheus.Counter) *seriesChunksLimiter {
+	return &seriesChunksLimiter{limit: limit, failedCounter: ctr}
+}
+
+// Check returns an error if num chunks of a single series exceed the limit.
+func (l *seriesChunksLimiter) Check(num uint64) error {
+	if l.limit == 0 || num <= l.limit {
+		return nil
+	}
+	l.failedOnce.Do(l.failedCounter.Inc)
+	return errors.Errorf("limit %v violated (got %v)", l.limit, num)
+}
+
 // NewChunksLimiterFactory makes a new ChunksLimiterFactory with a static limit.
 func NewChunksLimiterFactory(limit uint64) ChunksLimiterFactory {
 	return func(failedCounter prometheus.Counter) ChunksLimiter {
@@ -65,6 +65,8 @@ type ProxyStore struct {
 
 type proxyStoreMetrics struct {
 	emptyStreamResponses prometheus.Counter
+	storesQueried        prometheus.Histogram
+	storeFailures        prometheus.Counter
 }
 
 func newProxyStoreMetrics(reg prometheus.Registerer) *proxyStoreMetrics {
@@ -74,6 +76,15 @@ func newProxyStoreMetrics(reg prometheus.Registerer) *proxyStoreMetrics {
 		Name: "thanos_proxy_store_empty_stream_responses_total",
 		Help: "Total number of empty responses received.",
 	})
+	m.storesQueried = promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+		Name:    "thanos_proxy_store_series_stores_queried",
+		Help:    "Number of stores a Series request was fanned out to.",
+		Buckets: []float64{0, 1, 2, 4, 8, 16, 32, 64, 128},
+	})
+	m.storeFailures = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "thanos_proxy_store_series_store_failures_total",
+		Help: "Total number of stores that failed to return series for a Series request.",
+	})
 
 	return &m
 }
@@ -226,12 +237,14 @@ func (s *ProxyStore) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesSe
 				SkipChunks:              r.SkipChunks,
 				PartialResponseDisabled: r.PartialResponseDisabled,
 			}
-			wg = &sync.WaitGroup{}
+			wg      = &sync.WaitGroup{}
+			queried int
 		)
 
 		defer func() {
 			wg.Wait()
 			close(respCh)
+			s.metrics.storesQueried.Observe(float64(queried))
 		}()
 
 		for _, st := range s.stores() {
@@ -242,6 +255,7 @@ func (s *ProxyStore) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesSe
 			}
 
 			storeDebugMsgs = append(storeDebugMsgs, fmt.Sprintf("Store %s queried", st))
+			queried++
 
 			// This is used to cancel this stream when one operations takes too long.
 			seriesCtx, closeSeries := context.WithCancel(gctx)
@@ -257,6 +271,7 @@ func (s *ProxyStore) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesSe
 					storeID = "Store Gateway"
 				}
 				err = errors.Wrapf(err, "fetch series for %s %s", storeID, st)
+				s.metrics.storeFailures.Inc()
 				if r.PartialResponseDisabled {
 					level.Error(reqLogger).Log("err", err, "msg", "partial response disabled; aborting request")
 					return err
@@ -268,7 +283,7 @@ func (s *ProxyStore) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesSe
 			// Schedule streamSeriesSet that translates gRPC streamed response
 			// into seriesSet (if series) or respCh if warnings.
 			seriesSet = append(seriesSet, startStreamSeriesSet(seriesCtx, reqLogger, closeSeries,
-				wg, sc, respSender, st.String(), !r.PartialResponseDisabled, s.responseTimeout, s.metrics.emptyStreamResponses))
+				wg, sc, respSender, st.String(), !r.PartialResponseDisabled, s.responseTimeout, s.metrics.emptyStreamResponses, s.metrics.storeFailures))
 		}
 
 		level.Debug(reqLogger).Log("msg", "Series: started fanout streams", "status", strings.Join(storeDebugMsgs, ";"))
@@ -362,6 +377,7 @@ func startStreamSeriesSet(
 	partialResponse bool,
 	responseTimeout time.Duration,
 	emptyStreamResponses prometheus.Counter,
+	storeFailures prometheus.Counter,
 ) *streamSeriesSet {
 	s := &streamSeriesSet{
 		ctx:             ctx,
@@ -409,6 +425,7 @@ func startStreamSeriesSet(
 				s.handleErr(errors.Wrapf(ctx.Err(), "failed to receive any data from %s", s.name), done)
 				return
 			case <-frameTimeoutCtx.Done():
+				storeFailures.Inc()
 				s.handleErr(errors.Wrapf(frameTimeoutCtx.Err(), "failed to receive any data in %s from %s", s.responseTimeout.String(), s.name), done)
 				return
 			case rr = <-rCh:
@@ -420,6 +437,7 @@ func startStreamSeriesSet(
 			}
 
 			if rr.err != nil {
+				storeFailures.Inc()
 				s.handleErr(errors.Wrapf(rr.err, "receive series from %s", s.name), done)
 				return
 			}
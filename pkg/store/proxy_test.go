@@ -19,6 +19,8 @@ import (
 	"github.com/gogo/protobuf/proto"
 	"github.com/gogo/protobuf/types"
 	"github.com/pkg/errors"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/pkg/timestamp"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
@@ -1898,3 +1900,65 @@ func TestProxyStore_storeMatchMetadata(t *testing.T) {
 	testutil.Assert(t, ok)
 	testutil.Equals(t, "", reason)
 }
+
+func TestProxyStore_Series_FanoutMetrics(t *testing.T) {
+	defer testutil.TolerantVerifyLeak(t)
+
+	q := NewProxyStore(nil,
+		nil,
+		func() []Client {
+			return []Client{
+				&testClient{
+					StoreClient: &mockedStoreAPI{
+						RespSeries: []*storepb.SeriesResponse{
+							storeSeriesResponse(t, labels.FromStrings("a", "a"), []sample{{1, 1}, {2, 2}}),
+						},
+					},
+					minTime: 1,
+					maxTime: 300,
+				},
+				&testClient{
+					StoreClient: &mockedStoreAPI{
+						RespError: errors.New("error!"),
+					},
+					minTime: 1,
+					maxTime: 300,
+				},
+				&testClient{
+					StoreClient: &mockedStoreAPI{
+						injectedError: errors.New("stream error!"),
+					},
+					minTime: 1,
+					maxTime: 300,
+				},
+				// Filtered out by time range, hence not queried.
+				&testClient{
+					StoreClient: &mockedStoreAPI{
+						RespError: errors.New("error!"),
+					},
+					minTime: 400,
+					maxTime: 500,
+				},
+			}
+		},
+		component.Query,
+		nil,
+		0*time.Second,
+	)
+
+	s := newStoreSeriesServer(context.Background())
+	testutil.Ok(t, q.Series(&storepb.SeriesRequest{
+		MinTime:  1,
+		MaxTime:  300,
+		Matchers: []storepb.LabelMatcher{{Name: "a", Value: "a", Type: storepb.LabelMatcher_EQ}},
+	}, s))
+	testutil.Equals(t, 1, len(s.SeriesSet))
+	testutil.Equals(t, 2, len(s.Warnings), "got %v", s.Warnings)
+
+	testutil.Equals(t, 2.0, promtest.ToFloat64(q.metrics.storeFailures))
+
+	m := &dto.Metric{}
+	testutil.Ok(t, q.metrics.storesQueried.Write(m))
+	testutil.Equals(t, uint64(1), m.GetHistogram().GetSampleCount())
+	testutil.Equals(t, 3.0, m.GetHistogram().GetSampleSum())
+}
@@ -353,7 +353,7 @@ func testCompactWithStoreGateway(t *testing.T, penaltyDedup bool) {
 		SecretKey: e2edb.MinioSecretKey,
 		Endpoint:  m.HTTPEndpoint(), // We need separate client config, when connecting to minio from outside.
 		Insecure:  true,
-	}, "test-feed")
+	}, nil, "test-feed")
 	testutil.Ok(t, err)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 90*time.Second)
@@ -94,7 +94,7 @@ func TestStoreGateway(t *testing.T) {
 		SecretKey: e2edb.MinioSecretKey,
 		Endpoint:  m.HTTPEndpoint(), // We need separate client config, when connecting to minio from outside.
 		Insecure:  true,
-	}, "test-feed")
+	}, nil, "test-feed")
 	testutil.Ok(t, err)
 
 	testutil.Ok(t, objstore.UploadDir(ctx, l, bkt, path.Join(dir, id1.String()), id1.String()))